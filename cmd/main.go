@@ -28,6 +28,7 @@ import (
 	"github.com/saferwall/saferwall-api/internal/server"
 	"github.com/saferwall/saferwall-api/internal/storage"
 	tpl "github.com/saferwall/saferwall-api/internal/template"
+	"github.com/saferwall/saferwall-api/internal/user"
 	"github.com/saferwall/saferwall-api/pkg/log"
 	"github.com/yeka/zip"
 )
@@ -38,6 +39,8 @@ var Version = "0.9.0"
 var flagConfig = flag.String("config", "./../configs/", "path to the config file")
 var flagN1QLFiles = flag.String("db", "./../db/", "path to the n1ql files")
 var flagTplFiles = flag.String("tpl", "./../templates/", "path to html templates")
+var flagRotateKeys = flag.Bool("rotate-keys", false, "re-wrap the encrypted objects with the active master key and exit")
+var flagMigrateEdges = flag.Bool("migrate-edges", false, "move the likes, follows and submissions of the users to edge documents and exit, run it before serving this version")
 
 // @title Saferwall Web API
 // @version 1.0
@@ -100,6 +103,18 @@ func run(logger log.Logger) error {
 		return err
 	}
 
+	// Migrating the relationships embedded in the user documents is a one
+	// off job run before serving the first version storing them as edges.
+	if *flagMigrateEdges {
+		count, err := user.NewRepository(dbx, logger).MigrateEdges(
+			context.Background())
+		if err != nil {
+			return err
+		}
+		logger.Infof("migrated the relationships of %d users", count)
+		return nil
+	}
+
 	// Create a translator for validation error messages.
 	en := en.New()
 	uni := ut.New(en, en)
@@ -122,6 +137,17 @@ func run(logger log.Logger) error {
 		return err
 	}
 
+	// Rotating the master key is a one off job run after updating the keys.
+	if *flagRotateKeys {
+		count, err := storage.RotateKeys(context.Background(), updown,
+			cfg.ObjStorage)
+		if err != nil {
+			return err
+		}
+		logger.Infof("rotated the master key of %d objects", count)
+		return nil
+	}
+
 	// Create a producer to write messages to stream processing framework.
 	producer, err := queue.New(cfg.Broker.Address, cfg.Broker.Topic)
 	if err != nil {
@@ -145,9 +171,13 @@ func run(logger log.Logger) error {
 
 	recaptchaVerifier := recaptcha.NewVerifierV3(cfg.RecaptchaKey, recaptcha.VerifierV3Options{})
 
+	// The background tasks of the server stop on shutdown.
+	bgCtx, stopBg := context.WithCancel(context.Background())
+	defer stopBg()
+
 	hs := &http.Server{
 		Addr: cfg.Address,
-		Handler: server.BuildHandler(logger, dbx, sec, cfg, Version, trans,
+		Handler: server.BuildHandler(bgCtx, logger, dbx, sec, cfg, Version, trans,
 			updown, producer, smtpMailer, archiver, tokenGen, emailTemplates, recaptchaVerifier),
 	}
 
@@ -166,6 +196,7 @@ func run(logger log.Logger) error {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
+	stopBg()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := hs.Shutdown(ctx); err != nil {
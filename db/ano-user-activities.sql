@@ -11,9 +11,11 @@ WITH
       `bucket_name` AS activity
     WHERE
       activity.type = 'activity'
-      AND activity.src = "web"
-      AND activity.kind != "comment"
-      AND activity.kind != 'follow'
+      AND activity.kind IN $kinds
+      AND activity.src IN $sources
+      AND activity.timestamp > $since
+      AND ($until = 0 OR activity.timestamp <= $until)
+      AND (ARRAY_LENGTH($users) = 0 OR LOWER(activity.username) IN $users)
     ORDER BY
       activity.timestamp DESC
     OFFSET
@@ -36,6 +38,22 @@ SELECT
       ) [0]
     },
     "follow": false,
+    "comment": c.body,
+    "comment_id": c.id,
+    "parent_id": c.parent_id,
+    "mentions": c.mentions,
+    "verdict": (
+      CASE
+        WHEN activity.kind = "vote" THEN (
+          SELECT
+            RAW {"verdict": v.verdict, "family": v.family}
+          FROM
+            `bucket_name` v
+          USE KEYS "edge::vote::" || LOWER(activity.username) || "::" || activity.target
+        ) [0]
+        ELSE MISSING
+      END
+    ),
     "date": activity.timestamp
   }.*,
   (
@@ -58,4 +76,11 @@ SELECT
   ).*
 FROM
   activity_data AS activity
-  LEFT JOIN `bucket_name` AS f ON KEYS activity.target;
+  LEFT JOIN `bucket_name` AS c ON KEYS (
+    CASE
+      WHEN activity.kind IN ["comment", "reply", "mention"] THEN activity.target
+    END
+  )
+  LEFT JOIN `bucket_name` AS f ON KEYS IFMISSINGORNULL(c.sha256, activity.target)
+ORDER BY
+  activity.timestamp DESC;
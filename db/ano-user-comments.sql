@@ -5,6 +5,10 @@ SELECT
     "comment": c.body,
     "liked": false,
     "date": c.timestamp,
+    "parent_id": c.parent_id,
+    "replies_count": IFMISSINGORNULL(c.replies_count, 0),
+    "mentions": c.mentions,
+    "edited": IFMISSINGORNULL(ARRAY_LENGTH(c.history), 0) > 0,
     "file": {
       "hash": f.sha256,
       "tags": f.tags,
@@ -23,6 +27,7 @@ FROM
 WHERE
   c.`type` = 'comment'
   AND c.`username` = $user
+  AND c.status IS NOT VALUED
 ORDER BY
   c.timestamp DESC
 OFFSET
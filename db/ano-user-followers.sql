@@ -7,16 +7,14 @@ SELECT
     "follow": FALSE
   }
 FROM
-  `bucket_name` p
-USE KEYS [
-  (
-    SELECT
-      RAW ARRAY LOWER(u.username) FOR u IN s.`followers` END
-    FROM
-      `bucket_name` s
-    USE KEYS $user
-  ) [0]
-]
+  `bucket_name` e
+  INNER JOIN `bucket_name` p ON KEYS e.username
+WHERE
+  e.`type` = "edge"
+  AND e.kind = "follow"
+  AND e.target = $user
+ORDER BY
+  e.ts
 OFFSET
   $offset
 LIMIT
@@ -2,7 +2,7 @@
 SELECT
   {
     "id": UUID(),
-    "date": l.ts,
+    "date": e.ts,
     "liked": FALSE,
     "file": {
       "hash": f.sha256,
@@ -17,18 +17,15 @@ SELECT
     }
   }.*
 FROM
-  (
-    SELECT
-      userLikes.*
-    FROM
-      `bucket_name` s
-    USE KEYS $user
-    UNNEST
-      s.likes AS userLikes
-  ) AS l
-  LEFT JOIN `bucket_name` f ON f.sha256 = l.sha256
+  `bucket_name` e
+  INNER JOIN `bucket_name` f ON KEYS e.target
 WHERE
-  f.`type` = "file"
+  e.`type` = "edge"
+  AND e.kind = "like"
+  AND e.username = $user
+  AND f.`type` = "file"
+ORDER BY
+  e.ts
 OFFSET
   $offset
 LIMIT
@@ -1,9 +1,8 @@
 /* N1QL query to retrieve user submissions for an anonymous user. */
-/* N1QL query to retrieve likes for an anonymous user. */
 SELECT
   {
     "id": UUID(),
-    "date": l.ts,
+    "date": e.ts,
     "liked": FALSE,
     "file": {
       "hash": f.sha256,
@@ -18,18 +17,15 @@ SELECT
     }
   }.*
 FROM
-  (
-    SELECT
-      userSubmissions.*
-    FROM
-      `bucket_name` s
-    USE KEYS $user
-    UNNEST
-      s.submissions AS userSubmissions
-  ) AS l
-  LEFT JOIN `bucket_name` f ON f.sha256 = l.sha256
+  `bucket_name` e
+  INNER JOIN `bucket_name` f ON KEYS e.target
 WHERE
-  f.`type` = "file"
+  e.`type` = "edge"
+  AND e.kind = "submit"
+  AND e.username = $user
+  AND f.`type` = "file"
+ORDER BY
+  e.ts
 OFFSET
   $offset
 LIMIT
@@ -0,0 +1,23 @@
+/* N1QL query to retrieve the parts of a behavior report network indicators are extracted from. */
+SELECT
+  (
+    SELECT
+      RAW a.api_trace
+    FROM
+      `bucket_name` a
+    USE KEYS $behavior_id_apis
+  ) [0] AS api_trace,
+  (
+    SELECT
+      RAW s.sys_events
+    FROM
+      `bucket_name` s
+    USE KEYS $behavior_id_events
+  ) [0] AS sys_events,
+  (
+    SELECT
+      RAW d.artifacts
+    FROM
+      `bucket_name` d
+    USE KEYS $behavior_id
+  ) [0] AS artifacts
@@ -4,5 +4,8 @@ FROM
   `bucket_name` activity
 WHERE
   activity.type = "activity"
-  AND activity.src = "web"
-  AND activity.kind != "comment"
+  AND activity.kind IN $kinds
+  AND activity.src IN $sources
+  AND activity.timestamp > $since
+  AND ($until = 0 OR activity.timestamp <= $until)
+  AND (ARRAY_LENGTH($users) = 0 OR LOWER(activity.username) IN $users)
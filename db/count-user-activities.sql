@@ -1,26 +1,51 @@
 /* N1QL query to count activities for a logged-in user. */
 WITH
   user_following AS (
-    (
-      SELECT
-        RAW s.`following`
-      FROM
-        `bucket_name` AS s
-      USE KEYS $user
-    ) [0]
+    SELECT
+      RAW e.target
+    FROM
+      `bucket_name` AS e
+    WHERE
+      e.`type` = "edge"
+      AND e.kind = "follow"
+      AND e.username = $user
+  ),
+  user_mentions AS (
+    SELECT
+      RAW META(c).id
+    FROM
+      `bucket_name` AS c
+    WHERE
+      c.`type` = "comment"
+      AND ANY m IN c.mentions SATISFIES m = $user END
   ),
   activities AS (
     SELECT
-      COUNT(*) AS activity_count
+      RAW META(activity).id
     FROM
       user_following AS d
-      INNER JOIN `bucket_name` AS activity ON activity.username = d.username
+      INNER JOIN `bucket_name` AS activity ON LOWER(activity.username) = d
+    WHERE
+      activity.`type` = 'activity'
+      AND activity.kind IN $kinds
+      AND activity.src IN $sources
+      AND activity.timestamp > $since
+      AND ($until = 0 OR activity.timestamp <= $until)
+      AND (ARRAY_LENGTH($users) = 0 OR LOWER(activity.username) IN $users)
+    UNION
+    SELECT
+      RAW META(activity).id
+    FROM
+      `bucket_name` AS activity
     WHERE
       activity.`type` = 'activity'
-      AND activity.src = 'web'
-      AND activity.kind != 'comment'
+      AND activity.kind = 'mention'
+      AND activity.target IN user_mentions
+      AND activity.kind IN $kinds
+      AND activity.src IN $sources
+      AND activity.timestamp > $since
+      AND ($until = 0 OR activity.timestamp <= $until)
+      AND (ARRAY_LENGTH($users) = 0 OR LOWER(activity.username) IN $users)
   )
 SELECT
-  RAW activity_count
-FROM
-  activities;
+  RAW ARRAY_COUNT(activities);
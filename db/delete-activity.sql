@@ -3,5 +3,5 @@ DELETE FROM `bucket_name`
 WHERE
   `type` = "activity"
   AND kind = $kind
-  AND username = $username
+  AND LOWER(username) = LOWER($username)
   AND target = $target
@@ -1,22 +1,24 @@
 /* N1QL query to get file comments. */
 SELECT
   {
-    "comment": c.body,
+    "comment": (CASE WHEN c.status IS VALUED THEN MISSING ELSE c.body END),
+    "status": c.status,
     "date": c.timestamp,
     "id": META(c).id,
+    "parent_id": c.parent_id,
+    "replies_count": IFMISSINGORNULL(c.replies_count, 0),
+    "mentions": (CASE WHEN c.status IS VALUED THEN MISSING ELSE c.mentions END),
+    "edited": IFMISSINGORNULL(ARRAY_LENGTH(c.history), 0) > 0,
     "author": {
-      "follow": ARRAY_BINARY_SEARCH(
-        ARRAY_SORT(
-          (
-            SELECT
-              RAW `following`
-            FROM
-              `bucket_name`
-            USE KEYS $loggedInUser
-          ) [0]
-        ),
-        c.username
-      ) >= 0,
+      "follow": ARRAY_LENGTH(
+        (
+          SELECT
+            RAW 1
+          FROM
+            `bucket_name` n
+          USE KEYS "edge::follow::" || $loggedInUser || "::" || LOWER(c.username)
+        )
+      ) > 0,
       "username": c.username,
       "member_since": (
         SELECT
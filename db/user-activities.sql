@@ -1,26 +1,50 @@
 WITH
   user_following AS (
-    (
-      SELECT
-        RAW s.`following`
-      FROM
-        `bucket_name` AS s
-      USE KEYS $user
-    ) [0]
+    SELECT
+      RAW e.target
+    FROM
+      `bucket_name` AS e
+    WHERE
+      e.`type` = "edge"
+      AND e.kind = "follow"
+      AND e.username = $user
+  ),
+  user_mentions AS (
+    SELECT
+      RAW META(c).id
+    FROM
+      `bucket_name` AS c
+    WHERE
+      c.`type` = "comment"
+      AND ANY m IN c.mentions SATISFIES m = $user END
   ),
   activities AS (
     SELECT
-      activity.*,
-      d.username,
-      d.member_since
+      activity.*
     FROM
       user_following AS d
-      INNER JOIN `bucket_name` AS activity ON activity.username = d.username
+      INNER JOIN `bucket_name` AS activity ON LOWER(activity.username) = d
+    WHERE
+      activity.`type` = 'activity'
+      AND activity.kind IN $kinds
+      AND activity.src IN $sources
+      AND activity.timestamp > $since
+      AND ($until = 0 OR activity.timestamp <= $until)
+      AND (ARRAY_LENGTH($users) = 0 OR LOWER(activity.username) IN $users)
+    UNION
+    SELECT
+      activity.*
+    FROM
+      `bucket_name` AS activity
     WHERE
       activity.`type` = 'activity'
-      AND activity.src = 'web'
-      AND activity.kind != 'comment'
-      AND activity.kind != 'follow'
+      AND activity.kind = 'mention'
+      AND activity.target IN user_mentions
+      AND activity.kind IN $kinds
+      AND activity.src IN $sources
+      AND activity.timestamp > $since
+      AND ($until = 0 OR activity.timestamp <= $until)
+      AND (ARRAY_LENGTH($users) = 0 OR LOWER(activity.username) IN $users)
   )
 SELECT
   {
@@ -36,8 +60,31 @@ SELECT
         USE KEYS LOWER(activity.username)
       ) [0]
     },
-    "follow": TRUE,
-    "comment": f.body,
+    "follow": ARRAY_LENGTH(
+      (
+        SELECT
+          RAW 1
+        FROM
+          `bucket_name` n
+        USE KEYS "edge::follow::" || $user || "::" || LOWER(activity.username)
+      )
+    ) > 0,
+    "comment": c.body,
+    "comment_id": c.id,
+    "parent_id": c.parent_id,
+    "mentions": c.mentions,
+    "verdict": (
+      CASE
+        WHEN activity.kind = "vote" THEN (
+          SELECT
+            RAW {"verdict": v.verdict, "family": v.family}
+          FROM
+            `bucket_name` v
+          USE KEYS "edge::vote::" || LOWER(activity.username) || "::" || activity.target
+        ) [0]
+        ELSE MISSING
+      END
+    ),
     "date": activity.timestamp
   }.*,
   (
@@ -60,9 +107,15 @@ SELECT
   ).*
 FROM
   activities AS activity
-  INNER JOIN `bucket_name` AS f ON activity.target = META(f).id
+  LEFT JOIN `bucket_name` AS c ON KEYS (
+    CASE
+      WHEN activity.kind IN ["comment", "reply", "mention"] THEN activity.target
+    END
+  )
+  LEFT JOIN `bucket_name` AS f ON KEYS IFMISSINGORNULL(c.sha256, activity.target)
 WHERE
-  f.`type` = 'file'
+  activity.kind = 'follow'
+  OR f.`type` = 'file'
 ORDER BY
   activity.timestamp DESC
 OFFSET
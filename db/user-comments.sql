@@ -3,19 +3,20 @@ SELECT
   {
     "id": META(c).id,
     "comment": c.body,
-    "liked": ARRAY_BINARY_SEARCH(
-      ARRAY_SORT(
-        (
-          SELECT
-            RAW likes
-          FROM
-            `bucket_name`
-          USE KEYS $loggedInUser
-        ) [0]
-      ),
-      c.sha256
-    ) >= 0,
+    "liked": ARRAY_LENGTH(
+      (
+        SELECT
+          RAW 1
+        FROM
+          `bucket_name` l
+        USE KEYS "edge::like::" || $loggedInUser || "::" || c.sha256
+      )
+    ) > 0,
     "date": c.timestamp,
+    "parent_id": c.parent_id,
+    "replies_count": IFMISSINGORNULL(c.replies_count, 0),
+    "mentions": c.mentions,
+    "edited": IFMISSINGORNULL(ARRAY_LENGTH(c.history), 0) > 0,
     "file": {
       "hash": f.sha256,
       "tags": f.tags,
@@ -34,6 +35,7 @@ FROM
 WHERE
   c.`type` = 'comment'
   AND c.`username` = $user
+  AND c.status IS NOT VALUED
 ORDER BY
   c.timestamp DESC
 OFFSET
@@ -4,30 +4,25 @@ SELECT
     "id": META(p).id,
     "username": p.`username`,
     "member_since": p.`member_since`,
-    "follow": ARRAY_BINARY_SEARCH(
-      ARRAY_SORT(
-        (
-          SELECT
-            RAW ARRAY LOWER(u.username) FOR u IN n.`following` END
-          FROM
-            `bucket_name` n
-          USE KEYS $loggedInUser
-        ) [0]
-      ),
-      META(p).id
-    ) >= 0
+    "follow": ARRAY_LENGTH(
+      (
+        SELECT
+          RAW 1
+        FROM
+          `bucket_name` n
+        USE KEYS "edge::follow::" || $loggedInUser || "::" || META(p).id
+      )
+    ) > 0
   }
 FROM
-  `bucket_name` p
-USE KEYS [
-  (
-    SELECT
-      RAW ARRAY LOWER(u.username) FOR u IN s.`following` END
-    FROM
-      `bucket_name` s
-    USE KEYS $user
-  ) [0]
-]
+  `bucket_name` e
+  INNER JOIN `bucket_name` p ON KEYS e.target
+WHERE
+  e.`type` = "edge"
+  AND e.kind = "follow"
+  AND e.username = $user
+ORDER BY
+  e.ts
 OFFSET
   $offset
 LIMIT
@@ -2,19 +2,16 @@
 SELECT
   {
     "id": UUID(),
-    "date": l.ts,
-    "liked": ARRAY_BINARY_SEARCH(
-      ARRAY_SORT(
-        (
-          SELECT
-            RAW ARRAY like_item.sha256 FOR like_item IN u.`likes` END AS sha256_array
-          FROM
-            `bucket_name` u
-          USE KEYS $loggedInUser
-        ) [0]
-      ),
-      f.sha256
-    ) >= 0,
+    "date": e.ts,
+    "liked": ARRAY_LENGTH(
+      (
+        SELECT
+          RAW 1
+        FROM
+          `bucket_name` l
+        USE KEYS "edge::like::" || $loggedInUser || "::" || f.sha256
+      )
+    ) > 0,
     "file": {
       "hash": f.sha256,
       "tags": f.tags,
@@ -28,18 +25,15 @@ SELECT
     }
   }.*
 FROM
-  (
-    SELECT
-      userSubmissions.*
-    FROM
-      `bucket_name` s
-    USE KEYS $user
-    UNNEST
-      s.submissions AS userSubmissions
-  ) AS l
-  LEFT JOIN `bucket_name` f ON f.sha256 = l.sha256
+  `bucket_name` e
+  INNER JOIN `bucket_name` f ON KEYS e.target
 WHERE
-  f.`type` = "file"
+  e.`type` = "edge"
+  AND e.kind = "submit"
+  AND e.username = $user
+  AND f.`type` = "file"
+ORDER BY
+  e.ts
 OFFSET
   $offset
 LIMIT
@@ -0,0 +1,566 @@
+// Copyright 2021 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/yeka/zip"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	// ErrTooLarge is returned when the entries do not fit in a zip archive
+	// without the zip64 extensions.
+	ErrTooLarge = errors.New("archive too large")
+	// ErrNotSkippable is returned when skipping the content of an entry
+	// whose records depend on it, or which is not written before a range.
+	ErrNotSkippable = errors.New("entry can not be skipped")
+)
+
+// Archives are written deterministically: entries are stored without
+// compression, with a fixed modification time, and the salts and headers
+// of the encryption are derived from the password and the entry name. The
+// same content always gives the same archive, of a size known in advance,
+// so that parts of it can be served again.
+const (
+	// dosDate is 1980-01-01, the earliest MS-DOS date.
+	dosDate = 0x21
+	dosTime = 0
+
+	localHeaderLen      = 30
+	centralHeaderLen    = 46
+	dataDescriptorLen   = 16
+	endOfCentralDirLen  = 22
+	zipCryptoHeaderLen  = 12
+	aesExtraLen         = 11
+	aesSaltLen          = 16
+	aesVerifierLen      = 2
+	aesKeyLen           = 32
+	aesMACLen           = 10
+	aesIterations       = 1000
+	methodStore         = 0
+	methodAES           = 99
+	flagEncrypted       = 0x1
+	flagDataDescriptor  = 0x8
+	versionStore        = 20
+	versionAES          = 51
+	sigLocalHeader      = 0x04034b50
+	sigCentralHeader    = 0x02014b50
+	sigDataDescriptor   = 0x08074b50
+	sigEndOfCentralDir  = 0x06054b50
+	aesExtraID          = 0x9901
+	aesVendorVersion    = 2 // AE-2, the checksum is left out
+	aesStrength256      = 3
+	maxEntries          = math.MaxUint16
+	maxArchiveEntrySize = math.MaxUint32
+)
+
+// EndSize is the size of the end of an archive past its entries.
+const EndSize = endOfCentralDirLen
+
+// Writer streams a zip archive entry by entry.
+type Writer interface {
+	// Create adds an entry, encrypted when the archive has a password. The
+	// entry must be closed once written.
+	Create(name string) (io.WriteCloser, error)
+	// CreatePlain adds an entry which is never encrypted. The entry must
+	// be closed once written.
+	CreatePlain(name string) (io.WriteCloser, error)
+	// Skip adds an entry of size bytes without its content, when the
+	// archive is written to a RangeWriter and the entry lies before the
+	// range. Only AES entries can be skipped, as their records do not
+	// depend on their content.
+	Skip(name string, size int64) error
+	// Close finishes writing the archive.
+	Close() error
+}
+
+// NewWriter creates a zip writer encrypting the entries with password using
+// enc, zip.StandardEncryption stands for the legacy ZipCrypto encryption and
+// the AES encryptions all use 256 bits keys. Entries are not encrypted when
+// password is empty.
+func NewWriter(w io.Writer, enc zip.EncryptionMethod, password string) Writer {
+	return &writer{w: &countWriter{w: w}, enc: encryption(enc, password),
+		password: []byte(password)}
+}
+
+// EntrySize returns the size an entry holding size bytes takes in an
+// archive, including its record in the central directory.
+func EntrySize(enc zip.EncryptionMethod, password, name string,
+	size int64) int64 {
+
+	h := newHeader(encryption(enc, password), name, 0)
+	return 2*int64(len(name)+len(h.extra)) + localHeaderLen +
+		centralHeaderLen + dataDescriptorLen + h.overhead() + size
+}
+
+// Source writes length bytes of the content of an entry, starting at
+// offset.
+type Source func(w io.Writer, offset, length int64) error
+
+// WriteRange writes the bytes [start, end) of the archive holding a single
+// entry of size bytes whose content is read from src. AES encrypted
+// content is read only as far as needed, except when the range includes
+// the authentication code following it.
+func WriteRange(w io.Writer, enc zip.EncryptionMethod, password,
+	name string, size int64, src Source, start, end int64) error {
+
+	rw := NewRangeWriter(w, start, end)
+	zw := NewWriter(rw, enc, password).(*writer)
+	entry, err := zw.Create(name)
+	if err != nil {
+		return rw.IgnoreDone(err)
+	}
+	dataStart := rw.pos
+	dataEnd := dataStart + size
+
+	if e, ok := entry.(*aesEntry); ok && end <= dataEnd {
+		offset := max(start-dataStart, 0)
+		if end <= dataStart+offset {
+			return nil
+		}
+		if offset > 0 {
+			e.seek(offset)
+			rw.pos += offset
+		}
+		return rw.IgnoreDone(src(entry, offset, end-dataStart-offset))
+	}
+
+	// Other encryptions need the content from the start, and the
+	// checksums written after it need all of it.
+	length := size
+	if end < dataEnd {
+		length = max(end-dataStart, 0)
+	}
+	if length > 0 {
+		if err = src(entry, 0, length); err != nil {
+			return rw.IgnoreDone(err)
+		}
+	}
+	if length < size {
+		return nil
+	}
+	if err = entry.Close(); err != nil {
+		return rw.IgnoreDone(err)
+	}
+	return rw.IgnoreDone(zw.Close())
+}
+
+// encryptionMethod is the encryption applied to the entries of an archive.
+type encryptionMethod int
+
+const (
+	encryptionNone encryptionMethod = iota
+	encryptionZipCrypto
+	encryptionAES
+)
+
+func encryption(enc zip.EncryptionMethod, password string) encryptionMethod {
+	switch {
+	case password == "":
+		return encryptionNone
+	case enc == zip.StandardEncryption:
+		return encryptionZipCrypto
+	default:
+		return encryptionAES
+	}
+}
+
+// header holds the fields of an entry shared by its local header and its
+// record in the central directory.
+type header struct {
+	name    string
+	enc     encryptionMethod
+	version uint16
+	flags   uint16
+	method  uint16
+	extra   []byte
+	crc32   uint32
+	csize   uint64
+	usize   uint64
+	offset  uint64
+}
+
+func newHeader(enc encryptionMethod, name string, offset uint64) *header {
+	h := &header{name: name, enc: enc, version: versionStore,
+		flags: flagDataDescriptor, method: methodStore, offset: offset}
+	if enc != encryptionNone {
+		h.flags |= flagEncrypted
+	}
+	if enc == encryptionAES {
+		h.version = versionAES
+		h.method = methodAES
+		h.extra = make([]byte, aesExtraLen)
+		b := h.extra
+		binary.LittleEndian.PutUint16(b, aesExtraID)
+		binary.LittleEndian.PutUint16(b[2:], aesExtraLen-4)
+		binary.LittleEndian.PutUint16(b[4:], aesVendorVersion)
+		copy(b[6:], "AE")
+		b[8] = aesStrength256
+		binary.LittleEndian.PutUint16(b[9:], methodStore)
+	}
+	return h
+}
+
+// overhead returns the number of bytes the encryption adds to the content
+// of an entry.
+func (h *header) overhead() int64 {
+	switch h.enc {
+	case encryptionZipCrypto:
+		return zipCryptoHeaderLen
+	case encryptionAES:
+		return aesSaltLen + aesVerifierLen + aesMACLen
+	default:
+		return 0
+	}
+}
+
+func (h *header) writeLocal(w io.Writer) error {
+	b := make([]byte, localHeaderLen, localHeaderLen+len(h.name)+len(h.extra))
+	binary.LittleEndian.PutUint32(b, sigLocalHeader)
+	binary.LittleEndian.PutUint16(b[4:], h.version)
+	binary.LittleEndian.PutUint16(b[6:], h.flags)
+	binary.LittleEndian.PutUint16(b[8:], h.method)
+	binary.LittleEndian.PutUint16(b[10:], dosTime)
+	binary.LittleEndian.PutUint16(b[12:], dosDate)
+	// The checksum and sizes follow the content in the data descriptor.
+	binary.LittleEndian.PutUint16(b[26:], uint16(len(h.name)))
+	binary.LittleEndian.PutUint16(b[28:], uint16(len(h.extra)))
+	b = append(append(b, h.name...), h.extra...)
+	_, err := w.Write(b)
+	return err
+}
+
+func (h *header) writeDataDescriptor(w io.Writer) error {
+	b := make([]byte, dataDescriptorLen)
+	binary.LittleEndian.PutUint32(b, sigDataDescriptor)
+	binary.LittleEndian.PutUint32(b[4:], h.crc32)
+	binary.LittleEndian.PutUint32(b[8:], uint32(h.csize))
+	binary.LittleEndian.PutUint32(b[12:], uint32(h.usize))
+	_, err := w.Write(b)
+	return err
+}
+
+func (h *header) writeCentral(w io.Writer) error {
+	b := make([]byte, centralHeaderLen,
+		centralHeaderLen+len(h.name)+len(h.extra))
+	binary.LittleEndian.PutUint32(b, sigCentralHeader)
+	binary.LittleEndian.PutUint16(b[4:], versionStore)
+	binary.LittleEndian.PutUint16(b[6:], h.version)
+	binary.LittleEndian.PutUint16(b[8:], h.flags)
+	binary.LittleEndian.PutUint16(b[10:], h.method)
+	binary.LittleEndian.PutUint16(b[12:], dosTime)
+	binary.LittleEndian.PutUint16(b[14:], dosDate)
+	binary.LittleEndian.PutUint32(b[16:], h.crc32)
+	binary.LittleEndian.PutUint32(b[20:], uint32(h.csize))
+	binary.LittleEndian.PutUint32(b[24:], uint32(h.usize))
+	binary.LittleEndian.PutUint16(b[28:], uint16(len(h.name)))
+	binary.LittleEndian.PutUint16(b[30:], uint16(len(h.extra)))
+	binary.LittleEndian.PutUint32(b[42:], uint32(h.offset))
+	b = append(append(b, h.name...), h.extra...)
+	_, err := w.Write(b)
+	return err
+}
+
+// writer writes a zip archive.
+type writer struct {
+	w        *countWriter
+	enc      encryptionMethod
+	password []byte
+	headers  []*header
+}
+
+func (w *writer) Create(name string) (io.WriteCloser, error) {
+	return w.create(name, w.enc)
+}
+
+func (w *writer) CreatePlain(name string) (io.WriteCloser, error) {
+	return w.create(name, encryptionNone)
+}
+
+func (w *writer) Skip(name string, size int64) error {
+	rw, ok := w.w.w.(*RangeWriter)
+	if !ok || w.enc != encryptionAES {
+		return ErrNotSkippable
+	}
+	if size > maxArchiveEntrySize {
+		return ErrTooLarge
+	}
+	// The whole entry must lie before the range, its authentication code
+	// is not valid.
+	h := newHeader(w.enc, name, 0)
+	end := rw.pos + localHeaderLen + int64(len(name)+len(h.extra)) +
+		h.overhead() + size + dataDescriptorLen
+	if end > rw.start {
+		return ErrNotSkippable
+	}
+
+	entry, err := w.create(name, w.enc)
+	if err != nil {
+		return err
+	}
+	e := entry.(*aesEntry)
+	if err = rw.Skip(size); err != nil {
+		return err
+	}
+	w.w.n += size
+	e.h.usize += uint64(size)
+	e.h.csize += uint64(size)
+	return e.Close()
+}
+
+func (w *writer) create(name string, enc encryptionMethod) (
+	io.WriteCloser, error) {
+
+	if len(w.headers) == maxEntries || w.w.n > maxArchiveEntrySize {
+		return nil, ErrTooLarge
+	}
+	h := newHeader(enc, name, uint64(w.w.n))
+	if err := h.writeLocal(w.w); err != nil {
+		return nil, err
+	}
+	w.headers = append(w.headers, h)
+
+	stored := &storedEntry{w: w.w, h: h, crc32: crc32.NewIEEE()}
+	switch enc {
+	case encryptionZipCrypto:
+		return newZipCryptoEntry(stored, w.password)
+	case encryptionAES:
+		return newAESEntry(stored, w.password)
+	default:
+		return stored, nil
+	}
+}
+
+func (w *writer) Close() error {
+	start := w.w.n
+	for _, h := range w.headers {
+		if err := h.writeCentral(w.w); err != nil {
+			return err
+		}
+	}
+	b := make([]byte, endOfCentralDirLen)
+	binary.LittleEndian.PutUint32(b, sigEndOfCentralDir)
+	binary.LittleEndian.PutUint16(b[8:], uint16(len(w.headers)))
+	binary.LittleEndian.PutUint16(b[10:], uint16(len(w.headers)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(w.w.n-start))
+	binary.LittleEndian.PutUint32(b[16:], uint32(start))
+	_, err := w.w.Write(b)
+	return err
+}
+
+// storedEntry writes the content of an entry as is.
+type storedEntry struct {
+	w     io.Writer
+	h     *header
+	crc32 hash.Hash32
+}
+
+func (e *storedEntry) Write(p []byte) (int, error) {
+	if e.h.usize+uint64(len(p)) > maxArchiveEntrySize {
+		return 0, ErrTooLarge
+	}
+	e.crc32.Write(p)
+	e.h.usize += uint64(len(p))
+	return e.writeRaw(p)
+}
+
+// writeRaw writes p as part of the entry without accounting for it in the
+// checksum and the uncompressed size.
+func (e *storedEntry) writeRaw(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	e.h.csize += uint64(n)
+	return n, err
+}
+
+func (e *storedEntry) Close() error {
+	e.h.crc32 = e.crc32.Sum32()
+	return e.h.writeDataDescriptor(e.w)
+}
+
+// zipCryptoEntry encrypts the content of an entry with ZipCrypto.
+type zipCryptoEntry struct {
+	*storedEntry
+	cipher *zip.ZipCrypto
+}
+
+func newZipCryptoEntry(e *storedEntry, password []byte) (
+	*zipCryptoEntry, error) {
+
+	// With a data descriptor, readers check the password against the last
+	// byte of the header, the high order byte of the modification time.
+	header := derive(password, "zipcrypto|"+e.h.name, zipCryptoHeaderLen)
+	header[zipCryptoHeaderLen-1] = byte(dosTime >> 8)
+
+	cipher := zip.NewZipCrypto(password)
+	if _, err := e.writeRaw(cipher.Encrypt(header)); err != nil {
+		return nil, err
+	}
+	return &zipCryptoEntry{e, cipher}, nil
+}
+
+func (e *zipCryptoEntry) Write(p []byte) (int, error) {
+	if e.h.usize+uint64(len(p)) > maxArchiveEntrySize {
+		return 0, ErrTooLarge
+	}
+	e.crc32.Write(p)
+	e.h.usize += uint64(len(p))
+	return e.writeRaw(e.cipher.Encrypt(p))
+}
+
+// aesEntry encrypts the content of an entry following the WinZip AE-2
+// specification: AES in counter mode authenticated with HMAC-SHA1.
+type aesEntry struct {
+	*storedEntry
+	block   cipher.Block
+	mac     hash.Hash
+	counter uint64
+	stream  []byte
+	buf     []byte
+}
+
+func newAESEntry(e *storedEntry, password []byte) (*aesEntry, error) {
+	salt := derive(password, "salt|"+e.h.name, aesSaltLen)
+	key := pbkdf2.Key(password, salt, aesIterations,
+		2*aesKeyLen+aesVerifierLen, sha1.New)
+	block, err := aes.NewCipher(key[:aesKeyLen])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = e.writeRaw(append(salt, key[2*aesKeyLen:]...)); err != nil {
+		return nil, err
+	}
+	return &aesEntry{storedEntry: e, block: block,
+		mac: hmac.New(sha1.New, key[aesKeyLen:2*aesKeyLen])}, nil
+}
+
+// seek moves the key stream to offset in the content. The authentication
+// code is no longer valid afterwards.
+func (e *aesEntry) seek(offset int64) {
+	e.counter = uint64(offset / aes.BlockSize)
+	e.stream = nil
+	if rem := offset % aes.BlockSize; rem > 0 {
+		e.stream = e.nextBlock()[rem:]
+	}
+}
+
+// nextBlock returns the key stream of the next block, the counter is
+// little endian and starts at 1.
+func (e *aesEntry) nextBlock() []byte {
+	e.counter++
+	block := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint64(block, e.counter)
+	e.block.Encrypt(block, block)
+	return block
+}
+
+func (e *aesEntry) Write(p []byte) (int, error) {
+	if e.h.usize+uint64(len(p)) > maxArchiveEntrySize {
+		return 0, ErrTooLarge
+	}
+	e.buf = append(e.buf[:0], p...)
+	for i := range e.buf {
+		if len(e.stream) == 0 {
+			e.stream = e.nextBlock()
+		}
+		e.buf[i] ^= e.stream[0]
+		e.stream = e.stream[1:]
+	}
+	// The content is not checksummed in AE-2, the checksum is left to 0.
+	e.mac.Write(e.buf)
+	e.h.usize += uint64(len(p))
+	return e.writeRaw(e.buf)
+}
+
+func (e *aesEntry) Close() error {
+	if _, err := e.writeRaw(e.mac.Sum(nil)[:aesMACLen]); err != nil {
+		return err
+	}
+	return e.storedEntry.Close()
+}
+
+// derive deterministically derives n bytes from the password, distinct for
+// every label.
+func derive(password []byte, label string, n int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)[:n]
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// errRangeDone stops writing once past the requested range.
+var errRangeDone = errors.New("range done")
+
+// RangeWriter only lets through the bytes [start, end) of what is written
+// to it, and fails once past them to stop the writes.
+type RangeWriter struct {
+	w          io.Writer
+	start, end int64
+	pos        int64
+	done       bool
+}
+
+// NewRangeWriter creates a writer letting through the bytes [start, end)
+// to w.
+func NewRangeWriter(w io.Writer, start, end int64) *RangeWriter {
+	return &RangeWriter{w: w, start: start, end: end}
+}
+
+func (rw *RangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	from := min(max(rw.start-rw.pos, 0), int64(n))
+	to := min(max(rw.end-rw.pos, 0), int64(n))
+	rw.pos += int64(n)
+	if from < to {
+		if _, err := rw.w.Write(p[from:to]); err != nil {
+			return 0, err
+		}
+	}
+	if rw.pos >= rw.end {
+		rw.done = true
+		return n, errRangeDone
+	}
+	return n, nil
+}
+
+// Skip moves past n bytes lying before the range without writing them.
+func (rw *RangeWriter) Skip(n int64) error {
+	if rw.pos+n > rw.start {
+		return ErrNotSkippable
+	}
+	rw.pos += n
+	return nil
+}
+
+// IgnoreDone drops the error stopping the writes once past the range,
+// which may have been wrapped on the way.
+func (rw *RangeWriter) IgnoreDone(err error) error {
+	if rw.done {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,230 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yeka/zip"
+)
+
+const password = "infected"
+
+var formats = []struct {
+	name     string
+	enc      zip.EncryptionMethod
+	password string
+}{
+	{"plain", 0, ""},
+	{"zipcrypto", zip.StandardEncryption, password},
+	{"aes", zip.AES256Encryption, password},
+}
+
+type entry struct {
+	name    string
+	content []byte
+	plain   bool
+}
+
+func newContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i*7 + i/251)
+	}
+	return content
+}
+
+var entries = []entry{
+	{"empty", nil, false},
+	{"small", []byte("saferwall"), false},
+	{"blocks", newContent(3*16 + 5), false},
+	{"large", newContent(100_000), false},
+	{"manifest.json", []byte(`{"included": []}`), true},
+}
+
+// writeArchive writes an archive of the entries to w.
+func writeArchive(t *testing.T, w io.Writer, enc zip.EncryptionMethod,
+	password string, entries []entry) {
+
+	zw := NewWriter(w, enc, password)
+	for _, e := range entries {
+		create := zw.Create
+		if e.plain {
+			create = zw.CreatePlain
+		}
+		ew, err := create(e.name)
+		require.Nil(t, err)
+		_, err = ew.Write(e.content)
+		require.Nil(t, err)
+		require.Nil(t, ew.Close())
+	}
+	require.Nil(t, zw.Close())
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			writeArchive(t, buf, f.enc, f.password, entries)
+
+			r, err := zip.NewReader(bytes.NewReader(buf.Bytes()),
+				int64(buf.Len()))
+			require.Nil(t, err)
+			require.Len(t, r.File, len(entries))
+			for i, zf := range r.File {
+				e := entries[i]
+				assert.Equal(t, e.name, zf.Name)
+				assert.Equal(t, f.password != "" && !e.plain,
+					zf.IsEncrypted(), e.name)
+				if zf.IsEncrypted() {
+					zf.SetPassword(f.password)
+				}
+				rc, err := zf.Open()
+				require.Nil(t, err, e.name)
+				content, err := io.ReadAll(rc)
+				require.Nil(t, err, e.name)
+				require.Nil(t, rc.Close(), e.name)
+				assert.True(t, bytes.Equal(e.content, content), e.name)
+			}
+		})
+	}
+}
+
+func TestWriterWrongPassword(t *testing.T) {
+	for _, f := range formats[1:] {
+		buf := &bytes.Buffer{}
+		writeArchive(t, buf, f.enc, f.password, entries[1:2])
+
+		r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.Nil(t, err)
+		r.File[0].SetPassword("wrong")
+		rc, err := r.File[0].Open()
+		if err == nil {
+			_, err = io.ReadAll(rc)
+		}
+		assert.NotNil(t, err, f.name)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	for _, f := range formats {
+		a, b := &bytes.Buffer{}, &bytes.Buffer{}
+		writeArchive(t, a, f.enc, f.password, entries)
+		writeArchive(t, b, f.enc, f.password, entries)
+		assert.Equal(t, a.Bytes(), b.Bytes(), f.name)
+	}
+}
+
+func TestEntrySize(t *testing.T) {
+	for _, f := range formats {
+		buf := &bytes.Buffer{}
+		writeArchive(t, buf, f.enc, f.password, entries)
+
+		size := int64(EndSize)
+		for _, e := range entries {
+			if e.plain {
+				size += EntrySize(0, "", e.name, int64(len(e.content)))
+			} else {
+				size += EntrySize(f.enc, f.password, e.name,
+					int64(len(e.content)))
+			}
+		}
+		assert.Equal(t, int64(buf.Len()), size, f.name)
+	}
+}
+
+func TestWriteRange(t *testing.T) {
+	content := newContent(5000)
+	src := func(w io.Writer, offset, length int64) error {
+		_, err := w.Write(content[offset : offset+length])
+		return err
+	}
+
+	for _, f := range formats {
+		buf := &bytes.Buffer{}
+		writeArchive(t, buf, f.enc, f.password,
+			[]entry{{"sample", content, false}})
+		full := buf.Bytes()
+		size := int64(len(full))
+		require.Equal(t, EntrySize(f.enc, f.password, "sample",
+			int64(len(content)))+EndSize, size, f.name)
+
+		for _, r := range []struct{ start, end int64 }{
+			{0, size},
+			{0, 1},
+			{10, 40},     // within the headers
+			{40, 100},    // across the start of the content
+			{100, 1000},  // within the content
+			{1001, 1017}, // not aligned on the AES blocks
+			{4000, size}, // the end of the content and the records
+			{size - 60, size - 10},
+			{size - 1, size},
+		} {
+			out := &bytes.Buffer{}
+			err := WriteRange(out, f.enc, f.password, "sample",
+				int64(len(content)), src, r.start, r.end)
+			require.Nil(t, err, f.name, r)
+			assert.Equal(t, full[r.start:r.end], out.Bytes(),
+				fmt.Sprintf("%s %v", f.name, r))
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeArchive(t, buf, zip.AES256Encryption, password, entries)
+	full := buf.Bytes()
+
+	// The entries before the range are skipped, the others written.
+	skipped := 3
+	var start int64
+	for _, e := range entries[:skipped] {
+		start += EntrySize(zip.AES256Encryption, password, e.name,
+			int64(len(e.content)))
+	}
+	end := int64(len(full))
+
+	out := &bytes.Buffer{}
+	rw := NewRangeWriter(out, start, end)
+	zw := NewWriter(rw, zip.AES256Encryption, password)
+	for i, e := range entries {
+		if i < skipped {
+			require.Nil(t, zw.Skip(e.name, int64(len(e.content))), e.name)
+			continue
+		}
+		create := zw.Create
+		if e.plain {
+			create = zw.CreatePlain
+		}
+		ew, err := create(e.name)
+		require.Nil(t, rw.IgnoreDone(err))
+		_, err = ew.Write(e.content)
+		require.Nil(t, rw.IgnoreDone(err))
+		require.Nil(t, rw.IgnoreDone(ew.Close()))
+	}
+	require.Nil(t, rw.IgnoreDone(zw.Close()))
+	assert.Equal(t, full[start:end], out.Bytes())
+}
+
+func TestSkipNotAllowed(t *testing.T) {
+	large := entries[3]
+	size := int64(len(large.content))
+
+	// Outside of a range.
+	zw := NewWriter(&bytes.Buffer{}, zip.AES256Encryption, password)
+	assert.Equal(t, ErrNotSkippable, zw.Skip(large.name, size))
+
+	// The records of the other encryptions depend on the content.
+	rw := NewRangeWriter(&bytes.Buffer{}, 1<<20, 2<<20)
+	zw = NewWriter(rw, zip.StandardEncryption, password)
+	assert.Equal(t, ErrNotSkippable, zw.Skip(large.name, size))
+
+	// The entry must end before the range.
+	entrySize := EntrySize(zip.AES256Encryption, password, large.name, size)
+	rw = NewRangeWriter(&bytes.Buffer{}, size, entrySize)
+	zw = NewWriter(rw, zip.AES256Encryption, password)
+	assert.Equal(t, ErrNotSkippable, zw.Skip(large.name, size))
+}
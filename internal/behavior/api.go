@@ -5,12 +5,15 @@
 package behavior
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/internal/ioc"
 	"github.com/saferwall/saferwall-api/pkg/log"
 	"github.com/saferwall/saferwall-api/pkg/pagination"
 )
@@ -24,7 +27,7 @@ const (
 )
 
 func RegisterHandlers(g *echo.Group, service Service,
-	cacheResponse, verifyID echo.MiddlewareFunc, logger log.Logger) {
+	cacheResponse, verifyID, requireLogin echo.MiddlewareFunc, logger log.Logger) {
 
 	res := resource{service, logger}
 
@@ -32,6 +35,10 @@ func RegisterHandlers(g *echo.Group, service Service,
 	g.GET("/behaviors/:id/api-trace/", res.apis, cacheResponse, verifyID)
 	g.GET("/behaviors/:id/sys-events/", res.events, cacheResponse, verifyID)
 	g.GET("/behaviors/:id/artifacts/", res.artifacts, cacheResponse, verifyID)
+	g.GET("/behaviors/:id/capabilities/", res.capabilities, cacheResponse, verifyID)
+	g.GET("/behaviors/:id/iocs/", res.iocs, verifyID)
+	g.POST("/behaviors/:id/artifacts/download/", res.bulkDownloadArtifacts, verifyID, requireLogin)
+	g.GET("/behaviors/:id/artifacts/:artifact_id/download/", res.downloadArtifact, verifyID, requireLogin)
 
 }
 
@@ -147,6 +154,152 @@ func (r resource) artifacts(c echo.Context) error {
 	return c.JSON(http.StatusOK, pages)
 }
 
+// @Summary Capabilities summary.
+// @Description Returns the capabilities of a behavior report grouped by MITRE ATT&CK tactic.
+// @Tags Behavior
+// @Param id path string true "Behavior report GUID"
+// @Success 200 {object} CapabilitiesSummary
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /behaviors/{id}/capabilities/ [get]
+func (r resource) capabilities(c echo.Context) error {
+	summary, err := r.service.Capabilities(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, summary)
+}
+
+// @Summary Network indicators of compromise.
+// @Description Returns the deduplicated domains, IPs and URLs observed in the API trace, system events and artifacts of a behavior report.
+// @Tags Behavior
+// @Produce json,plain
+// @Param id path string true "Behavior report GUID"
+// @Param format query string false "Output format: json (default), csv or text"
+// @Param type query string false "Comma separated list of indicator types: url, domain, ipv4, ipv6"
+// @Success 200 {object} ioc.Response
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /behaviors/{id}/iocs/ [get]
+func (r resource) iocs(c echo.Context) error {
+	format := c.QueryParam("format")
+	contentType, err := ioc.ContentType(format)
+	if err != nil {
+		return errors.BadRequest(err.Error())
+	}
+
+	types, err := ioc.ParseTypes(c.QueryParam("type"))
+	if err != nil {
+		return errors.BadRequest(err.Error())
+	}
+
+	iocs, err := r.service.IOCs(c.Request().Context(), c.Param("id"), types)
+	if err != nil {
+		return err
+	}
+
+	// Encode before committing to a status code so an encoding failure is
+	// still reported as an error response.
+	var buf bytes.Buffer
+	if err = ioc.Write(&buf, format, iocs); err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
+
+// @Summary Download an artifact
+// @Description Download an artifact such as a memdump or a dropped file. Artifacts are in zip format and password protected.
+// @Tags Behavior
+// @Produce mpfd
+// @Param id path string true "Behavior report GUID"
+// @Param artifact_id path string true "Artifact SHA256"
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /behaviors/{id}/artifacts/{artifact_id}/download/ [get]
+// @Security Bearer
+func (r resource) downloadArtifact(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	artifactID := strings.ToLower(c.Param("artifact_id"))
+	if !sha256reg.MatchString(artifactID) {
+		return errors.BadRequest("invalid artifact id")
+	}
+
+	pkg, err := r.service.PackageArtifact(ctx, c.Param("id"), artifactID)
+	if err != nil {
+		switch err {
+		case ErrArtifactNotFound:
+			return errors.NotFound("")
+		default:
+			return err
+		}
+	}
+	return r.serveArtifacts(c, pkg)
+}
+
+// @Summary Download many artifacts
+// @Description Download the artifacts of a behavior report in a single
+// @Description archive. Artifacts are in zip format and password protected,
+// @Description a `manifest.json` entry lists the artifacts included, missing
+// @Description or failed. All the artifacts are included when the body is
+// @Description empty.
+// @Tags Behavior
+// @Accept json
+// @Produce mpfd
+// @Param id path string true "Behavior report GUID"
+// @Param data body DownloadArtifactsRequest false "Artifacts SHA256, all artifacts are included when empty"
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /behaviors/{id}/artifacts/download/ [post]
+// @Security Bearer
+func (r resource) bulkDownloadArtifacts(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var input DownloadArtifactsRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&input); err != nil {
+			r.logger.With(ctx).Info(err)
+			return errors.BadRequest("")
+		}
+	}
+	for i, artifactID := range input.Artifacts {
+		input.Artifacts[i] = strings.ToLower(artifactID)
+	}
+
+	pkg, err := r.service.PackageArtifacts(ctx, c.Param("id"),
+		input.Artifacts)
+	if err != nil {
+		switch err {
+		case ErrArtifactNotFound:
+			return errors.NotFound("")
+		default:
+			return err
+		}
+	}
+	return r.serveArtifacts(c, pkg)
+}
+
+// serveArtifacts streams an archive of artifacts with its exact size.
+func (r resource) serveArtifacts(c echo.Context, pkg ArtifactsPackage) error {
+	header := c.Response().Header()
+	header.Set("Content-Length", fmt.Sprint(pkg.Size))
+	header.Set("Content-Type", "application/zip")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
+		pkg.Name))
+	c.Response().WriteHeader(http.StatusOK)
+
+	// Failures past this point end the response early.
+	_ = r.service.DownloadArtifacts(c.Request().Context(), pkg,
+		c.Response().Writer)
+	return nil
+}
+
 // WithFilters returns a context that contains the API filters.
 func WithFilters(ctx context.Context, queryParams map[string][]string) context.Context {
 	// Attach our filters only when the query parameters are not `page` or `per_page`
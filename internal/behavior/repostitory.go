@@ -34,6 +34,12 @@ type Repository interface {
 	Events(ctx context.Context, id string, offset, limit int) (
 		interface{}, error)
 	Artifacts(ctx context.Context, id string, offset, limit int) (interface{}, error)
+	// ArtifactsByHash returns the metadata of the artifacts matching the given
+	// hashes. When no hash is provided, all artifacts are returned.
+	ArtifactsByHash(ctx context.Context, id string, hashes []string) ([]Artifact, error)
+	// IOCsSources returns the API trace, system events and artifacts of a
+	// behavior report, keyed by their IOC source name.
+	IOCsSources(ctx context.Context, id string) (map[string]interface{}, error)
 }
 
 // repository persists file scan behaviors in database.
@@ -406,3 +412,60 @@ func (r repository) Artifacts(ctx context.Context, id string, offset,
 	}
 	return results.([]interface{}), nil
 }
+
+// ArtifactsByHash retrieves the metadata of the artifacts identified by their
+// SHA256 hashes from a behavior document.
+func (r repository) ArtifactsByHash(ctx context.Context, id string,
+	hashes []string) ([]Artifact, error) {
+
+	var results interface{}
+
+	params := make(map[string]interface{}, 1)
+	params["id"] = id
+	statement :=
+		"SELECT RAW artifacts FROM `" + r.db.Bucket.Name() + "` d" +
+			" USE KEYS $id UNNEST d.artifacts as artifacts"
+	if len(hashes) > 0 {
+		statement += " WHERE LOWER(artifacts.sha256) IN $hashes"
+		params["hashes"] = hashes
+	}
+
+	err := r.db.Query(ctx, statement, params, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := []Artifact{}
+	for _, a := range results.([]interface{}) {
+		artifact := Artifact{}
+		b, _ := json.Marshal(a)
+		_ = json.Unmarshal(b, &artifact)
+		artifacts = append(artifacts, artifact)
+	}
+	return artifacts, nil
+}
+
+// IOCsSources reads the parts of a behavior report where network indicators
+// are extracted from.
+func (r repository) IOCsSources(ctx context.Context, id string) (
+	map[string]interface{}, error) {
+
+	var res interface{}
+	params := make(map[string]interface{}, 3)
+	params["behavior_id"] = id
+	params["behavior_id_apis"] = id + "::apis"
+	params["behavior_id_events"] = id + "::events"
+
+	statement := r.db.N1QLQuery[dbcontext.BehaviorIOCsSources]
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := res.([]interface{})
+	if len(rows) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	sources, _ := rows[0].(map[string]interface{})
+	return sources, nil
+}
@@ -6,11 +6,36 @@ package behavior
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/saferwall/saferwall-api/internal/archive"
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
 	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/ioc"
+	"github.com/saferwall/saferwall-api/internal/storage/object"
 	"github.com/saferwall/saferwall-api/pkg/log"
+	"github.com/yeka/zip"
 )
 
+var (
+	// ErrArtifactNotFound is returned when an artifact does not exist in the
+	// behavior report or in the object storage.
+	ErrArtifactNotFound = errors.New("artifact not found")
+	// artifact download timeout in seconds.
+	artifactDownloadTimeout = time.Duration(time.Second * 30)
+)
+
+// artifactsManifest is the name of the manifest of a bulk download.
+const artifactsManifest = "manifest.json"
+
 // Service encapsulates usecase logic for behaviors.
 type Service interface {
 	Get(ctx context.Context, id string, fields []string) (Behavior, error)
@@ -22,6 +47,21 @@ type Service interface {
 	Artifacts(ctx context.Context, id string, offset, limit int) (interface{}, error)
 	APIs(ctx context.Context, id string, offset, limit int) (interface{}, error)
 	Events(ctx context.Context, id string, offset, limit int) (interface{}, error)
+	Capabilities(ctx context.Context, id string) (CapabilitiesSummary, error)
+	IOCs(ctx context.Context, id string, types []ioc.Type) ([]ioc.IOC, error)
+	PackageArtifact(ctx context.Context, id, artifactID string) (ArtifactsPackage, error)
+	PackageArtifacts(ctx context.Context, id string, artifactIDs []string) (ArtifactsPackage, error)
+	DownloadArtifacts(ctx context.Context, pkg ArtifactsPackage, file io.Writer) error
+	DeleteArtifacts(ctx context.Context, sha256 string) error
+}
+
+// Downloader represents the object storage interface used to retrieve
+// and clean up artifacts.
+type Downloader interface {
+	Download(ctx context.Context, bucket, key string, file io.Writer) error
+	Stat(ctx context.Context, bucket, key string) (object.Info, error)
+	List(ctx context.Context, bucket, prefix string) ([]object.Info, error)
+	Delete(ctx context.Context, bucket, key string) error
 }
 
 // Behavior represents the data about a behavior scan.
@@ -29,14 +69,82 @@ type Behavior struct {
 	entity.Behavior
 }
 
+// Artifact represents the metadata of a file produced during a behavior scan,
+// for instance a memory dump or a dropped file.
+type Artifact struct {
+	Name      string `json:"name"`
+	SHA256    string `json:"sha256"`
+	Kind      string `json:"kind,omitempty"`
+	FileType  string `json:"file_type,omitempty"`
+	Detection string `json:"detection,omitempty"`
+}
+
+// TacticSummary represents the capabilities observed for an ATT&CK tactic.
+type TacticSummary struct {
+	Tactic       string                   `json:"tactic"`
+	Techniques   []entity.AttackTechnique `json:"techniques"`
+	Capabilities []entity.Capability      `json:"capabilities"`
+}
+
+// CapabilitiesSummary represents the capabilities of a behavior report
+// grouped by ATT&CK tactic.
+type CapabilitiesSummary struct {
+	Count   int             `json:"count"`
+	Tactics []TacticSummary `json:"tactics"`
+	// Uncategorized holds the capabilities which do not map to any technique.
+	Uncategorized []entity.Capability `json:"uncategorized"`
+}
+
+// DownloadArtifactsRequest represents a request to download many artifacts.
+type DownloadArtifactsRequest struct {
+	// Artifacts represents the SHA256 of the artifacts to include, when empty,
+	// all the artifacts of the behavior report are included.
+	Artifacts []string `json:"artifacts" validate:"omitempty,max=100,dive,len=64,hexadecimal"`
+}
+
+// ArtifactsPackage describes artifacts packaged in a password protected zip
+// for download. Its size is exact as long as every artifact can be fetched.
+type ArtifactsPackage struct {
+	Name string
+	Size int64
+
+	artifacts []artifactObject
+	manifest  *ArtifactsManifest
+}
+
+// ArtifactsManifest lists the outcome of every artifact of a bulk download,
+// it is added to the archive as `manifest.json`.
+type ArtifactsManifest struct {
+	Included []string          `json:"included"`
+	Missing  []string          `json:"missing"`
+	Failed   []ArtifactFailure `json:"failed"`
+}
+
+// ArtifactFailure describes an artifact which could not be downloaded.
+type ArtifactFailure struct {
+	SHA256 string `json:"sha256"`
+	Reason string `json:"reason"`
+}
+
+// artifactObject locates an artifact in the object storage.
+type artifactObject struct {
+	id   string
+	key  string
+	size int64
+}
+
 type service struct {
-	repo   Repository
-	logger log.Logger
+	repo          Repository
+	logger        log.Logger
+	objSto        Downloader
+	bucket        string
+	samplesZipPwd string
 }
 
-// NewService creates a new user service.
-func NewService(repo Repository, logger log.Logger) Service {
-	return service{repo, logger}
+// NewService creates a new behavior service.
+func NewService(repo Repository, logger log.Logger, objSto Downloader,
+	bucket, samplesZipPwd string) Service {
+	return service{repo, logger, objSto, bucket, samplesZipPwd}
 }
 
 // Get returns the file behavior scan given its ID.
@@ -58,6 +166,36 @@ func (s service) Count(ctx context.Context) (int, error) {
 	return s.repo.Count(ctx)
 }
 
+// Capabilities returns the capabilities of a behavior report grouped by
+// ATT&CK tactic.
+func (s service) Capabilities(ctx context.Context, id string) (
+	CapabilitiesSummary, error) {
+
+	behavior, err := s.repo.Get(ctx, id, []string{"capabilities"})
+	if err != nil && !errors.Is(err, dbcontext.ErrSubDocNotFound) {
+		return CapabilitiesSummary{}, err
+	}
+	return summarizeCapabilities(behavior.Capabilities), nil
+}
+
+// IOCs returns the deduplicated network indicators found in the API trace,
+// system events and artifacts of a behavior report.
+func (s service) IOCs(ctx context.Context, id string, types []ioc.Type) (
+	[]ioc.IOC, error) {
+
+	sources, err := s.repo.IOCsSources(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	set := ioc.NewSet()
+	for _, source := range []string{ioc.SourceAPITrace, ioc.SourceSysEvents,
+		ioc.SourceArtifacts} {
+		set.ExtractAll(source, sources[source])
+	}
+	return set.List(types...), nil
+}
+
 func (s service) CountAPIs(ctx context.Context, id string) (int, error) {
 	count, err := s.repo.CountAPIs(ctx, id)
 	if err != nil {
@@ -111,3 +249,257 @@ func (s service) Artifacts(ctx context.Context, id string, offset, limit int) (
 	}
 	return result, nil
 }
+
+// PackageArtifact plans a password protected zip archive holding a single
+// artifact.
+func (s service) PackageArtifact(ctx context.Context, id, artifactID string) (
+	ArtifactsPackage, error) {
+
+	keys, err := s.artifactKeys(ctx, id, []string{artifactID})
+	if err != nil {
+		return ArtifactsPackage{}, err
+	}
+	key, ok := keys[artifactID]
+	if !ok {
+		return ArtifactsPackage{}, ErrArtifactNotFound
+	}
+
+	info, err := s.objSto.Stat(ctx, s.bucket, key)
+	if errors.Is(err, object.ErrNotFound) {
+		return ArtifactsPackage{}, ErrArtifactNotFound
+	}
+	if err != nil {
+		s.logger.With(ctx).Error(err)
+		return ArtifactsPackage{}, err
+	}
+
+	pkg := ArtifactsPackage{
+		Name:      artifactID + ".zip",
+		Size:      archive.EndSize,
+		artifacts: []artifactObject{{artifactID, key, info.Size}},
+	}
+	pkg.Size += archive.EntrySize(zip.AES256Encryption, s.samplesZipPwd,
+		artifactID, info.Size)
+	return pkg, nil
+}
+
+// PackageArtifacts plans a password protected zip archive of many artifacts
+// of a behavior report followed by a manifest listing the artifacts
+// included, missing or failed. When no artifact ID is given, all artifacts
+// are included.
+func (s service) PackageArtifacts(ctx context.Context, id string,
+	artifactIDs []string) (ArtifactsPackage, error) {
+
+	keys, err := s.artifactKeys(ctx, id, artifactIDs)
+	if err != nil {
+		return ArtifactsPackage{}, err
+	}
+
+	// The archive lists the artifacts in a stable order.
+	ids := slices.Clone(artifactIDs)
+	if len(ids) == 0 {
+		for artifactID := range keys {
+			ids = append(ids, artifactID)
+		}
+	}
+	sort.Strings(ids)
+	ids = slices.Compact(ids)
+
+	pkg := ArtifactsPackage{
+		Name: fmt.Sprint(time.Now().Unix()) + ".zip",
+		Size: archive.EndSize,
+		manifest: &ArtifactsManifest{
+			Included: []string{},
+			Missing:  []string{},
+			Failed:   []ArtifactFailure{},
+		},
+	}
+	for _, artifactID := range ids {
+		key, ok := keys[artifactID]
+		if !ok {
+			pkg.manifest.Missing = append(pkg.manifest.Missing, artifactID)
+			continue
+		}
+		info, err := s.objSto.Stat(ctx, s.bucket, key)
+		switch {
+		case errors.Is(err, object.ErrNotFound):
+			pkg.manifest.Missing = append(pkg.manifest.Missing, artifactID)
+			continue
+		case err != nil:
+			s.logger.With(ctx).Errorf("failed to stat artifact %s: %v", key, err)
+			pkg.manifest.Failed = append(pkg.manifest.Failed, ArtifactFailure{
+				SHA256: artifactID,
+				Reason: "failed to retrieve the artifact",
+			})
+			continue
+		}
+		pkg.artifacts = append(pkg.artifacts,
+			artifactObject{artifactID, key, info.Size})
+		pkg.manifest.Included = append(pkg.manifest.Included, artifactID)
+		pkg.Size += archive.EntrySize(zip.AES256Encryption, s.samplesZipPwd,
+			artifactID, info.Size)
+	}
+	if len(pkg.artifacts) == 0 {
+		return ArtifactsPackage{}, ErrArtifactNotFound
+	}
+
+	content, err := json.MarshalIndent(pkg.manifest, "", "  ")
+	if err != nil {
+		return ArtifactsPackage{}, err
+	}
+	pkg.Size += archive.EntrySize(0, "", artifactsManifest, int64(len(content)))
+	return pkg, nil
+}
+
+// DownloadArtifacts streams to file the archive planned by PackageArtifact
+// or PackageArtifacts. When an artifact fails to be fetched, the archive is
+// closed without the remaining entries, it is then shorter than announced.
+func (s service) DownloadArtifacts(ctx context.Context, pkg ArtifactsPackage,
+	file io.Writer) error {
+
+	aw := archive.NewWriter(file, zip.AES256Encryption, s.samplesZipPwd)
+	for _, artifact := range pkg.artifacts {
+		if err := s.writeArtifact(ctx, aw, artifact); err != nil {
+			s.logger.With(ctx).Errorf("failed to download artifact %s: %v",
+				artifact.key, err)
+			if closeErr := aw.Close(); closeErr != nil {
+				s.logger.With(ctx).Error(closeErr)
+			}
+			return err
+		}
+	}
+
+	if pkg.manifest != nil {
+		content, err := json.MarshalIndent(pkg.manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		w, err := aw.CreatePlain(artifactsManifest)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(content); err != nil {
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// writeArtifact adds an artifact to an archive, the entry is closed even
+// when the download fails so that the archive can still be terminated.
+func (s service) writeArtifact(ctx context.Context, aw archive.Writer,
+	artifact artifactObject) error {
+
+	entry, err := aw.Create(artifact.id)
+	if err != nil {
+		return err
+	}
+
+	// Abort the download when it takes more than the timeout.
+	downloadCtx, cancelFn := context.WithTimeout(ctx, artifactDownloadTimeout)
+	defer cancelFn()
+
+	cw := &countWriter{w: entry}
+	err = s.objSto.Download(downloadCtx, s.bucket, artifact.key, cw)
+	if err == nil && cw.n != artifact.size {
+		err = fmt.Errorf("incomplete download: %d out of %d bytes", cw.n,
+			artifact.size)
+	}
+	if closeErr := entry.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// DeleteArtifacts removes the artifacts produced by all the behavior scans
+// of a file from the object storage.
+func (s service) DeleteArtifacts(ctx context.Context, sha256 string) error {
+	objects, err := s.objSto.List(ctx, s.bucket, sha256+"/")
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err = s.objSto.Delete(ctx, s.bucket, obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// artifactKeys maps the artifacts IDs to their location in the object storage.
+// Artifacts are stored under `<sha256>/<behavior_id>/artifacts/<name>`.
+func (s service) artifactKeys(ctx context.Context, id string,
+	artifactIDs []string) (map[string]string, error) {
+
+	bhv, err := s.repo.Get(ctx, id, []string{"sha256"})
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts, err := s.repo.ArtifactsByHash(ctx, id, artifactIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string, len(artifacts))
+	for _, artifact := range artifacts {
+		if artifact.SHA256 == "" || artifact.Name == "" {
+			continue
+		}
+		keys[strings.ToLower(artifact.SHA256)] = path.Join(bhv.SHA256, id, "artifacts",
+			path.Base(artifact.Name))
+	}
+	return keys, nil
+}
+
+// summarizeCapabilities groups capabilities by tactic. A capability mapping
+// to techniques of different tactics appears under each of them. Tactics are
+// ordered following the ATT&CK enterprise matrix.
+func summarizeCapabilities(capabilities []entity.Capability) CapabilitiesSummary {
+	summary := CapabilitiesSummary{
+		Count:         len(capabilities),
+		Tactics:       []TacticSummary{},
+		Uncategorized: []entity.Capability{},
+	}
+
+	index := make(map[string]int)
+	for _, capability := range capabilities {
+		if len(capability.Techniques) == 0 {
+			summary.Uncategorized = append(summary.Uncategorized, capability)
+			continue
+		}
+
+		seen := make(map[string]bool)
+		for _, technique := range capability.Techniques {
+			tactic := strings.ToLower(technique.Tactic)
+			i, ok := index[tactic]
+			if !ok {
+				i = len(summary.Tactics)
+				index[tactic] = i
+				summary.Tactics = append(summary.Tactics, TacticSummary{
+					Tactic:       tactic,
+					Techniques:   []entity.AttackTechnique{},
+					Capabilities: []entity.Capability{},
+				})
+			}
+
+			group := &summary.Tactics[i]
+			if !containsTechnique(group.Techniques, technique.ID) {
+				group.Techniques = append(group.Techniques, technique)
+			}
+			if !seen[tactic] {
+				seen[tactic] = true
+				group.Capabilities = append(group.Capabilities, capability)
+			}
+		}
+	}
+
+	sort.SliceStable(summary.Tactics, func(i, j int) bool {
+		return tacticRank(summary.Tactics[i].Tactic) <
+			tacticRank(summary.Tactics[j].Tactic)
+	})
+	return summary
+}
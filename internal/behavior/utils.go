@@ -5,11 +5,34 @@
 package behavior
 
 import (
+	"io"
 	"regexp"
+	"strings"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
 )
 
 var (
 	regPathNotation = regexp.MustCompile(`^[\w.]+$`)
+	sha256reg       = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+	// tactics lists the ATT&CK enterprise tactics in kill chain order.
+	tactics = []string{
+		"reconnaissance",
+		"resource-development",
+		"initial-access",
+		"execution",
+		"persistence",
+		"privilege-escalation",
+		"defense-evasion",
+		"credential-access",
+		"discovery",
+		"lateral-movement",
+		"collection",
+		"command-and-control",
+		"exfiltration",
+		"impact",
+	}
 )
 
 // areFieldsAllowed check if we are allowed to filter GET with fields
@@ -21,3 +44,36 @@ func areFieldsAllowed(fields []string) bool {
 	}
 	return true
 }
+
+// tacticRank returns the position of a tactic in the ATT&CK matrix, unknown
+// tactics are ranked last.
+func tacticRank(tactic string) int {
+	for i, t := range tactics {
+		if t == tactic {
+			return i
+		}
+	}
+	return len(tactics)
+}
+
+// containsTechnique checks if a technique ID is part of a list of techniques.
+func containsTechnique(techniques []entity.AttackTechnique, id string) bool {
+	for _, technique := range techniques {
+		if strings.EqualFold(technique.ID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
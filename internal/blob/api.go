@@ -0,0 +1,89 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+// Package blob serves the download links of the storage backends which can't
+// pre-sign URLs themselves, like the local file system.
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/labstack/echo/v4"
+	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/internal/storage"
+	"github.com/saferwall/saferwall-api/internal/storage/local"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// Store represents an object storage which signs its download links with
+// tokens the API verifies.
+type Store interface {
+	VerifyToken(token string) (bucket, key string, err error)
+	Stat(ctx context.Context, bucket, key string) (storage.ObjectInfo, error)
+	Download(ctx context.Context, bucket, key string, file io.Writer) error
+}
+
+type resource struct {
+	store  Store
+	logger log.Logger
+}
+
+// RegisterHandlers registers the handlers that serve the download links.
+func RegisterHandlers(g *echo.Group, store Store, logger log.Logger) {
+	res := resource{store, logger}
+	g.GET("/blobs/:token/", res.download)
+}
+
+// @Summary Download an object using a pre-signed URL
+// @Description Stream an object from the local storage given the signed token
+// @Description of a link generated by `/files/{sha256}/generate-presigned-url/`.
+// @Tags Blob
+// @Produce octet-stream
+// @Param token path string true "Signed download token"
+// @Success 200 {file} file
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /blobs/{token}/ [get]
+func (r resource) download(c echo.Context) error {
+	ctx := c.Request().Context()
+	bucket, key, err := r.store.VerifyToken(c.Param("token"))
+	if err != nil {
+		switch err {
+		case local.ErrInvalidToken, local.ErrTokenExpired:
+			return errors.Forbidden(err.Error())
+		case storage.ErrNotSupported:
+			return errors.NotFound("")
+		default:
+			return err
+		}
+	}
+
+	info, err := r.store.Stat(ctx, bucket, key)
+	if err != nil {
+		switch err {
+		case storage.ErrObjectNotFound:
+			return errors.NotFound("")
+		default:
+			return err
+		}
+	}
+
+	header := c.Response().Header()
+	header.Set("Content-Length", fmt.Sprint(info.Size))
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"",
+		path.Base(key)))
+	c.Response().WriteHeader(http.StatusOK)
+
+	// Headers are already sent, a failure can only be logged.
+	if err = r.store.Download(ctx, bucket, key, c.Response()); err != nil {
+		r.logger.With(ctx).Error(err)
+	}
+	return nil
+}
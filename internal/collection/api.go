@@ -0,0 +1,251 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package collection
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/internal/file"
+	"github.com/saferwall/saferwall-api/pkg/log"
+	"github.com/saferwall/saferwall-api/pkg/pagination"
+)
+
+type resource struct {
+	service Service
+	fileSvc file.Service
+	logger  log.Logger
+}
+
+func RegisterHandlers(g *echo.Group, service Service, fileSvc file.Service,
+	logger log.Logger, requireLogin, optionalLogin echo.MiddlewareFunc,
+	verifyID echo.MiddlewareFunc) {
+
+	res := resource{service, fileSvc, logger}
+
+	g.GET("/collections/", res.list, optionalLogin)
+	g.POST("/collections/", res.create, requireLogin)
+	g.GET("/collections/:id/", res.get, verifyID, optionalLogin)
+	g.PATCH("/collections/:id/", res.update, verifyID, requireLogin)
+	g.DELETE("/collections/:id/", res.delete, verifyID, requireLogin)
+	g.POST("/collections/:id/files/", res.addFiles, verifyID, requireLogin)
+	g.DELETE("/collections/:id/files/:sha256/", res.removeFile, verifyID,
+		requireLogin)
+	g.GET("/collections/:id/download/", res.download, verifyID, requireLogin)
+}
+
+// @Summary Retrieves a paginated list of collections
+// @Description List the public collections and the ones of the logged in
+// @Description user, the most recent first.
+// @Tags Collection
+// @Produce json
+// @Param per_page query uint false "Number of collections per page"
+// @Param page query uint false "Specify the page number"
+// @Param username query string false "List only the collections of this user"
+// @Success 200 {object} pagination.Pages{items=[]entity.Collection}
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /collections/ [get]
+// @Security Bearer || {}
+func (r resource) list(c echo.Context) error {
+	ctx := c.Request().Context()
+	owner := c.QueryParam("username")
+
+	count, err := r.service.Count(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	pages := pagination.NewFromRequest(c.Request(), count)
+	cols, err := r.service.Query(ctx, owner, pages.Offset(), pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = cols
+	return c.JSON(http.StatusOK, pages)
+}
+
+// @Summary Create a new collection
+// @Description Create a new collection owned by the logged in user.
+// @Tags Collection
+// @Accept json
+// @Produce json
+// @Param data body CreateCollectionRequest true "Collection data"
+// @Success 201 {object} entity.Collection
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /collections/ [post]
+// @Security Bearer
+func (r resource) create(c echo.Context) error {
+	var input CreateCollectionRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	col, err := r.service.Create(ctx, input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, col)
+}
+
+// @Summary Get collection by ID
+// @Description Retrieves a collection, private collections are only visible
+// @Description to their owner.
+// @Tags Collection
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Success 200 {object} entity.Collection
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /collections/{id}/ [get]
+// @Security Bearer || {}
+func (r resource) get(c echo.Context) error {
+	ctx := c.Request().Context()
+	col, err := r.service.Get(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, col)
+}
+
+// @Summary Update a collection
+// @Description Change the name, the description or the visibility of a
+// @Description collection. Only the owner or an admin can update it.
+// @Tags Collection
+// @Accept json
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Param data body UpdateCollectionRequest true "Fields to update"
+// @Success 200 {object} entity.Collection
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /collections/{id}/ [patch]
+// @Security Bearer
+func (r resource) update(c echo.Context) error {
+	var input UpdateCollectionRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	col, err := r.service.Update(ctx, c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, col)
+}
+
+// @Summary Deletes a collection
+// @Description Deletes a collection, its files are kept. Only the owner or
+// @Description an admin can delete it.
+// @Tags Collection
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Success 200 {object} entity.Collection
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /collections/{id}/ [delete]
+// @Security Bearer
+func (r resource) delete(c echo.Context) error {
+	ctx := c.Request().Context()
+	col, err := r.service.Delete(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, col)
+}
+
+// @Summary Add files to a collection
+// @Description Add files to a collection, the files already in it are
+// @Description skipped. Only the owner or an admin can add files.
+// @Tags Collection
+// @Accept json
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Param data body AddFilesRequest true "Files to add"
+// @Success 200 {object} entity.Collection
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /collections/{id}/files/ [post]
+// @Security Bearer
+func (r resource) addFiles(c echo.Context) error {
+	var input AddFilesRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	col, err := r.service.AddFiles(ctx, c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, col)
+}
+
+// @Summary Remove a file from a collection
+// @Description Remove a file from a collection. Only the owner or an admin
+// @Description can remove files.
+// @Tags Collection
+// @Produce json
+// @Param id path string true "Collection ID"
+// @Param sha256 path string true "File SHA256"
+// @Success 200 {object} entity.Collection
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /collections/{id}/files/{sha256}/ [delete]
+// @Security Bearer
+func (r resource) removeFile(c echo.Context) error {
+	ctx := c.Request().Context()
+	col, err := r.service.RemoveFile(ctx, c.Param("id"), c.Param("sha256"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, col)
+}
+
+// @Summary Download the files of a collection
+// @Description Download the files of a collection in a single archive, see
+// @Description the bulk download of files for the formats and the manifest.
+// @Description Collections larger than the bulk download limit are rejected.
+// @Tags Collection
+// @Produce mpfd
+// @Param id path string true "Collection ID"
+// @Param format query string false "Packaging format, defaults to the user preference" Enums(zip, zipcrypto, xor, base64)
+// @Param X-Zip-Password header string false "Password of the zip formats"
+// @Param Range header string false "Single byte range of the archive"
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 413 {object} errors.ErrorResponse
+// @Failure 416 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /collections/{id}/download/ [get]
+// @Security Bearer
+func (r resource) download(c echo.Context) error {
+	ctx := c.Request().Context()
+	col, err := r.service.Get(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if len(col.Files) == 0 {
+		return errors.BadRequest("collection is empty")
+	}
+	return file.ServeBulkDownload(c, r.fileSvc, col.Files)
+}
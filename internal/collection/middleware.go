@@ -0,0 +1,49 @@
+// Copyright 2022 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package collection
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	e "github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+type middleware struct {
+	service Service
+	logger  log.Logger
+}
+
+// NewMiddleware creates a new collection Middleware.
+func NewMiddleware(service Service, logger log.Logger) middleware {
+	return middleware{service, logger}
+}
+
+// VerifyID validates the collection ID and check if the collection exists.
+func (m middleware) VerifyID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		collectionID := strings.ToLower(c.Param("id"))
+		if !entity.IsValidID(collectionID) {
+			m.logger.Error("failed to match regex for collection ID %v",
+				collectionID)
+			return e.BadRequest("invalid collection ID string")
+		}
+
+		docExists, err := m.service.Exists(c.Request().Context(), collectionID)
+		if err != nil {
+			return err
+		}
+
+		if !docExists {
+			return db.ErrDocumentNotFound
+		}
+
+		return next(c)
+	}
+}
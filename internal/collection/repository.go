@@ -0,0 +1,151 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access collections from the data
+// source.
+type Repository interface {
+	// Get returns the collection with the specified collection ID.
+	Get(ctx context.Context, id string) (entity.Collection, error)
+	// Create saves a new collection in the storage.
+	Create(ctx context.Context, col entity.Collection) error
+	// Patch updates a field of the collection with given ID in the storage.
+	Patch(ctx context.Context, id, path string, val interface{}) error
+	// Delete removes the collection with given ID from the storage.
+	Delete(ctx context.Context, id string) error
+	// Exists checks if a collection exists with a given ID.
+	Exists(ctx context.Context, id string) (bool, error)
+	// Count returns the number of collections visible to a user,
+	// optionally owned by a given user.
+	Count(ctx context.Context, viewer, owner string) (int, error)
+	// Query returns the list of collections visible to a user, optionally
+	// owned by a given user, with the given offset and limit.
+	Query(ctx context.Context, viewer, owner string, offset, limit int) (
+		[]entity.Collection, error)
+	// AddFile adds a file to a collection.
+	AddFile(ctx context.Context, id, sha256 string) error
+	// RemoveFile removes a file from a collection.
+	RemoveFile(ctx context.Context, id, sha256 string) error
+}
+
+// repository persists collections in database.
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new collection repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Get reads the collection with the specified ID from the database.
+func (r repository) Get(ctx context.Context, id string) (
+	entity.Collection, error) {
+	var col entity.Collection
+	err := r.db.Get(ctx, strings.ToLower(id), &col)
+	return col, err
+}
+
+// Create saves a new collection record in the database.
+func (r repository) Create(ctx context.Context, col entity.Collection) error {
+	return r.db.Create(ctx, col.ID, &col)
+}
+
+// Patch updates a field of a collection in the database, the list of files
+// is changed concurrently and is never replaced.
+func (r repository) Patch(ctx context.Context, id, path string,
+	val interface{}) error {
+	return r.db.Patch(ctx, id, path, val)
+}
+
+// Delete deletes a collection with the specified ID from the database.
+func (r repository) Delete(ctx context.Context, id string) error {
+	return r.db.Delete(ctx, id)
+}
+
+// Exists checks if a collection exists for the given id.
+func (r repository) Exists(ctx context.Context, id string) (bool, error) {
+	docExists := false
+	key := strings.ToLower(id)
+	err := r.db.Exists(ctx, key, &docExists)
+	return docExists, err
+}
+
+// Count returns the number of collections visible to a user, an anonymous
+// user is given an empty viewer and sees only the public ones.
+func (r repository) Count(ctx context.Context, viewer, owner string) (
+	int, error) {
+	var count int
+
+	statement, params := visibleStatement(
+		"SELECT RAW COUNT(*) AS count FROM `"+r.db.Bucket.Name()+"` d",
+		viewer, owner)
+
+	err := r.db.Count(ctx, statement, params, &count)
+	return count, err
+}
+
+// Query retrieves the collections visible to a user with the specified
+// offset and limit from the database, the most recent first.
+func (r repository) Query(ctx context.Context, viewer, owner string, offset,
+	limit int) ([]entity.Collection, error) {
+	var res interface{}
+
+	statement, params := visibleStatement(
+		"SELECT d.* FROM `"+r.db.Bucket.Name()+"` d", viewer, owner)
+	statement += " ORDER BY d.timestamp DESC OFFSET $offset LIMIT $limit"
+	params["offset"] = offset
+	params["limit"] = limit
+
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return []entity.Collection{}, err
+	}
+
+	cols := []entity.Collection{}
+	b, _ := json.Marshal(res)
+	_ = json.Unmarshal(b, &cols)
+	return cols, nil
+}
+
+// AddFile adds a file to a collection. The file document is left as is, it
+// is public while the collection may not be.
+func (r repository) AddFile(ctx context.Context, id, sha256 string) error {
+	return r.db.ArrayAddUnique(ctx, id, "files", sha256)
+}
+
+// RemoveFile removes a file from a collection.
+func (r repository) RemoveFile(ctx context.Context, id, sha256 string) error {
+	return r.db.ArrayRemove(ctx, id, "files", sha256)
+}
+
+// visibleStatement completes a statement selecting the collections visible
+// to a user, optionally owned by a given user.
+func visibleStatement(statement, viewer, owner string) (
+	string, map[string]interface{}) {
+
+	params := make(map[string]interface{}, 5)
+	params["docType"] = "collection"
+	statement += " WHERE d.`type` = $docType"
+
+	statement += " AND (d.public = true OR d.username = $viewer)"
+	params["viewer"] = viewer
+	if owner != "" {
+		statement += " AND d.username = $owner"
+		params["owner"] = owner
+	}
+	return statement, params
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package collection
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/internal/file"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// Service encapsulates usecase logic for collections.
+type Service interface {
+	Exists(ctx context.Context, id string) (bool, error)
+	Get(ctx context.Context, id string) (entity.Collection, error)
+	Create(ctx context.Context, input CreateCollectionRequest) (entity.Collection, error)
+	Update(ctx context.Context, id string, input UpdateCollectionRequest) (entity.Collection, error)
+	Delete(ctx context.Context, id string) (entity.Collection, error)
+	Count(ctx context.Context, owner string) (int, error)
+	Query(ctx context.Context, owner string, offset, limit int) ([]entity.Collection, error)
+	AddFiles(ctx context.Context, id string, input AddFilesRequest) (entity.Collection, error)
+	RemoveFile(ctx context.Context, id, sha256 string) (entity.Collection, error)
+}
+
+type service struct {
+	repo    Repository
+	logger  log.Logger
+	fileSvc file.Service
+}
+
+// CreateCollectionRequest represents a collection creation request.
+type CreateCollectionRequest struct {
+	Name        string `json:"name" validate:"required,max=64" example:"APT28 2024 campaign"`
+	Description string `json:"description" validate:"max=1024"`
+	Public      bool   `json:"public"`
+}
+
+// UpdateCollectionRequest represents a collection update request, only the
+// given fields are changed.
+type UpdateCollectionRequest struct {
+	Name        *string `json:"name" validate:"omitempty,min=1,max=64"`
+	Description *string `json:"description" validate:"omitempty,max=1024"`
+	Public      *bool   `json:"public"`
+}
+
+// AddFilesRequest represents files added to a collection.
+type AddFilesRequest struct {
+	Hashes []string `json:"hashes" validate:"required,min=1,max=100,dive,alphanum,len=64"`
+}
+
+// NewService creates a new collection service.
+func NewService(repo Repository, logger log.Logger,
+	fileSvc file.Service) Service {
+	return service{repo, logger, fileSvc}
+}
+
+// Exists checks if a collection exists for the given id.
+func (s service) Exists(ctx context.Context, id string) (bool, error) {
+	return s.repo.Exists(ctx, id)
+}
+
+// Get returns the collection with the specified ID, a private collection
+// is only visible to its owner and to admins.
+func (s service) Get(ctx context.Context, id string) (entity.Collection, error) {
+	col, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return entity.Collection{}, err
+	}
+	if col.Type != "collection" || (!col.Public && !canEdit(ctx, col)) {
+		return entity.Collection{}, errors.NotFound("")
+	}
+	return col, nil
+}
+
+// Create creates a new collection owned by the logged in user.
+func (s service) Create(ctx context.Context, req CreateCollectionRequest) (
+	entity.Collection, error) {
+
+	now := time.Now().Unix()
+	col := entity.Collection{
+		Meta:        &entity.DocMetadata{CreatedAt: now, LastUpdated: now, Version: 1},
+		Type:        "collection",
+		ID:          entity.ID(),
+		Name:        strings.TrimSpace(req.Name),
+		Description: req.Description,
+		Username:    viewer(ctx),
+		Public:      req.Public,
+		Timestamp:   now,
+	}
+	if col.Name == "" {
+		return entity.Collection{}, errors.BadRequest("name is required")
+	}
+	err := s.repo.Create(ctx, col)
+	return col, err
+}
+
+// Update changes the name, the description or the visibility of a
+// collection, only its owner or an admin can update it.
+func (s service) Update(ctx context.Context, id string,
+	input UpdateCollectionRequest) (entity.Collection, error) {
+
+	col, err := s.editable(ctx, id)
+	if err != nil {
+		return entity.Collection{}, err
+	}
+
+	if input.Name != nil {
+		col.Name = strings.TrimSpace(*input.Name)
+		if col.Name == "" {
+			return entity.Collection{}, errors.BadRequest("name is required")
+		}
+		if err = s.repo.Patch(ctx, col.ID, "name", col.Name); err != nil {
+			return entity.Collection{}, err
+		}
+	}
+	if input.Description != nil {
+		col.Description = *input.Description
+		err = s.repo.Patch(ctx, col.ID, "description", col.Description)
+		if err != nil {
+			return entity.Collection{}, err
+		}
+	}
+	if input.Public != nil {
+		col.Public = *input.Public
+		if err = s.repo.Patch(ctx, col.ID, "public", col.Public); err != nil {
+			return entity.Collection{}, err
+		}
+	}
+
+	col.Meta.LastUpdated = time.Now().Unix()
+	err = s.repo.Patch(ctx, col.ID, "doc.last_updated", col.Meta.LastUpdated)
+	return col, err
+}
+
+// Delete deletes a collection, only its owner or an admin can delete it.
+func (s service) Delete(ctx context.Context, id string) (
+	entity.Collection, error) {
+
+	col, err := s.editable(ctx, id)
+	if err != nil {
+		return entity.Collection{}, err
+	}
+	err = s.repo.Delete(ctx, col.ID)
+	return col, err
+}
+
+// Count returns the number of collections visible to the logged in user,
+// optionally owned by a given user.
+func (s service) Count(ctx context.Context, owner string) (int, error) {
+	return s.repo.Count(ctx, viewer(ctx), strings.ToLower(owner))
+}
+
+// Query returns the collections visible to the logged in user with the
+// specified offset and limit, optionally owned by a given user.
+func (s service) Query(ctx context.Context, owner string, offset,
+	limit int) ([]entity.Collection, error) {
+	return s.repo.Query(ctx, viewer(ctx), strings.ToLower(owner), offset,
+		limit)
+}
+
+// AddFiles adds files to a collection, the files already in it are
+// skipped. Only its owner or an admin can add files.
+func (s service) AddFiles(ctx context.Context, id string,
+	input AddFilesRequest) (entity.Collection, error) {
+
+	col, err := s.editable(ctx, id)
+	if err != nil {
+		return entity.Collection{}, err
+	}
+
+	var hashes []string
+	for _, sha256 := range input.Hashes {
+		sha256 = strings.ToLower(sha256)
+		if contains(col.Files, sha256) || contains(hashes, sha256) {
+			continue
+		}
+		exists, err := s.fileSvc.Exists(ctx, sha256)
+		if err != nil {
+			return entity.Collection{}, err
+		}
+		if !exists {
+			return entity.Collection{}, errors.BadRequest(
+				"file not found: " + sha256)
+		}
+		hashes = append(hashes, sha256)
+	}
+	if len(col.Files)+len(hashes) > maxFiles {
+		return entity.Collection{}, errors.BadRequest(
+			"too many files in the collection")
+	}
+
+	for _, sha256 := range hashes {
+		if err = s.repo.AddFile(ctx, col.ID, sha256); err != nil {
+			return entity.Collection{}, err
+		}
+	}
+	col.Files = append(col.Files, hashes...)
+	return col, nil
+}
+
+// RemoveFile removes a file from a collection, only its owner or an admin
+// can remove files.
+func (s service) RemoveFile(ctx context.Context, id, sha256 string) (
+	entity.Collection, error) {
+
+	col, err := s.editable(ctx, id)
+	if err != nil {
+		return entity.Collection{}, err
+	}
+
+	sha256 = strings.ToLower(sha256)
+	if !contains(col.Files, sha256) {
+		return entity.Collection{}, errors.NotFound("file not in collection")
+	}
+	if err = s.repo.RemoveFile(ctx, col.ID, sha256); err != nil {
+		return entity.Collection{}, err
+	}
+
+	files := make([]string, 0, len(col.Files)-1)
+	for _, f := range col.Files {
+		if f != sha256 {
+			files = append(files, f)
+		}
+	}
+	col.Files = files
+	return col, nil
+}
+
+// editable returns a collection the logged in user is allowed to change.
+func (s service) editable(ctx context.Context, id string) (
+	entity.Collection, error) {
+
+	col, err := s.Get(ctx, id)
+	if err != nil {
+		return entity.Collection{}, err
+	}
+	if !canEdit(ctx, col) {
+		return entity.Collection{}, errors.Forbidden("")
+	}
+	return col, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package collection
+
+import (
+	"context"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
+)
+
+const (
+	// maxFiles is the maximum number of files in a collection.
+	maxFiles = 1000
+)
+
+// viewer returns the ID of the logged in user, empty when anonymous.
+func viewer(ctx context.Context) string {
+	user, _ := ctx.Value(entity.UserKey).(entity.User)
+	return user.ID()
+}
+
+// canEdit checks if the logged in user owns the collection or is an admin.
+func canEdit(ctx context.Context, col entity.Collection) bool {
+	user, ok := ctx.Value(entity.UserKey).(entity.User)
+	return ok && (user.ID() == col.Username || user.IsAdmin())
+}
+
+// contains checks if a list of hashes contains the given one.
+func contains(hashes []string, sha256 string) bool {
+	for _, h := range hashes {
+		if h == sha256 {
+			return true
+		}
+	}
+	return false
+}
@@ -31,6 +31,10 @@ func RegisterHandlers(g *echo.Group, service Service,
 	g.POST("/comments/", res.create, requireLogin)
 	g.PATCH("/comments/:id/", res.update, verifyID, requireLogin)
 	g.DELETE("/comments/:id/", res.delete, verifyID, requireLogin)
+	g.POST("/comments/:id/report/", res.report, verifyID, requireLogin)
+	g.GET("/admin/comments/reported/", res.listReported, requireLogin)
+	g.POST("/admin/comments/:id/moderate/", res.moderate, verifyID,
+		requireLogin)
 }
 
 // @Summary Retrieves a paginated list of comments
@@ -40,6 +44,7 @@ func RegisterHandlers(g *echo.Group, service Service,
 // @Produce json
 // @Param per_page query uint false "Number of comments  per page"
 // @Param page query uint false "Specify the page number"
+// @Param parent_id query string false "List only the replies to this comment"
 // @Success 200 {object} pagination.Pages{items=[]entity.Comment}
 // @Failure 403 {object} errors.ErrorResponse
 // @Failure 404 {object} errors.ErrorResponse
@@ -177,7 +182,9 @@ func (r resource) update(c echo.Context) error {
 }
 
 // @Summary Deletes a comment
-// @Description Deletes a comment by ID.
+// @Description Deletes a comment by ID, a tombstone is left in its place to
+// @Description keep the replies threaded. Only the author or an admin can
+// @Description delete a comment.
 // @Tags Comment
 // @Produce json
 // @Param id path string true "Comment ID"
@@ -201,7 +208,7 @@ func (r resource) delete(c echo.Context) error {
 		return err
 	}
 
-	if comment.Username != curUsername {
+	if comment.Username != curUsername && !isAdmin(ctx) {
 		return errors.Forbidden("")
 	}
 
@@ -212,3 +219,99 @@ func (r resource) delete(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, comment)
 }
+
+// @Summary Report a comment
+// @Description Report an abusive comment to the moderators.
+// @Tags Comment
+// @Accept json
+// @Produce json
+// @Param id path string true "Comment ID"
+// @Param data body ReportCommentRequest true "Report reason"
+// @Success 200 {object} entity.Comment
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /comments/{id}/report/ [post]
+// @Security Bearer
+func (r resource) report(c echo.Context) error {
+	var input ReportCommentRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	comment, err := r.service.Report(ctx, c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, comment)
+}
+
+// @Summary Retrieves the moderation queue
+// @Description List the comments having reports pending review, the most
+// @Description reported first. Admin only.
+// @Tags Admin
+// @Produce json
+// @Param per_page query uint false "Number of comments per page"
+// @Param page query uint false "Specify the page number"
+// @Success 200 {object} pagination.Pages{items=[]entity.Comment}
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /admin/comments/reported/ [get]
+// @Security Bearer
+func (r resource) listReported(c echo.Context) error {
+	ctx := c.Request().Context()
+	if !isAdmin(ctx) {
+		return errors.Forbidden("")
+	}
+
+	count, err := r.service.CountReported(ctx)
+	if err != nil {
+		return err
+	}
+
+	pages := pagination.NewFromRequest(c.Request(), count)
+	comments, err := r.service.QueryReported(ctx, pages.Offset(), pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = comments
+	return c.JSON(http.StatusOK, pages)
+}
+
+// @Summary Moderate a comment
+// @Description Hide, unhide or delete a comment, or dismiss its reports.
+// @Description The counters and activities of the author are kept in sync.
+// @Description Admin only.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Comment ID"
+// @Param data body ModerateCommentRequest true "Moderation action"
+// @Success 200 {object} entity.Comment
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /admin/comments/{id}/moderate/ [post]
+// @Security Bearer
+func (r resource) moderate(c echo.Context) error {
+	var input ModerateCommentRequest
+
+	ctx := c.Request().Context()
+	if !isAdmin(ctx) {
+		return errors.Forbidden("")
+	}
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	comment, err := r.service.Moderate(ctx, c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, comment)
+}
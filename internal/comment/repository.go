@@ -23,6 +23,8 @@ type Repository interface {
 	Create(ctx context.Context, Comment entity.Comment) error
 	// Update updates the comment with given ID in the storage.
 	Update(ctx context.Context, User entity.Comment) error
+	// Increment adds delta to a counter in the comment with given ID.
+	Increment(ctx context.Context, id, path string, delta int64) error
 	// Delete removes the comment with given ID from the storage.
 	Delete(ctx context.Context, id string) error
 	// Exists checks if a comment exists with a given ID.
@@ -31,6 +33,14 @@ type Repository interface {
 	Count(ctx context.Context) (int, error)
 	// Query returns the list of comments with the given offset and limit.
 	Query(ctx context.Context, offset, limit int, fields []string) ([]entity.Comment, error)
+	// CountSince returns the number of comments made by a user since the
+	// given timestamp.
+	CountSince(ctx context.Context, username string, since int64) (int, error)
+	// CountReported returns the number of comments pending moderation.
+	CountReported(ctx context.Context) (int, error)
+	// QueryReported returns the list of comments pending moderation with
+	// the given offset and limit.
+	QueryReported(ctx context.Context, offset, limit int) ([]entity.Comment, error)
 }
 
 // repository persists comments in database.
@@ -72,6 +82,12 @@ func (r repository) Update(ctx context.Context, comment entity.Comment) error {
 	return r.db.Update(ctx, comment.ID, &comment)
 }
 
+// Increment adds delta to a counter of a comment in the database.
+func (r repository) Increment(ctx context.Context, id, path string,
+	delta int64) error {
+	return r.db.Increment(ctx, id, path, delta)
+}
+
 // Delete deletes a comment with the specified ID from the database.
 func (r repository) Delete(ctx context.Context, id string) error {
 	return r.db.Delete(ctx, id)
@@ -127,9 +143,12 @@ func (r repository) Query(ctx context.Context, offset, limit int, fields []strin
 	if len(fields) > 0 {
 		statement = "SELECT "
 		for _, field := range fields {
-			statement += fmt.Sprintf("%s,", field)
+			if field != "status" {
+				statement += fmt.Sprintf("%s,", field)
+			}
 		}
-		statement = strings.TrimSuffix(statement, ",")
+		// The status is always needed to redact the removed comments.
+		statement += "status"
 		statement += fmt.Sprintf(" FROM `%s` d WHERE d.`type` = $docType",
 			r.db.Bucket.Name())
 	} else {
@@ -155,6 +174,73 @@ func (r repository) Query(ctx context.Context, offset, limit int, fields []strin
 	if err != nil {
 		return []entity.Comment{}, err
 	}
+	return toComments(res), nil
+}
+
+// CountSince returns the number of comments made by a user since the given
+// timestamp.
+func (r repository) CountSince(ctx context.Context, username string,
+	since int64) (int, error) {
+	var count int
+
+	params := make(map[string]interface{}, 3)
+	params["docType"] = "comment"
+	params["username"] = username
+	params["since"] = since
+
+	statement :=
+		"SELECT RAW COUNT(*) AS count FROM `" + r.db.Bucket.Name() + "` d " +
+			"WHERE d.`type` = $docType AND d.username = $username " +
+			"AND d.timestamp >= $since"
+
+	err := r.db.Count(ctx, statement, params, &count)
+	return count, err
+}
+
+// CountReported returns the number of visible comments having reports
+// pending moderation.
+func (r repository) CountReported(ctx context.Context) (int, error) {
+	var count int
+
+	params := make(map[string]interface{}, 1)
+	params["docType"] = "comment"
+
+	statement :=
+		"SELECT RAW COUNT(*) AS count FROM `" + r.db.Bucket.Name() + "` d " +
+			"WHERE d.`type` = $docType AND d.reports_count > 0 " +
+			"AND d.status IS NOT VALUED"
+
+	err := r.db.Count(ctx, statement, params, &count)
+	return count, err
+}
+
+// QueryReported retrieves the visible comments having reports pending
+// moderation, the most reported first.
+func (r repository) QueryReported(ctx context.Context, offset, limit int) (
+	[]entity.Comment, error) {
+	var res interface{}
+
+	params := make(map[string]interface{}, 3)
+	params["docType"] = "comment"
+	params["offset"] = offset
+	params["limit"] = limit
+
+	statement :=
+		"SELECT d.* FROM `" + r.db.Bucket.Name() + "` d " +
+			"WHERE d.`type` = $docType AND d.reports_count > 0 " +
+			"AND d.status IS NOT VALUED " +
+			"ORDER BY d.reports_count DESC, d.timestamp DESC " +
+			"OFFSET $offset LIMIT $limit"
+
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return []entity.Comment{}, err
+	}
+	return toComments(res), nil
+}
+
+// toComments converts the rows of a query result to comments.
+func toComments(res interface{}) []entity.Comment {
 	comments := []entity.Comment{}
 	for _, u := range res.([]interface{}) {
 		comment := entity.Comment{}
@@ -162,5 +248,5 @@ func (r repository) Query(ctx context.Context, offset, limit int, fields []strin
 		_ = json.Unmarshal(b, &comment)
 		comments = append(comments, comment)
 	}
-	return comments, nil
+	return comments
 }
@@ -7,18 +7,24 @@ package comment
 import (
 	"context"
 	"encoding/json"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/saferwall/saferwall-api/internal/activity"
 	"github.com/saferwall/saferwall-api/internal/entity"
 	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/internal/notification"
 	"github.com/saferwall/saferwall-api/internal/user"
 	"github.com/saferwall/saferwall-api/pkg/log"
+	"github.com/saferwall/saferwall-api/pkg/markdown"
 )
 
 // Comment represents a comment made by a user for a file.
 type Comment struct {
 	entity.Comment
+	// BodyHTML represents the sanitized HTML rendering of the markdown body.
+	BodyHTML string `json:"body_html,omitempty"`
 }
 
 // Service encapsulates usecase logic for files.
@@ -30,19 +36,28 @@ type Service interface {
 	Delete(ctx context.Context, id string) (Comment, error)
 	Count(ctx context.Context) (int, error)
 	Query(ctx context.Context, offset, limit int, fields []string) ([]Comment, error)
+	Report(ctx context.Context, id string, input ReportCommentRequest) (Comment, error)
+	Moderate(ctx context.Context, id string, input ModerateCommentRequest) (Comment, error)
+	CountReported(ctx context.Context) (int, error)
+	QueryReported(ctx context.Context, offset, limit int) ([]Comment, error)
 }
 
 type service struct {
-	repo    Repository
-	logger  log.Logger
-	actSvc  activity.Service
-	userSvc user.Service
+	repo     Repository
+	logger   log.Logger
+	actSvc   activity.Service
+	userSvc  user.Service
+	notifSvc notification.Service
+	// maxPerHour limits the number of comments a user can post per hour,
+	// 0 disables the limit.
+	maxPerHour int
 }
 
 // CreateCommentRequest represents a comment creation request.
 type CreateCommentRequest struct {
 	Body     string `json:"body" validate:"required"`
 	SHA256   string `json:"sha256" validate:"required,alphanum,len=64"`
+	ParentID string `json:"parent_id" validate:"omitempty,uuid"`
 	Username string
 }
 
@@ -51,10 +66,21 @@ type UpdateCommentRequest struct {
 	Body string `json:"body" validate:"required"`
 }
 
+// ReportCommentRequest represents a request to report a comment to the
+// moderators.
+type ReportCommentRequest struct {
+	Reason string `json:"reason" validate:"required,max=256"`
+}
+
+// ModerateCommentRequest represents a moderator action on a comment.
+type ModerateCommentRequest struct {
+	Action string `json:"action" validate:"required,oneof=hide unhide delete dismiss"`
+}
+
 // NewService creates a new user service.
 func NewService(repo Repository, logger log.Logger, actSvc activity.Service,
-	userSvc user.Service) Service {
-	return service{repo, logger, actSvc, userSvc}
+	userSvc user.Service, notifSvc notification.Service, maxPerHour int) Service {
+	return service{repo, logger, actSvc, userSvc, notifSvc, maxPerHour}
 }
 
 // Exists checks if a comment exists for the given id.
@@ -66,45 +92,70 @@ func (s service) Exists(ctx context.Context, id string) (bool, error) {
 func (s service) Create(ctx context.Context, req CreateCommentRequest) (
 	Comment, error) {
 
+	if s.maxPerHour > 0 {
+		since := time.Now().Add(-time.Hour).Unix()
+		count, err := s.repo.CountSince(ctx, req.Username, since)
+		if err != nil {
+			return Comment{}, err
+		}
+		if count >= s.maxPerHour {
+			return Comment{}, errors.TooManyRequests(
+				"too many comments posted in the last hour")
+		}
+	}
+
+	// A reply must be made on the same file as the comment it replies to.
+	parentID := strings.ToLower(req.ParentID)
+	if parentID != "" {
+		exists, err := s.repo.Exists(ctx, parentID)
+		if err != nil {
+			return Comment{}, err
+		}
+		if !exists {
+			return Comment{}, errors.BadRequest("parent comment not found")
+		}
+		parent, err := s.repo.Get(ctx, parentID, nil)
+		if err != nil {
+			return Comment{}, err
+		}
+		if parent.SHA256 != req.SHA256 {
+			return Comment{}, errors.BadRequest(
+				"parent comment belongs to another file")
+		}
+		if parent.Status == entity.CommentDeleted {
+			return Comment{}, errors.BadRequest(
+				"parent comment has been deleted")
+		}
+	}
+
+	mentions, err := s.mentions(ctx, req.Body, req.Username)
+	if err != nil {
+		return Comment{}, err
+	}
+
 	now := time.Now().Unix()
-	id := entity.ID()
-	err := s.repo.Create(ctx, entity.Comment{
+	com := entity.Comment{
 		Meta:      &entity.DocMetadata{CreatedAt: now, LastUpdated: now, Version: 1},
 		Type:      "comment",
-		ID:        id,
+		ID:        entity.ID(),
 		Body:      req.Body,
 		SHA256:    req.SHA256,
 		Username:  req.Username,
 		Timestamp: now,
-	})
-	if err != nil {
-		return Comment{}, err
+		ParentID:  parentID,
+		Mentions:  mentions,
 	}
-
-	user, err := s.userSvc.Get(ctx, req.Username)
-	if err != nil {
+	if err = s.repo.Create(ctx, com); err != nil {
 		return Comment{}, err
 	}
 
-	// Update comments count on user object.
-	err = s.userSvc.Patch(ctx, req.Username, "comments_count", user.CommentsCount+1)
-	if err != nil {
+	if err = s.publish(ctx, com); err != nil {
 		return Comment{}, err
 	}
-
-	// Get the source of the HTTP request from the ctx.
-	source, _ := ctx.Value(entity.SourceKey).(string)
-
-	// Create a new `comment` activity.
-	if _, err = s.actSvc.Create(ctx, activity.CreateActivityRequest{
-		Kind:     "comment",
-		Username: user.Username,
-		Target:   id,
-		Source:   source,
-	}); err != nil {
+	if err = s.notify(ctx, com, mentions, true); err != nil {
 		return Comment{}, err
 	}
-	return s.Get(ctx, id, nil)
+	return s.Get(ctx, com.ID, nil)
 }
 
 // Get returns the comment with the specified comment ID.
@@ -113,26 +164,54 @@ func (s service) Get(ctx context.Context, id string, fields []string) (Comment,
 	if err != nil {
 		return Comment{}, err
 	}
-	return Comment{com}, nil
+
+	// The status decides which fields are shown, it is looked up separately
+	// as it is missing from the visible comments.
+	if len(fields) > 0 && !isAdmin(ctx) {
+		full, err := s.repo.Get(ctx, id, nil)
+		if err != nil {
+			return Comment{}, err
+		}
+		com.Status = full.Status
+	}
+	return view(ctx, com), nil
 }
 
 // Update updates the comment with the specified ID.
 func (s service) Update(ctx context.Context, id string, input UpdateCommentRequest) (
 	Comment, error) {
 
-	var curUsername string
+	var curUsername, displayName string
 
-	comment, err := s.Get(ctx, id, nil)
+	com, err := s.repo.Get(ctx, id, nil)
 	if err != nil {
-		return comment, err
+		return Comment{}, err
 	}
+	comment := Comment{Comment: com}
 
 	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
 		curUsername = user.ID()
+		displayName = user.Username
 	}
 
 	if comment.Username != curUsername {
-		return comment, errors.Forbidden("")
+		return Comment{}, errors.Forbidden("")
+	}
+	if comment.Status != "" {
+		return Comment{}, errors.BadRequest("comment has been removed")
+	}
+
+	mentions, err := s.mentions(ctx, input.Body, curUsername)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	// Keep the body being replaced in the edit history.
+	if input.Body != comment.Body {
+		comment.History = append(comment.History, entity.CommentRevision{
+			Body:      comment.Body,
+			Timestamp: comment.Meta.LastUpdated,
+		})
 	}
 
 	data, err := json.Marshal(input)
@@ -145,6 +224,30 @@ func (s service) Update(ctx context.Context, id string, input UpdateCommentReque
 		return comment, err
 	}
 
+	// The `mention` activity is kept for as long as the comment mentions
+	// someone, the mentioned users are read from the comment itself.
+	switch {
+	case len(comment.Mentions) == 0 && len(mentions) > 0:
+		err = s.createActivity(ctx, "mention", displayName, comment.ID)
+	case len(comment.Mentions) > 0 && len(mentions) == 0:
+		err = s.actSvc.DeleteWith(ctx, "mention", curUsername, comment.ID)
+	}
+	if err != nil {
+		return comment, err
+	}
+
+	// Only the users mentioned by this edit are notified.
+	var added []string
+	for _, id := range mentions {
+		if !slices.Contains(comment.Mentions, id) {
+			added = append(added, id)
+		}
+	}
+	if err = s.notify(ctx, comment.Comment, added, false); err != nil {
+		return comment, err
+	}
+	comment.Mentions = mentions
+
 	// update the last modified time.
 	comment.Meta.LastUpdated = time.Now().Unix()
 
@@ -152,25 +255,48 @@ func (s service) Update(ctx context.Context, id string, input UpdateCommentReque
 		return comment, err
 	}
 
-	return comment, nil
+	return view(ctx, comment.Comment), nil
 }
 
-// Delete deletes the comment with the specified ID.
+// Delete replaces the comment with the specified ID by a tombstone, which
+// keeps its replies threaded.
 func (s service) Delete(ctx context.Context, id string) (Comment, error) {
-	com, err := s.Get(ctx, id, nil)
+	var curUsername string
+
+	com, err := s.repo.Get(ctx, id, nil)
 	if err != nil {
 		return Comment{}, err
 	}
-	if err = s.repo.Delete(ctx, id); err != nil {
-		return Comment{}, err
+	if com.Status == entity.CommentDeleted {
+		return view(ctx, com), nil
 	}
 
-	// Delete corresponding activity.
-	if err = s.actSvc.DeleteWith(ctx, "comment", com.Username, id); err != nil {
-		return Comment{}, err
+	// A hidden comment is already retracted.
+	if com.Status == "" {
+		if err = s.retract(ctx, com); err != nil {
+			return Comment{}, err
+		}
 	}
 
-	return com, nil
+	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
+		curUsername = user.ID()
+	}
+	if com.Username != curUsername {
+		com.Moderation = &entity.CommentModeration{Action: "delete",
+			Username: curUsername, Timestamp: time.Now().Unix()}
+	}
+
+	com.Status = entity.CommentDeleted
+	com.Body = ""
+	com.History = nil
+	com.Mentions = nil
+	com.Reports = nil
+	com.ReportsCount = 0
+	com.Meta.LastUpdated = time.Now().Unix()
+	if err = s.repo.Update(ctx, com); err != nil {
+		return Comment{}, err
+	}
+	return view(ctx, com), nil
 }
 
 // Count returns the number of comments.
@@ -188,7 +314,255 @@ func (s service) Query(ctx context.Context, offset, limit int, fields []string)
 	}
 	result := []Comment{}
 	for _, item := range items {
-		result = append(result, Comment{item})
+		result = append(result, view(ctx, item))
+	}
+	return result, nil
+}
+
+// Report records a user reporting a comment to the moderators.
+func (s service) Report(ctx context.Context, id string,
+	input ReportCommentRequest) (Comment, error) {
+
+	var curUsername string
+
+	com, err := s.repo.Get(ctx, id, nil)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
+		curUsername = user.ID()
+	}
+	if com.Username == curUsername {
+		return Comment{}, errors.BadRequest("can not report your own comment")
+	}
+	if com.Status != "" {
+		return Comment{}, errors.BadRequest("comment has been removed")
+	}
+	for _, report := range com.Reports {
+		if report.Username == curUsername {
+			return Comment{}, errors.BadRequest("comment already reported")
+		}
+	}
+
+	com.Reports = append(com.Reports, entity.CommentReport{
+		Username:  curUsername,
+		Reason:    input.Reason,
+		Timestamp: time.Now().Unix(),
+	})
+	com.ReportsCount = len(com.Reports)
+	if err = s.repo.Update(ctx, com); err != nil {
+		return Comment{}, err
+	}
+	return view(ctx, com), nil
+}
+
+// Moderate applies a moderator action on the comment with the specified ID.
+// Hiding a comment retracts it like a deletion, but keeps its body so that
+// it can be restored, dismissing discards the pending reports.
+func (s service) Moderate(ctx context.Context, id string,
+	input ModerateCommentRequest) (Comment, error) {
+
+	var curUsername string
+
+	if input.Action == "delete" {
+		return s.Delete(ctx, id)
+	}
+
+	com, err := s.repo.Get(ctx, id, nil)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	switch input.Action {
+	case "hide":
+		if com.Status != "" {
+			return Comment{}, errors.BadRequest("comment is not visible")
+		}
+		if err = s.retract(ctx, com); err != nil {
+			return Comment{}, err
+		}
+		com.Status = entity.CommentHidden
+	case "unhide":
+		if com.Status != entity.CommentHidden {
+			return Comment{}, errors.BadRequest("comment is not hidden")
+		}
+		if err = s.publish(ctx, com); err != nil {
+			return Comment{}, err
+		}
+		com.Status = ""
+	}
+
+	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
+		curUsername = user.ID()
+	}
+	com.Reports = nil
+	com.ReportsCount = 0
+	com.Moderation = &entity.CommentModeration{Action: input.Action,
+		Username: curUsername, Timestamp: time.Now().Unix()}
+	if err = s.repo.Update(ctx, com); err != nil {
+		return Comment{}, err
+	}
+	return view(ctx, com), nil
+}
+
+// CountReported returns the number of comments pending moderation.
+func (s service) CountReported(ctx context.Context) (int, error) {
+	return s.repo.CountReported(ctx)
+}
+
+// QueryReported returns the comments pending moderation, the most reported
+// first.
+func (s service) QueryReported(ctx context.Context, offset, limit int) (
+	[]Comment, error) {
+
+	items, err := s.repo.QueryReported(ctx, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	result := []Comment{}
+	for _, item := range items {
+		result = append(result, view(ctx, item))
 	}
 	return result, nil
 }
+
+// view wraps a comment entity for the user making the request and renders
+// its body. The reports and the content of a hidden comment are only shown
+// to the admins.
+func view(ctx context.Context, com entity.Comment) Comment {
+	if !isAdmin(ctx) {
+		com.Reports = nil
+		com.ReportsCount = 0
+		if com.Status != "" {
+			com.Body = ""
+			com.History = nil
+			com.Mentions = nil
+		}
+	}
+	comment := Comment{Comment: com}
+	if com.Body != "" {
+		comment.BodyHTML = markdown.Render(com.Body)
+	}
+	return comment
+}
+
+// publish accounts for a visible comment: it increments the counters of
+// its author and parent, and creates its activities.
+func (s service) publish(ctx context.Context, com entity.Comment) error {
+	user, err := s.userSvc.Get(ctx, com.Username)
+	if err != nil {
+		return err
+	}
+	err = s.userSvc.Patch(ctx, com.Username, "comments_count",
+		user.CommentsCount+1)
+	if err != nil {
+		return err
+	}
+	if err = s.incrementReplies(ctx, com, 1); err != nil {
+		return err
+	}
+
+	// A `mention` activity shows up in the feed of the mentioned users.
+	for _, kind := range activityKinds(com) {
+		if err = s.createActivity(ctx, kind, user.Username, com.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retract undoes publish when a comment stops being visible.
+func (s service) retract(ctx context.Context, com entity.Comment) error {
+	user, err := s.userSvc.Get(ctx, com.Username)
+	if err != nil {
+		return err
+	}
+	err = s.userSvc.Patch(ctx, com.Username, "comments_count",
+		max(user.CommentsCount-1, 0))
+	if err != nil {
+		return err
+	}
+	if err = s.incrementReplies(ctx, com, -1); err != nil {
+		return err
+	}
+	for _, kind := range activityKinds(com) {
+		if err = s.actSvc.DeleteWith(ctx, kind, com.Username, com.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// incrementReplies updates the replies counter of the parent of a reply
+// when the parent still exists.
+func (s service) incrementReplies(ctx context.Context, com entity.Comment,
+	delta int64) error {
+
+	if com.ParentID == "" {
+		return nil
+	}
+	exists, err := s.repo.Exists(ctx, com.ParentID)
+	if err != nil || !exists {
+		return err
+	}
+	return s.repo.Increment(ctx, com.ParentID, "replies_count", delta)
+}
+
+// mentions returns the users mentioned in a comment's body which exist,
+// the author mentioning themselves is ignored.
+func (s service) mentions(ctx context.Context, body, author string) (
+	[]string, error) {
+
+	var mentions []string
+	for _, id := range parseMentions(body) {
+		if id == strings.ToLower(author) {
+			continue
+		}
+		exists, err := s.userSvc.Exists(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			mentions = append(mentions, id)
+		}
+	}
+	return mentions, nil
+}
+
+// notify notifies the users mentioned in a comment and, for a new comment,
+// the users who submitted the file.
+func (s service) notify(ctx context.Context, com entity.Comment,
+	mentions []string, created bool) error {
+
+	n := entity.Notification{
+		Kind:   entity.NotificationMention,
+		Actor:  com.Username,
+		Target: com.ID,
+		SHA256: com.SHA256,
+	}
+	if err := s.notifSvc.Notify(ctx, n, mentions); err != nil {
+		return err
+	}
+	if !created {
+		return nil
+	}
+	n.Kind = entity.NotificationComment
+	return s.notifSvc.NotifySubmitters(ctx, n)
+}
+
+// createActivity creates an activity of the given kind about a comment.
+func (s service) createActivity(ctx context.Context, kind, username,
+	id string) error {
+
+	// Get the source of the HTTP request from the ctx.
+	source, _ := ctx.Value(entity.SourceKey).(string)
+
+	_, err := s.actSvc.Create(ctx, activity.CreateActivityRequest{
+		Kind:     kind,
+		Username: username,
+		Target:   id,
+		Source:   source,
+	})
+	return err
+}
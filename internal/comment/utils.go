@@ -7,6 +7,9 @@ package comment
 import (
 	"context"
 	"regexp"
+	"strings"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
 )
 
 // contextKey defines a custom time to get/set values from a context.
@@ -17,8 +20,16 @@ const (
 	FiltersKey contextKey = iota
 )
 
+const (
+	// maxMentions is the maximum number of users a comment can mention.
+	maxMentions = 10
+)
+
 var (
 	regPathNotation = regexp.MustCompile(`^[\w.]+$`)
+	// regMention matches a `@username` which is not part of a word, an
+	// email address for instance.
+	regMention = regexp.MustCompile(`(?:^|[^\w@.])@([a-zA-Z0-9]{1,20})\b`)
 )
 
 // areFieldsAllowed check if we are allowed to filter GET with fields
@@ -35,3 +46,36 @@ func areFieldsAllowed(fields []string) bool {
 func WithFilters(ctx context.Context, value map[string][]string) context.Context {
 	return context.WithValue(ctx, FiltersKey, value)
 }
+
+// parseMentions returns the IDs of the users mentioned in a comment's body,
+// in their order of appearance and without duplicates.
+func parseMentions(body string) []string {
+	var mentions []string
+	seen := make(map[string]bool)
+	for _, match := range regMention.FindAllStringSubmatch(body, -1) {
+		id := strings.ToLower(match[1])
+		if !seen[id] && len(mentions) < maxMentions {
+			seen[id] = true
+			mentions = append(mentions, id)
+		}
+	}
+	return mentions
+}
+
+// isAdmin checks if the user making the request is an admin.
+func isAdmin(ctx context.Context) bool {
+	user, ok := ctx.Value(entity.UserKey).(entity.User)
+	return ok && user.IsAdmin()
+}
+
+// activityKinds returns the kinds of the activities created for a comment.
+func activityKinds(com entity.Comment) []string {
+	kinds := []string{"comment"}
+	if com.ParentID != "" {
+		kinds[0] = "reply"
+	}
+	if len(com.Mentions) > 0 {
+		kinds = append(kinds, "mention")
+	}
+	return kinds
+}
@@ -44,6 +44,8 @@ type AWSS3Cfg struct {
 	Region    string `mapstructure:"region"`
 	SecretKey string `mapstructure:"secret_key"`
 	AccessKey string `mapstructure:"access_key"`
+	// Endpoint targets an S3 compatible service instead of AWS.
+	Endpoint string `mapstructure:"endpoint"`
 }
 
 // MinioCfg represents Minio credentials.
@@ -54,25 +56,75 @@ type MinioCfg struct {
 	Region    string `mapstructure:"region"`
 }
 
+// GCSCfg represents Google Cloud Storage credentials.
+type GCSCfg struct {
+	ProjectID string `mapstructure:"project_id"`
+	Location  string `mapstructure:"location"`
+	// CredentialsFile is the path to a service account key, application
+	// default credentials are used when empty.
+	CredentialsFile string `mapstructure:"credentials_file"`
+	// Endpoint overrides the API endpoint, used for emulators.
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+// AzureCfg represents Azure Blob Storage credentials.
+type AzureCfg struct {
+	AccountName string `mapstructure:"account_name"`
+	AccountKey  string `mapstructure:"account_key"`
+	// Endpoint overrides the service URL, used for emulators.
+	Endpoint string `mapstructure:"endpoint"`
+}
+
 // LocalFsCfg represents local file system storage data.
 type LocalFsCfg struct {
 	RootDir string `mapstructure:"root_dir"`
+	// SigningKey is the secret used to sign the download links served by
+	// the API, pre-signed URLs are disabled when empty.
+	SigningKey string `mapstructure:"signing_key"`
+	// PublicURL is the URL the API is reachable at.
+	PublicURL string `mapstructure:"public_url"`
+}
+
+// EncryptionCfg represents the encryption at rest of the samples.
+type EncryptionCfg struct {
+	// Enabled turns on the encryption of the samples and the behavior
+	// scans artifacts.
+	Enabled bool `mapstructure:"enabled"`
+	// MasterKeys lists base64 encoded 256 bits keys wrapping the per-object
+	// data keys. The first key is used for new objects, the others are
+	// retired keys kept to read the objects which are not rotated yet.
+	MasterKeys []string `mapstructure:"master_keys"`
 }
 
 // StorageCfg represents the object storage config.
 type StorageCfg struct {
-	// Deployment kind, possible values: aws, gcp, azure, local.
+	// Deployment kind, possible values: aws, minio, gcs, azure, local.
 	DeploymentKind string `mapstructure:"deployment_kind"`
 	// FileContainerName represents the name of the container for samples.
 	FileContainerName string `mapstructure:"files_container_name"`
 	// AvatarsContainerName represents the name of the container for avatars.
 	AvatarsContainerName string `mapstructure:"avatars_container_name"`
+	// ArtifactsContainerName represents the name of the container for
+	// artifacts produced during behavior scans (memdumps, dropped files, ..).
+	ArtifactsContainerName string `mapstructure:"artifacts_container_name"`
+	// QuarantineContainerName represents the name of the container where
+	// samples failing their integrity check are moved to.
+	QuarantineContainerName string `mapstructure:"quarantine_container_name"`
+	// PresignTTL represents the lifetime of pre-signed URLs in minutes.
+	// Defaults to 5 minutes.
+	PresignTTL int `mapstructure:"presign_ttl"`
 	// S3 represents AWS S3 object storage connection details.
 	S3 AWSS3Cfg `mapstructure:"s3"`
 	// S3 represents MinIO object storage connection details.
 	Minio MinioCfg `mapstructure:"minio"`
+	// GCS represents Google Cloud Storage connection details.
+	GCS GCSCfg `mapstructure:"gcs"`
+	// Azure represents Azure Blob Storage connection details.
+	Azure AzureCfg `mapstructure:"azure"`
 	// Local represents local file system config.
 	Local LocalFsCfg `mapstructure:"local"`
+	// Encryption represents the encryption at rest config.
+	Encryption EncryptionCfg `mapstructure:"encryption"`
 }
 
 type SMTPConfig struct {
@@ -82,6 +134,33 @@ type SMTPConfig struct {
 	Password string `mapstructure:"password"`
 }
 
+// BulkDownloadCfg represents the limits of the bulk file download.
+type BulkDownloadCfg struct {
+	// Maximum number of hashes per request. Defaults to 100.
+	MaxHashes int `mapstructure:"max_hashes"`
+	// Maximum total size of the samples in MB. Defaults to 512.
+	MaxSize int `mapstructure:"max_size"`
+	// Number of samples fetched concurrently. Defaults to 4.
+	Workers int `mapstructure:"workers"`
+}
+
+// CommentsCfg represents the comments config.
+type CommentsCfg struct {
+	// Maximum number of comments a user can post per hour, 0 disables
+	// the limit.
+	MaxPerHour int `mapstructure:"max_per_hour"`
+}
+
+// NotificationsCfg represents the notifications config.
+type NotificationsCfg struct {
+	// Interval in seconds between the lookups of the finished scans to
+	// notify the uploaders of, 0 disables the scan notifications.
+	ScanInterval int `mapstructure:"scan_interval"`
+	// Interval in hours between the email digests of the unread
+	// notifications, 0 disables the digests.
+	DigestInterval int `mapstructure:"digest_interval"`
+}
+
 // Config represents our application config.
 type Config struct {
 	// The IP:Port. Defaults to 8080.
@@ -105,6 +184,12 @@ type Config struct {
 	MaxAvatarSize int `mapstructure:"max_avatar_file_size"`
 	// Password used to zip the samples during file download.
 	SamplesZipPwd string `mapstructure:"samples_zip_password"`
+	// Limits of the bulk file download.
+	BulkDownload BulkDownloadCfg `mapstructure:"bulk_download"`
+	// Comments configuration.
+	Comments CommentsCfg `mapstructure:"comments"`
+	// Notifications configuration.
+	Notifications NotificationsCfg `mapstructure:"notifications"`
 	// Recaptcha server-side secret key.
 	RecaptchaKey string `mapstructure:"recaptcha_key"`
 	// Database configuration.
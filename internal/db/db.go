@@ -8,11 +8,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
 	gocb "github.com/couchbase/gocb/v2"
 	"github.com/couchbase/gocb/v2/search"
+	"github.com/saferwall/saferwall-api/internal/entity"
 	"github.com/saferwall/saferwall-api/internal/query-parser/gen"
 )
 
@@ -26,6 +28,10 @@ var (
 	// ErrDocumentNotFound is returned when the doc does not exist in the DB.
 	ErrDocumentNotFound = errors.New("document not found")
 	ErrSubDocNotFound   = gocb.ErrPathNotFound
+	// ErrSubDocExists is returned when inserting a path which is set.
+	ErrSubDocExists = gocb.ErrPathExists
+	// ErrDocumentExists is returned when creating a doc whose key is taken.
+	ErrDocumentExists = gocb.ErrDocumentExists
 )
 
 // DB represents the database connection.
@@ -71,6 +77,52 @@ func Open(server, username, password, bucketName, ftsIndexName string) (*DB, err
 		return nil, err
 	}
 
+	// Create secondary indexes used to lookup files by other hashes than
+	// their SHA256.
+	for _, field := range []string{"md5", "sha1", "sha512", "crc32"} {
+		err = mgr.CreateIndex(bucketName, "idx_"+field, []string{field},
+			&gocb.CreateQueryIndexOptions{IgnoreIfExists: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create secondary indexes used to lookup the relationships documents
+	// by either of their endpoints, the comments by the users they mention,
+	// the users by their number of votes for the leaderboard, the user tags
+	// by file, the collections by owner, the notifications by recipient, the
+	// members of the organizations and their private submissions, and the
+	// behavior reports by ATT&CK technique.
+	for _, index := range []struct {
+		name   string
+		fields []string
+	}{
+		{"idx_edge_username", []string{"`type`", "kind", "username", "ts"}},
+		{"idx_edge_target", []string{"`type`", "kind", "target", "ts"}},
+		{"idx_comment_mentions", []string{
+			"DISTINCT ARRAY m FOR m IN mentions END"}},
+		{"idx_user_votes", []string{"`type`", "votes_count"}},
+		{"idx_usertag_sha256", []string{"`type`", "sha256", "ts"}},
+		{"idx_usertag_username", []string{"`type`", "username", "ts"}},
+		{"idx_collection_username", []string{"`type`", "username", "timestamp"}},
+		{"idx_notification_username", []string{
+			"`type`", "username", "`read`", "timestamp"}},
+		{"idx_orgmember_org", []string{"`type`", "org", "role", "ts"}},
+		{"idx_orgmember_username", []string{"`type`", "username", "ts"}},
+		{"idx_orgsubmission", []string{"`type`", "org", "sha256", "timestamp"}},
+		{"idx_orgsubmission_username", []string{"`type`", "username"}},
+		{"idx_behavior_technique", []string{
+			"DISTINCT ARRAY (DISTINCT ARRAY UPPER(t.id) FOR t IN c.techniques END) " +
+				"FOR c IN capabilities END", "`type`"}},
+		{"idx_file_behavior", []string{"`type`", "default_behavior_report.id"}},
+	} {
+		err = mgr.CreateIndex(bucketName, index.name, index.fields,
+			&gocb.CreateQueryIndexOptions{IgnoreIfExists: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &DB{
 		Bucket:       bucket,
 		Cluster:      cluster,
@@ -90,12 +142,26 @@ func (db *DB) Exists(ctx context.Context, key string, docExists *bool) error {
 	return nil
 }
 
-// Query executes a N1QL query.
+// Query executes a N1QL query. The indexes are not waited for, the results
+// may miss the mutations made just before.
 func (db *DB) Query(ctx context.Context, statement string,
 	args map[string]interface{}, val *interface{}) error {
+	return db.query(statement, args, val, gocb.QueryScanConsistencyNotBounded)
+}
+
+// QueryConsistent executes a N1QL query once the indexes caught up with the
+// mutations made before it, for the results which must include them.
+func (db *DB) QueryConsistent(ctx context.Context, statement string,
+	args map[string]interface{}, val *interface{}) error {
+	return db.query(statement, args, val, gocb.QueryScanConsistencyRequestPlus)
+}
+
+// query executes a N1QL query with the given scan consistency.
+func (db *DB) query(statement string, args map[string]interface{},
+	val *interface{}, consistency gocb.QueryScanConsistency) error {
 
 	results, err := db.Cluster.Query(statement, &gocb.QueryOptions{
-		NamedParameters: args, Adhoc: true})
+		NamedParameters: args, Adhoc: true, ScanConsistency: consistency})
 	if err != nil {
 		return err
 	}
@@ -164,9 +230,116 @@ func (db *DB) Patch(ctx context.Context, key string, path string,
 	return err
 }
 
+// Insert sets the path of a document unless it is already set, the
+// sub document operation is atomic so a single caller can set a path.
+func (db *DB) Insert(ctx context.Context, key, path string,
+	val interface{}) error {
+
+	mops := []gocb.MutateInSpec{
+		gocb.InsertSpec(path, val, &gocb.InsertSpecOptions{}),
+	}
+	_, err := db.Collection.MutateIn(key, mops,
+		&gocb.MutateInOptions{Timeout: 10050 * time.Millisecond})
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return ErrDocumentNotFound
+	}
+	return err
+}
+
+// Increment atomically adds delta to the counter at path in a document,
+// the counter is created when missing.
+func (db *DB) Increment(ctx context.Context, key, path string,
+	delta int64) error {
+
+	opts := &gocb.CounterSpecOptions{CreatePath: true}
+	spec := gocb.IncrementSpec(path, delta, opts)
+	if delta < 0 {
+		spec = gocb.DecrementSpec(path, -delta, opts)
+	}
+	_, err := db.Collection.MutateIn(key, []gocb.MutateInSpec{spec},
+		&gocb.MutateInOptions{Timeout: 10050 * time.Millisecond})
+	return err
+}
+
+// Unset removes paths from a document, the paths must exist.
+func (db *DB) Unset(ctx context.Context, key string, paths []string) error {
+	mops := []gocb.MutateInSpec{}
+	for _, path := range paths {
+		mops = append(mops, gocb.RemoveSpec(path, &gocb.RemoveSpecOptions{}))
+	}
+	_, err := db.Collection.MutateIn(key, mops,
+		&gocb.MutateInOptions{Timeout: 10050 * time.Millisecond})
+	return err
+}
+
+// ArrayAddUnique adds a value to the array at path in a document unless it
+// is already there, the array is created when missing.
+func (db *DB) ArrayAddUnique(ctx context.Context, key, path string,
+	val interface{}) error {
+
+	mops := []gocb.MutateInSpec{
+		gocb.ArrayAddUniqueSpec(path, val,
+			&gocb.ArrayAddUniqueSpecOptions{CreatePath: true}),
+	}
+	_, err := db.Collection.MutateIn(key, mops,
+		&gocb.MutateInOptions{Timeout: 10050 * time.Millisecond})
+	if errors.Is(err, gocb.ErrPathExists) {
+		return nil
+	}
+	return err
+}
+
+// ArrayRemove removes a value from the array at path in a document, it does
+// nothing when the array does not contain it. Sub document operations remove
+// array elements by position, the document is compared and swapped to not
+// remove a shifted element.
+func (db *DB) ArrayRemove(ctx context.Context, key, path string,
+	val interface{}) error {
+
+	for {
+		res, err := db.Collection.LookupIn(key, []gocb.LookupInSpec{
+			gocb.GetSpec(path, &gocb.GetSpecOptions{})},
+			&gocb.LookupInOptions{})
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return ErrDocumentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var values []interface{}
+		err = res.ContentAt(0, &values)
+		if errors.Is(err, gocb.ErrPathNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		i := 0
+		for i < len(values) && values[i] != val {
+			i++
+		}
+		if i == len(values) {
+			return nil
+		}
+		mops := []gocb.MutateInSpec{
+			gocb.RemoveSpec(fmt.Sprintf("%s[%d]", path, i),
+				&gocb.RemoveSpecOptions{}),
+		}
+		_, err = db.Collection.MutateIn(key, mops, &gocb.MutateInOptions{
+			Cas: res.Cas(), Timeout: 10050 * time.Millisecond})
+		if !errors.Is(err, gocb.ErrCasMismatch) {
+			return err
+		}
+	}
+}
+
 // Delete removes a document from the collection.
 func (db *DB) Delete(ctx context.Context, key string) error {
 	_, err := db.Collection.Remove(key, &gocb.RemoveOptions{})
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return ErrDocumentNotFound
+	}
 	return err
 }
 
@@ -238,6 +411,70 @@ func (db *DB) Lookup(ctx context.Context, key string, paths []string,
 	return nil
 }
 
+// maxResolvedIDs bounds the number of documents a search identifier which
+// is not indexed in the full text search index can resolve to.
+const maxResolvedIDs = 10000
+
+// filesByTechnique returns the SHA256 of the files whose default behavior
+// report exhibits an ATT&CK technique or one of its sub-techniques.
+func (db *DB) filesByTechnique(ctx context.Context, technique string) (
+	[]string, error) {
+
+	statement := fmt.Sprintf(
+		"SELECT RAW META(f).id FROM `%[1]s` f "+
+			"WHERE f.`type` = 'file' AND f.default_behavior_report.id IN ("+
+			"SELECT RAW META(b).id FROM `%[1]s` b WHERE b.`type` = 'behavior' "+
+			"AND ANY c IN b.capabilities SATISFIES "+
+			"(ANY t IN c.techniques SATISFIES "+
+			"UPPER(t.id) = $technique OR UPPER(t.id) LIKE $prefix END) END) "+
+			"LIMIT %[2]d", db.Bucket.Name(), maxResolvedIDs)
+	technique = strings.ToUpper(technique)
+	args := map[string]interface{}{
+		"technique": technique,
+		"prefix":    technique + ".%",
+	}
+
+	var results interface{}
+	err := db.Query(ctx, statement, args, &results)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, r := range results.([]interface{}) {
+		if id, ok := r.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// filesInCollection returns the SHA256 of the files of a collection visible
+// to the logged in user: a public collection, one of their own, or any
+// collection for an admin. The files are not indexed by collection, as the
+// file documents are public.
+func (db *DB) filesInCollection(ctx context.Context, id string) (
+	[]string, error) {
+
+	var col entity.Collection
+	err := db.Get(ctx, strings.ToLower(id), &col)
+	if errors.Is(err, ErrDocumentNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, _ := ctx.Value(entity.UserKey).(entity.User)
+	if col.Type != "collection" ||
+		!(col.Public || user.ID() == col.Username || user.IsAdmin()) {
+		return nil, nil
+	}
+	if len(col.Files) > maxResolvedIDs {
+		return col.Files[:maxResolvedIDs], nil
+	}
+	return col.Files, nil
+}
+
 func (db *DB) Search(ctx context.Context, stringQuery string, page uint32, perPage uint32, sortBy string, order string, val *interface{}, totalHits *uint64) error {
 
 	query, err := gen.Generate(stringQuery,
@@ -314,6 +551,22 @@ func (db *DB) Search(ctx context.Context, stringQuery string, page uint32, perPa
 			"fsecure": {
 				Field: "multiav.last_scan.detections.fsecure.output",
 			},
+			"technique": {
+				Resolve: func(value string) ([]string, error) {
+					return db.filesByTechnique(ctx, value)
+				},
+			},
+			"community": {
+				Field: "community.verdict",
+			},
+			"usertag": {
+				Field: "user_tags",
+			},
+			"collection": {
+				Resolve: func(value string) ([]string, error) {
+					return db.filesInCollection(ctx, value)
+				},
+			},
 			"engines": {
 				FieldGroup: []string{
 					"multiav.last_scan.detections.avast.output",
@@ -344,6 +597,8 @@ func (db *DB) Search(ctx context.Context, stringQuery string, page uint32, perPa
 		Fields: []string{"size", "file_extension", "file_format", "first_seen", "last_scanned", "tags.packer", "tags.pe",
 			"tags.avira", "tags.eset", "tags.windefender", "submissions.filename", "classification",
 			"multiav.last_scan.stats.positives", "multiav.last_scan.stats.engines_count",
+			"community.verdict",
+			"user_tags",
 		},
 	}
 
@@ -381,7 +636,7 @@ func (db *DB) Search(ctx context.Context, stringQuery string, page uint32, perPa
 		delete(fields, "multiav.last_scan.stats.engines_count")
 		delete(fields, "submissions.filename")
 		delete(fields, "classification")
-		unflattenFields(fields)
+		UnflattenFields(fields)
 		rows = append(rows, fields)
 	}
 
@@ -13,17 +13,13 @@ import (
 type n1qlQuery int
 
 const (
-	ActionFollow n1qlQuery = iota
-	ActionLike
-	ActionSubmit
-	ActionUnfollow
-	ActionUnlike
-	AnoUserActivities
+	AnoUserActivities n1qlQuery = iota
 	AnoUserComments
 	AnoUserFollowers
 	AnoUserFollowing
 	AnoUserLikes
 	AnoUserSubmissions
+	BehaviorIOCsSources
 	BehaviorReport
 	CountAnoUserActivities
 	CountStrings
@@ -45,17 +41,13 @@ const (
 )
 
 var fileQueryMap = map[string]n1qlQuery{
-	"action-follow.sql":             ActionFollow,
-	"action-like.sql":               ActionLike,
-	"action-submit.sql":             ActionSubmit,
-	"action-unfollow.sql":           ActionUnfollow,
-	"action-unlike.sql":             ActionUnlike,
 	"ano-user-activities.sql":       AnoUserActivities,
 	"ano-user-comments.sql":         AnoUserComments,
 	"ano-user-followers.sql":        AnoUserFollowers,
 	"ano-user-following.sql":        AnoUserFollowing,
 	"ano-user-likes.sql":            AnoUserLikes,
 	"ano-user-submissions.sql":      AnoUserSubmissions,
+	"behavior-iocs-sources.sql":     BehaviorIOCsSources,
 	"behavior-report.sql":           BehaviorReport,
 	"count-ano-user-activities.sql": CountAnoUserActivities,
 	"count-strings.sql":             CountStrings,
@@ -112,8 +104,12 @@ func (db *DB) PrepareQueries(filePath, bucketName string) error {
 		query := string(c)
 		query = strings.ReplaceAll(query, "bucket_name", bucketName)
 
-		name := filepath.Base(f)
-		key := fileQueryMap[name]
+		// Skip the files which are not known queries, such as the ones
+		// left over from a previous version.
+		key, ok := fileQueryMap[filepath.Base(f)]
+		if !ok {
+			continue
+		}
 		db.N1QLQuery[key] = query
 	}
 
@@ -2,7 +2,9 @@ package db
 
 import "strings"
 
-func unflattenFields(fields map[string]interface{}) {
+// UnflattenFields expands in place the keys of a map using the dot
+// notation into nested maps.
+func UnflattenFields(fields map[string]interface{}) {
 	for k, col := range fields {
 		if strings.Contains(k, ".") { // checks if the field is flattened
 			parts := strings.Split(k, ".")
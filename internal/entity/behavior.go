@@ -4,6 +4,12 @@
 
 package entity
 
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
 // Behavior represents a dynamic file scan report.
 type Behavior struct {
 	Meta             *DocMetadata         `json:"doc,omitempty"`
@@ -15,10 +21,122 @@ type Behavior struct {
 	Artifacts        interface{}          `json:"artifacts,omitempty"`
 	SystemEvents     interface{}          `json:"sys_events,omitempty"`
 	ProcessTree      interface{}          `json:"proc_tree,omitempty"`
-	Capabilities     interface{}          `json:"capabilities,omitempty"`
+	Capabilities     Capabilities         `json:"capabilities,omitempty"`
 	ScreenshotsCount int                  `json:"screenshots_count,omitempty"`
 	ScanConfig       interface{}          `json:"scan_cfg,omitempty"`
 	SandboxLog       interface{}          `json:"sandbox_log,omitempty"`
 	AgentLog         interface{}          `json:"agent_log,omitempty"`
 	Status           FileScanProgressType `json:"status,omitempty"`
 }
+
+// AttackTechnique represents a MITRE ATT&CK technique.
+type AttackTechnique struct {
+	// ID is the technique or sub-technique identifier, for example: T1055.
+	ID string `json:"id"`
+	// Name is the human readable name of the technique, for example:
+	// Process Injection.
+	Name string `json:"name,omitempty"`
+	// Tactic is the ATT&CK tactic short name the technique belongs to,
+	// for example: defense-evasion.
+	Tactic string `json:"tactic"`
+}
+
+// Capability represents a behavior rule that matched during a dynamic scan.
+type Capability struct {
+	// Category of the capability, for example: anti-analysis, persistence.
+	Category string `json:"category"`
+	// Severity is one of: info, low, medium or high.
+	Severity string `json:"severity"`
+	// Description explains what the capability is about.
+	Description string `json:"description"`
+	// Module is the name of the module in which the capability was observed.
+	Module string `json:"module,omitempty"`
+	// ProcessID is the identifier of the process which exhibited the capability.
+	ProcessID string `json:"pid,omitempty"`
+	// Techniques is the list of ATT&CK techniques the capability maps to.
+	Techniques []AttackTechnique `json:"techniques,omitempty"`
+}
+
+// Capabilities is the list of capabilities of a behavior report. Reports
+// produced before the capabilities had a schema stored them as free form
+// JSON, either an array or an object keyed by rule name. They are decoded
+// on a best effort basis instead of failing the whole report.
+type Capabilities []Capability
+
+// UnmarshalJSON decodes the current and the legacy shapes of capabilities.
+func (c *Capabilities) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		var keyed map[string]json.RawMessage
+		if json.Unmarshal(data, &keyed) != nil {
+			*c = nil
+			return nil
+		}
+		keys := make([]string, 0, len(keyed))
+		for k := range keyed {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			items = append(items, keyed[k])
+		}
+	}
+
+	capabilities := make(Capabilities, 0, len(items))
+	for _, item := range items {
+		var capability Capability
+		if json.Unmarshal(item, &capability) != nil {
+			continue
+		}
+		capabilities = append(capabilities, capability)
+	}
+	*c = capabilities
+	return nil
+}
+
+// UnmarshalJSON decodes a capability, accepting the legacy shapes where the
+// process ID is a number, the techniques are plain IDs and the capability
+// is only a description.
+func (c *Capability) UnmarshalJSON(data []byte) error {
+	var description string
+	if json.Unmarshal(data, &description) == nil {
+		*c = Capability{Description: description}
+		return nil
+	}
+
+	var raw struct {
+		Category    string            `json:"category"`
+		Severity    string            `json:"severity"`
+		Description string            `json:"description"`
+		Module      string            `json:"module"`
+		ProcessID   interface{}       `json:"pid"`
+		Techniques  []json.RawMessage `json:"techniques"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*c = Capability{
+		Category:    raw.Category,
+		Severity:    raw.Severity,
+		Description: raw.Description,
+		Module:      raw.Module,
+	}
+	switch pid := raw.ProcessID.(type) {
+	case string:
+		c.ProcessID = pid
+	case float64:
+		c.ProcessID = fmt.Sprint(int64(pid))
+	}
+	for _, t := range raw.Techniques {
+		var technique AttackTechnique
+		if json.Unmarshal(t, &technique.ID) != nil &&
+			json.Unmarshal(t, &technique) != nil {
+			continue
+		}
+		if technique.ID != "" {
+			c.Techniques = append(c.Techniques, technique)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package entity
+
+// Collection represents a named group of files curated by a user, to track
+// a campaign for instance.
+type Collection struct {
+	// Meta represents document metadata.
+	Meta *DocMetadata `json:"doc,omitempty"`
+	// Type represents the document type.
+	Type string `json:"type,omitempty"`
+	// ID represents the collection identifier.
+	ID string `json:"id,omitempty"`
+	// Name represents the title of the collection.
+	Name string `json:"name,omitempty"`
+	// Description gives details about the collection.
+	Description string `json:"description,omitempty"`
+	// Username represents the owner of the collection.
+	Username string `json:"username,omitempty"`
+	// Public collections are visible to everyone, private ones only to
+	// their owner.
+	Public bool `json:"public"`
+	// Files lists the SHA256 of the files in the collection, in the order
+	// they were added.
+	Files []string `json:"files,omitempty"`
+	// Timestamp when the collection was created.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
@@ -20,4 +20,59 @@ type Comment struct {
 	Timestamp int64 `json:"timestamp,omitempty"`
 	// Username represents the author of the comment.
 	Username string `json:"username,omitempty"`
+	// ParentID references the comment this comment replies to.
+	ParentID string `json:"parent_id,omitempty"`
+	// RepliesCount represents the number of direct replies to the comment.
+	RepliesCount int `json:"replies_count,omitempty"`
+	// Mentions lists the IDs of the users mentioned in the body.
+	Mentions []string `json:"mentions,omitempty"`
+	// History keeps the previous revisions of the body, oldest first.
+	History []CommentRevision `json:"history,omitempty"`
+	// Status is empty for a visible comment, otherwise one of
+	// CommentHidden or CommentDeleted.
+	Status string `json:"status,omitempty"`
+	// Reports lists the reports made by users about the comment which
+	// were not reviewed yet by a moderator.
+	Reports []CommentReport `json:"reports,omitempty"`
+	// ReportsCount represents the number of reports pending review.
+	ReportsCount int `json:"reports_count,omitempty"`
+	// Moderation describes the last moderator action on the comment.
+	Moderation *CommentModeration `json:"moderation,omitempty"`
+}
+
+const (
+	// CommentHidden marks a comment hidden by a moderator, its body is
+	// kept so that it can be restored.
+	CommentHidden = "hidden"
+	// CommentDeleted marks a tombstone left in place of a deleted comment,
+	// to keep the replies threaded.
+	CommentDeleted = "deleted"
+)
+
+// CommentReport represents a user reporting a comment to the moderators.
+type CommentReport struct {
+	// Username represents the user who reported the comment.
+	Username string `json:"username"`
+	// Reason describes why the comment was reported.
+	Reason string `json:"reason"`
+	// Timestamp when the comment was reported.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// CommentModeration represents a moderator action on a comment.
+type CommentModeration struct {
+	// Action is one of hide, unhide, delete or dismiss.
+	Action string `json:"action"`
+	// Username represents the moderator.
+	Username string `json:"username"`
+	// Timestamp when the action was taken.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// CommentRevision represents a previous version of a comment's body.
+type CommentRevision struct {
+	// Body represents the content of the comment at that time.
+	Body string `json:"body"`
+	// Timestamp when this revision was written.
+	Timestamp int64 `json:"timestamp"`
 }
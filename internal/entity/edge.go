@@ -0,0 +1,49 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package entity
+
+// Kinds of relationships between users and files.
+const (
+	// EdgeLike links a user to a file they like.
+	EdgeLike = "like"
+	// EdgeFollow links a user to a user they follow.
+	EdgeFollow = "follow"
+	// EdgeSubmit links a user to a file they submitted.
+	EdgeSubmit = "submit"
+	// EdgeVote links a user to a file they gave a verdict on.
+	EdgeVote = "vote"
+)
+
+// Edge represents a relationship of a user to a file or to another user.
+// Every relationship is stored in its own document, looked up by either
+// of its endpoints.
+type Edge struct {
+	// Type represents the document type.
+	Type string `json:"type"`
+	// Kind represents the type of the relationship,
+	// possible values: "like", "follow", "submit", "vote".
+	Kind string `json:"kind"`
+	// Username represents the user the relationship starts from, in lower
+	// case.
+	Username string `json:"username"`
+	// Target could be a sha256 or a username in lower case.
+	Target string `json:"target"`
+	// Timestamp when the relationship was created.
+	Timestamp int64 `json:"ts"`
+	// Verdict and Family describe the vote of a "vote" relationship.
+	Verdict string `json:"verdict,omitempty"`
+	Family  string `json:"family,omitempty"`
+}
+
+// ID returns the key of the document of an edge, a relationship is only
+// recorded once.
+func (e Edge) ID() string {
+	return EdgeID(e.Kind, e.Username, e.Target)
+}
+
+// EdgeID returns the key of the document of an edge given its endpoints.
+func EdgeID(kind, username, target string) string {
+	return "edge::" + kind + "::" + username + "::" + target
+}
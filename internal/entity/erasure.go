@@ -0,0 +1,51 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package entity
+
+// Status of an account erasure.
+const (
+	// ErasureRunning marks an erasure in progress.
+	ErasureRunning = "running"
+	// ErasureDone marks an erasure which removed all the personal data.
+	ErasureDone = "done"
+	// ErasureFailed marks an erasure which stopped on an error, it can be
+	// started again.
+	ErasureFailed = "failed"
+)
+
+// Erasure tracks the removal of the personal data of a user. It is kept
+// once the account is gone as a record of the erasure.
+type Erasure struct {
+	// Type represents the document type.
+	Type string `json:"type"`
+	// Username represents the user whose data is erased, in lower case.
+	Username string `json:"username"`
+	// RequestedBy represents the user who asked for the erasure, the user
+	// themselves or an admin.
+	RequestedBy string `json:"requested_by"`
+	// Status is one of ErasureRunning, ErasureDone or ErasureFailed.
+	Status string `json:"status"`
+	// Step represents the step being run, or the one which failed.
+	Step string `json:"step,omitempty"`
+	// Done and Total count the steps of the erasure.
+	Done  int `json:"done"`
+	Total int `json:"total"`
+	// Error describes why the erasure failed.
+	Error string `json:"error,omitempty"`
+	// StartedAt and UpdatedAt are the timestamps when the erasure started
+	// and when it last made progress.
+	StartedAt int64 `json:"started_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// ID returns the key of the document of an erasure.
+func (e Erasure) ID() string {
+	return ErasureID(e.Username)
+}
+
+// ErasureID returns the key of the document of the erasure of a user.
+func ErasureID(username string) string {
+	return "erasure::" + username
+}
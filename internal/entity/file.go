@@ -40,6 +40,50 @@ type File struct {
 	DefaultBhvReport interface{}            `json:"default_behavior_report,omitempty"`
 	BhvScans         interface{}            `json:"behavior_scans,omitempty"`
 	Status           FileScanProgressType   `json:"status,omitempty"`
+	Community        *CommunityVerdict      `json:"community,omitempty"`
+	// UserTags lists the distinct tags attached by the users, the tags
+	// from the scanners are found in Tags.
+	UserTags []string `json:"user_tags,omitempty"`
+}
+
+// UserTag represents a tag attached to a file by a user. A tag is attached
+// once per file, by the first user who used it.
+type UserTag struct {
+	Type      string `json:"type"`
+	SHA256    string `json:"sha256"`
+	Tag       string `json:"tag"`
+	Username  string `json:"username"`
+	Timestamp int64  `json:"ts"`
+}
+
+// ID returns the key of the document of a user tag.
+func (t UserTag) ID() string {
+	return UserTagID(t.SHA256, t.Tag)
+}
+
+// UserTagID returns the key of the document of a tag attached to a file.
+func UserTagID(sha256, tag string) string {
+	return "usertag::" + sha256 + "::" + tag
+}
+
+// Verdicts users can vote for a file.
+const (
+	VerdictMalicious  = "malicious"
+	VerdictSuspicious = "suspicious"
+	VerdictBenign     = "benign"
+)
+
+// CommunityVerdict aggregates the verdicts voted by the users for a file.
+type CommunityVerdict struct {
+	Malicious  int `json:"malicious"`
+	Suspicious int `json:"suspicious"`
+	Benign     int `json:"benign"`
+	// Verdict is the verdict having the most votes, the most severe one
+	// wins a tie. It is empty when there are no votes.
+	Verdict string `json:"verdict,omitempty"`
+	// Family is the family name the most voted among the votes which are
+	// not benign.
+	Family string `json:"family,omitempty"`
 }
 
 // Submission represents a file submission.
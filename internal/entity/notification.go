@@ -0,0 +1,66 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package entity
+
+// Kinds of notifications.
+const (
+	// NotificationFollow tells a user someone followed them.
+	NotificationFollow = "follow"
+	// NotificationComment tells a user someone commented on a file they
+	// submitted.
+	NotificationComment = "comment"
+	// NotificationMention tells a user someone mentioned them in a comment.
+	NotificationMention = "mention"
+	// NotificationScan tells a user the scan of a file they uploaded
+	// finished.
+	NotificationScan = "scan"
+)
+
+// Notification represents an event addressed to a user.
+type Notification struct {
+	// Type represents the document type.
+	Type string `json:"type"`
+	// ID represents the notification identifier.
+	ID string `json:"id"`
+	// Kind represents the type of the notification, possible values:
+	// "follow", "comment", "mention", "scan".
+	Kind string `json:"kind"`
+	// Username represents the recipient of the notification, in lower case.
+	Username string `json:"username"`
+	// Actor represents the user who caused the notification, empty for the
+	// notifications of the system.
+	Actor string `json:"actor,omitempty"`
+	// Target could be a sha256, a username or a comment id.
+	Target string `json:"target"`
+	// SHA256 references the file a comment was made on.
+	SHA256 string `json:"sha256,omitempty"`
+	// Read tells if the recipient has seen the notification.
+	Read bool `json:"read"`
+	// Emailed tells if the notification was sent in an email digest.
+	Emailed bool `json:"emailed,omitempty"`
+	// Timestamp when the notification was created.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// NotificationPreferences represents the notification settings of a user.
+type NotificationPreferences struct {
+	// Muted lists the kinds of notifications the user does not receive.
+	Muted []string `json:"muted,omitempty"`
+	// Digest enables a periodic email summarizing the unread notifications.
+	Digest bool `json:"digest"`
+}
+
+// ScanWatch represents a user waiting for the scan of a file they uploaded.
+type ScanWatch struct {
+	Type      string `json:"type"`
+	SHA256    string `json:"sha256"`
+	Username  string `json:"username"`
+	Timestamp int64  `json:"ts"`
+}
+
+// ID returns the key of the document of a scan watch.
+func (w ScanWatch) ID() string {
+	return "scanwatch::" + w.SHA256 + "::" + w.Username
+}
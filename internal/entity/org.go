@@ -0,0 +1,99 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package entity
+
+// Roles of the members of an organization, an owner can do everything an
+// admin can, and an admin everything a member can.
+const (
+	// OrgMember sees the private submissions of the organization.
+	OrgMember = "member"
+	// OrgAdmin also adds and removes members.
+	OrgAdmin = "admin"
+	// OrgOwner also manages the admins and the owners, and deletes the
+	// organization.
+	OrgOwner = "owner"
+)
+
+// Visibility of a submission.
+const (
+	// VisibilityPublic submissions are shown to everyone.
+	VisibilityPublic = "public"
+	// VisibilityOrg submissions are only shown to the members of an
+	// organization.
+	VisibilityOrg = "org"
+)
+
+// Organization represents a group of users sharing private submissions,
+// an incident response team for instance.
+type Organization struct {
+	// Meta represents document metadata.
+	Meta *DocMetadata `json:"doc,omitempty"`
+	// Type represents the document type.
+	Type string `json:"type,omitempty"`
+	// ID represents the organization identifier.
+	ID string `json:"id,omitempty"`
+	// Name represents the display name of the organization.
+	Name string `json:"name,omitempty"`
+	// Description gives details about the organization.
+	Description string `json:"description,omitempty"`
+	// Username represents the user who created the organization.
+	Username string `json:"username,omitempty"`
+	// MembersCount represents the number of members.
+	MembersCount int `json:"members_count"`
+	// Timestamp when the organization was created.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// OrgMembership represents a user being a member of an organization.
+type OrgMembership struct {
+	// Type represents the document type.
+	Type string `json:"type"`
+	// Org references the ID of the organization.
+	Org string `json:"org"`
+	// Username represents the member, in lower case.
+	Username string `json:"username"`
+	// Role is one of OrgMember, OrgAdmin or OrgOwner.
+	Role string `json:"role"`
+	// Timestamp when the user joined the organization.
+	Timestamp int64 `json:"ts"`
+}
+
+// ID returns the key of the document of a membership.
+func (m OrgMembership) ID() string {
+	return OrgMembershipID(m.Org, m.Username)
+}
+
+// OrgMembershipID returns the key of the document of the membership of a
+// user to an organization.
+func OrgMembershipID(org, username string) string {
+	return "orgmember::" + org + "::" + username
+}
+
+// OrgSubmission represents a file submitted privately to an organization,
+// its metadata is kept apart from the file so that only the members of the
+// organization see it.
+type OrgSubmission struct {
+	// Type represents the document type.
+	Type string `json:"type"`
+	// ID represents the submission identifier.
+	ID string `json:"id"`
+	// Org references the ID of the organization.
+	Org string `json:"org"`
+	// SHA256 references the hash of the file submitted.
+	SHA256 string `json:"sha256"`
+	// Username represents the member who submitted the file.
+	Username string `json:"username"`
+	// Filename represents the name of the file submitted.
+	Filename string `json:"filename,omitempty"`
+	// Source describes weather the file was submitted from a web browser
+	// or a script.
+	Source string `json:"src,omitempty"`
+	// Country the file was submitted from.
+	Country string `json:"country,omitempty"`
+	// Comment represents a note left by the member about the submission.
+	Comment string `json:"comment,omitempty"`
+	// Timestamp when the file was submitted.
+	Timestamp int64 `json:"timestamp"`
+}
@@ -18,6 +18,14 @@ type UserSubmission struct {
 	Timestamp int64  `json:"ts"`
 }
 
+// UserVote represents the verdict given by a user on a file.
+type UserVote struct {
+	SHA256    string `json:"sha256"`
+	Verdict   string `json:"verdict"`
+	Family    string `json:"family,omitempty"`
+	Timestamp int64  `json:"ts"`
+}
+
 // UserFollows represents users' following or followers.
 type UserFollows struct {
 	Username  string `json:"username"`
@@ -26,24 +34,32 @@ type UserFollows struct {
 
 // User represents a user.
 type User struct {
-	Meta          *DocMetadata     `json:"doc,omitempty"`
-	Type          string           `json:"type"`
-	Email         string           `json:"email,omitempty"`
-	Username      string           `json:"username"`
-	Password      string           `json:"password,omitempty"`
-	FullName      string           `json:"name"`
-	Location      string           `json:"location"`
-	URL           string           `json:"url"`
-	Bio           string           `json:"bio"`
-	Confirmed     bool             `json:"confirmed"`
-	MemberSince   int64            `json:"member_since"`
-	LastSeen      int64            `json:"last_seen"`
-	Admin         bool             `json:"admin"`
-	Following     []UserFollows    `json:"following"`
-	Followers     []UserFollows    `json:"followers"`
-	Likes         []UserLike       `json:"likes"`
-	Submissions   []UserSubmission `json:"submissions"`
-	CommentsCount int              `json:"comments_count"`
+	Meta          *DocMetadata `json:"doc,omitempty"`
+	Type          string       `json:"type"`
+	Email         string       `json:"email,omitempty"`
+	Username      string       `json:"username"`
+	Password      string       `json:"password,omitempty"`
+	FullName      string       `json:"name"`
+	Location      string       `json:"location"`
+	URL           string       `json:"url"`
+	Bio           string       `json:"bio"`
+	Confirmed     bool         `json:"confirmed"`
+	MemberSince   int64        `json:"member_since"`
+	LastSeen      int64        `json:"last_seen"`
+	Admin         bool         `json:"admin"`
+	CommentsCount int          `json:"comments_count"`
+	// Counters of the relationships of the user, the relationships are
+	// stored as edge documents.
+	LikesCount       int `json:"likes_count"`
+	SubmissionsCount int `json:"submissions_count"`
+	FollowingCount   int `json:"following_count"`
+	FollowersCount   int `json:"followers_count"`
+	VotesCount       int `json:"votes_count"`
+	// DownloadFormat is the packaging format of the samples downloaded when
+	// none is requested.
+	DownloadFormat string `json:"download_format,omitempty"`
+	// Notifications holds the notification preferences of the user.
+	Notifications *NotificationPreferences `json:"notifications,omitempty"`
 }
 
 // UserPrivate represent a user with sensitive fields included.
@@ -0,0 +1,69 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package entity
+
+// Status of a storage verification.
+const (
+	// VerificationRunning marks a verification in progress.
+	VerificationRunning = "running"
+	// VerificationDone marks a verification which walked the whole bucket.
+	VerificationDone = "done"
+)
+
+// StorageVerificationID is the key of the document of the storage
+// verification, a single verification runs at a time.
+const StorageVerificationID = "verification::storage"
+
+// CorruptSample represents a sample failing its integrity check.
+type CorruptSample struct {
+	SHA256      string `json:"sha256"`
+	Reason      string `json:"reason"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+// StorageError represents an object, or a page of objects, which could not
+// be verified.
+type StorageError struct {
+	// Key of the object, or the prefix of the page ending with a *.
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// StorageVerification tracks the verification of the samples stored in the
+// object storage, it is kept once done as its report.
+type StorageVerification struct {
+	// Type represents the document type.
+	Type string `json:"type"`
+	// RequestedBy represents the admin who started the verification.
+	RequestedBy string `json:"requested_by"`
+	// Deep downloads every sample to verify its content.
+	Deep bool `json:"deep"`
+	// Quarantine moves the corrupt samples to quarantine.
+	Quarantine bool `json:"quarantine"`
+	// Status is one of VerificationRunning or VerificationDone.
+	Status string `json:"status"`
+	// Step represents the prefix of the page of objects being verified.
+	Step string `json:"step,omitempty"`
+	// Done and Total count the pages of objects.
+	Done  int `json:"done"`
+	Total int `json:"total"`
+	// Checked is the number of samples verified.
+	Checked int `json:"checked"`
+	// Corrupt lists the samples failing their integrity check.
+	Corrupt []CorruptSample `json:"corrupt"`
+	// Missing lists the files whose sample is absent from the storage.
+	Missing []string `json:"missing"`
+	// Orphaned lists the samples which do not belong to any file.
+	Orphaned []string `json:"orphaned"`
+	// Failed lists the objects which could not be verified.
+	Failed []StorageError `json:"failed"`
+	// Truncated tells whether some of the findings were left out of the
+	// lists to bound the size of the report.
+	Truncated bool `json:"truncated,omitempty"`
+	// StartedAt and UpdatedAt are the timestamps when the verification
+	// started and when it last made progress.
+	StartedAt int64 `json:"started_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
@@ -117,6 +117,30 @@ func UnsupportedMediaType(msg string) ErrorResponse {
 	}
 }
 
+// RangeNotSatisfiable creates a new error response representing a range
+// lying outside of the requested resource (HTTP 416).
+func RangeNotSatisfiable(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The requested range is not satisfiable."
+	}
+	return ErrorResponse{
+		Status:  http.StatusRequestedRangeNotSatisfiable,
+		Message: msg,
+	}
+}
+
+// TooManyRequests creates a new error response representing a client
+// exceeding its rate limit (HTTP 429).
+func TooManyRequests(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "You have sent too many requests, try again later."
+	}
+	return ErrorResponse{
+		Status:  http.StatusTooManyRequests,
+		Message: msg,
+	}
+}
+
 // BuildErrorResponse builds an error response from an error.
 func BuildErrorResponse(err error, trans ut.Translator) ErrorResponse {
 	switch err := err.(type) {
@@ -65,6 +65,22 @@ func TestBadRequest(t *testing.T) {
 	assert.NotEmpty(t, res.Error())
 }
 
+func TestRangeNotSatisfiable(t *testing.T) {
+	res := RangeNotSatisfiable("test")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = RangeNotSatisfiable("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestTooManyRequests(t *testing.T) {
+	res := TooManyRequests("test")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = TooManyRequests("")
+	assert.NotEmpty(t, res.Error())
+}
+
 // func TestInvalidInput(t *testing.T) {
 // 	err := invalidInput(validator.ValidationErrors{
 // 		"xyz": fmt.Errorf("2"),
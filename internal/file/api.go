@@ -5,14 +5,17 @@
 package file
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
+	"path"
 	"strings"
-	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/saferwall/saferwall-api/internal/entity"
 	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/internal/ioc"
+	"github.com/saferwall/saferwall-api/internal/storage"
 	"github.com/saferwall/saferwall-api/pkg/log"
 	"github.com/saferwall/saferwall-api/pkg/pagination"
 )
@@ -20,6 +23,17 @@ import (
 const (
 	KB = 1000
 	MB = 1000 * KB
+
+	// mispMaxEvents is the maximum number of events in a search export.
+	mispMaxEvents = 100
+
+	// maxSubmissionComment is the maximum length of the comment of a
+	// private submission.
+	maxSubmissionComment = 1024
+
+	// zipPasswordHeader is the header holding the password of the zip
+	// download formats.
+	zipPasswordHeader = "X-Zip-Password"
 )
 
 type resource struct {
@@ -46,13 +60,27 @@ func RegisterHandlers(g *echo.Group, service Service, logger log.Logger,
 	g.GET("/files/:sha256/comments/", res.comments, modifyResponse, verifyHash, optionalLogin)
 	g.POST("/files/:sha256/like/", res.like, verifyHash, requireLogin)
 	g.POST("/files/:sha256/unlike/", res.unlike, verifyHash, requireLogin)
+	g.POST("/files/:sha256/vote/", res.vote, verifyHash, requireLogin)
+	g.POST("/files/:sha256/unvote/", res.unvote, verifyHash, requireLogin)
+	g.GET("/files/:sha256/tags/", res.userTags, verifyHash)
+	g.POST("/files/:sha256/tags/", res.addTags, verifyHash, requireLogin)
+	g.DELETE("/files/:sha256/tags/:tag/", res.removeTag, verifyHash, requireLogin)
 	g.POST("/files/:sha256/rescan/", res.rescan, verifyHash, requireLogin)
 	g.GET("/files/:sha256/download/", res.download, verifyHash, requireLogin)
 	g.GET("/files/:sha256/generate-presigned-url/", res.generatePresignedURL, verifyHash, requireLogin)
 	g.GET("/files/:sha256/meta-ui/", res.metaUI, verifyHash, optionalLogin)
+	g.GET("/files/:sha256/iocs/", res.iocs, verifyHash)
+	g.GET("/files/:sha256/stix/", res.stix, verifyHash)
+	g.GET("/files/:sha256/misp/", res.misp, verifyHash, optionalLogin)
 	g.POST("/files/search/", res.search, requireLogin)
+	g.POST("/files/search/misp/", res.searchMISP, requireLogin)
 	g.GET("/files/search/autocomplete/", res.autocomplete)
+	g.GET("/files/lookup/", res.lookup)
+	g.POST("/files/lookup/", res.bulkLookup)
+	g.POST("/files/batch/", res.batch, requireLogin)
 	g.POST("/files/download/", res.bulkDownload, verifyHashes, requireLogin)
+	g.POST("/admin/storage/verify/", res.verifyStorage, requireLogin)
+	g.GET("/admin/storage/verify/", res.storageVerification, requireLogin)
 	//
 }
 
@@ -108,13 +136,19 @@ func (r resource) get(c echo.Context) error {
 }
 
 // @Summary Submit a new file for scanning
-// @Description Upload file for analysis.
+// @Description Upload file for analysis. With the `org` visibility, the
+// @Description file name and the comment of the submission are only shown
+// @Description to the members of the organization.
 // @Tags File
 // @Accept mpfd
 // @Produce json
 // @Param file formData file true  "binary file"
+// @Param visibility formData string false "Visibility of the submission" Enums(public, org)
+// @Param org formData string false "Organization ID, required with the org visibility"
+// @Param comment formData string false "Comment shared with the organization"
 // @Success 201 {object} entity.File
 // @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
 // @Failure 404 {object} errors.ErrorResponse
 // @Failure 413 {object} errors.ErrorResponse
 // @Failure 500 {object} errors.ErrorResponse
@@ -149,11 +183,35 @@ func (r resource) create(c echo.Context) error {
 		return errors.BadRequest("")
 	}
 
+	visibility := c.FormValue("visibility")
+	orgID := strings.ToLower(c.FormValue("org"))
+	comment := c.FormValue("comment")
+	switch visibility {
+	case "", entity.VisibilityPublic:
+		visibility = entity.VisibilityPublic
+		if orgID != "" || comment != "" {
+			return errors.BadRequest(
+				"org and comment require the org visibility")
+		}
+	case entity.VisibilityOrg:
+		if !entity.IsValidID(orgID) {
+			return errors.BadRequest("invalid organization ID string")
+		}
+		if len(comment) > maxSubmissionComment {
+			return errors.BadRequest("comment too long")
+		}
+	default:
+		return errors.BadRequest("invalid visibility: " + visibility)
+	}
+
 	input := CreateFileRequest{
-		src:      src,
-		filename: f.Filename,
-		geoip:    c.Request().Header.Get("X-Geoip-Country"),
-		scanCfg:  scanCfg,
+		src:        src,
+		filename:   f.Filename,
+		geoip:      c.Request().Header.Get("X-Geoip-Country"),
+		scanCfg:    scanCfg,
+		visibility: visibility,
+		org:        orgID,
+		comment:    comment,
 	}
 	file, err := r.service.Create(ctx, input)
 	if err != nil {
@@ -303,6 +361,101 @@ func (r resource) list(c echo.Context) error {
 	return c.JSON(http.StatusOK, pages)
 }
 
+// @Summary Lookup a file by hash
+// @Description Redirects to the file identified by a CRC32 (0x prefixed), MD5, SHA1, SHA256 or SHA512 hash. When a CRC32 matches many files, the list of matches is returned instead.
+// @Tags File
+// @Produce json
+// @Param hash query string true "File hash"
+// @Success 302 {string} string "Redirect to the file report"
+// @Success 300 {object} LookupResult
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/lookup/ [get]
+func (r resource) lookup(c echo.Context) error {
+	hash := c.QueryParam("hash")
+	if hash == "" {
+		return errors.BadRequest("missing hash")
+	}
+
+	res, err := r.service.Lookup(c.Request().Context(), []string{hash})
+	if err != nil {
+		if err == ErrInvalidHash {
+			return errors.BadRequest(err.Error())
+		}
+		return err
+	}
+	if len(res.Results) == 0 {
+		return errors.NotFound("")
+	}
+
+	result := res.Results[0]
+	if len(result.SHA256) > 1 {
+		return c.JSON(http.StatusMultipleChoices, result)
+	}
+
+	// Redirect to the canonical file route, relative to the current group.
+	base := path.Dir(strings.TrimSuffix(c.Request().URL.Path, "/"))
+	return c.Redirect(http.StatusFound, path.Join(base, result.SHA256[0])+"/")
+}
+
+// @Summary Lookup many files by hash
+// @Description Resolves up to 1000 CRC32 (0x prefixed), MD5, SHA1, SHA256 or SHA512 hashes to the SHA256 of the matching files.
+// @Tags File
+// @Accept json
+// @Produce json
+// @Param data body LookupRequest true "Hashes to lookup"
+// @Success 200 {object} LookupResponse
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/lookup/ [post]
+func (r resource) bulkLookup(c echo.Context) error {
+	var input LookupRequest
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(c.Request().Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	res, err := r.service.Lookup(c.Request().Context(), input.Hashes)
+	if err != nil {
+		if err == ErrInvalidHash {
+			return errors.BadRequest(err.Error())
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// @Summary Retrieve many file reports
+// @Description Returns the reports of up to 1000 files in a single request, hashes which do not exist are listed in `missing`.
+// @Tags File
+// @Accept json
+// @Produce json
+// @Param data body BatchRequest true "SHA256 hashes and optional fields projection"
+// @Success 200 {object} BatchResponse
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/batch/ [post]
+// @Security Bearer
+func (r resource) batch(c echo.Context) error {
+	var input BatchRequest
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(c.Request().Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	if len(input.Fields) > 0 && !areFieldsAllowed(input.Fields) {
+		return errors.BadRequest("field not allowed")
+	}
+
+	res, err := r.service.Batch(c.Request().Context(), input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
 // @Summary Searches files based on files' metadata
 // @Description Search files
 // @Tags File
@@ -335,6 +488,47 @@ func (r resource) search(c echo.Context) error {
 	return c.JSON(http.StatusOK, pages)
 }
 
+// @Summary Exports search results as MISP events
+// @Description Search files and returns a MISP event for each file of the requested page, at most 100 files per page.
+// @Description The events hold the file hashes and names, anti-virus detections and tags only, the network indicators
+// @Description and comments are exported per file by GET /files/{sha256}/misp/.
+// @Tags File
+// @Accept json
+// @Produce json
+// @Param data body FileSearchRequest true "Search query"
+// @Success 200 {object} misp.Events
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/search/misp/ [post]
+// @Security Bearer
+func (r resource) searchMISP(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var input FileSearchRequest
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(c.Request().Context()).Info(err)
+		return errors.BadRequest("")
+	}
+
+	if input.PerPage > mispMaxEvents {
+		return errors.BadRequest(
+			fmt.Sprintf("per_page must not exceed %d", mispMaxEvents))
+	}
+	if input.PerPage == 0 {
+		input.PerPage = mispMaxEvents
+	}
+	if input.Page == 0 {
+		input.Page = 1
+	}
+
+	events, err := r.service.SearchMISP(ctx, input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, events)
+}
+
 // @Summary Returns a paginated list of strings
 // @Description List strings of a file.
 // @Tags File
@@ -377,6 +571,78 @@ func (r resource) strings(c echo.Context) error {
 	return c.JSON(http.StatusOK, pages)
 }
 
+// @Summary Network indicators of compromise.
+// @Description Returns the deduplicated domains, IPs and URLs found in the strings of a file and its default behavior report.
+// @Tags File
+// @Produce json,plain
+// @Param sha256 path string true "File SHA256"
+// @Param format query string false "Output format: json (default), csv or text"
+// @Param type query string false "Comma separated list of indicator types: url, domain, ipv4, ipv6"
+// @Success 200 {object} ioc.Response
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/{sha256}/iocs/ [get]
+func (r resource) iocs(c echo.Context) error {
+	format := c.QueryParam("format")
+	contentType, err := ioc.ContentType(format)
+	if err != nil {
+		return errors.BadRequest(err.Error())
+	}
+
+	types, err := ioc.ParseTypes(c.QueryParam("type"))
+	if err != nil {
+		return errors.BadRequest(err.Error())
+	}
+
+	iocs, err := r.service.IOCs(c.Request().Context(), c.Param("sha256"), types)
+	if err != nil {
+		return err
+	}
+
+	// Encode before committing to a status code so an encoding failure is
+	// still reported as an error response.
+	var buf bytes.Buffer
+	if err = ioc.Write(&buf, format, iocs); err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
+
+// @Summary STIX 2.1 bundle of a file report
+// @Description Returns a STIX 2.1 bundle with the file, its anti-virus analyses, network indicators and ATT&CK techniques.
+// @Tags File
+// @Produce json
+// @Param sha256 path string true "File SHA256"
+// @Success 200 {object} stix.Bundle
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/{sha256}/stix/ [get]
+func (r resource) stix(c echo.Context) error {
+	bundle, err := r.service.STIX(c.Request().Context(), c.Param("sha256"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, bundle)
+}
+
+// @Summary MISP event of a file report
+// @Description Returns a MISP event with the file hashes and names, anti-virus detections, network indicators and comments.
+// @Tags File
+// @Produce json
+// @Param sha256 path string true "File SHA256"
+// @Success 200 {object} misp.Event
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/{sha256}/misp/ [get]
+func (r resource) misp(c echo.Context) error {
+	event, err := r.service.MISP(c.Request().Context(), c.Param("sha256"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, event)
+}
+
 // @Summary File summary and metadata
 // @Description File metadata returned in the summary view of a file.
 // @Tags File
@@ -472,6 +738,137 @@ func (r resource) unlike(c echo.Context) error {
 	}{"ok", http.StatusOK})
 }
 
+// @Summary Vote for a file verdict
+// @Description Gives the verdict of the logged in user on a file, voting again
+// @Description replaces the previous vote. Returns the community verdict.
+// @Tags File
+// @Accept json
+// @Produce json
+// @Param sha256 path string true "File SHA256"
+// @Param data body VoteRequest true "Verdict and optional family name"
+// @Success 200 {object} entity.CommunityVerdict
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/{sha256}/vote/ [post]
+// @Security Bearer
+func (r resource) vote(c echo.Context) error {
+	var input VoteRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	community, err := r.service.Vote(ctx, c.Param("sha256"), input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, community)
+}
+
+// @Summary Remove a file verdict vote
+// @Description Removes the vote of the logged in user on a file. Returns the
+// @Description community verdict.
+// @Tags File
+// @Produce json
+// @Param sha256 path string true "File SHA256"
+// @Success 200 {object} entity.CommunityVerdict
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/{sha256}/unvote/ [post]
+// @Security Bearer
+func (r resource) unvote(c echo.Context) error {
+	ctx := c.Request().Context()
+	community, err := r.service.Unvote(ctx, c.Param("sha256"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, community)
+}
+
+// @Summary List the user tags of a file
+// @Description Returns the tags attached to a file by users.
+// @Tags File
+// @Produce json
+// @Param sha256 path string true "File SHA256"
+// @Success 200 {object} []entity.UserTag
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/{sha256}/tags/ [get]
+func (r resource) userTags(c echo.Context) error {
+	ctx := c.Request().Context()
+	tags, err := r.service.UserTags(ctx, c.Param("sha256"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tags)
+}
+
+// @Summary Tag a file
+// @Description Attaches tags to a file on behalf of the logged in user.
+// @Description Returns the user tags of the file.
+// @Tags File
+// @Accept json
+// @Produce json
+// @Param sha256 path string true "File SHA256"
+// @Param data body AddTagsRequest true "Tags to attach"
+// @Success 200 {object} []entity.UserTag
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/{sha256}/tags/ [post]
+// @Security Bearer
+func (r resource) addTags(c echo.Context) error {
+	var input AddTagsRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	tags, err := r.service.AddTags(ctx, c.Param("sha256"), input)
+	if err != nil {
+		switch err {
+		case ErrInvalidTag, ErrTooManyTags:
+			return errors.BadRequest(err.Error())
+		default:
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, tags)
+}
+
+// @Summary Remove a user tag from a file
+// @Description Detaches a tag from a file, only the user who attached it or
+// @Description an admin can remove it. Returns the user tags of the file.
+// @Tags File
+// @Produce json
+// @Param sha256 path string true "File SHA256"
+// @Param tag path string true "Tag"
+// @Success 200 {object} []entity.UserTag
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /files/{sha256}/tags/{tag}/ [delete]
+// @Security Bearer
+func (r resource) removeTag(c echo.Context) error {
+	ctx := c.Request().Context()
+	tags, err := r.service.RemoveTag(ctx, c.Param("sha256"), c.Param("tag"))
+	if err != nil {
+		if err == ErrTagNotOwned {
+			return errors.Forbidden(err.Error())
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, tags)
+}
+
 // @Summary Rescan an existing file
 // @Description Rescan an existing file.
 // @Tags File
@@ -505,17 +902,27 @@ func (r resource) rescan(c echo.Context) error {
 }
 
 // @Summary Download many files
-// @Description Download a binary file. Files are in zip format and password protected.
+// @Description Download binary files. Files are in zip format and password protected.
+// @Description The archive includes a `manifest.json` listing the hashes which
+// @Description were included, missing or failed to download. Neutered formats are
+// @Description stored in a zip without encryption. The archive is generated
+// @Description deterministically, an interrupted download is resumed with a `Range`
+// @Description request. A sample failing to be fetched aborts the download.
 // @Tags File
 // @Produce mpfd
+// @Param format query string false "Packaging format, defaults to the user preference" Enums(zip, zipcrypto, xor, base64)
+// @Param X-Zip-Password header string false "Password of the zip formats"
+// @Param Range header string false "Single byte range of the archive"
+// @Param If-Range header string false "ETag of the archive the range applies to"
+// @Failure 400 {object} errors.ErrorResponse
 // @Failure 403 {object} errors.ErrorResponse
 // @Failure 404 {object} errors.ErrorResponse
+// @Failure 413 {object} errors.ErrorResponse
+// @Failure 416 {object} errors.ErrorResponse
 // @Failure 500 {object} errors.ErrorResponse
 // @Router /files/download/ [post]
 // @Security Bearer
 func (r resource) bulkDownload(c echo.Context) error {
-	ctx := c.Request().Context()
-
 	var input struct {
 		Hashes []string `json:"hashes"`
 	}
@@ -523,51 +930,151 @@ func (r resource) bulkDownload(c echo.Context) error {
 		r.logger.With(c.Request().Context()).Info(err)
 		return errors.BadRequest("")
 	}
+	return ServeBulkDownload(c, r.service, input.Hashes)
+}
+
+// ServeBulkDownload answers a request with the package of several samples,
+// the packaging options are read from the query parameters.
+func ServeBulkDownload(c echo.Context, service Service, hashes []string) error {
+	ctx := c.Request().Context()
+
+	opts, err := bindDownloadOptions(c)
+	if err != nil {
+		return err
+	}
 
-	size, wait, err := r.service.DownloadMany(ctx, input.Hashes, c.Response().Writer)
+	pkg, err := service.PackageMany(ctx, hashes, opts)
+	if err != nil {
+		switch err {
+		case ErrTooManyHashes:
+			return errors.BadRequest(err.Error())
+		case ErrDownloadTooLarge:
+			return errors.TooLargeEntity(err.Error())
+		default:
+			return downloadError(err)
+		}
+	}
 
-	if err == nil {
-		c.Response().Header().Set("Content-Length", fmt.Sprint(size))
-		c.Response().Header().Set("Content-Type", "application/zip")
-		c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fmt.Sprint(time.Now().Unix())+".zip"))
-		<-wait
+	// Ranges are served against the ETag of the archive to resume an
+	// interrupted download.
+	rng, err := writeDownloadHeaders(c, pkg)
+	if err != nil {
+		return err
 	}
-	return err
+	// Failures past this point end the response early.
+	_ = service.DownloadMany(ctx, pkg, rng, c.Response().Writer)
+	return nil
 }
 
 // @Summary Download a file
-// @Description Download a binary file. Files are in zip format and password protected.
+// @Description Download a binary file. Files are in zip format and password protected
+// @Description by default. `zipcrypto` uses the legacy zip encryption, `xor` and `base64`
+// @Description return the neutered sample and are reserved to admins. Packages are
+// @Description generated deterministically and support `Range` requests.
 // @Tags File
 // @Produce mpfd
 // @Param sha256 path string true "File SHA256"
+// @Param format query string false "Packaging format, defaults to the user preference" Enums(zip, zipcrypto, xor, base64)
+// @Param X-Zip-Password header string false "Password of the zip formats"
+// @Param Range header string false "Single byte range of the package"
+// @Param If-Range header string false "ETag of the package the range applies to"
+// @Failure 400 {object} errors.ErrorResponse
 // @Failure 403 {object} errors.ErrorResponse
 // @Failure 404 {object} errors.ErrorResponse
+// @Failure 416 {object} errors.ErrorResponse
 // @Failure 500 {object} errors.ErrorResponse
 // @Router /files/{sha256}/download/ [get]
 // @Security Bearer
 func (r resource) download(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	size, wait, err := r.service.DownloadRaw(ctx, c.Param("sha256"), c.Response().Writer)
+	opts, err := bindDownloadOptions(c)
+	if err != nil {
+		return err
+	}
+
+	pkg, err := r.service.Package(ctx, c.Param("sha256"), opts)
 	if err != nil {
 		switch err {
 		case ErrObjectNotFound:
 			return errors.NotFound("")
+		case ErrCorruptObject:
+			// The sample has been moved to quarantine.
+			return errors.NotFound(err.Error())
 		default:
-			return err
+			return downloadError(err)
 		}
 	}
 
-	fileName := c.Param("sha256")
-	zipFileName := fileName + ".zip"
-	zipFileSize := size + 164 + int64(len(fileName))*2
+	rng, err := writeDownloadHeaders(c, pkg)
+	if err != nil {
+		return err
+	}
+	// Failures past this point end the response early.
+	_ = r.service.DownloadRaw(ctx, pkg, rng, c.Response().Writer)
+	return nil
+}
 
-	c.Response().Header().Set("Content-Length", fmt.Sprint(zipFileSize))
-	c.Response().Header().Set("Content-Type", "application/zip")
-	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", zipFileName))
+// writeDownloadHeaders answers a download with the requested range of the
+// package if any, or the whole package, and returns the range.
+func writeDownloadHeaders(c echo.Context, pkg DownloadPackage) (
+	*ByteRange, error) {
+
+	header := c.Response().Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("ETag", pkg.ETag)
+
+	// A range is ignored when the package changed since If-Range.
+	req := c.Request()
+	rng, err := parseRange(req.Header.Get("Range"), pkg.Size)
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" &&
+		ifRange != pkg.ETag {
+		rng, err = nil, nil
+	}
+	if err != nil {
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", pkg.Size))
+		return nil, errors.RangeNotSatisfiable("")
+	}
 
-	<-wait
-	return err
+	header.Set("Content-Type", pkg.ContentType)
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", pkg.Name))
+	if rng == nil {
+		header.Set("Content-Length", fmt.Sprint(pkg.Size))
+		c.Response().WriteHeader(http.StatusOK)
+		return nil, nil
+	}
+	header.Set("Content-Length", fmt.Sprint(rng.End-rng.Start))
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.Start,
+		rng.End-1, pkg.Size))
+	c.Response().WriteHeader(http.StatusPartialContent)
+	return rng, nil
+}
+
+// bindDownloadOptions reads the packaging options of a download. The
+// password is read from a header, to keep it out of the access logs and of
+// the browser history.
+func bindDownloadOptions(c echo.Context) (DownloadOptions, error) {
+	var opts DownloadOptions
+	err := echo.QueryParamsBinder(c).
+		String("format", &opts.Format).
+		BindError()
+	if err != nil {
+		return opts, errors.BadRequest("")
+	}
+	opts.Password = c.Request().Header.Get(zipPasswordHeader)
+	return opts, nil
+}
+
+// downloadError maps the errors of the download options.
+func downloadError(err error) error {
+	switch err {
+	case ErrUnsupportedFormat, ErrPasswordNotSupported, ErrInvalidPassword:
+		return errors.BadRequest(err.Error())
+	case ErrFormatForbidden:
+		return errors.Forbidden(err.Error())
+	default:
+		return err
+	}
 }
 
 // @Summary Generate a pre-signed URL for downloading samples.
@@ -576,6 +1083,7 @@ func (r resource) download(c echo.Context) error {
 // @Produce json
 // @Param sha256 path string true "File SHA256"
 // @Success 200 {object} object{}
+// @Failure 400 {object} errors.ErrorResponse
 // @Failure 403 {object} errors.ErrorResponse
 // @Failure 404 {object} errors.ErrorResponse
 // @Failure 500 {object} errors.ErrorResponse
@@ -588,6 +1096,8 @@ func (r resource) generatePresignedURL(c echo.Context) error {
 		switch err {
 		case ErrObjectNotFound:
 			return errors.NotFound("")
+		case storage.ErrNotSupported:
+			return errors.BadRequest("pre-signed URLs are not supported by the storage backend")
 		default:
 			return err
 		}
@@ -766,6 +1276,22 @@ func (r resource) autocomplete(c echo.Context) error {
 				"packer",
 				"Search inside Detect it Easy output",
 			},
+			{
+				"technique",
+				"MITRE ATT&CK technique observed during the behavior scan. Example: T1055",
+			},
+			{
+				"community",
+				"Verdict voted by the community. Example:{malicious, suspicious, benign}",
+			},
+			{
+				"usertag",
+				"Tag attached to the file by a user. Example: apt28",
+			},
+			{
+				"collection",
+				"ID of a collection the file belongs to, quoted. Example: \"5f0c1d2e-8c4a-4b4e-9a51-2f3d6f1b7c90\"",
+			},
 			{
 				"tags",
 				"Search tags, the full list of supported tags is available in the doc page",
@@ -775,3 +1301,71 @@ func (r resource) autocomplete(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, fileAutocomplete)
 }
+
+// @Summary Verify the samples stored in the object storage
+// @Description Walk the samples bucket and report the samples which are corrupt,
+// @Description missing, or do not belong to any file. The verification runs in
+// @Description the background, its progress is returned. Admin only.
+// @Tags Admin
+// @Produce json
+// @Param deep query bool false "Download every sample to verify its checksum"
+// @Param quarantine query bool false "Move the corrupt samples to quarantine"
+// @Success 202 {object} entity.StorageVerification
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /admin/storage/verify/ [post]
+// @Security Bearer
+func (r resource) verifyStorage(c echo.Context) error {
+	var isAdmin bool
+	ctx := c.Request().Context()
+	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
+		isAdmin = user.IsAdmin()
+	}
+	if !isAdmin {
+		return errors.Forbidden("")
+	}
+
+	var req VerifyStorageRequest
+	err := echo.QueryParamsBinder(c).
+		Bool("deep", &req.Deep).
+		Bool("quarantine", &req.Quarantine).
+		BindError()
+	if err != nil {
+		return errors.BadRequest(err.Error())
+	}
+
+	v, err := r.service.VerifyStorage(ctx, req)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, v)
+}
+
+// @Summary Get the progress of the verification of the object storage
+// @Description Returns the progress of the last verification of the samples
+// @Description bucket, or its report once done. Admin only.
+// @Tags Admin
+// @Produce json
+// @Success 200 {object} entity.StorageVerification
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /admin/storage/verify/ [get]
+// @Security Bearer
+func (r resource) storageVerification(c echo.Context) error {
+	var isAdmin bool
+	ctx := c.Request().Context()
+	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
+		isAdmin = user.IsAdmin()
+	}
+	if !isAdmin {
+		return errors.Forbidden("")
+	}
+
+	v, err := r.service.StorageVerification(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, v)
+}
@@ -51,8 +51,16 @@ func (m middleware) VerifyHash(next echo.HandlerFunc) echo.HandlerFunc {
 
 		sha256 := strings.ToLower(c.Param("sha256"))
 		if !sha256reg.MatchString(sha256) {
-			m.logger.Errorf("failed to match sha256 regex for doc %v", sha256)
-			return e.BadRequest("invalid sha256 hash")
+			// MD5, SHA1 and SHA512 are transparently resolved to the SHA256.
+			resolved, err := m.service.Resolve(c.Request().Context(), sha256)
+			if err == ErrInvalidHash {
+				m.logger.Errorf("failed to match sha256 regex for doc %v", sha256)
+				return e.BadRequest("invalid sha256 hash")
+			}
+			if err != nil {
+				return err
+			}
+			sha256 = resolved
 		}
 
 		// Change the <sha256> path parameter to lower case. This will reflect on
@@ -7,6 +7,7 @@ package file
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -44,6 +45,33 @@ type Repository interface {
 	// MetaUI returns metadata required for the UI when loading an analysis report.
 	MetaUI(ctx context.Context, id string) (interface{}, error)
 	Search(ctx context.Context, input FileSearchRequest) (FileSearchResponse, error)
+	// GetMany returns the files with the specified IDs in a single round trip.
+	GetMany(ctx context.Context, ids []string, fields []string) ([]entity.File, error)
+	// LookupHashes returns the SHA256 of the files whose hash field matches
+	// one of the given hashes.
+	LookupHashes(ctx context.Context, field string, hashes []string) (
+		[]HashMatch, error)
+	// Sizes returns the size of the files whose SHA256 starts with a prefix
+	// keyed by their SHA256, the size is zero until the file has been
+	// scanned.
+	Sizes(ctx context.Context, prefix string) (map[string]int64, error)
+	// StorageVerification returns the verification of the object storage.
+	StorageVerification(ctx context.Context) (entity.StorageVerification, error)
+	// SaveStorageVerification creates or replaces the verification of the
+	// object storage.
+	SaveStorageVerification(ctx context.Context, v entity.StorageVerification) error
+	// Votes returns the number of votes of a file grouped by verdict and
+	// family.
+	Votes(ctx context.Context, id string) ([]VoteCount, error)
+	// AddUserTag attaches a user tag to a file, it returns false when the
+	// tag was already attached.
+	AddUserTag(ctx context.Context, tag entity.UserTag) (bool, error)
+	// GetUserTag returns a tag attached by a user to a file.
+	GetUserTag(ctx context.Context, id, tag string) (entity.UserTag, error)
+	// RemoveUserTag detaches a user tag from a file.
+	RemoveUserTag(ctx context.Context, id, tag string) error
+	// UserTags returns the tags attached by users to a file.
+	UserTags(ctx context.Context, id string) ([]entity.UserTag, error)
 }
 
 // repository persists files in database.
@@ -267,3 +295,222 @@ func (r repository) Search(ctx context.Context, input FileSearchRequest) (FileSe
 	resp.Results = resp.Results.([]interface{})
 	return resp, nil
 }
+
+// LookupHashes resolves hashes of a given type to the SHA256 of the matching
+// files using the secondary index of the hash field.
+func (r repository) LookupHashes(ctx context.Context, field string,
+	hashes []string) ([]HashMatch, error) {
+
+	var results interface{}
+
+	params := make(map[string]interface{}, 2)
+	params["docType"] = "file"
+	params["hashes"] = hashes
+
+	var statement string
+	if field == "sha256" {
+		// Files are keyed by their SHA256, no need for an index scan.
+		statement = "SELECT META(f).id AS hash, META(f).id AS sha256 FROM `" +
+			r.db.Bucket.Name() + "` f USE KEYS $hashes WHERE f.`type` = $docType"
+	} else {
+		statement = fmt.Sprintf(
+			"SELECT f.`%[1]s` AS hash, META(f).id AS sha256 FROM `%[2]s` f "+
+				"WHERE f.`%[1]s` IN $hashes AND f.`type` = $docType",
+			field, r.db.Bucket.Name())
+	}
+
+	err := r.db.Query(ctx, statement, params, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []HashMatch{}
+	b, _ := json.Marshal(results)
+	_ = json.Unmarshal(b, &matches)
+	return matches, nil
+}
+
+// GetMany reads the files with the specified IDs from the database. When
+// fields are provided, only those paths are retrieved, the SHA256 is always
+// included to identify the files.
+func (r repository) GetMany(ctx context.Context, ids []string,
+	fields []string) ([]entity.File, error) {
+
+	var res interface{}
+
+	params := make(map[string]interface{}, 2)
+	params["docType"] = "file"
+	params["keys"] = ids
+
+	projection := "f.*"
+	if len(fields) > 0 {
+		projection = "META(f).id AS sha256"
+		for _, field := range fields {
+			if field == "sha256" {
+				continue
+			}
+			projection += fmt.Sprintf(", f.`%s` AS `%s`",
+				strings.ReplaceAll(field, ".", "`.`"), field)
+		}
+	}
+	statement := fmt.Sprintf(
+		"SELECT %s FROM `%s` f USE KEYS $keys WHERE f.`type` = $docType",
+		projection, r.db.Bucket.Name())
+
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []entity.File{}
+	for _, row := range res.([]interface{}) {
+		if fields, ok := row.(map[string]interface{}); ok {
+			dbcontext.UnflattenFields(fields)
+		}
+		file := entity.File{}
+		b, _ := json.Marshal(row)
+		_ = json.Unmarshal(b, &file)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Sizes returns the size of the files whose SHA256 starts with a prefix
+// keyed by their SHA256.
+func (r repository) Sizes(ctx context.Context, prefix string) (
+	map[string]int64, error) {
+
+	var results interface{}
+
+	params := make(map[string]interface{}, 2)
+	params["docType"] = "file"
+	params["prefix"] = prefix + "%"
+
+	statement := "SELECT META(f).id AS sha256, f.size FROM `" +
+		r.db.Bucket.Name() + "` f WHERE META(f).id LIKE $prefix " +
+		"AND f.`type` = $docType"
+
+	err := r.db.Query(ctx, statement, params, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []struct {
+		SHA256 string `json:"sha256"`
+		Size   int64  `json:"size"`
+	}{}
+	b, _ := json.Marshal(results)
+	_ = json.Unmarshal(b, &rows)
+
+	sizes := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		sizes[row.SHA256] = row.Size
+	}
+	return sizes, nil
+}
+
+// StorageVerification reads the verification of the object storage from the
+// database.
+func (r repository) StorageVerification(ctx context.Context) (
+	entity.StorageVerification, error) {
+	var v entity.StorageVerification
+	err := r.db.Get(ctx, entity.StorageVerificationID, &v)
+	return v, err
+}
+
+// SaveStorageVerification saves the verification of the object storage in
+// the database.
+func (r repository) SaveStorageVerification(ctx context.Context,
+	v entity.StorageVerification) error {
+	v.Type = "verification"
+	err := r.db.Create(ctx, entity.StorageVerificationID, &v)
+	if errors.Is(err, dbcontext.ErrDocumentExists) {
+		return r.db.Update(ctx, entity.StorageVerificationID, &v)
+	}
+	return err
+}
+
+// Votes returns the number of votes of a file grouped by verdict and family,
+// including the votes cast or removed just before.
+func (r repository) Votes(ctx context.Context, id string) ([]VoteCount, error) {
+
+	var results interface{}
+
+	params := make(map[string]interface{}, 3)
+	params["docType"] = "edge"
+	params["kind"] = entity.EdgeVote
+	params["sha256"] = id
+
+	statement := "SELECT e.verdict, e.family, COUNT(*) AS `count` FROM `" +
+		r.db.Bucket.Name() + "` e WHERE e.`type` = $docType " +
+		"AND e.kind = $kind AND e.target = $sha256 " +
+		"GROUP BY e.verdict, e.family"
+
+	err := r.db.QueryConsistent(ctx, statement, params, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	votes := []VoteCount{}
+	b, _ := json.Marshal(results)
+	_ = json.Unmarshal(b, &votes)
+	return votes, nil
+}
+
+// AddUserTag saves a user tag and adds it to the user tags of the file.
+func (r repository) AddUserTag(ctx context.Context, tag entity.UserTag) (
+	bool, error) {
+
+	tag.Type = "usertag"
+	err := r.db.Create(ctx, tag.ID(), &tag)
+	if errors.Is(err, dbcontext.ErrDocumentExists) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, r.db.ArrayAddUnique(ctx, tag.SHA256, "user_tags", tag.Tag)
+}
+
+// GetUserTag reads a tag attached by a user to a file.
+func (r repository) GetUserTag(ctx context.Context, id, tag string) (
+	entity.UserTag, error) {
+
+	var userTag entity.UserTag
+	err := r.db.Get(ctx, entity.UserTagID(id, tag), &userTag)
+	return userTag, err
+}
+
+// RemoveUserTag deletes a user tag and removes it from the user tags of the
+// file.
+func (r repository) RemoveUserTag(ctx context.Context, id, tag string) error {
+	err := r.db.Delete(ctx, entity.UserTagID(id, tag))
+	if err != nil {
+		return err
+	}
+	return r.db.ArrayRemove(ctx, id, "user_tags", tag)
+}
+
+// UserTags returns the tags attached by users to a file, oldest first.
+func (r repository) UserTags(ctx context.Context, id string) (
+	[]entity.UserTag, error) {
+
+	var results interface{}
+
+	params := make(map[string]interface{}, 2)
+	params["docType"] = "usertag"
+	params["sha256"] = id
+
+	statement := "SELECT t.* FROM `" + r.db.Bucket.Name() + "` t " +
+		"WHERE t.`type` = $docType AND t.sha256 = $sha256 ORDER BY t.ts"
+
+	err := r.db.Query(ctx, statement, params, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []entity.UserTag{}
+	b, _ := json.Marshal(results)
+	_ = json.Unmarshal(b, &tags)
+	return tags, nil
+}
@@ -9,17 +9,32 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/saferwall/saferwall-api/internal/activity"
+	"github.com/saferwall/saferwall-api/internal/archive"
+	"github.com/saferwall/saferwall-api/internal/behavior"
 	"github.com/saferwall/saferwall-api/internal/comment"
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
 	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/ioc"
+	"github.com/saferwall/saferwall-api/internal/misp"
+	"github.com/saferwall/saferwall-api/internal/notification"
+	"github.com/saferwall/saferwall-api/internal/org"
+	"github.com/saferwall/saferwall-api/internal/stix"
+	"github.com/saferwall/saferwall-api/internal/storage"
 	"github.com/saferwall/saferwall-api/internal/user"
 	"github.com/saferwall/saferwall-api/pkg/log"
-	"github.com/yeka/zip"
+	"github.com/saferwall/saferwall-api/pkg/markdown"
 )
 
 var (
@@ -27,10 +42,134 @@ var (
 	ErrDocumentNotFound = "document not found"
 	// ErrObjectNotFound is returned when an object does not exist in Obj storage.
 	ErrObjectNotFound = errors.New("object not found")
+	// ErrInvalidHash is returned when a hash is not a CRC32, MD5, SHA1,
+	// SHA256 or SHA512.
+	ErrInvalidHash = errors.New("invalid hash")
+	// ErrTooManyHashes is returned when a bulk download requests more
+	// samples than allowed.
+	ErrTooManyHashes = errors.New("too many hashes requested")
+	// ErrDownloadTooLarge is returned when the samples of a bulk download
+	// exceed the allowed total size.
+	ErrDownloadTooLarge = errors.New("requested samples exceed the maximum download size")
+	// ErrRangeNotSatisfiable is returned when a requested range lies past
+	// the end of a download.
+	ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+	// ErrUnsupportedFormat is returned when a download packaging format is
+	// unknown.
+	ErrUnsupportedFormat = errors.New("unsupported download format")
+	// ErrFormatForbidden is returned when a non admin user requests a
+	// neutered download format.
+	ErrFormatForbidden = errors.New("download format reserved to admins")
+	// ErrInvalidPassword is returned when a zip password is too long.
+	ErrInvalidPassword = errors.New("zip password is too long")
+	// ErrPasswordNotSupported is returned when a password is given for a
+	// download format which is not password protected.
+	ErrPasswordNotSupported = errors.New("password is only supported by the zip formats")
+	// ErrCorruptObject is returned when a sample does not match its SHA256,
+	// the sample is then moved to quarantine.
+	ErrCorruptObject = errors.New("sample failed its integrity check")
+	// ErrInvalidTag is returned when a user tag has unsupported characters.
+	ErrInvalidTag = errors.New(
+		"tags are made of lower case letters, digits, '.', '_' and '-'")
+	// ErrTooManyTags is returned when a file has too many user tags.
+	ErrTooManyTags = errors.New("too many user tags on the file")
+	// ErrTagNotOwned is returned when removing a tag attached by another
+	// user.
+	ErrTagNotOwned = errors.New("tag attached by another user")
 	// file upload timeout in seconds.
 	fileUploadTimeout = time.Duration(time.Second * 30)
+	// maximum number of comments included in a MISP event.
+	mispMaxComments = 100
+	// time after which a verification of the storage which made no
+	// progress is considered stopped and can be started again.
+	verificationTimeout = time.Hour
 )
 
+const (
+	// metadata key holding the checksum of the samples in the object storage.
+	metaSHA256 = "sha256"
+	// name of the archive entry listing the outcome of a bulk download.
+	bulkDownloadManifest = "manifest.json"
+	// maximum length of the per-request zip passwords.
+	maxZipPasswordLen = 128
+	// bulk download limits used when not configured.
+	defaultBulkMaxHashes = 100
+	defaultBulkMaxSize   = 512 * 1024 * 1024
+	defaultBulkWorkers   = 4
+	// maximum number of findings listed in a storage verification.
+	maxVerificationItems = 10000
+)
+
+// Download packaging formats.
+const (
+	// FormatZip is an AES-256 encrypted zip, the default format.
+	FormatZip = "zip"
+	// FormatZipCrypto is a zip using the legacy ZipCrypto encryption, for
+	// the tools which can't open AES zips.
+	FormatZipCrypto = "zipcrypto"
+	// FormatXOR is the raw sample XORed with a single byte key, admins only.
+	FormatXOR = "xor"
+	// FormatBase64 is the raw sample encoded in base64, admins only.
+	FormatBase64 = "base64"
+)
+
+// DownloadOptions represents how samples are packaged for download.
+type DownloadOptions struct {
+	// Format of the package, defaults to the preference of the user or to
+	// an AES-256 zip.
+	Format string
+	// Password of the zip formats, defaults to the samples zip password.
+	Password string
+}
+
+// DownloadPackage describes one or many samples packaged for download.
+// Packages are generated deterministically, so that any part of them can
+// be served again.
+type DownloadPackage struct {
+	Name        string
+	ContentType string
+	// Size is the exact size of the package.
+	Size int64
+	// ETag identifies the content of the package.
+	ETag string
+
+	opts     DownloadOptions
+	sha256   string
+	samples  []storage.ObjectInfo
+	manifest BulkDownloadManifest
+}
+
+// ByteRange is a range of bytes of a package, End is excluded.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// BulkDownloadLimits represents the limits of a bulk download, zero values
+// fall back to the defaults.
+type BulkDownloadLimits struct {
+	// Maximum number of hashes per request.
+	MaxHashes int
+	// Maximum total size of the samples in bytes.
+	MaxSize int64
+	// Number of samples fetched concurrently.
+	Workers int
+}
+
+// BulkDownloadManifest lists the outcome of every hash of a bulk download,
+// it is added to the archive as `manifest.json`.
+type BulkDownloadManifest struct {
+	Included []string              `json:"included"`
+	Missing  []string              `json:"missing"`
+	Failed   []BulkDownloadFailure `json:"failed"`
+}
+
+// BulkDownloadFailure describes a sample which could not be downloaded.
+type BulkDownloadFailure struct {
+	SHA256 string `json:"sha256"`
+	Reason string `json:"reason"`
+}
+
 // Service encapsulates use case logic for files.
 type Service interface {
 	Get(ctx context.Context, id string, fields []string) (File, error)
@@ -44,6 +183,11 @@ type Service interface {
 	Summary(ctx context.Context, id string) (interface{}, error)
 	Like(ctx context.Context, id string) error
 	Unlike(ctx context.Context, id string) error
+	Vote(ctx context.Context, id string, input VoteRequest) (entity.CommunityVerdict, error)
+	Unvote(ctx context.Context, id string) (entity.CommunityVerdict, error)
+	UserTags(ctx context.Context, id string) ([]entity.UserTag, error)
+	AddTags(ctx context.Context, id string, input AddTagsRequest) ([]entity.UserTag, error)
+	RemoveTag(ctx context.Context, id, tag string) ([]entity.UserTag, error)
 	ReScan(ctx context.Context, id string, input FileScanRequest) error
 	Comments(ctx context.Context, id string, offset, limit int) (
 		[]interface{}, error)
@@ -51,20 +195,46 @@ type Service interface {
 	CountComments(ctx context.Context, id string) (int, error)
 	Strings(ctx context.Context, id string, queryString string, offset, limit int) (interface{}, error)
 	Download(ctx context.Context, id string, zipFile *string) error
-	DownloadRaw(ctx context.Context, id string, file io.Writer) (int64, chan struct{}, error)
-	DownloadMany(ctx context.Context, ids []string, file io.Writer) (int64, chan struct{}, error)
+	Package(ctx context.Context, id string, opts DownloadOptions) (DownloadPackage, error)
+	PackageMany(ctx context.Context, ids []string, opts DownloadOptions) (DownloadPackage, error)
+	DownloadRaw(ctx context.Context, pkg DownloadPackage, rng *ByteRange, file io.Writer) error
+	DownloadMany(ctx context.Context, pkg DownloadPackage, rng *ByteRange, file io.Writer) error
 	GeneratePresignedURL(ctx context.Context, id string) (string, error)
 	MetaUI(ctx context.Context, id string) (interface{}, error)
 	Search(ctx context.Context, input FileSearchRequest) (FileSearchResponse, error)
+	IOCs(ctx context.Context, id string, types []ioc.Type) ([]ioc.IOC, error)
+	STIX(ctx context.Context, id string) (stix.Bundle, error)
+	MISP(ctx context.Context, id string) (misp.Event, error)
+	SearchMISP(ctx context.Context, input FileSearchRequest) (misp.Events, error)
+	Lookup(ctx context.Context, hashes []string) (LookupResponse, error)
+	Batch(ctx context.Context, input BatchRequest) (BatchResponse, error)
+	Resolve(ctx context.Context, hash string) (string, error)
+	VerifyStorage(ctx context.Context, req VerifyStorageRequest) (entity.StorageVerification, error)
+	StorageVerification(ctx context.Context) (entity.StorageVerification, error)
 }
 
 type UploadDownloader interface {
 	Upload(ctx context.Context, bucket, key string, file io.Reader) error
+	UploadWithMetadata(ctx context.Context, bucket, key string, file io.Reader, metadata map[string]string) error
 	Download(ctx context.Context, bucket, key string, file io.Writer) error
-	DownloadWithSize(ctx context.Context, bucket, key string, file io.Writer, done func()) (int64, error)
+	DownloadRange(ctx context.Context, bucket, key string, file io.Writer, offset, length int64) error
+	DownloadWithSize(ctx context.Context, bucket, key string, file io.Writer, done func(error)) (int64, error)
 	GetFileSize(ctx context.Context, bucket, key string, done func()) (int64, error)
 	Exists(ctx context.Context, bucket, key string) (bool, error)
 	GeneratePresignedURL(ctx context.Context, bucket, key string) (string, error)
+	Delete(ctx context.Context, bucket, key string) error
+	List(ctx context.Context, bucket, prefix string) ([]storage.ObjectInfo, error)
+	Stat(ctx context.Context, bucket, key string) (storage.ObjectInfo, error)
+}
+
+// VerifyStorageRequest represents a request to verify the samples stored in
+// the object storage.
+type VerifyStorageRequest struct {
+	// Deep downloads every sample to verify its content, otherwise only the
+	// sizes and the checksum metadata are compared.
+	Deep bool `json:"deep"`
+	// Quarantine moves the corrupt samples to quarantine.
+	Quarantine bool `json:"quarantine"`
 }
 
 // File represents the data about a File.
@@ -115,10 +285,13 @@ type FileScanCfg struct {
 
 // CreateFileRequest represents a file creation request.
 type CreateFileRequest struct {
-	src      io.Reader
-	filename string
-	geoip    string
-	scanCfg  FileScanRequest
+	src        io.Reader
+	filename   string
+	geoip      string
+	scanCfg    FileScanRequest
+	visibility string
+	org        string
+	comment    string
 }
 
 // UpdateUserRequest represents a File update request.
@@ -160,6 +333,64 @@ type FileSearchResponse struct {
 	TotalHits uint64
 }
 
+// BatchRequest represents a request to retrieve many file reports.
+type BatchRequest struct {
+	Hashes []string `json:"hashes" validate:"required,min=1,max=1000,dive,len=64,hexadecimal"`
+	// Fields optionally restricts the reports to the given paths.
+	Fields []string `json:"fields" validate:"omitempty,max=50"`
+}
+
+// BatchResponse represents the reports of a batch retrieval.
+type BatchResponse struct {
+	Files []File `json:"files"`
+	// Missing lists the hashes which do not exist.
+	Missing []string `json:"missing"`
+}
+
+// LookupRequest represents a request to resolve many hashes.
+type LookupRequest struct {
+	Hashes []string `json:"hashes" validate:"required,min=1,max=1000"`
+}
+
+// HashMatch represents a file whose hash matched a lookup.
+type HashMatch struct {
+	Hash   string `json:"hash"`
+	SHA256 string `json:"sha256"`
+}
+
+// LookupResult represents the files matching a hash. CRC32 checksums may
+// match more than one file.
+type LookupResult struct {
+	Hash   string   `json:"hash"`
+	Type   string   `json:"type"`
+	SHA256 []string `json:"sha256"`
+}
+
+// LookupResponse represents the result of a hash lookup.
+type LookupResponse struct {
+	Results []LookupResult `json:"results"`
+	// Missing lists the hashes which did not match any file.
+	Missing []string `json:"missing"`
+}
+
+// VoteRequest represents the verdict voted by a user for a file.
+type VoteRequest struct {
+	Verdict string `json:"verdict" validate:"required,oneof=malicious suspicious benign" example:"malicious"`
+	Family  string `json:"family" validate:"omitempty,max=64" example:"emotet"`
+}
+
+// AddTagsRequest represents tags attached by a user to a file.
+type AddTagsRequest struct {
+	Tags []string `json:"tags" validate:"required,min=1,max=10,dive,required,max=32" example:"apt28,phishing"`
+}
+
+// VoteCount represents the number of votes for a verdict and a family.
+type VoteCount struct {
+	Verdict string `json:"verdict"`
+	Family  string `json:"family"`
+	Count   int    `json:"count"`
+}
+
 // AutoCompleteEntry represents a file search autocomplete entry.
 type AutoCompleteEntry struct {
 	Query   string `json:"query"`
@@ -173,25 +404,46 @@ type FileSearchAutocomplete struct {
 }
 
 type service struct {
-	repo          Repository
-	logger        log.Logger
-	objSto        UploadDownloader
-	producer      Producer
-	topic         string
-	bucket        string
-	samplesZipPwd string
-	userSvc       user.Service
-	actSvc        activity.Service
-	comSvc        comment.Service
-	archiver      Archiver
-}
-
-// NewService creates a new File service.
+	repo             Repository
+	logger           log.Logger
+	objSto           UploadDownloader
+	producer         Producer
+	topic            string
+	bucket           string
+	quarantineBucket string
+	samplesZipPwd    string
+	etagKey          []byte
+	userSvc          user.Service
+	actSvc           activity.Service
+	comSvc           comment.Service
+	bhvSvc           behavior.Service
+	notifSvc         notification.Service
+	orgSvc           org.Service
+	archiver         Archiver
+	bulkLimits       BulkDownloadLimits
+}
+
+// NewService creates a new File service, secret keys the ETags of the
+// download packages.
 func NewService(repo Repository, logger log.Logger,
-	updown UploadDownloader, producer Producer, topic, bucket, samplesZipPwd string,
-	userSvc user.Service, actSvc activity.Service, commentSvc comment.Service, arch Archiver) Service {
-	return service{repo, logger, updown, producer, topic, bucket, samplesZipPwd,
-		userSvc, actSvc, commentSvc, arch}
+	updown UploadDownloader, producer Producer, topic, bucket, quarantineBucket,
+	samplesZipPwd, secret string, userSvc user.Service, actSvc activity.Service,
+	commentSvc comment.Service, bhvSvc behavior.Service,
+	notifSvc notification.Service, orgSvc org.Service, arch Archiver,
+	bulkLimits BulkDownloadLimits) Service {
+
+	if bulkLimits.MaxHashes <= 0 {
+		bulkLimits.MaxHashes = defaultBulkMaxHashes
+	}
+	if bulkLimits.MaxSize <= 0 {
+		bulkLimits.MaxSize = defaultBulkMaxSize
+	}
+	if bulkLimits.Workers <= 0 {
+		bulkLimits.Workers = defaultBulkWorkers
+	}
+	return service{repo, logger, updown, producer, topic, bucket, quarantineBucket,
+		samplesZipPwd, etagKey(secret), userSvc, actSvc, commentSvc, bhvSvc,
+		notifSvc, orgSvc, arch, bulkLimits}
 }
 
 // Get returns the File with the specified File ID.
@@ -214,13 +466,33 @@ func (s service) Create(ctx context.Context, req CreateFileRequest) (
 	}
 
 	sha256 := hash(fileContent)
+	now := time.Now().Unix()
+
+	// Get the source of the HTTP request from the ctx.
+	source, _ := ctx.Value(entity.SourceKey).(string)
+
+	// The metadata of a private submission is only kept in the organization,
+	// the upload is rejected when the user is not one of its members.
+	private := req.visibility == entity.VisibilityOrg
+	if private {
+		if err = s.orgSvc.Submit(ctx, entity.OrgSubmission{
+			Org:       req.org,
+			SHA256:    sha256,
+			Filename:  req.filename,
+			Source:    source,
+			Country:   req.geoip,
+			Comment:   req.comment,
+			Timestamp: now,
+		}); err != nil {
+			return File{}, err
+		}
+	}
+
 	file, err := s.Get(ctx, sha256, nil)
 	if err != nil && err.Error() != ErrDocumentNotFound {
 		return File{}, err
 	}
 
-	now := time.Now().Unix()
-
 	// When a new file has been uploaded, we create a new doc in the db.
 	if err != nil && err.Error() == ErrDocumentNotFound {
 
@@ -228,7 +500,9 @@ func (s service) Create(ctx context.Context, req CreateFileRequest) (
 			existsCtx, cancelExistsFn := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancelExistsFn()
 
-			if ok, _ := s.objSto.Exists(existsCtx, s.bucket, sha256); ok {
+			// A previous upload might have been truncated, the upload is
+			// only skipped when the stored sample is intact.
+			if s.isIntact(existsCtx, sha256, int64(len(fileContent))) {
 				return
 			}
 
@@ -242,7 +516,7 @@ func (s service) Create(ctx context.Context, req CreateFileRequest) (
 				// Ensure the context is canceled to prevent leaking.
 				defer cancelUploadFn()
 
-				err = s.objSto.Upload(uploadCtx, s.bucket, sha256, bytes.NewReader(fileContent))
+				err = s.uploadSample(uploadCtx, sha256, fileContent)
 				if err == nil {
 					break
 				}
@@ -274,15 +548,15 @@ func (s service) Create(ctx context.Context, req CreateFileRequest) (
 
 		}()
 
-		// Get the source of the HTTP request from the ctx.
-		source, _ := ctx.Value(entity.SourceKey).(string)
-
-		// Create a new submission.
-		submission := entity.Submission{
-			Timestamp: now,
-			Filename:  req.filename,
-			Source:    source,
-			Country:   req.geoip,
+		// Create a new submission, unless private.
+		submissions := file.Submissions
+		if !private {
+			submissions = append(submissions, entity.Submission{
+				Timestamp: now,
+				Filename:  req.filename,
+				Source:    source,
+				Country:   req.geoip,
+			})
 		}
 
 		// Create a new file.
@@ -291,7 +565,7 @@ func (s service) Create(ctx context.Context, req CreateFileRequest) (
 			SHA256:      sha256,
 			Type:        "file",
 			FirstSeen:   now,
-			Submissions: append(file.Submissions, submission),
+			Submissions: submissions,
 			Status:      entity.FileScanProgressQueued,
 		})
 		if err != nil {
@@ -305,28 +579,51 @@ func (s service) Create(ctx context.Context, req CreateFileRequest) (
 			return File{}, err
 		}
 
-		// Create a new `submit` activity.
-		if _, err = s.actSvc.Create(ctx, activity.CreateActivityRequest{
-			Kind:     "submit",
-			Username: user.Username,
-			Target:   sha256,
-			Source:   source,
-		}); err != nil {
-			return File{}, err
-		}
+		// A private submission shows neither in the activities nor in the
+		// submissions of the user.
+		if !private {
+			// Create a new `submit` activity.
+			if _, err = s.actSvc.Create(ctx, activity.CreateActivityRequest{
+				Kind:     "submit",
+				Username: user.Username,
+				Target:   sha256,
+				Source:   source,
+			}); err != nil {
+				return File{}, err
+			}
 
-		// Update user submissions.
-		newSubmission := entity.UserSubmission{
-			SHA256:    sha256,
-			Timestamp: now,
+			// Update user submissions.
+			newSubmission := entity.UserSubmission{
+				SHA256:    sha256,
+				Timestamp: now,
+			}
+			if err = s.userSvc.Submit(ctx, user.ID(), newSubmission); err != nil {
+				return File{}, err
+			}
 		}
-		if err = s.userSvc.Submit(ctx, user.ID(), newSubmission); err != nil {
+
+		// The uploader is notified once the scan finishes.
+		if err = s.notifSvc.WatchScan(ctx, user.ID(), sha256); err != nil {
 			return File{}, err
 		}
 
 		return s.Get(ctx, sha256, nil)
 
 	} else {
+		// Resubmitting a sample repairs its copy in the object storage when
+		// it is missing or corrupt.
+		go func() {
+			uploadCtx, cancelUploadFn := context.WithTimeout(context.Background(), fileUploadTimeout)
+			defer cancelUploadFn()
+
+			if s.isIntact(uploadCtx, sha256, int64(len(fileContent))) {
+				return
+			}
+			if err := s.uploadSample(uploadCtx, sha256, fileContent); err != nil {
+				s.logger.Error(err)
+			}
+		}()
+
 		// If not, we append this new submission to the file doc.
 		file.LastScanned = now
 		return file, nil
@@ -363,12 +660,20 @@ func (s service) Update(ctx context.Context, id string, req UpdateFileRequest) (
 	return file, nil
 }
 
-// Delete deletes the File with the specified ID.
+// Delete deletes the File with the specified ID, alongside the sample and the
+// behavior scans artifacts kept in the object storage. Blobs are removed
+// first so that a failed deletion can be retried.
 func (s service) Delete(ctx context.Context, id string) (File, error) {
 	file, err := s.Get(ctx, id, nil)
 	if err != nil {
 		return File{}, err
 	}
+	if err = s.objSto.Delete(ctx, s.bucket, id); err != nil {
+		return File{}, err
+	}
+	if err = s.bhvSvc.DeleteArtifacts(ctx, id); err != nil {
+		return File{}, err
+	}
 	if err = s.repo.Delete(ctx, id); err != nil {
 		return File{}, err
 	}
@@ -461,6 +766,165 @@ func (s service) Unlike(ctx context.Context, sha256 string) error {
 	return s.userSvc.Unlike(ctx, user.ID(), sha256)
 }
 
+// Vote records the verdict of the logged in user on a file, replacing their
+// previous vote, and returns the updated community verdict.
+func (s service) Vote(ctx context.Context, sha256 string, input VoteRequest) (
+	entity.CommunityVerdict, error) {
+
+	loggedInUser, _ := ctx.Value(entity.UserKey).(entity.User)
+	user, err := s.userSvc.Get(ctx, loggedInUser.ID())
+	if err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+
+	// A family name only makes sense for a file which is not benign.
+	family := strings.ToLower(strings.TrimSpace(input.Family))
+	if input.Verdict == entity.VerdictBenign {
+		family = ""
+	}
+
+	err = s.userSvc.Vote(ctx, user.ID(), entity.UserVote{
+		SHA256:    sha256,
+		Verdict:   input.Verdict,
+		Family:    family,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+
+	// Get the source of the HTTP request from the ctx.
+	source, _ := ctx.Value(entity.SourceKey).(string)
+
+	// Replace the `vote` activity, so that only the last one is shown.
+	if err = s.actSvc.DeleteWith(ctx, "vote", user.ID(), sha256); err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+	if _, err = s.actSvc.Create(ctx, activity.CreateActivityRequest{
+		Kind:     "vote",
+		Username: user.Username,
+		Target:   sha256,
+		Source:   source,
+	}); err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+
+	return s.updateCommunityVerdict(ctx, sha256)
+}
+
+// Unvote removes the verdict of the logged in user on a file and returns the
+// updated community verdict.
+func (s service) Unvote(ctx context.Context, sha256 string) (
+	entity.CommunityVerdict, error) {
+
+	loggedInUser, _ := ctx.Value(entity.UserKey).(entity.User)
+	user, err := s.userSvc.Get(ctx, loggedInUser.ID())
+	if err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+
+	if err = s.actSvc.DeleteWith(ctx, "vote", user.ID(), sha256); err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+	if err = s.userSvc.Unvote(ctx, user.ID(), sha256); err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+
+	return s.updateCommunityVerdict(ctx, sha256)
+}
+
+// updateCommunityVerdict recomputes the community verdict of a file from
+// the votes. It is computed from scratch every time, once the indexes
+// include the vote just cast or removed, so that concurrent votes are
+// reconciled by the next one.
+func (s service) updateCommunityVerdict(ctx context.Context, sha256 string) (
+	entity.CommunityVerdict, error) {
+
+	votes, err := s.repo.Votes(ctx, sha256)
+	if err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+	verdict := communityVerdict(votes)
+	if err = s.repo.Patch(ctx, sha256, "community", verdict); err != nil {
+		return entity.CommunityVerdict{}, err
+	}
+	return verdict, nil
+}
+
+// UserTags returns the tags attached by users to a file.
+func (s service) UserTags(ctx context.Context, sha256 string) (
+	[]entity.UserTag, error) {
+	return s.repo.UserTags(ctx, sha256)
+}
+
+// AddTags attaches tags to a file on behalf of the logged in user, the tags
+// already attached are skipped. It returns the user tags of the file.
+func (s service) AddTags(ctx context.Context, sha256 string,
+	input AddTagsRequest) ([]entity.UserTag, error) {
+
+	loggedInUser, _ := ctx.Value(entity.UserKey).(entity.User)
+
+	current, err := s.repo.UserTags(ctx, sha256)
+	if err != nil {
+		return nil, err
+	}
+	attached := make(map[string]bool, len(current)+len(input.Tags))
+	for _, userTag := range current {
+		attached[userTag.Tag] = true
+	}
+
+	// Only the new tags count toward the limit.
+	tags := make([]string, 0, len(input.Tags))
+	for _, tag := range input.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !regUserTag.MatchString(tag) {
+			return nil, ErrInvalidTag
+		}
+		if !attached[tag] {
+			attached[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(current)+len(tags) > maxUserTags {
+		return nil, ErrTooManyTags
+	}
+
+	now := time.Now().Unix()
+	for _, tag := range tags {
+		_, err = s.repo.AddUserTag(ctx, entity.UserTag{
+			SHA256:    sha256,
+			Tag:       tag,
+			Username:  loggedInUser.ID(),
+			Timestamp: now,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.repo.UserTags(ctx, sha256)
+}
+
+// RemoveTag detaches a tag from a file, only the user who attached it or an
+// admin can remove it. It returns the user tags of the file.
+func (s service) RemoveTag(ctx context.Context, sha256, tag string) (
+	[]entity.UserTag, error) {
+
+	loggedInUser, _ := ctx.Value(entity.UserKey).(entity.User)
+
+	tag = strings.ToLower(tag)
+	userTag, err := s.repo.GetUserTag(ctx, sha256, tag)
+	if err != nil {
+		return nil, err
+	}
+	if userTag.Username != loggedInUser.ID() && !loggedInUser.IsAdmin() {
+		return nil, ErrTagNotOwned
+	}
+	if err = s.repo.RemoveUserTag(ctx, sha256, tag); err != nil {
+		return nil, err
+	}
+	return s.repo.UserTags(ctx, sha256)
+}
+
 func (s service) ReScan(ctx context.Context, sha256 string, input FileScanRequest) error {
 
 	// Serialize the msg to send to the orchestrator.
@@ -480,117 +944,389 @@ func (s service) ReScan(ctx context.Context, sha256 string, input FileScanReques
 	return nil
 }
 
-func (s service) DownloadMany(ctx context.Context, hashes []string, file io.Writer) (totalSize int64, wait chan struct{}, err error) {
-	var validHashes = make([]string, 0)
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	wait = make(chan struct{})
-	totalSize = int64(22)       // base header size
-	fixedOverhead := int64(142) // represents the fixed overhead per file in a ZIP
-	// archive's structure. This is an approximation of the combined size of the local
-	// file header and central directory entry for a file in a standard ZIP archive.
-
-	//TODO: switch to a worker pool.
-	for _, sha256 := range hashes {
-		wg.Add(1)
-		go func(key string) {
-			size, err := s.objSto.GetFileSize(ctx, s.bucket, key, func() {})
-			if err != nil {
-				s.logger.With(ctx).Errorf("failed to perform bulk download for object: %s: %v", key, err)
-			} else {
-				mu.Lock()
-				defer mu.Unlock()
-				// each file included adds: a fixedOverhead + it's size + it's file path length * 2
-				totalSize += fixedOverhead + size + int64(len(key))*2
-				validHashes = append(validHashes, key)
+// PackageMany plans a password protected zip archive of the samples
+// followed by a manifest listing the hashes included, missing or failed.
+// The limits are checked before anything is written.
+func (s service) PackageMany(ctx context.Context, hashes []string,
+	opts DownloadOptions) (pkg DownloadPackage, err error) {
+
+	opts, err = s.downloadOptions(ctx, opts)
+	if err != nil {
+		return pkg, err
+	}
+	if len(hashes) > s.bulkLimits.MaxHashes {
+		return pkg, ErrTooManyHashes
+	}
+
+	// The archive lists the samples in a stable order.
+	hashes = slices.Clone(hashes)
+	sort.Strings(hashes)
+	hashes = slices.Compact(hashes)
+
+	manifest := BulkDownloadManifest{
+		Included: []string{},
+		Missing:  []string{},
+		Failed:   []BulkDownloadFailure{},
+	}
+	infos := make([]storage.ObjectInfo, len(hashes))
+	errs := make([]error, len(hashes))
+	s.runBounded(len(hashes), func(i int) {
+		infos[i], errs[i] = s.statSample(ctx, hashes[i])
+	})
+
+	var samples []storage.ObjectInfo
+	var totalSize int64
+	for i, sha256 := range hashes {
+		switch {
+		case errs[i] == nil:
+			infos[i].Key = sha256
+			samples = append(samples, infos[i])
+			manifest.Included = append(manifest.Included, sha256)
+			totalSize += infos[i].Size
+		case errors.Is(errs[i], ErrObjectNotFound):
+			manifest.Missing = append(manifest.Missing, sha256)
+		default:
+			manifest.Failed = append(manifest.Failed,
+				BulkDownloadFailure{sha256, failureReason(errs[i])})
+		}
+	}
+	if totalSize > s.bulkLimits.MaxSize {
+		return pkg, ErrDownloadTooLarge
+	}
+
+	pkg = DownloadPackage{
+		Name:        fmt.Sprint(time.Now().Unix()) + ".zip",
+		ContentType: "application/zip",
+		Size:        archive.EndSize,
+		opts:        opts,
+		samples:     samples,
+		manifest:    manifest,
+	}
+	for _, info := range samples {
+		pkg.Size += archiveEntrySize(info.Key, info.Size, opts)
+	}
+	content, err := encodeManifest(manifest)
+	if err != nil {
+		return pkg, err
+	}
+	pkg.Size += archive.EntrySize(0, "", bulkDownloadManifest,
+		int64(len(content)))
+
+	pkg.ETag = bulkDownloadETag(s.etagKey, samples, content, opts)
+	return pkg, nil
+}
+
+// DownloadMany streams to file the bulk download planned by PackageMany, or
+// only the range rng of it when not nil. A sample which fails to be fetched
+// aborts the download, leaving the archive unterminated, as it would no
+// longer match its size and ETag.
+func (s service) DownloadMany(ctx context.Context, pkg DownloadPackage,
+	rng *ByteRange, file io.Writer) error {
+
+	err := s.writeArchive(ctx, file, pkg, rng)
+	if err != nil {
+		s.logger.With(ctx).Errorf("failed to perform bulk download: %v", err)
+	}
+	return err
+}
+
+// fetchResult holds a sample fetched from the object storage.
+type fetchResult struct {
+	content *bytes.Buffer
+	err     error
+}
+
+// writeArchive writes the samples followed by the manifest to a zip archive,
+// neutered formats are stored in a zip without encryption. Samples are
+// fetched concurrently and fully verified before being added to the
+// archive, a failed fetch stops the archive before its entry.
+func (s service) writeArchive(ctx context.Context, file io.Writer,
+	pkg DownloadPackage, rng *ByteRange) error {
+
+	// Only the requested range is written. The AES entries lying entirely
+	// before it are skipped without being fetched, as their records do not
+	// depend on their content.
+	samples := pkg.samples
+	rw := archive.NewRangeWriter(file, 0, math.MaxInt64)
+	skipped := 0
+	if rng != nil {
+		rw = archive.NewRangeWriter(file, rng.Start, rng.End)
+		var offset int64
+		for _, info := range samples {
+			offset += archiveEntrySize(info.Key, info.Size, pkg.opts)
+			if pkg.opts.Format != FormatZip || offset > rng.Start {
+				break
 			}
-			wg.Done()
-		}(sha256)
+			skipped++
+		}
+	}
+
+	// At most `Workers` samples are held in memory, a slot is released
+	// once its sample is written to the archive.
+	slots := make(chan struct{}, s.bulkLimits.Workers)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	results := make([]chan fetchResult, len(samples))
+	for i := range results {
+		results[i] = make(chan fetchResult, 1)
 	}
-	wg.Wait()
 	go func() {
-		zipCtx := zip.NewWriter(file)
-		for _, sha256 := range validHashes {
-			filePath := sha256
-			zipFileHeader := &zip.FileHeader{
-				Name:   filePath,
-				Method: zip.Store, // no compression
-			}
-			zipFileHeader.SetPassword(s.samplesZipPwd)
-			zipFileHeader.SetEncryptionMethod(zip.AES256Encryption)
-			zipWriteEnd, _err := zipCtx.CreateHeader(zipFileHeader)
-			if _err != nil {
-				return
-			}
-			downloadCtx, cancelFn := context.WithTimeout(
-				context.Background(), time.Duration(time.Second*30))
-			wait := make(chan struct{})
-			_, err := s.objSto.DownloadWithSize(downloadCtx, s.bucket, sha256, zipWriteEnd,
-				func() {
-					cancelFn()
-					close(wait)
-				},
-			)
-			if err == nil {
-				<-wait
-			} else {
-				s.logger.With(ctx).Error(err)
-				cancelFn()
+		for i := skipped; i < len(samples); i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
 				return
 			}
+			go func() {
+				content, err := s.fetchSample(ctx, samples[i])
+				results[i] <- fetchResult{content, err}
+			}()
 		}
-		zipCtx.Close()
-		close(wait)
 	}()
 
-	return totalSize, wait, nil
-}
+	aw := newArchiveWriter(rw, pkg.opts)
+	for i, info := range samples {
+		if i < skipped {
+			if err := aw.Skip(info.Key, info.Size); err != nil {
+				return rw.IgnoreDone(err)
+			}
+			continue
+		}
+		res := <-results[i]
+		<-slots
+		if res.err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", info.Key, res.err)
+		}
+
+		zipWriteEnd, err := createArchiveEntry(aw, info.Key, pkg.opts.Format)
+		if err != nil {
+			return rw.IgnoreDone(err)
+		}
+		if _, err = io.Copy(zipWriteEnd, res.content); err != nil {
+			return rw.IgnoreDone(err)
+		}
+		if err = zipWriteEnd.Close(); err != nil {
+			return rw.IgnoreDone(err)
+		}
+	}
 
-func (s service) DownloadRaw(ctx context.Context, sha256 string, file io.Writer) (size int64, wait chan struct{}, err error) {
-	wait = make(chan struct{})
-	found, err := s.objSto.Exists(ctx, s.bucket, sha256)
+	content, err := encodeManifest(pkg.manifest)
 	if err != nil {
-		s.logger.With(ctx).Error(err)
-		return
+		return err
+	}
+	w, err := aw.CreatePlain(bulkDownloadManifest)
+	if err != nil {
+		return rw.IgnoreDone(err)
+	}
+	if _, err = w.Write(content); err != nil {
+		return rw.IgnoreDone(err)
+	}
+	if err = w.Close(); err != nil {
+		return rw.IgnoreDone(err)
 	}
+	return rw.IgnoreDone(aw.Close())
+}
 
-	if !found {
-		return size, wait, ErrObjectNotFound
+// encodeManifest serializes the manifest of a bulk download.
+func encodeManifest(manifest BulkDownloadManifest) ([]byte, error) {
+	return json.MarshalIndent(manifest, "", "  ")
+}
+
+// fetchSample downloads a sample in memory and verifies its integrity.
+func (s service) fetchSample(ctx context.Context, info storage.ObjectInfo) (
+	*bytes.Buffer, error) {
+
+	downloadCtx, cancelFn := context.WithTimeout(ctx, time.Second*30)
+	defer cancelFn()
+
+	buf := bytes.NewBuffer(make([]byte, 0, info.Size))
+	cw := newChecksumWriter(buf)
+	err := s.objSto.Download(downloadCtx, s.bucket, info.Key, cw)
+	if err != nil {
+		return nil, err
 	}
+	if !s.verifyChecksum(info.Key, info.Size, cw) {
+		return nil, ErrCorruptObject
+	}
+	return buf, nil
+}
 
-	filePath := sha256
+// runBounded calls fn for every index in [0, n) using at most `Workers`
+// goroutines.
+func (s service) runBounded(n int, fn func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(s.bulkLimits.Workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
 
-	zipCtx := zip.NewWriter(file)
-	zipFileHeader := &zip.FileHeader{
-		Name:   filePath,
-		Method: zip.Store, // no compression
+// failureReason describes to the user why a sample could not be included in
+// a bulk download, without leaking internal errors.
+func failureReason(err error) string {
+	if errors.Is(err, ErrCorruptObject) {
+		return ErrCorruptObject.Error()
 	}
+	return "failed to retrieve the sample"
+}
 
-	zipFileHeader.SetPassword(s.samplesZipPwd)
-	zipFileHeader.SetEncryptionMethod(zip.AES256Encryption)
-	zipWriteEnd, err := zipCtx.CreateHeader(zipFileHeader)
+// Package describes a sample packaged as requested by opts.
+func (s service) Package(ctx context.Context, sha256 string,
+	opts DownloadOptions) (pkg DownloadPackage, err error) {
 
+	opts, err = s.downloadOptions(ctx, opts)
 	if err != nil {
-		return
+		return pkg, err
 	}
+	info, err := s.statSample(ctx, sha256)
+	if err != nil {
+		return pkg, err
+	}
+	pkg = newDownloadPackage(s.etagKey, sha256, info.Size, opts)
+	pkg.opts = opts
+	pkg.sha256 = sha256
+	pkg.samples = []storage.ObjectInfo{info}
+	return pkg, nil
+}
+
+// DownloadRaw streams to file the sample packaged by Package, or only the
+// range rng of the package when not nil. The integrity of the sample is
+// only verified when the whole package is requested.
+func (s service) DownloadRaw(ctx context.Context, pkg DownloadPackage,
+	rng *ByteRange, file io.Writer) error {
 
 	// Create a context with a timeout that will abort the download if it takes
 	// more than the passed in timeout.
 	downloadCtx, cancelFn := context.WithTimeout(
 		context.Background(), time.Duration(time.Second*30))
-	size, err = s.objSto.DownloadWithSize(downloadCtx, s.bucket, sha256, zipWriteEnd,
-		func() {
-			zipCtx.Close()
-			cancelFn()
-			close(wait)
-		},
-	)
+	defer cancelFn()
+
+	var err error
+	if rng == nil {
+		err = s.downloadPackage(downloadCtx, pkg, file)
+	} else {
+		err = s.downloadPackageRange(downloadCtx, pkg, *rng, file)
+	}
 	if err != nil {
 		s.logger.With(ctx).Error(err)
-		cancelFn()
-		return size, wait, err
 	}
-	return size, wait, nil
+	return err
+}
+
+// downloadPackage streams a whole package to file. The package is left
+// unterminated when the sample is corrupt, so that it can't be mistaken
+// for a complete one.
+func (s service) downloadPackage(ctx context.Context, pkg DownloadPackage,
+	file io.Writer) error {
+
+	// Neutered formats are streamed as is, the other ones in a zip.
+	var aw archive.Writer
+	var w io.WriteCloser
+	var err error
+	switch pkg.opts.Format {
+	case FormatXOR, FormatBase64:
+		w = neuter(file, pkg.opts.Format)
+	default:
+		aw = newArchiveWriter(file, pkg.opts)
+		w, err = createArchiveEntry(aw, pkg.sha256, pkg.opts.Format)
+		if err != nil {
+			return err
+		}
+	}
+
+	info := pkg.samples[0]
+	cw := newChecksumWriter(w)
+	err = s.objSto.Download(ctx, s.bucket, pkg.sha256, cw)
+	if err != nil {
+		return err
+	}
+	if !s.verifyChecksum(pkg.sha256, info.Size, cw) {
+		return ErrCorruptObject
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if aw != nil {
+		return aw.Close()
+	}
+	return nil
+}
+
+// downloadPackageRange streams a range of a package to file, reading from
+// the object storage only the part of the sample needed when possible.
+func (s service) downloadPackageRange(ctx context.Context,
+	pkg DownloadPackage, rng ByteRange, file io.Writer) error {
+
+	info := pkg.samples[0]
+	download := func(w io.Writer, offset, length int64) error {
+		return s.objSto.DownloadRange(ctx, s.bucket, pkg.sha256, w, offset,
+			length)
+	}
+
+	switch pkg.opts.Format {
+	case FormatXOR:
+		return download(neuter(file, FormatXOR), rng.Start, rng.End-rng.Start)
+	case FormatBase64:
+		// Every 3 bytes of the sample are encoded to 4 characters, the
+		// range is extended to whole groups.
+		start := rng.Start / 4 * 3
+		end := min((rng.End+3)/4*3, info.Size)
+		rw := archive.NewRangeWriter(file, rng.Start%4, rng.Start%4+rng.End-rng.Start)
+		w := neuter(rw, FormatBase64)
+		if err := download(w, start, end-start); err != nil {
+			return rw.IgnoreDone(err)
+		}
+		return rw.IgnoreDone(w.Close())
+	default:
+		enc, password := zipEncryption(pkg.opts)
+		return archive.WriteRange(file, enc, password, pkg.sha256, info.Size,
+			download, rng.Start, rng.End)
+	}
+}
+
+// downloadOptions validates the download options and fills in the defaults.
+func (s service) downloadOptions(ctx context.Context, opts DownloadOptions) (
+	DownloadOptions, error) {
+
+	loggedInUser, _ := ctx.Value(entity.UserKey).(entity.User)
+	if opts.Format == "" {
+		opts.Format = loggedInUser.DownloadFormat
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = FormatZip
+	case FormatZip, FormatZipCrypto:
+	case FormatXOR, FormatBase64:
+		if !loggedInUser.IsAdmin() {
+			return opts, ErrFormatForbidden
+		}
+		if opts.Password != "" {
+			return opts, ErrPasswordNotSupported
+		}
+		return opts, nil
+	default:
+		return opts, ErrUnsupportedFormat
+	}
+
+	if len(opts.Password) > maxZipPasswordLen {
+		return opts, ErrInvalidPassword
+	}
+	if opts.Password == "" {
+		opts.Password = s.samplesZipPwd
+	}
+	return opts, nil
 }
 
 func (s service) Download(ctx context.Context, sha256 string, zipFile *string) error {
@@ -601,22 +1337,21 @@ func (s service) Download(ctx context.Context, sha256 string, zipFile *string) e
 		context.Background(), time.Duration(time.Second*30))
 	defer cancelFn()
 
-	found, err := s.objSto.Exists(ctx, s.bucket, sha256)
+	info, err := s.statSample(ctx, sha256)
 	if err != nil {
-		s.logger.With(ctx).Error(err)
 		return err
 	}
 
-	if !found {
-		return ErrObjectNotFound
-	}
-
 	buf := new(bytes.Buffer)
-	err = s.objSto.Download(downloadCtx, s.bucket, sha256, buf)
+	cw := newChecksumWriter(buf)
+	err = s.objSto.Download(downloadCtx, s.bucket, sha256, cw)
 	if err != nil {
 		s.logger.With(ctx).Error(err)
 		return err
 	}
+	if !s.verifyChecksum(sha256, info.Size, cw) {
+		return ErrCorruptObject
+	}
 
 	*zipFile = filepath.Join("/tmp", sha256+".zip")
 	err = s.archiver.Archive(*zipFile, s.samplesZipPwd, buf)
@@ -627,6 +1362,245 @@ func (s service) Download(ctx context.Context, sha256 string, zipFile *string) e
 	return nil
 }
 
+// VerifyStorage starts the verification of the samples bucket in the
+// background and returns its progress. A verification already running is
+// returned as is.
+func (s service) VerifyStorage(ctx context.Context, req VerifyStorageRequest) (
+	entity.StorageVerification, error) {
+
+	v, err := s.repo.StorageVerification(ctx)
+	if err != nil && !errors.Is(err, dbcontext.ErrDocumentNotFound) {
+		return entity.StorageVerification{}, err
+	}
+	if err == nil && v.Status == entity.VerificationRunning &&
+		time.Since(time.Unix(v.UpdatedAt, 0)) < verificationTimeout {
+		return v, nil
+	}
+
+	now := time.Now().Unix()
+	requester, _ := ctx.Value(entity.UserKey).(entity.User)
+	v = entity.StorageVerification{
+		RequestedBy: requester.ID(),
+		Deep:        req.Deep,
+		Quarantine:  req.Quarantine,
+		Status:      entity.VerificationRunning,
+		Total:       len(storagePages()),
+		Corrupt:     []entity.CorruptSample{},
+		Missing:     []string{},
+		Orphaned:    []string{},
+		Failed:      []entity.StorageError{},
+		StartedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err = s.repo.SaveStorageVerification(ctx, v); err != nil {
+		return entity.StorageVerification{}, err
+	}
+
+	// The verification outlives the request.
+	go s.verifyStorage(context.Background(), v)
+
+	return v, nil
+}
+
+// StorageVerification returns the progress of the verification of the
+// samples bucket.
+func (s service) StorageVerification(ctx context.Context) (
+	entity.StorageVerification, error) {
+	return s.repo.StorageVerification(ctx)
+}
+
+// verifyStorage walks the samples bucket page by page, saving its progress
+// after each one.
+func (s service) verifyStorage(ctx context.Context,
+	v entity.StorageVerification) {
+
+	save := func() {
+		v.UpdatedAt = time.Now().Unix()
+		if err := s.repo.SaveStorageVerification(ctx, v); err != nil {
+			s.logger.Errorf("failed to save the storage verification: %v", err)
+		}
+	}
+
+	for i, prefix := range storagePages() {
+		v.Step = prefix
+		v.Done = i
+		save()
+		s.verifyPage(ctx, &v, prefix)
+	}
+
+	v.Status = entity.VerificationDone
+	v.Step = ""
+	v.Done = v.Total
+	save()
+}
+
+// verifyPage verifies the samples whose SHA256 starts with a prefix and adds
+// its findings to the verification. The errors are recorded per object so
+// that they do not stop the verification.
+func (s service) verifyPage(ctx context.Context,
+	v *entity.StorageVerification, prefix string) {
+
+	sizes, err := s.repo.Sizes(ctx, prefix)
+	if err != nil {
+		addFinding(v, &v.Failed, entity.StorageError{
+			Key: prefix + "*", Error: err.Error()})
+		return
+	}
+	objects, err := s.objSto.List(ctx, s.bucket, prefix)
+	if err != nil {
+		addFinding(v, &v.Failed, entity.StorageError{
+			Key: prefix + "*", Error: err.Error()})
+		return
+	}
+
+	seen := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		size, ok := sizes[obj.Key]
+		if !ok {
+			addFinding(v, &v.Orphaned, obj.Key)
+			continue
+		}
+		seen[obj.Key] = true
+		v.Checked++
+
+		reason, err := s.checkSample(ctx, obj, size, v.Deep)
+		if err != nil {
+			addFinding(v, &v.Failed, entity.StorageError{
+				Key: obj.Key, Error: err.Error()})
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		corrupt := entity.CorruptSample{SHA256: obj.Key, Reason: reason}
+		if v.Quarantine {
+			corrupt.Quarantined = s.quarantineSample(obj.Key, reason) == nil
+		}
+		addFinding(v, &v.Corrupt, corrupt)
+	}
+
+	missing := []string{}
+	for sha256 := range sizes {
+		if !seen[sha256] {
+			missing = append(missing, sha256)
+		}
+	}
+	sort.Strings(missing)
+	for _, sha256 := range missing {
+		addFinding(v, &v.Missing, sha256)
+	}
+}
+
+// checkSample verifies a sample against the size recorded in its file doc and
+// its checksum metadata. A deep check verifies its content as well. It
+// returns why the sample is corrupt, or an empty string.
+func (s service) checkSample(ctx context.Context, obj storage.ObjectInfo,
+	size int64, deep bool) (string, error) {
+
+	// The size is only known once the file has been scanned.
+	if size > 0 && obj.Size != size {
+		return "size mismatch", nil
+	}
+
+	info, err := s.objSto.Stat(ctx, s.bucket, obj.Key)
+	if err != nil {
+		return "", err
+	}
+	if checksum, ok := info.Metadata[metaSHA256]; ok && checksum != obj.Key {
+		return "checksum metadata mismatch", nil
+	}
+
+	if deep {
+		cw := newChecksumWriter(io.Discard)
+		if err = s.objSto.Download(ctx, s.bucket, obj.Key, cw); err != nil {
+			return "", err
+		}
+		if cw.Sum() != obj.Key {
+			return "checksum mismatch", nil
+		}
+	}
+	return "", nil
+}
+
+// statSample returns the metadata of a sample in the object storage. A sample
+// whose checksum metadata does not match its SHA256 is moved to quarantine.
+func (s service) statSample(ctx context.Context, sha256 string) (
+	storage.ObjectInfo, error) {
+
+	info, err := s.objSto.Stat(ctx, s.bucket, sha256)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return info, ErrObjectNotFound
+	}
+	if err != nil {
+		s.logger.With(ctx).Error(err)
+		return info, err
+	}
+	if checksum, ok := info.Metadata[metaSHA256]; ok && checksum != sha256 {
+		go s.quarantineSample(sha256, "checksum metadata mismatch")
+		return info, ErrCorruptObject
+	}
+	return info, nil
+}
+
+// isIntact checks whether a sample is stored with the expected size and
+// checksum metadata.
+func (s service) isIntact(ctx context.Context, sha256 string, size int64) bool {
+	info, err := s.objSto.Stat(ctx, s.bucket, sha256)
+	return err == nil && info.Size == size && info.Metadata[metaSHA256] == sha256
+}
+
+// uploadSample uploads a sample alongside its checksum.
+func (s service) uploadSample(ctx context.Context, sha256 string,
+	content []byte) error {
+	return s.objSto.UploadWithMetadata(ctx, s.bucket, sha256,
+		bytes.NewReader(content), map[string]string{metaSHA256: sha256})
+}
+
+// verifyChecksum checks a sample once it has been streamed through cw. A
+// sample whose content does not match its SHA256 is moved to quarantine,
+// incomplete transfers are only reported.
+func (s service) verifyChecksum(sha256 string, size int64,
+	cw *checksumWriter) bool {
+
+	if cw.n != size {
+		s.logger.Errorf("incomplete download of %s: %d out of %d bytes",
+			sha256, cw.n, size)
+		return false
+	}
+	if cw.Sum() != sha256 {
+		go s.quarantineSample(sha256, "checksum mismatch")
+		return false
+	}
+	return true
+}
+
+// quarantineSample moves a sample failing its integrity check to the
+// quarantine bucket, so that it is no longer served.
+func (s service) quarantineSample(sha256, reason string) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), fileUploadTimeout)
+	defer cancelFn()
+
+	buf := new(bytes.Buffer)
+	err := s.objSto.Download(ctx, s.bucket, sha256, buf)
+	if err == nil {
+		err = s.objSto.UploadWithMetadata(ctx, s.quarantineBucket, sha256, buf,
+			map[string]string{
+				"reason":         reason,
+				"quarantined_at": strconv.FormatInt(time.Now().Unix(), 10),
+			})
+	}
+	if err == nil {
+		err = s.objSto.Delete(ctx, s.bucket, sha256)
+	}
+	if err != nil {
+		s.logger.Errorf("failed to quarantine %s: %v", sha256, err)
+		return err
+	}
+
+	s.logger.Infof("sample %s moved to quarantine: %s", sha256, reason)
+	return nil
+}
+
 func (s service) Comments(ctx context.Context, id string, offset, limit int) (
 	[]interface{}, error) {
 
@@ -634,6 +1608,7 @@ func (s service) Comments(ctx context.Context, id string, offset, limit int) (
 	if err != nil {
 		return nil, err
 	}
+	markdown.RenderItems(result, "comment", "body_html")
 	return result, nil
 }
 
@@ -700,3 +1675,241 @@ func (s service) Search(ctx context.Context, input FileSearchRequest) (
 	}
 	return result, nil
 }
+
+// IOCs returns the deduplicated network indicators found in the strings of
+// a file and in its default behavior report.
+func (s service) IOCs(ctx context.Context, id string, types []ioc.Type) (
+	[]ioc.IOC, error) {
+
+	set := ioc.NewSet()
+
+	file, err := s.repo.Get(ctx, id, []string{"strings"})
+	if err != nil && !errors.Is(err, dbcontext.ErrSubDocNotFound) {
+		return nil, err
+	}
+	set.ExtractAll(ioc.SourceStrings, file.Strings)
+
+	file, err = s.repo.Get(ctx, id, []string{"default_behavior_report.id"})
+	if err != nil && !errors.Is(err, dbcontext.ErrSubDocNotFound) {
+		return nil, err
+	}
+	if behaviorID := defaultBehaviorID(file); behaviorID != "" {
+		iocs, err := s.bhvSvc.IOCs(ctx, behaviorID, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range iocs {
+			set.Add(i)
+		}
+	}
+
+	return set.List(types...), nil
+}
+
+// STIX returns a STIX 2.1 bundle describing a file, its network indicators
+// and the ATT&CK techniques observed in its default behavior report.
+func (s service) STIX(ctx context.Context, id string) (stix.Bundle, error) {
+	file, err := s.repo.Get(ctx, id, nil)
+	if err != nil {
+		return stix.Bundle{}, err
+	}
+
+	iocs, err := s.IOCs(ctx, id, nil)
+	if err != nil {
+		return stix.Bundle{}, err
+	}
+
+	var capabilities []entity.Capability
+	if behaviorID := defaultBehaviorID(file); behaviorID != "" {
+		bhv, err := s.bhvSvc.Get(ctx, behaviorID, []string{"capabilities"})
+		if err != nil && !errors.Is(err, dbcontext.ErrSubDocNotFound) {
+			return stix.Bundle{}, err
+		}
+		capabilities = bhv.Capabilities
+	}
+
+	return stix.NewBundle(file, iocs, capabilities), nil
+}
+
+// MISP returns a MISP event describing a file, its network indicators and
+// the comments made on it.
+func (s service) MISP(ctx context.Context, id string) (misp.Event, error) {
+	file, err := s.repo.Get(ctx, id, nil)
+	if err != nil {
+		return misp.Event{}, err
+	}
+
+	iocs, err := s.IOCs(ctx, id, nil)
+	if err != nil {
+		return misp.Event{}, err
+	}
+
+	results, err := s.repo.Comments(ctx, id, 0, mispMaxComments)
+	if err != nil {
+		return misp.Event{}, err
+	}
+
+	comments := make([]entity.Comment, 0, len(results))
+	for _, result := range results {
+		var c struct {
+			ID     string `json:"id"`
+			Body   string `json:"comment"`
+			Date   int64  `json:"date"`
+			Author struct {
+				Username string `json:"username"`
+			} `json:"author"`
+		}
+		b, _ := json.Marshal(result)
+		_ = json.Unmarshal(b, &c)
+
+		// Skip the removed comments, only their tombstone is left.
+		if c.Body == "" {
+			continue
+		}
+		comments = append(comments, entity.Comment{ID: c.ID, Body: c.Body,
+			Timestamp: c.Date, Username: c.Author.Username})
+	}
+
+	return misp.NewEvent(file, iocs, comments), nil
+}
+
+// SearchMISP returns a MISP event for every file matching a search query, in
+// the order of the search results. Events only describe the files, their
+// anti-virus detections and tags: network indicators and comments are not
+// included and are exported per file.
+func (s service) SearchMISP(ctx context.Context, input FileSearchRequest) (
+	misp.Events, error) {
+
+	result, err := s.repo.Search(ctx, input)
+	if err != nil {
+		return misp.Events{}, err
+	}
+
+	ids := []string{}
+	rows, _ := result.Results.([]interface{})
+	for _, row := range rows {
+		if fields, ok := row.(map[string]interface{}); ok {
+			if id, _ := fields["id"].(string); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	events := misp.Events{Response: []misp.Event{}}
+	if len(ids) == 0 {
+		return events, nil
+	}
+	files, err := s.repo.GetMany(ctx, ids, nil)
+	if err != nil {
+		return misp.Events{}, err
+	}
+	byID := make(map[string]entity.File, len(files))
+	for _, file := range files {
+		byID[strings.ToLower(file.SHA256)] = file
+	}
+	for _, id := range ids {
+		if file, ok := byID[strings.ToLower(id)]; ok {
+			events.Response = append(events.Response,
+				misp.NewEvent(file, nil, nil))
+		}
+	}
+	return events, nil
+}
+
+// Lookup resolves a list of CRC32, MD5, SHA1, SHA256 or SHA512 hashes to the
+// SHA256 of the matching files. Results keep the order of the input hashes.
+func (s service) Lookup(ctx context.Context, hashes []string) (
+	LookupResponse, error) {
+
+	byType := make(map[string][]string)
+	var ordered []string
+	for _, hash := range hashes {
+		hash = strings.ToLower(strings.TrimSpace(hash))
+		typ := hashType(hash)
+		if typ == "" {
+			return LookupResponse{}, ErrInvalidHash
+		}
+		if !slices.Contains(byType[typ], hash) {
+			byType[typ] = append(byType[typ], hash)
+			ordered = append(ordered, hash)
+		}
+	}
+
+	matches := make(map[string][]string)
+	for typ, hashes := range byType {
+		res, err := s.repo.LookupHashes(ctx, typ, hashes)
+		if err != nil {
+			return LookupResponse{}, err
+		}
+		for _, m := range res {
+			hash := strings.ToLower(m.Hash)
+			matches[hash] = append(matches[hash], m.SHA256)
+		}
+	}
+
+	resp := LookupResponse{Results: []LookupResult{}, Missing: []string{}}
+	for _, hash := range ordered {
+		sha256s, ok := matches[hash]
+		if !ok {
+			resp.Missing = append(resp.Missing, hash)
+			continue
+		}
+		slices.Sort(sha256s)
+		resp.Results = append(resp.Results, LookupResult{
+			Hash: hash, Type: hashType(hash), SHA256: sha256s})
+	}
+	return resp, nil
+}
+
+// Resolve returns the SHA256 of the file identified by a MD5, SHA1, SHA256
+// or SHA512 hash.
+func (s service) Resolve(ctx context.Context, hash string) (string, error) {
+	hash = strings.ToLower(hash)
+	typ := hashType(hash)
+	if typ == "" || typ == hashCRC32 {
+		return "", ErrInvalidHash
+	}
+	if typ == hashSHA256 {
+		return hash, nil
+	}
+
+	res, err := s.repo.LookupHashes(ctx, typ, []string{hash})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 0 {
+		return "", dbcontext.ErrDocumentNotFound
+	}
+	return res[0].SHA256, nil
+}
+
+// Batch returns the reports of many files in one round trip to the database.
+func (s service) Batch(ctx context.Context, input BatchRequest) (
+	BatchResponse, error) {
+
+	var ids []string
+	for _, hash := range input.Hashes {
+		id := strings.ToLower(hash)
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	files, err := s.repo.GetMany(ctx, ids, input.Fields)
+	if err != nil {
+		return BatchResponse{}, err
+	}
+
+	resp := BatchResponse{Files: []File{}, Missing: []string{}}
+	found := make(map[string]bool, len(files))
+	for _, file := range files {
+		found[strings.ToLower(file.SHA256)] = true
+		resp.Files = append(resp.Files, File{file})
+	}
+	for _, id := range ids {
+		if !found[id] {
+			resp.Missing = append(resp.Missing, id)
+		}
+	}
+	return resp, nil
+}
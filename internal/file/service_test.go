@@ -0,0 +1,260 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/storage"
+	"github.com/saferwall/saferwall-api/internal/storage/local"
+	"github.com/saferwall/saferwall-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	samplesBucket    = "samples"
+	quarantineBucket = "quarantine"
+)
+
+// verificationRepo keeps the file sizes and the storage verification in
+// memory, the other methods of the repository are not implemented.
+type verificationRepo struct {
+	Repository
+	sizes map[string]int64
+
+	mu           sync.Mutex
+	verification []byte
+}
+
+func (r *verificationRepo) Sizes(ctx context.Context, prefix string) (
+	map[string]int64, error) {
+	sizes := map[string]int64{}
+	for sha256, size := range r.sizes {
+		if strings.HasPrefix(sha256, prefix) {
+			sizes[sha256] = size
+		}
+	}
+	return sizes, nil
+}
+
+func (r *verificationRepo) StorageVerification(ctx context.Context) (
+	entity.StorageVerification, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var v entity.StorageVerification
+	if r.verification == nil {
+		return v, dbcontext.ErrDocumentNotFound
+	}
+	err := json.Unmarshal(r.verification, &v)
+	return v, err
+}
+
+func (r *verificationRepo) SaveStorageVerification(ctx context.Context,
+	v entity.StorageVerification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	r.verification, err = json.Marshal(v)
+	return err
+}
+
+// failingStat is a local storage failing to stat one of the objects.
+type failingStat struct {
+	local.Service
+	key string
+}
+
+func (s failingStat) Stat(ctx context.Context, bucket, key string) (
+	storage.ObjectInfo, error) {
+	if key == s.key {
+		return storage.ObjectInfo{}, errors.New("stat failed")
+	}
+	return s.Service.Stat(ctx, bucket, key)
+}
+
+func newVerificationService(t *testing.T) (service, *verificationRepo,
+	failingStat, string) {
+
+	root := t.TempDir()
+	sto, err := local.New(root, "secret", "http://localhost", time.Minute)
+	require.Nil(t, err)
+
+	logger, _ := log.NewForTest()
+	repo := &verificationRepo{sizes: map[string]int64{}}
+	objSto := failingStat{Service: sto}
+	svc := service{repo: repo, logger: logger, objSto: objSto,
+		bucket: samplesBucket, quarantineBucket: quarantineBucket}
+	return svc, repo, objSto, root
+}
+
+// addSample stores a sample and records its file in the repository.
+func addSample(t *testing.T, svc service, repo *verificationRepo,
+	content string) string {
+	sha256 := hash([]byte(content))
+	require.Nil(t, svc.uploadSample(context.Background(), sha256,
+		[]byte(content)))
+	repo.sizes[sha256] = int64(len(content))
+	return sha256
+}
+
+func waitVerification(t *testing.T, repo *verificationRepo) entity.StorageVerification {
+	var v entity.StorageVerification
+	require.Eventually(t, func() bool {
+		var err error
+		v, err = repo.StorageVerification(context.Background())
+		return err == nil && v.Status == entity.VerificationDone
+	}, 10*time.Second, 10*time.Millisecond)
+	return v
+}
+
+func TestVerifyStorage(t *testing.T) {
+	ctx := context.Background()
+	svc, repo, objSto, root := newVerificationService(t)
+
+	intact := addSample(t, svc, repo, "intact sample")
+	corrupt := addSample(t, svc, repo, "corrupt sample")
+	resized := addSample(t, svc, repo, "resized sample")
+	failing := addSample(t, svc, repo, "failing sample")
+	missing := hash([]byte("missing sample"))
+	repo.sizes[missing] = 14
+	orphan := hash([]byte("orphan sample"))
+	require.Nil(t, svc.uploadSample(ctx, orphan, []byte("orphan sample")))
+
+	// Flip the content of a sample on disk, keeping its size and metadata.
+	path := filepath.Join(root, samplesBucket, corrupt)
+	require.Nil(t, os.WriteFile(path, []byte("CORRUPT SAMPLE"), 0644))
+	repo.sizes[resized]++
+	objSto.key = failing
+	svc.objSto = objSto
+
+	v, err := svc.VerifyStorage(ctx, VerifyStorageRequest{
+		Deep: true, Quarantine: true})
+	require.Nil(t, err)
+	assert.Equal(t, entity.VerificationRunning, v.Status)
+	assert.Equal(t, 256, v.Total)
+
+	v = waitVerification(t, repo)
+	assert.Equal(t, v.Total, v.Done)
+	assert.Equal(t, 4, v.Checked)
+	assert.ElementsMatch(t, []entity.CorruptSample{
+		{SHA256: corrupt, Reason: "checksum mismatch", Quarantined: true},
+		{SHA256: resized, Reason: "size mismatch", Quarantined: true},
+	}, v.Corrupt)
+	assert.Equal(t, []string{missing}, v.Missing)
+	assert.Equal(t, []string{orphan}, v.Orphaned)
+	assert.Equal(t, []entity.StorageError{
+		{Key: failing, Error: "stat failed"}}, v.Failed)
+	assert.False(t, v.Truncated)
+
+	// The corrupt sample is moved to quarantine, with its content as is.
+	_, err = objSto.Stat(ctx, samplesBucket, corrupt)
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+	buf := &bytes.Buffer{}
+	require.Nil(t, objSto.Download(ctx, quarantineBucket, corrupt, buf))
+	assert.Equal(t, "CORRUPT SAMPLE", buf.String())
+	info, err := objSto.Stat(ctx, quarantineBucket, corrupt)
+	require.Nil(t, err)
+	assert.Equal(t, "checksum mismatch", info.Metadata["reason"])
+
+	exists, err := objSto.Exists(ctx, samplesBucket, intact)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestVerifyStorageShallow(t *testing.T) {
+	ctx := context.Background()
+	svc, repo, _, root := newVerificationService(t)
+
+	corrupt := addSample(t, svc, repo, "corrupt sample")
+	path := filepath.Join(root, samplesBucket, corrupt)
+	require.Nil(t, os.WriteFile(path, []byte("CORRUPT SAMPLE"), 0644))
+
+	// Only a deep verification reads the content of the samples.
+	_, err := svc.VerifyStorage(ctx, VerifyStorageRequest{Quarantine: true})
+	require.Nil(t, err)
+	v := waitVerification(t, repo)
+	assert.Equal(t, 1, v.Checked)
+	assert.Empty(t, v.Corrupt)
+
+	exists, err := svc.objSto.Exists(ctx, samplesBucket, corrupt)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestVerifyStorageRunning(t *testing.T) {
+	ctx := context.Background()
+	svc, repo, _, _ := newVerificationService(t)
+
+	running := entity.StorageVerification{
+		Status:    entity.VerificationRunning,
+		Total:     256,
+		Done:      10,
+		StartedAt: time.Now().Add(-time.Minute).Unix(),
+		UpdatedAt: time.Now().Unix(),
+	}
+	require.Nil(t, repo.SaveStorageVerification(ctx, running))
+
+	v, err := svc.VerifyStorage(ctx, VerifyStorageRequest{Deep: true})
+	require.Nil(t, err)
+	assert.Equal(t, running.StartedAt, v.StartedAt)
+	assert.Equal(t, 10, v.Done)
+	assert.False(t, v.Deep)
+}
+
+// tagRepo keeps the user tags of a file in memory.
+type tagRepo struct {
+	Repository
+	tags []entity.UserTag
+}
+
+func (r *tagRepo) UserTags(ctx context.Context, id string) (
+	[]entity.UserTag, error) {
+	return append([]entity.UserTag{}, r.tags...), nil
+}
+
+func (r *tagRepo) AddUserTag(ctx context.Context, tag entity.UserTag) (
+	bool, error) {
+	for _, t := range r.tags {
+		if t.Tag == tag.Tag {
+			return false, nil
+		}
+	}
+	r.tags = append(r.tags, tag)
+	return true, nil
+}
+
+func TestAddTagsLimit(t *testing.T) {
+	ctx := context.WithValue(context.Background(), entity.UserKey,
+		entity.User{Username: "mike"})
+	repo := &tagRepo{}
+	for i := 0; i < maxUserTags-1; i++ {
+		repo.tags = append(repo.tags, entity.UserTag{Tag: fmt.Sprintf("tag%d", i)})
+	}
+	svc := service{repo: repo}
+
+	// The tags already attached or repeated do not count toward the limit.
+	tags, err := svc.AddTags(ctx, "sha256", AddTagsRequest{
+		Tags: []string{"tag0", "apt28", "APT28", " apt28 "}})
+	require.Nil(t, err)
+	assert.Len(t, tags, maxUserTags)
+	_, err = svc.AddTags(ctx, "sha256", AddTagsRequest{
+		Tags: []string{"tag1", "apt28"}})
+	assert.Nil(t, err)
+
+	_, err = svc.AddTags(ctx, "sha256", AddTagsRequest{
+		Tags: []string{"phishing"}})
+	assert.Equal(t, ErrTooManyTags, err)
+}
@@ -5,14 +5,41 @@
 package file
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/saferwall/saferwall-api/internal/archive"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/storage"
+	"github.com/yeka/zip"
 )
 
 var (
 	regPathNotation = regexp.MustCompile(`^[\w.]+$`)
+	regHash         = regexp.MustCompile(`^[a-f0-9]+$`)
+	regCRC32        = regexp.MustCompile(`^0x[a-f0-9]{1,8}$`)
+	regUserTag      = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+)
+
+const (
+	// maxUserTags is the maximum number of tags users can attach to a file.
+	maxUserTags = 50
+)
+
+// Hash types supported by file lookups.
+const (
+	hashCRC32  = "crc32"
+	hashMD5    = "md5"
+	hashSHA1   = "sha1"
+	hashSHA256 = "sha256"
+	hashSHA512 = "sha512"
 )
 
 // areFieldsAllowed check if we are allowed to filter GET with fields
@@ -32,6 +59,232 @@ func hash(b []byte) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// checksumWriter computes the sha256 hash of the content written through it.
+type checksumWriter struct {
+	w io.Writer
+	h interface {
+		io.Writer
+		Sum(b []byte) []byte
+	}
+	n int64
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{w: w, h: sha256.New()}
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.h.Write(p[:n])
+	cw.n += int64(n)
+	return n, err
+}
+
+// Sum returns the hex encoded hash of the content written so far.
+func (cw *checksumWriter) Sum() string {
+	return hex.EncodeToString(cw.h.Sum(nil))
+}
+
+// xorKey is the key the samples are XORed with in the `xor` download format.
+const xorKey = 0xff
+
+// newDownloadPackage describes a sample of the given size once packaged.
+func newDownloadPackage(etagKey []byte, sha256 string, size int64,
+	opts DownloadOptions) DownloadPackage {
+	pkg := DownloadPackage{Size: encodedSize(size, opts.Format)}
+	switch opts.Format {
+	case FormatXOR:
+		pkg.Name, pkg.ContentType = sha256+".xor", "application/octet-stream"
+	case FormatBase64:
+		pkg.Name, pkg.ContentType = sha256+".b64", "text/plain"
+	default:
+		pkg.Name, pkg.ContentType = sha256+".zip", "application/zip"
+		pkg.Size = archiveEntrySize(sha256, size, opts) + archive.EndSize
+	}
+
+	// Packages are deterministic, their content only depends on the
+	// sample and on how it is packaged.
+	pkg.ETag = packageETag(etagKey, sha256+"|"+opts.Format+"|"+opts.Password)
+	return pkg
+}
+
+// etagKey derives the key of the ETags of the packages from the secret of
+// the server.
+func etagKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("download etag"))
+	return mac.Sum(nil)
+}
+
+// packageETag returns the ETag of a package given what its content depends
+// on. The ETag is keyed, as shared caches store it and the zip password it
+// depends on must not be brute-forced from it.
+func packageETag(key []byte, content string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return `"` + hex.EncodeToString(mac.Sum(nil))[:32] + `"`
+}
+
+// bulkDownloadETag identifies the archive of a bulk download, which only
+// depends on the samples, the manifest and how they are packaged. A corrupt
+// sample is quarantined once detected, the next archive lists it as missing
+// and gets another ETag.
+func bulkDownloadETag(etagKey []byte, samples []storage.ObjectInfo,
+	manifest []byte, opts DownloadOptions) string {
+
+	var b strings.Builder
+	b.WriteString(opts.Format + "|" + opts.Password + "|")
+	for _, info := range samples {
+		fmt.Fprintf(&b, "%s:%d|", info.Key, info.Size)
+	}
+	b.Write(manifest)
+	return packageETag(etagKey, b.String())
+}
+
+// encodedSize returns the size of a sample once encoded in format.
+func encodedSize(size int64, format string) int64 {
+	if format == FormatBase64 {
+		return int64(base64.StdEncoding.EncodedLen(int(size)))
+	}
+	return size
+}
+
+// archiveEntrySize returns the size a sample takes in a download archive.
+func archiveEntrySize(sha256 string, size int64, opts DownloadOptions) int64 {
+	enc, password := zipEncryption(opts)
+	return archive.EntrySize(enc, password, sha256,
+		encodedSize(size, opts.Format))
+}
+
+// zipEncryption returns how a download archive is encrypted, the neutered
+// formats are stored without encryption.
+func zipEncryption(opts DownloadOptions) (zip.EncryptionMethod, string) {
+	switch opts.Format {
+	case FormatZip:
+		return zip.AES256Encryption, opts.Password
+	case FormatZipCrypto:
+		return zip.StandardEncryption, opts.Password
+	default:
+		return 0, ""
+	}
+}
+
+// newArchiveWriter creates the zip writer of a download.
+func newArchiveWriter(w io.Writer, opts DownloadOptions) archive.Writer {
+	enc, password := zipEncryption(opts)
+	return archive.NewWriter(w, enc, password)
+}
+
+// createArchiveEntry adds an entry to a download archive for a sample
+// packaged in format. The entry must be closed once written.
+func createArchiveEntry(aw archive.Writer, name, format string) (
+	io.WriteCloser, error) {
+
+	entry, err := aw.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return entryWriter{neuter(entry, format), entry}, nil
+}
+
+// entryWriter closes the encoder of an entry before the entry itself.
+type entryWriter struct {
+	io.WriteCloser
+	entry io.Closer
+}
+
+func (w entryWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.entry.Close()
+}
+
+// neuter wraps w to encode the content written through it in one of the
+// neutered formats, other formats are written as is.
+func neuter(w io.Writer, format string) io.WriteCloser {
+	switch format {
+	case FormatXOR:
+		return &xorWriter{w: w}
+	case FormatBase64:
+		return base64.NewEncoder(base64.StdEncoding, w)
+	default:
+		return nopWriteCloser{w}
+	}
+}
+
+// xorWriter XORs the content written through it with xorKey.
+type xorWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (xw *xorWriter) Write(p []byte) (int, error) {
+	xw.buf = append(xw.buf[:0], p...)
+	for i := range xw.buf {
+		xw.buf[i] ^= xorKey
+	}
+	return xw.w.Write(xw.buf)
+}
+
+func (xw *xorWriter) Close() error {
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// parseRange parses the value of a Range header for a content of size
+// bytes. Only single byte ranges are served, other ranges are ignored and
+// a nil range is returned. ErrRangeNotSatisfiable is returned when the
+// range lies past the content.
+func parseRange(value string, size int64) (*ByteRange, error) {
+	spec, ok := strings.CutPrefix(value, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	var start, end int64
+	var err error
+	if first == "" {
+		// A suffix range holds the last bytes of the content.
+		length, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || length < 0 {
+			return nil, nil
+		}
+		if length == 0 {
+			return nil, ErrRangeNotSatisfiable
+		}
+		start, end = max(size-length, 0), size
+	} else {
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+		end = size
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, nil
+			}
+			end = min(end+1, size)
+		}
+	}
+	if start >= size {
+		return nil, ErrRangeNotSatisfiable
+	}
+	return &ByteRange{start, end}, nil
+}
+
 // isBrowser returns true when the HTTP request is coming from a known user agent.
 func isBrowser(userAgent string) bool {
 	browserList := []string{
@@ -45,3 +298,103 @@ func isBrowser(userAgent string) bool {
 	}
 	return false
 }
+
+// defaultBehaviorID returns the ID of the default behavior report of a file,
+// or an empty string when the file was not detonated.
+func defaultBehaviorID(file entity.File) string {
+	report, ok := file.DefaultBhvReport.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	id, _ := report["id"].(string)
+	return id
+}
+
+// hashType guesses the type of a lower case hash from its length. CRC32
+// checksums are only recognized with a `0x` prefix, the same way they are
+// stored, since short hexadecimal strings are ambiguous otherwise.
+func hashType(hash string) string {
+	if regCRC32.MatchString(hash) {
+		return hashCRC32
+	}
+	if !regHash.MatchString(hash) {
+		return ""
+	}
+	switch len(hash) {
+	case 32:
+		return hashMD5
+	case 40:
+		return hashSHA1
+	case 64:
+		return hashSHA256
+	case 128:
+		return hashSHA512
+	default:
+		return ""
+	}
+}
+
+// communityVerdict aggregates the votes of a file. The verdict having the
+// most votes wins, the most severe one on a tie. The family is chosen the
+// same way among the votes which are not benign, the first in alphabetical
+// order on a tie so that the result does not depend on the votes order.
+func communityVerdict(votes []VoteCount) entity.CommunityVerdict {
+	var community entity.CommunityVerdict
+	families := make(map[string]int)
+	for _, vote := range votes {
+		switch vote.Verdict {
+		case entity.VerdictMalicious:
+			community.Malicious += vote.Count
+		case entity.VerdictSuspicious:
+			community.Suspicious += vote.Count
+		case entity.VerdictBenign:
+			community.Benign += vote.Count
+			continue
+		}
+		if vote.Family != "" {
+			families[vote.Family] += vote.Count
+		}
+	}
+
+	switch {
+	case community.Malicious == 0 && community.Suspicious == 0 &&
+		community.Benign == 0:
+	case community.Malicious >= community.Suspicious &&
+		community.Malicious >= community.Benign:
+		community.Verdict = entity.VerdictMalicious
+	case community.Suspicious >= community.Benign:
+		community.Verdict = entity.VerdictSuspicious
+	default:
+		community.Verdict = entity.VerdictBenign
+	}
+
+	for family, count := range families {
+		best := families[community.Family]
+		if count > best || (count == best && family < community.Family) {
+			community.Family = family
+		}
+	}
+	return community
+}
+
+// storagePages returns the prefixes the samples bucket is walked by, one
+// page per leading byte of the lower case hex SHA256 the samples are keyed
+// by.
+func storagePages() []string {
+	pages := make([]string, 0, 256)
+	for i := 0; i < 256; i++ {
+		pages = append(pages, hex.EncodeToString([]byte{byte(i)}))
+	}
+	return pages
+}
+
+// addFinding appends a finding to one of the lists of a verification, unless
+// the verification already lists maxVerificationItems findings.
+func addFinding[T any](v *entity.StorageVerification, list *[]T, item T) {
+	if len(v.Corrupt)+len(v.Missing)+len(v.Orphaned)+len(v.Failed) >=
+		maxVerificationItems {
+		v.Truncated = true
+		return
+	}
+	*list = append(*list, item)
+}
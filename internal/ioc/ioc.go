@@ -0,0 +1,260 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package ioc
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Type represents the type of a network indicator of compromise.
+type Type string
+
+// Types of indicators.
+const (
+	URL    Type = "url"
+	Domain Type = "domain"
+	IPv4   Type = "ipv4"
+	IPv6   Type = "ipv6"
+)
+
+// Sources the indicators are extracted from.
+const (
+	SourceAPITrace  = "api_trace"
+	SourceSysEvents = "sys_events"
+	SourceArtifacts = "artifacts"
+	SourceStrings   = "strings"
+)
+
+// Output formats.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+	FormatText = "text"
+)
+
+var (
+	// ErrUnsupportedFormat is returned when the output format is unknown.
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	// ErrUnsupportedType is returned when the indicator type is unknown.
+	ErrUnsupportedType = errors.New("unsupported ioc type")
+
+	urlReg    = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s"'<>\\^{}|` + "`" + `\x00-\x1f\x7f]+`)
+	domainReg = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,24}\b`)
+	ipv4Reg   = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Reg   = regexp.MustCompile(`(?i)[0-9a-f]{0,4}(?::[0-9a-f]{0,4}){2,7}`)
+
+	contentTypes = map[string]string{
+		FormatJSON: "application/json; charset=UTF-8",
+		FormatCSV:  "text/csv; charset=UTF-8",
+		FormatText: "text/plain; charset=UTF-8",
+	}
+)
+
+// IOC represents a network indicator of compromise.
+type IOC struct {
+	Type    Type     `json:"type"`
+	Value   string   `json:"value"`
+	Sources []string `json:"sources"`
+}
+
+// Response represents the JSON representation of a list of indicators.
+type Response struct {
+	Count int   `json:"count"`
+	IOCs  []IOC `json:"iocs"`
+}
+
+// Set represents a deduplicated collection of indicators.
+type Set struct {
+	iocs map[string]*IOC
+}
+
+// NewSet creates a new empty set of indicators.
+func NewSet() *Set {
+	return &Set{iocs: make(map[string]*IOC)}
+}
+
+// Add inserts an indicator in the set, the sources of an indicator already
+// present in the set are merged.
+func (s *Set) Add(ioc IOC) {
+	key := string(ioc.Type) + "|" + ioc.Value
+	existing, ok := s.iocs[key]
+	if !ok {
+		existing = &IOC{Type: ioc.Type, Value: ioc.Value, Sources: []string{}}
+		s.iocs[key] = existing
+	}
+	for _, src := range ioc.Sources {
+		if !contains(existing.Sources, src) {
+			existing.Sources = append(existing.Sources, src)
+		}
+	}
+}
+
+// Extract adds the indicators found in text to the set.
+func (s *Set) Extract(source, text string) {
+	for _, u := range urlReg.FindAllString(text, -1) {
+		u = strings.TrimRight(u, ".,;:!?)]'")
+		s.Add(IOC{Type: URL, Value: u, Sources: []string{source}})
+	}
+
+	for _, d := range domainReg.FindAllString(text, -1) {
+		d = strings.ToLower(d)
+		if isDomain(d) {
+			s.Add(IOC{Type: Domain, Value: d, Sources: []string{source}})
+		}
+	}
+
+	for _, ip := range ipv4Reg.FindAllString(text, -1) {
+		if addr, err := netip.ParseAddr(ip); err == nil && isPublic(addr) {
+			s.Add(IOC{Type: IPv4, Value: addr.String(), Sources: []string{source}})
+		}
+	}
+
+	for _, ip := range ipv6Reg.FindAllString(text, -1) {
+		addr, err := netip.ParseAddr(ip)
+		if err == nil && addr.Is6() && !addr.Is4In6() && isPublic(addr) {
+			s.Add(IOC{Type: IPv6, Value: addr.String(), Sources: []string{source}})
+		}
+	}
+}
+
+// ExtractAll walks a decoded JSON value and adds the indicators found in
+// every string it contains to the set.
+func (s *Set) ExtractAll(source string, v interface{}) {
+	switch val := v.(type) {
+	case string:
+		s.Extract(source, val)
+	case []interface{}:
+		for _, item := range val {
+			s.ExtractAll(source, item)
+		}
+	case map[string]interface{}:
+		for _, item := range val {
+			s.ExtractAll(source, item)
+		}
+	}
+}
+
+// List returns the indicators sorted by type and value. When types are
+// provided, only the indicators of those types are returned.
+func (s *Set) List(types ...Type) []IOC {
+	iocs := []IOC{}
+	for _, ioc := range s.iocs {
+		if len(types) > 0 && !containsType(types, ioc.Type) {
+			continue
+		}
+		sources := append([]string{}, ioc.Sources...)
+		sort.Strings(sources)
+		iocs = append(iocs, IOC{Type: ioc.Type, Value: ioc.Value, Sources: sources})
+	}
+
+	sort.Slice(iocs, func(i, j int) bool {
+		if iocs[i].Type != iocs[j].Type {
+			return iocs[i].Type < iocs[j].Type
+		}
+		return iocs[i].Value < iocs[j].Value
+	})
+	return iocs
+}
+
+// ParseTypes parses a comma separated list of indicator types.
+func ParseTypes(s string) ([]Type, error) {
+	var types []Type
+	if s == "" {
+		return types, nil
+	}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch Type(t) {
+		case URL, Domain, IPv4, IPv6:
+			types = append(types, Type(t))
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, t)
+		}
+	}
+	return types, nil
+}
+
+// ContentType returns the content type of an output format, an empty format
+// defaults to JSON.
+func ContentType(format string) (string, error) {
+	if format == "" {
+		format = FormatJSON
+	}
+	contentType, ok := contentTypes[format]
+	if !ok {
+		return "", ErrUnsupportedFormat
+	}
+	return contentType, nil
+}
+
+// Write serializes the indicators to w in the given format. The text format
+// outputs one indicator value per line, suitable as a blocklist feed.
+func Write(w io.Writer, format string, iocs []IOC) error {
+	switch format {
+	case "", FormatJSON:
+		return json.NewEncoder(w).Encode(Response{Count: len(iocs), IOCs: iocs})
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"type", "value", "sources"}); err != nil {
+			return err
+		}
+		for _, ioc := range iocs {
+			err := cw.Write([]string{string(ioc.Type), ioc.Value,
+				strings.Join(ioc.Sources, ";")})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatText:
+		for _, ioc := range iocs {
+			if _, err := fmt.Fprintln(w, ioc.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return ErrUnsupportedFormat
+	}
+}
+
+// isDomain checks that a candidate domain ends with a known top level domain
+// that is not commonly confused with a file extension.
+func isDomain(d string) bool {
+	tld := d[strings.LastIndex(d, ".")+1:]
+	return tlds[tld] && !fileExtensions[tld]
+}
+
+// isPublic filters out addresses which are meaningless in a blocklist.
+func isPublic(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsType(types []Type, t Type) bool {
+	for _, item := range types {
+		if item == t {
+			return true
+		}
+	}
+	return false
+}
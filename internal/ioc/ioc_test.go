@@ -0,0 +1,94 @@
+package ioc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSet_Extract(t *testing.T) {
+	tests := []struct {
+		tag      string
+		text     string
+		expected []IOC
+	}{
+		{"t1", "connecting to http://evil.com/gate.php?id=1.", []IOC{
+			{Domain, "evil.com", []string{SourceStrings}},
+			{URL, "http://evil.com/gate.php?id=1", []string{SourceStrings}},
+		}},
+		{"t2", "C:\\Windows\\System32\\kernel32.dll", []IOC{}},
+		{"t3", "8.8.8.8 192.168.1.1 127.0.0.1 0.0.0.0 999.1.1.1", []IOC{
+			{IPv4, "8.8.8.8", []string{SourceStrings}},
+		}},
+		{"t4", "2001:4860:4860::8888 ::1 fe80::1 12:30:45", []IOC{
+			{IPv6, "2001:4860:4860::8888", []string{SourceStrings}},
+		}},
+		{"t5", "run install.sh then reach Update.Example.ORG", []IOC{
+			{Domain, "update.example.org", []string{SourceStrings}},
+		}},
+	}
+
+	for _, test := range tests {
+		s := NewSet()
+		s.Extract(SourceStrings, test.text)
+		assert.Equal(t, test.expected, s.List(), test.tag)
+	}
+}
+
+func TestSet_ExtractAll(t *testing.T) {
+	s := NewSet()
+	s.ExtractAll(SourceAPITrace, []interface{}{
+		map[string]interface{}{
+			"name": "InternetOpenUrlA",
+			"args": []interface{}{
+				map[string]interface{}{"name": "lpszUrl", "val": "https://c2.example.net/"},
+			},
+		},
+	})
+	s.ExtractAll(SourceSysEvents, map[string]interface{}{"path": "c2.example.net:443", "pid": 1234.0})
+
+	expected := []IOC{
+		{Domain, "c2.example.net", []string{SourceAPITrace, SourceSysEvents}},
+		{URL, "https://c2.example.net/", []string{SourceAPITrace}},
+	}
+	assert.Equal(t, expected, s.List())
+	assert.Equal(t, expected[1:], s.List(URL))
+}
+
+func TestParseTypes(t *testing.T) {
+	types, err := ParseTypes("domain, IPv4")
+	assert.Nil(t, err)
+	assert.Equal(t, []Type{Domain, IPv4}, types)
+
+	types, err = ParseTypes("")
+	assert.Nil(t, err)
+	assert.Empty(t, types)
+
+	_, err = ParseTypes("hash")
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+}
+
+func TestWrite(t *testing.T) {
+	iocs := []IOC{
+		{Domain, "evil.com", []string{SourceAPITrace, SourceStrings}},
+		{IPv4, "8.8.8.8", []string{SourceSysEvents}},
+	}
+	tests := []struct {
+		tag      string
+		format   string
+		expected string
+	}{
+		{"t1", FormatJSON, `{"count":2,"iocs":[{"type":"domain","value":"evil.com","sources":["api_trace","strings"]},{"type":"ipv4","value":"8.8.8.8","sources":["sys_events"]}]}` + "\n"},
+		{"t2", FormatCSV, "type,value,sources\ndomain,evil.com,api_trace;strings\nipv4,8.8.8.8,sys_events\n"},
+		{"t3", FormatText, "evil.com\n8.8.8.8\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		assert.Nil(t, Write(&buf, test.format, iocs), test.tag)
+		assert.Equal(t, test.expected, buf.String(), test.tag)
+	}
+
+	assert.ErrorIs(t, Write(&bytes.Buffer{}, "xml", iocs), ErrUnsupportedFormat)
+}
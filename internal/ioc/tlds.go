@@ -0,0 +1,45 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package ioc
+
+import "strings"
+
+var (
+	// tlds is the set of top level domains recognized when extracting
+	// domains: generic ones frequently seen in malware and country codes.
+	tlds = toSet(`
+		com net org info biz edu gov mil int arpa name pro mobi tel asia
+		xyz top online site club shop store tech space website live life
+		fun icu vip work link click download win bid loan men date stream
+		trade review racing party science cricket accountant faith kim
+		host press cloud app dev page digital email network services
+		support today world zone best buzz cam monster rest bar cyou sbs
+		onion
+		ac ad ae af ag ai al am ao aq ar as at au aw ax az ba bb bd be bf
+		bg bh bi bj bm bn bo br bs bt bw by bz ca cc cd cf cg ch ci ck cl
+		cm cn co cr cu cv cw cx cy cz de dj dk dm do dz ec ee eg er es et
+		eu fi fj fk fm fo fr ga gb gd ge gf gg gh gi gl gm gn gp gq gr gs
+		gt gu gw gy hk hm hn hr ht hu id ie il im in io iq ir is it je jm
+		jo jp ke kg kh ki km kn kp kr kw ky kz la lb lc li lk lr ls lt lu
+		lv ly ma mc md me mg mh mk ml mm mn mo mp mq mr ms mt mu mv mw mx
+		my mz na nc ne nf ng ni nl no np nr nu nz om pa pe pf pg ph pk pl
+		pm pn pr ps pt pw py qa re ro rs ru rw sa sb sc sd se sg sh si sk
+		sl sm sn so sr ss st su sv sx sy sz tc td tf tg th tj tk tl tm tn
+		to tr tt tv tw tz ua ug uk us uy uz va vc ve vg vi vn vu wf ws ye
+		yt za zm zw`)
+
+	// fileExtensions is the set of top level domains colliding with file
+	// extensions often found in strings, such domains are not reported on
+	// their own but still appear within extracted URLs.
+	fileExtensions = toSet(`cc md ps py rs sh so`)
+)
+
+func toSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Fields(s) {
+		set[item] = true
+	}
+	return set
+}
@@ -0,0 +1,351 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+// Package misp converts saferwall file reports to MISP events.
+package misp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/ioc"
+)
+
+// Threat levels and analysis states as defined by MISP.
+const (
+	threatLevelHigh      = "1"
+	threatLevelMedium    = "2"
+	threatLevelLow       = "3"
+	threatLevelUndefined = "4"
+	analysisCompleted    = "2"
+	distributionOrgOnly  = "0"
+)
+
+// namespace is the UUIDv5 namespace used to derive stable identifiers, so
+// that re-exporting a report updates the existing MISP event.
+var namespace = uuid.MustParse("5d4c2c3b-2f8e-4f5a-9a2e-7d1b0c8e6f41")
+
+// Events represents a list of MISP events, in the same layout as the
+// MISP restSearch API response.
+type Events struct {
+	Response []Event `json:"response"`
+}
+
+// Event wraps a MISP event.
+type Event struct {
+	Event EventBody `json:"Event"`
+}
+
+// EventBody represents a MISP event.
+type EventBody struct {
+	UUID          string      `json:"uuid"`
+	Info          string      `json:"info"`
+	Date          string      `json:"date"`
+	Timestamp     string      `json:"timestamp"`
+	ThreatLevelID string      `json:"threat_level_id"`
+	Analysis      string      `json:"analysis"`
+	Distribution  string      `json:"distribution"`
+	Published     bool        `json:"published"`
+	Attribute     []Attribute `json:"Attribute"`
+	Object        []Object    `json:"Object"`
+	Tag           []Tag       `json:"Tag"`
+}
+
+// Attribute represents a MISP attribute.
+type Attribute struct {
+	UUID           string `json:"uuid"`
+	Type           string `json:"type"`
+	Category       string `json:"category"`
+	ObjectRelation string `json:"object_relation,omitempty"`
+	Value          string `json:"value"`
+	ToIDS          bool   `json:"to_ids"`
+	Comment        string `json:"comment,omitempty"`
+}
+
+// Object represents a MISP object, a group of attributes following an
+// object template identified by its name.
+type Object struct {
+	UUID         string      `json:"uuid"`
+	Name         string      `json:"name"`
+	MetaCategory string      `json:"meta-category"`
+	Comment      string      `json:"comment,omitempty"`
+	Attribute    []Attribute `json:"Attribute"`
+}
+
+// Tag represents a MISP tag.
+type Tag struct {
+	Name string `json:"name"`
+}
+
+// multiAV represents the subset of the multi-av scan results of a file.
+type multiAV struct {
+	LastScan struct {
+		Timestamp  int64 `json:"timestamp"`
+		Detections map[string]struct {
+			Infected bool   `json:"infected"`
+			Output   string `json:"output"`
+		} `json:"detections"`
+	} `json:"last_scan"`
+}
+
+// NewEvent generates a MISP event for a file, its network indicators and the
+// comments made on it. iocs and comments are optional.
+func NewEvent(file entity.File, iocs []ioc.IOC, comments []entity.Comment) Event {
+	sha256 := strings.ToLower(file.SHA256)
+	eventUUID := uuid.NewSHA1(namespace, []byte("event|"+sha256))
+	b := builder{eventUUID: eventUUID}
+
+	lastScanned := time.Unix(file.LastScanned, 0).UTC()
+	event := EventBody{
+		UUID:          eventUUID.String(),
+		Info:          "Saferwall report for " + sha256,
+		Date:          lastScanned.Format("2006-01-02"),
+		Timestamp:     strconv.FormatInt(file.LastScanned, 10),
+		ThreatLevelID: threatLevel(file.Classification),
+		Analysis:      analysisCompleted,
+		Distribution:  distributionOrgOnly,
+		Attribute:     []Attribute{},
+		Object:        []Object{b.file(file)},
+		Tag:           tags(file),
+	}
+
+	event.Object = append(event.Object, b.detections(file)...)
+	for _, i := range iocs {
+		event.Object = append(event.Object, b.ioc(i))
+	}
+	for _, comment := range comments {
+		event.Object = append(event.Object, b.comment(comment))
+	}
+
+	return Event{Event: event}
+}
+
+type builder struct {
+	eventUUID uuid.UUID
+}
+
+// uuid derives a stable identifier from the event identifier and a key.
+func (b builder) uuid(key string) string {
+	return uuid.NewSHA1(b.eventUUID, []byte(key)).String()
+}
+
+func (b builder) attribute(scope, relation, typ, category, value string) Attribute {
+	return Attribute{
+		UUID:           b.uuid(scope + "|" + relation + "|" + value),
+		Type:           typ,
+		Category:       category,
+		ObjectRelation: relation,
+		Value:          value,
+	}
+}
+
+// file returns a file object holding the hashes, names and size of a file.
+func (b builder) file(file entity.File) Object {
+	obj := Object{
+		UUID:         b.uuid("file"),
+		Name:         "file",
+		MetaCategory: "file",
+		Attribute:    []Attribute{},
+	}
+
+	for _, h := range []struct{ relation, value string }{
+		{"md5", file.MD5},
+		{"sha1", file.SHA1},
+		{"sha256", strings.ToLower(file.SHA256)},
+		{"sha512", file.SHA512},
+		{"ssdeep", file.SSDeep},
+		{"tlsh", file.TLSH},
+	} {
+		if h.value != "" {
+			attr := b.attribute("file", h.relation, h.relation, "Payload delivery", h.value)
+			attr.ToIDS = true
+			obj.Attribute = append(obj.Attribute, attr)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, submission := range file.Submissions {
+		if submission.Filename == "" || seen[submission.Filename] {
+			continue
+		}
+		seen[submission.Filename] = true
+		obj.Attribute = append(obj.Attribute, b.attribute("file", "filename",
+			"filename", "Payload delivery", submission.Filename))
+	}
+
+	if file.Size > 0 {
+		obj.Attribute = append(obj.Attribute, b.attribute("file", "size-in-bytes",
+			"size-in-bytes", "Other", strconv.FormatInt(file.Size, 10)))
+	}
+	return obj
+}
+
+// detections returns an av-signature object per engine flagging the file.
+func (b builder) detections(file entity.File) []Object {
+	var av multiAV
+	raw, _ := json.Marshal(file.MultiAV)
+	_ = json.Unmarshal(raw, &av)
+
+	engines := make([]string, 0, len(av.LastScan.Detections))
+	for engine, detection := range av.LastScan.Detections {
+		if detection.Infected {
+			engines = append(engines, engine)
+		}
+	}
+	sort.Strings(engines)
+
+	objects := []Object{}
+	for _, engine := range engines {
+		scope := "av-signature|" + engine
+		obj := Object{
+			UUID:         b.uuid(scope),
+			Name:         "av-signature",
+			MetaCategory: "misc",
+			Attribute: []Attribute{
+				b.attribute(scope, "software", "text", "Antivirus detection", engine),
+				b.attribute(scope, "signature", "text", "Antivirus detection",
+					av.LastScan.Detections[engine].Output),
+			},
+		}
+		if av.LastScan.Timestamp > 0 {
+			obj.Attribute = append(obj.Attribute, b.attribute(scope, "datetime",
+				"datetime", "Other", formatTime(av.LastScan.Timestamp)))
+		}
+		objects = append(objects, obj)
+	}
+	return objects
+}
+
+// ioc returns a network indicator as a MISP object: a domain-ip object for
+// domains and IP addresses, and an url object for URLs.
+func (b builder) ioc(i ioc.IOC) Object {
+	scope := "ioc|" + string(i.Type) + "|" + i.Value
+	obj := Object{
+		UUID:         b.uuid(scope),
+		Name:         "domain-ip",
+		MetaCategory: "network",
+		Comment:      "Found in: " + strings.Join(i.Sources, ", "),
+		Attribute:    []Attribute{},
+	}
+	indicator := func(relation, typ, value string) {
+		attr := b.attribute(scope, relation, typ, "Network activity", value)
+		attr.ToIDS = true
+		obj.Attribute = append(obj.Attribute, attr)
+	}
+	detail := func(relation, typ, value string) {
+		obj.Attribute = append(obj.Attribute,
+			b.attribute(scope, relation, typ, "Other", value))
+	}
+
+	switch i.Type {
+	case ioc.Domain:
+		indicator("domain", "domain", i.Value)
+	case ioc.IPv4, ioc.IPv6:
+		indicator("ip", "ip-dst", i.Value)
+	case ioc.URL:
+		obj.Name = "url"
+		indicator("url", "url", i.Value)
+		u, err := url.Parse(i.Value)
+		if err != nil {
+			break
+		}
+		if u.Scheme != "" {
+			detail("scheme", "text", u.Scheme)
+		}
+		if host := u.Hostname(); host != "" {
+			if net.ParseIP(host) != nil {
+				indicator("ip", "ip-dst", host)
+			} else {
+				indicator("domain", "domain", host)
+			}
+		}
+		if port := u.Port(); port != "" {
+			detail("port", "port", port)
+		}
+		if u.Path != "" && u.Path != "/" {
+			detail("resource_path", "text", u.Path)
+		}
+		if u.RawQuery != "" {
+			detail("query_string", "text", u.RawQuery)
+		}
+	}
+	return obj
+}
+
+// comment returns an annotation object for a user comment.
+func (b builder) comment(comment entity.Comment) Object {
+	scope := "annotation|" + comment.ID
+	obj := Object{
+		UUID:         b.uuid(scope),
+		Name:         "annotation",
+		MetaCategory: "misc",
+		Comment:      "Comment by " + comment.Username,
+		Attribute: []Attribute{
+			b.attribute(scope, "text", "text", "Other", comment.Body),
+			b.attribute(scope, "type", "text", "Other", "Comment"),
+		},
+	}
+	if comment.Timestamp > 0 {
+		obj.Attribute = append(obj.Attribute, b.attribute(scope, "creation-date",
+			"datetime", "Other", formatTime(comment.Timestamp)))
+	}
+	return obj
+}
+
+// tags derives the event tags from the file tags and classification.
+func tags(file entity.File) []Tag {
+	names := []string{}
+	if file.Classification != "" {
+		names = append(names, tagName("classification", file.Classification))
+	}
+
+	for key, val := range file.Tags {
+		switch v := val.(type) {
+		case []interface{}:
+			for _, item := range v {
+				names = append(names, tagName(key, fmt.Sprint(item)))
+			}
+		case string:
+			names = append(names, tagName(key, v))
+		}
+	}
+	sort.Strings(names)
+
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		tags = append(tags, Tag{Name: name})
+	}
+	return tags
+}
+
+func tagName(key, value string) string {
+	return fmt.Sprintf("saferwall:%s=\"%s\"", strings.ToLower(key),
+		strings.ToLower(value))
+}
+
+// threatLevel maps a file classification to a MISP threat level.
+func threatLevel(classification string) string {
+	switch strings.ToLower(classification) {
+	case "malicious":
+		return threatLevelHigh
+	case "suspicious", "grayware":
+		return threatLevelMedium
+	case "benign", "clean":
+		return threatLevelLow
+	default:
+		return threatLevelUndefined
+	}
+}
+
+func formatTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,66 @@
+package misp
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/ioc"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func loadFile(t *testing.T) entity.File {
+	data, err := os.ReadFile(filepath.Join("testdata", "file.json"))
+	assert.Nil(t, err)
+
+	var file entity.File
+	assert.Nil(t, json.Unmarshal(data, &file))
+	return file
+}
+
+// assertGolden compares the JSON serialization of v with a golden file.
+func assertGolden(t *testing.T, name string, v interface{}) {
+	actual, err := json.MarshalIndent(v, "", "  ")
+	assert.Nil(t, err)
+
+	golden := filepath.Join("testdata", name)
+	if *update {
+		assert.Nil(t, os.WriteFile(golden, append(actual, '\n'), 0644))
+	}
+
+	expected, err := os.ReadFile(golden)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(expected), string(actual))
+}
+
+func TestNewEvent(t *testing.T) {
+	file := loadFile(t)
+	iocs := []ioc.IOC{
+		{Type: ioc.Domain, Value: "evil.com", Sources: []string{ioc.SourceAPITrace, ioc.SourceStrings}},
+		{Type: ioc.IPv4, Value: "8.8.8.8", Sources: []string{ioc.SourceSysEvents}},
+		{Type: ioc.URL, Value: "http://evil.com/gate.php", Sources: []string{ioc.SourceAPITrace}},
+		{Type: ioc.URL, Value: "https://10.0.0.1:8443/drop?id=1", Sources: []string{ioc.SourceStrings}},
+	}
+	comments := []entity.Comment{
+		{ID: "b5f3c3c0-0d8a-4b1e-9d0e-5a9c1f3e7a21", Body: "Test file, not a real threat.",
+			Timestamp: 1700000100, Username: "analyst"},
+	}
+
+	assertGolden(t, "event.golden.json", NewEvent(file, iocs, comments))
+}
+
+func TestNewEvents(t *testing.T) {
+	file := loadFile(t)
+	other := entity.File{
+		SHA256:      "E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855",
+		LastScanned: 1700000000,
+	}
+
+	events := Events{Response: []Event{NewEvent(file, nil, nil), NewEvent(other, nil, nil)}}
+	assertGolden(t, "events.golden.json", events)
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package notification
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/pkg/log"
+	"github.com/saferwall/saferwall-api/pkg/pagination"
+)
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func RegisterHandlers(g *echo.Group, service Service, logger log.Logger,
+	requireLogin echo.MiddlewareFunc) {
+
+	res := resource{service, logger}
+
+	g.GET("/notifications/", res.list, requireLogin)
+	g.GET("/notifications/unread/", res.unread, requireLogin)
+	g.POST("/notifications/read/", res.markAllRead, requireLogin)
+	g.POST("/notifications/:id/read/", res.markRead, requireLogin)
+	g.GET("/notifications/preferences/", res.preferences, requireLogin)
+	g.PATCH("/notifications/preferences/", res.updatePreferences,
+		requireLogin)
+}
+
+// @Summary Retrieves a paginated list of notifications
+// @Description List the notifications of the logged in user, the most recent
+// @Description first. The unread counts are returned alongside.
+// @Tags Notification
+// @Produce json
+// @Param per_page query uint false "Number of notifications per page"
+// @Param page query uint false "Specify the page number"
+// @Param unread query bool false "List only the unread notifications"
+// @Success 200 {object} object{unread=UnreadCounts,items=[]entity.Notification}
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /notifications/ [get]
+// @Security Bearer
+func (r resource) list(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var unread bool
+	err := echo.QueryParamsBinder(c).Bool("unread", &unread).BindError()
+	if err != nil {
+		return errors.BadRequest("")
+	}
+
+	count, err := r.service.Count(ctx, unread)
+	if err != nil {
+		return err
+	}
+	counts, err := r.service.UnreadCounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	pages := pagination.NewFromRequest(c.Request(), count)
+	notifications, err := r.service.Query(ctx, unread, pages.Offset(),
+		pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = notifications
+	return c.JSON(http.StatusOK, struct {
+		*pagination.Pages
+		Unread UnreadCounts `json:"unread"`
+	}{pages, counts})
+}
+
+// @Summary Count the unread notifications
+// @Description Returns the number of unread notifications of the logged in
+// @Description user, in total and by kind.
+// @Tags Notification
+// @Produce json
+// @Success 200 {object} UnreadCounts
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /notifications/unread/ [get]
+// @Security Bearer
+func (r resource) unread(c echo.Context) error {
+	counts, err := r.service.UnreadCounts(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, counts)
+}
+
+// @Summary Mark a notification as read
+// @Description Mark a notification of the logged in user as read.
+// @Tags Notification
+// @Produce json
+// @Param id path string true "Notification ID"
+// @Success 200 {object} entity.Notification
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /notifications/{id}/read/ [post]
+// @Security Bearer
+func (r resource) markRead(c echo.Context) error {
+	ctx := c.Request().Context()
+	n, err := r.service.MarkRead(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, n)
+}
+
+// @Summary Mark all notifications as read
+// @Description Mark all the notifications of the logged in user as read.
+// @Tags Notification
+// @Produce json
+// @Success 200 {object} object{}
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /notifications/read/ [post]
+// @Security Bearer
+func (r resource) markAllRead(c echo.Context) error {
+	if err := r.service.MarkAllRead(c.Request().Context()); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Message string `json:"message"`
+		Status  int    `json:"status"`
+	}{"ok", http.StatusOK})
+}
+
+// @Summary Get the notification preferences
+// @Description Returns the kinds of notifications muted by the logged in
+// @Description user and whether the email digest is enabled.
+// @Tags Notification
+// @Produce json
+// @Success 200 {object} entity.NotificationPreferences
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /notifications/preferences/ [get]
+// @Security Bearer
+func (r resource) preferences(c echo.Context) error {
+	prefs, err := r.service.Preferences(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, prefs)
+}
+
+// @Summary Update the notification preferences
+// @Description Mute kinds of notifications or toggle the email digest of the
+// @Description unread notifications, only the given fields are changed.
+// @Tags Notification
+// @Accept json
+// @Produce json
+// @Param data body UpdatePreferencesRequest true "Preferences"
+// @Success 200 {object} entity.NotificationPreferences
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /notifications/preferences/ [patch]
+// @Security Bearer
+func (r resource) updatePreferences(c echo.Context) error {
+	var input UpdatePreferencesRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	prefs, err := r.service.UpdatePreferences(ctx, input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, prefs)
+}
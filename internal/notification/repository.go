@@ -0,0 +1,333 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access notifications from the data
+// source.
+type Repository interface {
+	// Get returns the notification with the specified ID.
+	Get(ctx context.Context, id string) (entity.Notification, error)
+	// Create saves a new notification in the storage.
+	Create(ctx context.Context, n entity.Notification) error
+	// Count returns the number of notifications of a user.
+	Count(ctx context.Context, username string, unread bool) (int, error)
+	// Query returns the notifications of a user with the given offset and
+	// limit.
+	Query(ctx context.Context, username string, unread bool, offset,
+		limit int) ([]entity.Notification, error)
+	// UnreadCounts returns the number of unread notifications of a user
+	// by kind.
+	UnreadCounts(ctx context.Context, username string) (map[string]int, error)
+	// MarkRead marks a notification as read.
+	MarkRead(ctx context.Context, id string) error
+	// MarkAllRead marks all the notifications of a user as read.
+	MarkAllRead(ctx context.Context, username string) error
+	// Preferences returns the notification preferences of a user.
+	Preferences(ctx context.Context, username string) (
+		entity.NotificationPreferences, error)
+	// SavePreferences saves the notification preferences of a user.
+	SavePreferences(ctx context.Context, username string,
+		prefs entity.NotificationPreferences) error
+	// Submitters returns the users who submitted a file.
+	Submitters(ctx context.Context, sha256 string) ([]string, error)
+	// Watch saves a user waiting for the scan of a file.
+	Watch(ctx context.Context, w entity.ScanWatch) error
+	// FinishedWatches returns the users waiting for scans which finished.
+	FinishedWatches(ctx context.Context) ([]entity.ScanWatch, error)
+	// Unwatch deletes a scan watch, it fails with ErrDocumentNotFound when
+	// the watch was already deleted.
+	Unwatch(ctx context.Context, w entity.ScanWatch) error
+	// PendingDigests returns the unread notifications not emailed yet of
+	// the users who enabled the email digest, grouped by user.
+	PendingDigests(ctx context.Context) ([]Digest, error)
+	// ClaimEmailed marks a notification as sent in an email digest, it
+	// returns false when the notification was already claimed.
+	ClaimEmailed(ctx context.Context, id string) (bool, error)
+	// ReleaseEmailed marks notifications as not sent in an email digest.
+	ReleaseEmailed(ctx context.Context, ids []string) error
+}
+
+// Digest represents the unread notifications of a user sent by email.
+type Digest struct {
+	Username      string                `json:"username"`
+	Email         string                `json:"email"`
+	Notifications []entity.Notification `json:"notifications"`
+}
+
+// repository persists notifications in database.
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new notification repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Get reads the notification with the specified ID from the database.
+func (r repository) Get(ctx context.Context, id string) (
+	entity.Notification, error) {
+	var n entity.Notification
+	err := r.db.Get(ctx, strings.ToLower(id), &n)
+	return n, err
+}
+
+// Create saves a new notification record in the database.
+func (r repository) Create(ctx context.Context, n entity.Notification) error {
+	return r.db.Create(ctx, n.ID, &n)
+}
+
+// Count returns the number of notifications of a user, only the unread ones
+// when unread is set.
+func (r repository) Count(ctx context.Context, username string,
+	unread bool) (int, error) {
+	var count int
+
+	statement, params := r.userStatement(
+		"SELECT RAW COUNT(*) AS count FROM `"+r.db.Bucket.Name()+"` d",
+		username, unread)
+
+	err := r.db.Count(ctx, statement, params, &count)
+	return count, err
+}
+
+// Query retrieves the notifications of a user with the specified offset and
+// limit from the database, the most recent first.
+func (r repository) Query(ctx context.Context, username string, unread bool,
+	offset, limit int) ([]entity.Notification, error) {
+	var res interface{}
+
+	statement, params := r.userStatement(
+		"SELECT d.* FROM `"+r.db.Bucket.Name()+"` d", username, unread)
+	statement += " ORDER BY d.timestamp DESC OFFSET $offset LIMIT $limit"
+	params["offset"] = offset
+	params["limit"] = limit
+
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return []entity.Notification{}, err
+	}
+
+	notifications := []entity.Notification{}
+	b, _ := json.Marshal(res)
+	_ = json.Unmarshal(b, &notifications)
+	return notifications, nil
+}
+
+// UnreadCounts returns the number of unread notifications of a user grouped
+// by kind.
+func (r repository) UnreadCounts(ctx context.Context, username string) (
+	map[string]int, error) {
+	var res interface{}
+
+	statement, params := r.userStatement(
+		"SELECT d.kind, COUNT(*) AS count FROM `"+r.db.Bucket.Name()+"` d",
+		username, true)
+	statement += " GROUP BY d.kind"
+
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Kind  string `json:"kind"`
+		Count int    `json:"count"`
+	}
+	b, _ := json.Marshal(res)
+	_ = json.Unmarshal(b, &rows)
+
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Kind] = row.Count
+	}
+	return counts, nil
+}
+
+// MarkRead marks a notification as read in the database.
+func (r repository) MarkRead(ctx context.Context, id string) error {
+	return r.db.Patch(ctx, id, "read", true)
+}
+
+// MarkAllRead marks all the unread notifications of a user as read in the
+// database.
+func (r repository) MarkAllRead(ctx context.Context, username string) error {
+	var res interface{}
+
+	params := make(map[string]interface{}, 2)
+	params["docType"] = "notification"
+	params["username"] = username
+
+	statement := "UPDATE `" + r.db.Bucket.Name() + "` d " +
+		"SET d.`read` = true WHERE d.`type` = $docType " +
+		"AND d.username = $username AND d.`read` = false"
+
+	return r.db.Query(ctx, statement, params, &res)
+}
+
+// Preferences reads the notification preferences stored in the document of
+// a user, a user who never saved them gets the defaults.
+func (r repository) Preferences(ctx context.Context, username string) (
+	entity.NotificationPreferences, error) {
+
+	var user entity.User
+	err := r.db.Lookup(ctx, username, []string{"notifications"}, &user)
+	if errors.Is(err, dbcontext.ErrSubDocNotFound) {
+		return entity.NotificationPreferences{}, nil
+	}
+	if err != nil || user.Notifications == nil {
+		return entity.NotificationPreferences{}, err
+	}
+	return *user.Notifications, nil
+}
+
+// SavePreferences saves the notification preferences in the document of a
+// user.
+func (r repository) SavePreferences(ctx context.Context, username string,
+	prefs entity.NotificationPreferences) error {
+	return r.db.Patch(ctx, username, "notifications", prefs)
+}
+
+// Submitters returns the users who submitted a file.
+func (r repository) Submitters(ctx context.Context, sha256 string) (
+	[]string, error) {
+	var res interface{}
+
+	params := make(map[string]interface{}, 3)
+	params["docType"] = "edge"
+	params["kind"] = entity.EdgeSubmit
+	params["sha256"] = sha256
+
+	statement := "SELECT RAW e.username FROM `" + r.db.Bucket.Name() + "` e " +
+		"WHERE e.`type` = $docType AND e.kind = $kind AND e.target = $sha256"
+
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var usernames []string
+	b, _ := json.Marshal(res)
+	_ = json.Unmarshal(b, &usernames)
+	return usernames, nil
+}
+
+// Watch saves a user waiting for the scan of a file in the database.
+func (r repository) Watch(ctx context.Context, w entity.ScanWatch) error {
+	w.Type = "scanwatch"
+	err := r.db.Create(ctx, w.ID(), &w)
+	if errors.Is(err, dbcontext.ErrDocumentExists) {
+		return nil
+	}
+	return err
+}
+
+// FinishedWatches returns the users waiting for the scans of files which
+// finished.
+func (r repository) FinishedWatches(ctx context.Context) (
+	[]entity.ScanWatch, error) {
+	var res interface{}
+
+	params := make(map[string]interface{}, 2)
+	params["docType"] = "scanwatch"
+	params["finished"] = entity.FileScanProgressFinished
+
+	statement := "SELECT w.* FROM `" + r.db.Bucket.Name() + "` w " +
+		"JOIN `" + r.db.Bucket.Name() + "` f ON KEYS w.sha256 " +
+		"WHERE w.`type` = $docType AND f.status = $finished"
+
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var watches []entity.ScanWatch
+	b, _ := json.Marshal(res)
+	_ = json.Unmarshal(b, &watches)
+	return watches, nil
+}
+
+// Unwatch deletes a scan watch from the database.
+func (r repository) Unwatch(ctx context.Context, w entity.ScanWatch) error {
+	return r.db.Delete(ctx, w.ID())
+}
+
+// PendingDigests returns the unread notifications which were not emailed
+// yet of the users who enabled the email digest.
+func (r repository) PendingDigests(ctx context.Context) ([]Digest, error) {
+	var res interface{}
+
+	params := make(map[string]interface{}, 2)
+	params["userType"] = "user"
+	params["docType"] = "notification"
+
+	statement := "SELECT u.username, u.email, (" +
+		"SELECT n.* FROM `" + r.db.Bucket.Name() + "` n " +
+		"WHERE n.`type` = $docType AND n.username = LOWER(u.username) " +
+		"AND n.`read` = false AND n.emailed IS NOT VALUED " +
+		"ORDER BY n.timestamp) AS notifications " +
+		"FROM `" + r.db.Bucket.Name() + "` u " +
+		"WHERE u.`type` = $userType AND u.notifications.digest = true"
+
+	err := r.db.Query(ctx, statement, params, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []Digest
+	b, _ := json.Marshal(res)
+	_ = json.Unmarshal(b, &digests)
+	return digests, nil
+}
+
+// ClaimEmailed marks a notification as sent in an email digest in the
+// database. The flag is inserted atomically, so when several instances send
+// the digests a single one claims the notification.
+func (r repository) ClaimEmailed(ctx context.Context, id string) (bool, error) {
+	err := r.db.Insert(ctx, id, "emailed", true)
+	if errors.Is(err, dbcontext.ErrSubDocExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseEmailed marks notifications as not sent in an email digest in the
+// database, for the next digest to include them.
+func (r repository) ReleaseEmailed(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if err := r.db.Unset(ctx, id, []string{"emailed"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userStatement completes a statement selecting the notifications of a user,
+// only the unread ones when unread is set.
+func (r repository) userStatement(statement, username string, unread bool) (
+	string, map[string]interface{}) {
+
+	params := make(map[string]interface{}, 4)
+	params["docType"] = "notification"
+	params["username"] = username
+
+	statement += " WHERE d.`type` = $docType AND d.username = $username"
+	if unread {
+		statement += " AND d.`read` = false"
+	}
+	return statement, params
+}
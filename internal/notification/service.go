@@ -0,0 +1,359 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package notification
+
+import (
+	"bytes"
+	"context"
+	e "errors"
+	"fmt"
+	"strings"
+	"time"
+
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/internal/mailer"
+	tpl "github.com/saferwall/saferwall-api/internal/template"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// Service encapsulates usecase logic for notifications.
+type Service interface {
+	Notify(ctx context.Context, n entity.Notification, recipients []string) error
+	NotifySubmitters(ctx context.Context, n entity.Notification) error
+	WatchScan(ctx context.Context, username, sha256 string) error
+	Count(ctx context.Context, unread bool) (int, error)
+	Query(ctx context.Context, unread bool, offset, limit int) ([]entity.Notification, error)
+	UnreadCounts(ctx context.Context) (UnreadCounts, error)
+	MarkRead(ctx context.Context, id string) (entity.Notification, error)
+	MarkAllRead(ctx context.Context) error
+	Preferences(ctx context.Context) (entity.NotificationPreferences, error)
+	UpdatePreferences(ctx context.Context, input UpdatePreferencesRequest) (entity.NotificationPreferences, error)
+	Run(ctx context.Context, scanInterval, digestInterval time.Duration)
+}
+
+type service struct {
+	repo      Repository
+	logger    log.Logger
+	mailer    mailer.Mailer
+	templater tpl.Service
+	// uiAddress is the address of the frontend the digests link to.
+	uiAddress string
+}
+
+// UnreadCounts represents the number of unread notifications of a user.
+type UnreadCounts struct {
+	Total  int            `json:"total"`
+	ByKind map[string]int `json:"by_kind"`
+}
+
+// UpdatePreferencesRequest represents a notification preferences update
+// request, only the given fields are changed.
+type UpdatePreferencesRequest struct {
+	Muted  *[]string `json:"muted" validate:"omitempty,dive,oneof=follow comment mention scan" example:"follow"`
+	Digest *bool     `json:"digest"`
+}
+
+// NewService creates a new notification service.
+func NewService(repo Repository, logger log.Logger, mailer mailer.Mailer,
+	templater tpl.Service, uiAddress string) Service {
+	return service{repo, logger, mailer, templater, uiAddress}
+}
+
+// Notify creates a notification for every recipient who did not mute its
+// kind, the actor is never notified of its own actions.
+func (s service) Notify(ctx context.Context, n entity.Notification,
+	recipients []string) error {
+
+	seen := make(map[string]bool, len(recipients))
+	for _, recipient := range recipients {
+		recipient = strings.ToLower(recipient)
+		if seen[recipient] || recipient == strings.ToLower(n.Actor) {
+			continue
+		}
+		seen[recipient] = true
+
+		prefs, err := s.repo.Preferences(ctx, recipient)
+		if err != nil {
+			return err
+		}
+		if isMuted(prefs, n.Kind) {
+			continue
+		}
+
+		n.Type = "notification"
+		n.ID = entity.ID()
+		n.Username = recipient
+		n.Read = false
+		n.Timestamp = time.Now().Unix()
+		if err = s.repo.Create(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotifySubmitters notifies the users who submitted the file of a
+// notification.
+func (s service) NotifySubmitters(ctx context.Context,
+	n entity.Notification) error {
+
+	submitters, err := s.repo.Submitters(ctx, n.SHA256)
+	if err != nil {
+		return err
+	}
+	return s.Notify(ctx, n, submitters)
+}
+
+// WatchScan makes a user notified when the scan of a file finishes.
+func (s service) WatchScan(ctx context.Context, username, sha256 string) error {
+	return s.repo.Watch(ctx, entity.ScanWatch{
+		SHA256:    sha256,
+		Username:  strings.ToLower(username),
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// Count returns the number of notifications of the logged in user.
+func (s service) Count(ctx context.Context, unread bool) (int, error) {
+	return s.repo.Count(ctx, recipient(ctx), unread)
+}
+
+// Query returns the notifications of the logged in user with the specified
+// offset and limit, the most recent first.
+func (s service) Query(ctx context.Context, unread bool, offset, limit int) (
+	[]entity.Notification, error) {
+	return s.repo.Query(ctx, recipient(ctx), unread, offset, limit)
+}
+
+// UnreadCounts returns the number of unread notifications of the logged in
+// user, in total and by kind.
+func (s service) UnreadCounts(ctx context.Context) (UnreadCounts, error) {
+	byKind, err := s.repo.UnreadCounts(ctx, recipient(ctx))
+	if err != nil {
+		return UnreadCounts{}, err
+	}
+	counts := UnreadCounts{ByKind: byKind}
+	for _, count := range byKind {
+		counts.Total += count
+	}
+	return counts, nil
+}
+
+// MarkRead marks a notification of the logged in user as read.
+func (s service) MarkRead(ctx context.Context, id string) (
+	entity.Notification, error) {
+
+	n, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return entity.Notification{}, err
+	}
+	if n.Type != "notification" || n.Username != recipient(ctx) {
+		return entity.Notification{}, errors.NotFound("")
+	}
+	if !n.Read {
+		if err = s.repo.MarkRead(ctx, n.ID); err != nil {
+			return entity.Notification{}, err
+		}
+		n.Read = true
+	}
+	return n, nil
+}
+
+// MarkAllRead marks all the notifications of the logged in user as read.
+func (s service) MarkAllRead(ctx context.Context) error {
+	return s.repo.MarkAllRead(ctx, recipient(ctx))
+}
+
+// Preferences returns the notification preferences of the logged in user.
+func (s service) Preferences(ctx context.Context) (
+	entity.NotificationPreferences, error) {
+	return s.repo.Preferences(ctx, recipient(ctx))
+}
+
+// UpdatePreferences changes the notification preferences of the logged in
+// user.
+func (s service) UpdatePreferences(ctx context.Context,
+	input UpdatePreferencesRequest) (entity.NotificationPreferences, error) {
+
+	username := recipient(ctx)
+	prefs, err := s.repo.Preferences(ctx, username)
+	if err != nil {
+		return entity.NotificationPreferences{}, err
+	}
+	if input.Muted != nil {
+		prefs.Muted = *input.Muted
+	}
+	if input.Digest != nil {
+		prefs.Digest = *input.Digest
+	}
+	err = s.repo.SavePreferences(ctx, username, prefs)
+	return prefs, err
+}
+
+// Run notifies the users of their finished scans every scanInterval and
+// emails the digests every digestInterval until the context is done. A
+// zero interval disables the task, the digests are also disabled when
+// emails are not configured.
+func (s service) Run(ctx context.Context, scanInterval,
+	digestInterval time.Duration) {
+
+	if len(s.templater.EmailRequestTemplate) == 0 {
+		digestInterval = 0
+	}
+	scanTicks, stopScans := tick(scanInterval)
+	defer stopScans()
+	digestTicks, stopDigests := tick(digestInterval)
+	defer stopDigests()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-scanTicks:
+			if err := s.notifyFinishedScans(ctx); err != nil {
+				s.logger.Errorf("failed to notify the finished scans: %v", err)
+			}
+		case <-digestTicks:
+			if err := s.sendDigests(ctx); err != nil {
+				s.logger.Errorf("failed to send the digests: %v", err)
+			}
+		}
+	}
+}
+
+// notifyFinishedScans notifies the users waiting for scans which finished.
+// Every instance of the server runs this task, a watch is deleted before
+// notifying its user so that a single instance claims it.
+func (s service) notifyFinishedScans(ctx context.Context) error {
+	watches, err := s.repo.FinishedWatches(ctx)
+	if err != nil {
+		return err
+	}
+	for _, w := range watches {
+		err = s.repo.Unwatch(ctx, w)
+		if e.Is(err, dbcontext.ErrDocumentNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = s.Notify(ctx, entity.Notification{
+			Kind:   entity.NotificationScan,
+			Target: w.SHA256,
+			SHA256: w.SHA256,
+		}, []string{w.Username})
+		if err != nil {
+			// Watch the scan again for the next run to notify the user.
+			if werr := s.repo.Watch(ctx, w); werr != nil {
+				s.logger.Errorf("failed to watch the scan of %s again: %v",
+					w.SHA256, werr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDigests emails the users who enabled the digest their unread
+// notifications which were not emailed yet. Every instance of the server
+// runs this task, a notification is claimed before being emailed so that
+// a single instance sends it, and released when the email fails.
+func (s service) sendDigests(ctx context.Context) error {
+	digests, err := s.repo.PendingDigests(ctx)
+	if err != nil {
+		return err
+	}
+
+	digestTpl := s.templater.EmailRequestTemplate[tpl.NotificationDigest]
+	var attachments []mailer.Attachment
+	for _, attachment := range digestTpl.InlineImgs {
+		attachments = append(attachments, attachment)
+	}
+
+	for _, digest := range digests {
+		if len(digest.Notifications) == 0 || digest.Email == "" {
+			continue
+		}
+
+		templateData := struct {
+			Username      string
+			Notifications []digestItem
+			InboxURL      string
+			SupportEmail  string
+		}{
+			Username:     digest.Username,
+			InboxURL:     s.uiAddress + "/notifications",
+			SupportEmail: "contact@saferwall.com",
+		}
+		ids := make([]string, 0, len(digest.Notifications))
+		for _, n := range digest.Notifications {
+			claimed, err := s.repo.ClaimEmailed(ctx, n.ID)
+			if err != nil {
+				s.release(ctx, ids)
+				return err
+			}
+			if !claimed {
+				continue
+			}
+			templateData.Notifications = append(templateData.Notifications,
+				s.digestItem(n))
+			ids = append(ids, n.ID)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		body := new(bytes.Buffer)
+		if err = digestTpl.Execute(templateData, body); err != nil {
+			s.release(ctx, ids)
+			return err
+		}
+		err = s.mailer.Send(body.String(), digestTpl.Subject, digestTpl.From,
+			digest.Email, attachments)
+		if err != nil {
+			s.logger.Errorf("failed to send the digest of %s: %v",
+				digest.Username, err)
+			s.release(ctx, ids)
+		}
+	}
+	return nil
+}
+
+// release gives back the notifications claimed for a digest which was not
+// sent, for the next digest to include them.
+func (s service) release(ctx context.Context, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := s.repo.ReleaseEmailed(ctx, ids); err != nil {
+		s.logger.Errorf("failed to release the notifications %v: %v",
+			ids, err)
+	}
+}
+
+// digestItem represents a notification listed in an email digest.
+type digestItem struct {
+	Text string
+	URL  string
+}
+
+// digestItem describes a notification in an email digest.
+func (s service) digestItem(n entity.Notification) digestItem {
+	fileURL := fmt.Sprintf("%s/file/%s", s.uiAddress, n.SHA256)
+	switch n.Kind {
+	case entity.NotificationFollow:
+		return digestItem{n.Actor + " started following you",
+			fmt.Sprintf("%s/user/%s", s.uiAddress, n.Actor)}
+	case entity.NotificationComment:
+		return digestItem{n.Actor + " commented on a file you submitted",
+			fileURL}
+	case entity.NotificationMention:
+		return digestItem{n.Actor + " mentioned you in a comment", fileURL}
+	default:
+		return digestItem{"The scan of a file you uploaded finished",
+			fileURL}
+	}
+}
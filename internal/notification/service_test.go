@@ -0,0 +1,276 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/mailer"
+	tpl "github.com/saferwall/saferwall-api/internal/template"
+	"github.com/saferwall/saferwall-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memRepo keeps the notifications and the scan watches in memory, the
+// other methods of the repository are not implemented.
+type memRepo struct {
+	Repository
+
+	mu            sync.Mutex
+	notifications map[string]entity.Notification
+	watches       map[string]entity.ScanWatch
+	emails        map[string]string
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{
+		notifications: map[string]entity.Notification{},
+		watches:       map[string]entity.ScanWatch{},
+		emails:        map[string]string{},
+	}
+}
+
+func (r *memRepo) Create(ctx context.Context, n entity.Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifications[n.ID] = n
+	return nil
+}
+
+func (r *memRepo) Preferences(ctx context.Context, username string) (
+	entity.NotificationPreferences, error) {
+	return entity.NotificationPreferences{Digest: true}, nil
+}
+
+func (r *memRepo) Watch(ctx context.Context, w entity.ScanWatch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watches[w.ID()] = w
+	return nil
+}
+
+func (r *memRepo) FinishedWatches(ctx context.Context) (
+	[]entity.ScanWatch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var watches []entity.ScanWatch
+	for _, w := range r.watches {
+		watches = append(watches, w)
+	}
+	return watches, nil
+}
+
+func (r *memRepo) Unwatch(ctx context.Context, w entity.ScanWatch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.watches[w.ID()]; !ok {
+		return dbcontext.ErrDocumentNotFound
+	}
+	delete(r.watches, w.ID())
+	return nil
+}
+
+func (r *memRepo) PendingDigests(ctx context.Context) ([]Digest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	digests := map[string]*Digest{}
+	for _, n := range r.notifications {
+		if n.Read || n.Emailed {
+			continue
+		}
+		d, ok := digests[n.Username]
+		if !ok {
+			d = &Digest{Username: n.Username, Email: r.emails[n.Username]}
+			digests[n.Username] = d
+		}
+		d.Notifications = append(d.Notifications, n)
+	}
+	var res []Digest
+	for _, d := range digests {
+		res = append(res, *d)
+	}
+	return res, nil
+}
+
+func (r *memRepo) ClaimEmailed(ctx context.Context, id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.notifications[id]
+	if n.Emailed {
+		return false, nil
+	}
+	n.Emailed = true
+	r.notifications[id] = n
+	return true, nil
+}
+
+func (r *memRepo) ReleaseEmailed(ctx context.Context, ids []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		n := r.notifications[id]
+		n.Emailed = false
+		r.notifications[id] = n
+	}
+	return nil
+}
+
+// staleRepo lists the watches and the digests read by another instance
+// before it claimed them.
+type staleRepo struct {
+	*memRepo
+	watches []entity.ScanWatch
+	digests []Digest
+}
+
+func (r staleRepo) FinishedWatches(ctx context.Context) (
+	[]entity.ScanWatch, error) {
+	return r.watches, nil
+}
+
+func (r staleRepo) PendingDigests(ctx context.Context) ([]Digest, error) {
+	return r.digests, nil
+}
+
+// memMailer records the emails it sends, it fails when err is set.
+type memMailer struct {
+	mu   sync.Mutex
+	sent []string
+	err  error
+}
+
+func (m *memMailer) Send(body, subject, from, to string,
+	attachments []mailer.Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, to+": "+body)
+	return nil
+}
+
+func newTestService(t *testing.T, repo Repository, m mailer.Mailer) service {
+	dir := filepath.Join(t.TempDir(), "notification-digest")
+	require.Nil(t, os.Mkdir(dir, 0755))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte(
+		"{{range .Notifications}}{{.Text}};{{end}}"), 0644))
+	templater, err := tpl.New(filepath.Dir(dir))
+	require.Nil(t, err)
+
+	logger, _ := log.NewForTest()
+	return service{repo, logger, m, templater, "http://localhost"}
+}
+
+func notifications(repo *memRepo, kind string) []entity.Notification {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	var res []entity.Notification
+	for _, n := range repo.notifications {
+		if n.Kind == kind {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func TestNotifyFinishedScansOnce(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	m := &memMailer{}
+	first := newTestService(t, repo, m)
+	require.Nil(t, first.WatchScan(ctx, "Alice", "sha256"))
+	watches, err := repo.FinishedWatches(ctx)
+	require.Nil(t, err)
+
+	// Another instance listed the watch before the first one claimed it.
+	require.Nil(t, first.notifyFinishedScans(ctx))
+	second := newTestService(t, staleRepo{memRepo: repo, watches: watches}, m)
+	require.Nil(t, second.notifyFinishedScans(ctx))
+
+	scans := notifications(repo, entity.NotificationScan)
+	require.Len(t, scans, 1)
+	assert.Equal(t, "alice", scans[0].Username)
+	assert.Equal(t, "sha256", scans[0].SHA256)
+	assert.Empty(t, repo.watches)
+}
+
+func TestSendDigestsOnce(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	repo.emails["alice"] = "alice@example.com"
+	m := &memMailer{}
+	first := newTestService(t, repo, m)
+	for _, actor := range []string{"bob", "carol"} {
+		require.Nil(t, first.Notify(ctx, entity.Notification{
+			Kind: entity.NotificationFollow, Actor: actor, Target: "alice"},
+			[]string{"alice"}))
+	}
+	digests, err := repo.PendingDigests(ctx)
+	require.Nil(t, err)
+
+	// Another instance listed the digests before the first one sent them.
+	require.Nil(t, first.sendDigests(ctx))
+	second := newTestService(t, staleRepo{memRepo: repo, digests: digests}, m)
+	require.Nil(t, second.sendDigests(ctx))
+
+	require.Len(t, m.sent, 1)
+	assert.True(t, strings.HasPrefix(m.sent[0], "alice@example.com: "))
+	assert.Contains(t, m.sent[0], "bob started following you")
+	assert.Contains(t, m.sent[0], "carol started following you")
+	for _, n := range notifications(repo, entity.NotificationFollow) {
+		assert.True(t, n.Emailed, n.Actor)
+	}
+}
+
+func TestSendDigestsRelease(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	repo.emails["alice"] = "alice@example.com"
+	m := &memMailer{err: errors.New("smtp unavailable")}
+	svc := newTestService(t, repo, m)
+	require.Nil(t, svc.Notify(ctx, entity.Notification{
+		Kind: entity.NotificationFollow, Actor: "bob", Target: "alice"},
+		[]string{"alice"}))
+
+	// A failed email leaves the notifications to the next digest.
+	require.Nil(t, svc.sendDigests(ctx))
+	assert.Empty(t, m.sent)
+	assert.False(t, notifications(repo, entity.NotificationFollow)[0].Emailed)
+
+	m.err = nil
+	require.Nil(t, svc.sendDigests(ctx))
+	assert.Len(t, m.sent, 1)
+	assert.True(t, notifications(repo, entity.NotificationFollow)[0].Emailed)
+}
+
+func TestRunStops(t *testing.T) {
+	repo := newMemRepo()
+	svc := newTestService(t, repo, &memMailer{})
+	require.Nil(t, svc.WatchScan(context.Background(), "alice", "sha256"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.Run(ctx, time.Millisecond, time.Millisecond)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		return len(notifications(repo, entity.NotificationScan)) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return once the context was done")
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package notification
+
+import (
+	"context"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
+)
+
+// recipient returns the ID of the logged in user.
+func recipient(ctx context.Context) string {
+	user, _ := ctx.Value(entity.UserKey).(entity.User)
+	return user.ID()
+}
+
+// isMuted checks if a user muted a kind of notifications.
+func isMuted(prefs entity.NotificationPreferences, kind string) bool {
+	for _, muted := range prefs.Muted {
+		if muted == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// tick returns a channel receiving the time every interval, a nil channel
+// which never receives when the interval is zero, and a function stopping
+// the ticks.
+func tick(interval time.Duration) (<-chan time.Time, func()) {
+	if interval <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(interval)
+	return t.C, t.Stop
+}
@@ -0,0 +1,289 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package org
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/saferwall/saferwall-api/pkg/log"
+	"github.com/saferwall/saferwall-api/pkg/pagination"
+)
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func RegisterHandlers(g *echo.Group, service Service, logger log.Logger,
+	requireLogin, verifyID echo.MiddlewareFunc) {
+
+	res := resource{service, logger}
+
+	g.GET("/orgs/", res.list, requireLogin)
+	g.POST("/orgs/", res.create, requireLogin)
+	g.GET("/orgs/:id/", res.get, verifyID, requireLogin)
+	g.PATCH("/orgs/:id/", res.update, verifyID, requireLogin)
+	g.DELETE("/orgs/:id/", res.delete, verifyID, requireLogin)
+	g.GET("/orgs/:id/members/", res.members, verifyID, requireLogin)
+	g.PUT("/orgs/:id/members/:username/", res.setMember, verifyID,
+		requireLogin)
+	g.DELETE("/orgs/:id/members/:username/", res.removeMember, verifyID,
+		requireLogin)
+	g.GET("/orgs/:id/submissions/", res.submissions, verifyID, requireLogin)
+}
+
+// @Summary Retrieves a paginated list of organizations
+// @Description List the organizations the logged in user is a member of,
+// @Description the most recently joined first.
+// @Tags Organization
+// @Produce json
+// @Param per_page query uint false "Number of organizations per page"
+// @Param page query uint false "Specify the page number"
+// @Success 200 {object} pagination.Pages{items=[]entity.Organization}
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/ [get]
+// @Security Bearer
+func (r resource) list(c echo.Context) error {
+	ctx := c.Request().Context()
+	count, err := r.service.Count(ctx)
+	if err != nil {
+		return err
+	}
+
+	pages := pagination.NewFromRequest(c.Request(), count)
+	orgs, err := r.service.Query(ctx, pages.Offset(), pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = orgs
+	return c.JSON(http.StatusOK, pages)
+}
+
+// @Summary Create a new organization
+// @Description Create a new organization, the logged in user becomes its
+// @Description owner.
+// @Tags Organization
+// @Accept json
+// @Produce json
+// @Param data body CreateOrgRequest true "Organization data"
+// @Success 201 {object} entity.Organization
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/ [post]
+// @Security Bearer
+func (r resource) create(c echo.Context) error {
+	var input CreateOrgRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	org, err := r.service.Create(ctx, input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, org)
+}
+
+// @Summary Get organization by ID
+// @Description Retrieves an organization, only visible to its members.
+// @Tags Organization
+// @Produce json
+// @Param id path string true "Organization ID"
+// @Success 200 {object} entity.Organization
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/{id}/ [get]
+// @Security Bearer
+func (r resource) get(c echo.Context) error {
+	ctx := c.Request().Context()
+	org, err := r.service.Get(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, org)
+}
+
+// @Summary Update an organization
+// @Description Change the name or the description of an organization. Only
+// @Description its admins and owners can update it.
+// @Tags Organization
+// @Accept json
+// @Produce json
+// @Param id path string true "Organization ID"
+// @Param data body UpdateOrgRequest true "Fields to update"
+// @Success 200 {object} entity.Organization
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/{id}/ [patch]
+// @Security Bearer
+func (r resource) update(c echo.Context) error {
+	var input UpdateOrgRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	org, err := r.service.Update(ctx, c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, org)
+}
+
+// @Summary Deletes an organization
+// @Description Deletes an organization with its members and its private
+// @Description submissions, the files are kept. Only its owners can delete
+// @Description it.
+// @Tags Organization
+// @Produce json
+// @Param id path string true "Organization ID"
+// @Success 200 {object} entity.Organization
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/{id}/ [delete]
+// @Security Bearer
+func (r resource) delete(c echo.Context) error {
+	ctx := c.Request().Context()
+	org, err := r.service.Delete(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, org)
+}
+
+// @Summary Retrieves a paginated list of the members of an organization
+// @Description List the members of an organization and their role, the
+// @Description oldest first. Only the members can list them.
+// @Tags Organization
+// @Produce json
+// @Param id path string true "Organization ID"
+// @Param per_page query uint false "Number of members per page"
+// @Param page query uint false "Specify the page number"
+// @Success 200 {object} pagination.Pages{items=[]entity.OrgMembership}
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/{id}/members/ [get]
+// @Security Bearer
+func (r resource) members(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	count, err := r.service.CountMembers(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	pages := pagination.NewFromRequest(c.Request(), count)
+	members, err := r.service.Members(ctx, id, pages.Offset(), pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = members
+	return c.JSON(http.StatusOK, pages)
+}
+
+// @Summary Add a member to an organization or change their role
+// @Description Add a user to an organization with a role, or change the
+// @Description role of a member. The admins manage the members, only the
+// @Description owners manage the admins and the owners. The last owner
+// @Description cannot be demoted.
+// @Tags Organization
+// @Accept json
+// @Produce json
+// @Param id path string true "Organization ID"
+// @Param username path string true "Username"
+// @Param data body SetMemberRequest true "Role of the member"
+// @Success 200 {object} entity.OrgMembership
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/{id}/members/{username}/ [put]
+// @Security Bearer
+func (r resource) setMember(c echo.Context) error {
+	var input SetMemberRequest
+
+	ctx := c.Request().Context()
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Info(err)
+		return err
+	}
+
+	m, err := r.service.SetMember(ctx, c.Param("id"), c.Param("username"),
+		input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, m)
+}
+
+// @Summary Remove a member from an organization
+// @Description Remove a user from an organization. The admins remove the
+// @Description members, only the owners remove the admins and the owners,
+// @Description and any member can leave. The last owner cannot leave.
+// @Tags Organization
+// @Produce json
+// @Param id path string true "Organization ID"
+// @Param username path string true "Username"
+// @Success 204
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/{id}/members/{username}/ [delete]
+// @Security Bearer
+func (r resource) removeMember(c echo.Context) error {
+	ctx := c.Request().Context()
+	err := r.service.RemoveMember(ctx, c.Param("id"), c.Param("username"))
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// @Summary Retrieves a paginated list of the private submissions of an organization
+// @Description List the files submitted with the `org` visibility to an
+// @Description organization, with their file name and comment, the most
+// @Description recent first. Only the members can see them.
+// @Tags Organization
+// @Produce json
+// @Param id path string true "Organization ID"
+// @Param sha256 query string false "List only the submissions of this file"
+// @Param per_page query uint false "Number of submissions per page"
+// @Param page query uint false "Specify the page number"
+// @Success 200 {object} pagination.Pages{items=[]entity.OrgSubmission}
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /orgs/{id}/submissions/ [get]
+// @Security Bearer
+func (r resource) submissions(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	sha256 := c.QueryParam("sha256")
+
+	count, err := r.service.CountSubmissions(ctx, id, sha256)
+	if err != nil {
+		return err
+	}
+
+	pages := pagination.NewFromRequest(c.Request(), count)
+	subs, err := r.service.Submissions(ctx, id, sha256, pages.Offset(),
+		pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = subs
+	return c.JSON(http.StatusOK, pages)
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package org
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	e "github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+type middleware struct {
+	service Service
+	logger  log.Logger
+}
+
+// NewMiddleware creates a new organization Middleware.
+func NewMiddleware(service Service, logger log.Logger) middleware {
+	return middleware{service, logger}
+}
+
+// VerifyID validates the organization ID and check if the organization exists.
+func (m middleware) VerifyID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		orgID := strings.ToLower(c.Param("id"))
+		if !entity.IsValidID(orgID) {
+			m.logger.Error("failed to match regex for organization ID %v",
+				orgID)
+			return e.BadRequest("invalid organization ID string")
+		}
+
+		docExists, err := m.service.Exists(c.Request().Context(), orgID)
+		if err != nil {
+			return err
+		}
+
+		if !docExists {
+			return db.ErrDocumentNotFound
+		}
+
+		return next(c)
+	}
+}
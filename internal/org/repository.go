@@ -0,0 +1,362 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package org
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access organizations, their members
+// and their private submissions from the data source.
+type Repository interface {
+	// Get returns the organization with the specified ID.
+	Get(ctx context.Context, id string) (entity.Organization, error)
+	// Create saves a new organization in the storage.
+	Create(ctx context.Context, org entity.Organization) error
+	// Patch updates a field of the organization with given ID.
+	Patch(ctx context.Context, id, path string, val interface{}) error
+	// Delete removes the organization with given ID, its memberships and
+	// its private submissions from the storage.
+	Delete(ctx context.Context, id string) error
+	// Exists checks if an organization exists with a given ID.
+	Exists(ctx context.Context, id string) (bool, error)
+	// CountOrgs returns the number of organizations a user is a member of.
+	CountOrgs(ctx context.Context, username string) (int, error)
+	// Orgs returns the organizations a user is a member of with the given
+	// offset and limit.
+	Orgs(ctx context.Context, username string, offset, limit int) (
+		[]entity.Organization, error)
+	// Membership returns the membership of a user to an organization.
+	Membership(ctx context.Context, org, username string) (
+		entity.OrgMembership, error)
+	// Memberships returns the memberships of a user to all organizations.
+	Memberships(ctx context.Context, username string) (
+		[]entity.OrgMembership, error)
+	// AddMember saves a new membership and counts the new member.
+	AddMember(ctx context.Context, m entity.OrgMembership) error
+	// SetRole changes the role of a member.
+	SetRole(ctx context.Context, org, username, role string) error
+	// RemoveMember deletes a membership and uncounts the member.
+	RemoveMember(ctx context.Context, org, username string) error
+	// CountMembers returns the number of members of an organization,
+	// optionally having a given role.
+	CountMembers(ctx context.Context, org, role string) (int, error)
+	// Members returns the members of an organization with the given offset
+	// and limit.
+	Members(ctx context.Context, org string, offset, limit int) (
+		[]entity.OrgMembership, error)
+	// CreateSubmission saves a private submission.
+	CreateSubmission(ctx context.Context, sub entity.OrgSubmission) error
+	// CountSubmissions returns the number of private submissions of an
+	// organization, optionally of a given file.
+	CountSubmissions(ctx context.Context, org, sha256 string) (int, error)
+	// Submissions returns the private submissions of an organization,
+	// optionally of a given file, with the given offset and limit.
+	Submissions(ctx context.Context, org, sha256 string, offset,
+		limit int) ([]entity.OrgSubmission, error)
+	// UserSubmissions returns the private submissions made by a user.
+	UserSubmissions(ctx context.Context, username string) (
+		[]entity.OrgSubmission, error)
+	// AnonymizeSubmissions removes the user and the country from the
+	// private submissions made by a user.
+	AnonymizeSubmissions(ctx context.Context, username string) error
+}
+
+// repository persists organizations in database.
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new organization repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Get reads the organization with the specified ID from the database.
+func (r repository) Get(ctx context.Context, id string) (
+	entity.Organization, error) {
+	var org entity.Organization
+	err := r.db.Get(ctx, strings.ToLower(id), &org)
+	return org, err
+}
+
+// Create saves a new organization record in the database.
+func (r repository) Create(ctx context.Context, org entity.Organization) error {
+	return r.db.Create(ctx, org.ID, &org)
+}
+
+// Patch updates a field of an organization in the database, the number of
+// members is changed concurrently and is never replaced.
+func (r repository) Patch(ctx context.Context, id, path string,
+	val interface{}) error {
+	return r.db.Patch(ctx, id, path, val)
+}
+
+// Delete deletes the memberships and the private submissions of an
+// organization, then the organization itself.
+func (r repository) Delete(ctx context.Context, id string) error {
+	for _, docType := range []string{"orgmember", "orgsubmission"} {
+		statement := "DELETE FROM `" + r.db.Bucket.Name() + "` d " +
+			"WHERE d.`type` = $docType AND d.org = $org"
+		err := r.exec(ctx, statement, map[string]interface{}{
+			"docType": docType,
+			"org":     id,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return r.db.Delete(ctx, id)
+}
+
+// Exists checks if an organization exists for the given id.
+func (r repository) Exists(ctx context.Context, id string) (bool, error) {
+	docExists := false
+	key := strings.ToLower(id)
+	err := r.db.Exists(ctx, key, &docExists)
+	return docExists, err
+}
+
+// CountOrgs returns the number of organizations a user is a member of.
+func (r repository) CountOrgs(ctx context.Context, username string) (
+	int, error) {
+	var count int
+
+	statement := "SELECT RAW COUNT(*) AS count FROM `" +
+		r.db.Bucket.Name() + "` m " +
+		"WHERE m.`type` = $docType AND m.username = $username"
+	err := r.db.Count(ctx, statement, map[string]interface{}{
+		"docType":  "orgmember",
+		"username": username,
+	}, &count)
+	return count, err
+}
+
+// Orgs retrieves the organizations a user is a member of, the most
+// recently joined first.
+func (r repository) Orgs(ctx context.Context, username string, offset,
+	limit int) ([]entity.Organization, error) {
+
+	statement := "SELECT o.* FROM `" + r.db.Bucket.Name() + "` m " +
+		"JOIN `" + r.db.Bucket.Name() + "` o ON KEYS m.org " +
+		"WHERE m.`type` = $docType AND m.username = $username " +
+		"ORDER BY m.ts DESC OFFSET $offset LIMIT $limit"
+
+	orgs := []entity.Organization{}
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "orgmember",
+		"username": username,
+		"offset":   offset,
+		"limit":    limit,
+	}, &orgs)
+	return orgs, err
+}
+
+// Membership reads the membership of a user to an organization.
+func (r repository) Membership(ctx context.Context, org, username string) (
+	entity.OrgMembership, error) {
+	var m entity.OrgMembership
+	err := r.db.Get(ctx, entity.OrgMembershipID(org, username), &m)
+	return m, err
+}
+
+// Memberships retrieves the memberships of a user to all organizations.
+func (r repository) Memberships(ctx context.Context, username string) (
+	[]entity.OrgMembership, error) {
+
+	statement := "SELECT m.* FROM `" + r.db.Bucket.Name() + "` m " +
+		"WHERE m.`type` = $docType AND m.username = $username " +
+		"ORDER BY m.ts DESC"
+
+	ms := []entity.OrgMembership{}
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "orgmember",
+		"username": username,
+	}, &ms)
+	return ms, err
+}
+
+// AddMember saves a new membership and increments the number of members
+// of the organization, nothing changes when the user is already a member.
+func (r repository) AddMember(ctx context.Context,
+	m entity.OrgMembership) error {
+
+	err := r.db.Create(ctx, m.ID(), &m)
+	if errors.Is(err, dbcontext.ErrDocumentExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.db.Increment(ctx, m.Org, "members_count", 1)
+}
+
+// SetRole changes the role of a member of an organization.
+func (r repository) SetRole(ctx context.Context, org, username,
+	role string) error {
+	return r.db.Patch(ctx, entity.OrgMembershipID(org, username), "role",
+		role)
+}
+
+// RemoveMember deletes a membership and decrements the number of members
+// of the organization.
+func (r repository) RemoveMember(ctx context.Context, org,
+	username string) error {
+
+	err := r.db.Delete(ctx, entity.OrgMembershipID(org, username))
+	if err != nil {
+		return err
+	}
+	return r.db.Increment(ctx, org, "members_count", -1)
+}
+
+// CountMembers returns the number of members of an organization, only the
+// ones having the given role when it is not empty.
+func (r repository) CountMembers(ctx context.Context, org, role string) (
+	int, error) {
+	var count int
+
+	params := map[string]interface{}{
+		"docType": "orgmember",
+		"org":     org,
+	}
+	statement := "SELECT RAW COUNT(*) AS count FROM `" +
+		r.db.Bucket.Name() + "` m " +
+		"WHERE m.`type` = $docType AND m.org = $org"
+	if role != "" {
+		statement += " AND m.role = $role"
+		params["role"] = role
+	}
+	err := r.db.Count(ctx, statement, params, &count)
+	return count, err
+}
+
+// Members retrieves the members of an organization, the oldest first.
+func (r repository) Members(ctx context.Context, org string, offset,
+	limit int) ([]entity.OrgMembership, error) {
+
+	statement := "SELECT m.* FROM `" + r.db.Bucket.Name() + "` m " +
+		"WHERE m.`type` = $docType AND m.org = $org " +
+		"ORDER BY m.ts OFFSET $offset LIMIT $limit"
+
+	ms := []entity.OrgMembership{}
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType": "orgmember",
+		"org":     org,
+		"offset":  offset,
+		"limit":   limit,
+	}, &ms)
+	return ms, err
+}
+
+// CreateSubmission saves a private submission record in the database.
+func (r repository) CreateSubmission(ctx context.Context,
+	sub entity.OrgSubmission) error {
+	return r.db.Create(ctx, "orgsubmission::"+sub.ID, &sub)
+}
+
+// CountSubmissions returns the number of private submissions of an
+// organization, only the ones of a file when sha256 is not empty.
+func (r repository) CountSubmissions(ctx context.Context, org,
+	sha256 string) (int, error) {
+	var count int
+
+	statement, params := submissionsStatement(
+		"SELECT RAW COUNT(*) AS count FROM `"+r.db.Bucket.Name()+"` s",
+		org, sha256)
+	err := r.db.Count(ctx, statement, params, &count)
+	return count, err
+}
+
+// Submissions retrieves the private submissions of an organization, the
+// most recent first.
+func (r repository) Submissions(ctx context.Context, org, sha256 string,
+	offset, limit int) ([]entity.OrgSubmission, error) {
+
+	statement, params := submissionsStatement(
+		"SELECT s.* FROM `"+r.db.Bucket.Name()+"` s", org, sha256)
+	statement += " ORDER BY s.timestamp DESC OFFSET $offset LIMIT $limit"
+	params["offset"] = offset
+	params["limit"] = limit
+
+	subs := []entity.OrgSubmission{}
+	err := r.query(ctx, statement, params, &subs)
+	return subs, err
+}
+
+// UserSubmissions retrieves the private submissions made by a user, the
+// most recent first.
+func (r repository) UserSubmissions(ctx context.Context, username string) (
+	[]entity.OrgSubmission, error) {
+
+	statement := "SELECT s.* FROM `" + r.db.Bucket.Name() + "` s " +
+		"WHERE s.`type` = $docType AND s.username = $username " +
+		"ORDER BY s.timestamp DESC"
+
+	subs := []entity.OrgSubmission{}
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "orgsubmission",
+		"username": username,
+	}, &subs)
+	return subs, err
+}
+
+// AnonymizeSubmissions removes the user and the country from the private
+// submissions made by a user, the organization keeps the file names and
+// the comments.
+func (r repository) AnonymizeSubmissions(ctx context.Context,
+	username string) error {
+
+	statement := "UPDATE `" + r.db.Bucket.Name() + "` s " +
+		"UNSET s.username, s.country " +
+		"WHERE s.`type` = $docType AND s.username = $username"
+	return r.exec(ctx, statement, map[string]interface{}{
+		"docType":  "orgsubmission",
+		"username": username,
+	})
+}
+
+// query runs a statement and decodes its rows into val.
+func (r repository) query(ctx context.Context, statement string,
+	params map[string]interface{}, val interface{}) error {
+
+	var res interface{}
+	if err := r.db.Query(ctx, statement, params, &res); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(res)
+	return json.Unmarshal(b, val)
+}
+
+// exec runs a statement which returns no rows.
+func (r repository) exec(ctx context.Context, statement string,
+	params map[string]interface{}) error {
+	var res interface{}
+	return r.db.Query(ctx, statement, params, &res)
+}
+
+// submissionsStatement completes a statement selecting the private
+// submissions of an organization, optionally of a given file.
+func submissionsStatement(statement, org, sha256 string) (
+	string, map[string]interface{}) {
+
+	params := make(map[string]interface{}, 5)
+	params["docType"] = "orgsubmission"
+	params["org"] = org
+	statement += " WHERE s.`type` = $docType AND s.org = $org"
+	if sha256 != "" {
+		statement += " AND s.sha256 = $sha256"
+		params["sha256"] = sha256
+	}
+	return statement, params
+}
@@ -0,0 +1,449 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package org
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/internal/user"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// Service encapsulates usecase logic for organizations.
+type Service interface {
+	Exists(ctx context.Context, id string) (bool, error)
+	Get(ctx context.Context, id string) (entity.Organization, error)
+	Create(ctx context.Context, input CreateOrgRequest) (entity.Organization, error)
+	Update(ctx context.Context, id string, input UpdateOrgRequest) (entity.Organization, error)
+	Delete(ctx context.Context, id string) (entity.Organization, error)
+	Count(ctx context.Context) (int, error)
+	Query(ctx context.Context, offset, limit int) ([]entity.Organization, error)
+	CountMembers(ctx context.Context, id string) (int, error)
+	Members(ctx context.Context, id string, offset, limit int) ([]entity.OrgMembership, error)
+	SetMember(ctx context.Context, id, username string, input SetMemberRequest) (entity.OrgMembership, error)
+	RemoveMember(ctx context.Context, id, username string) error
+	Submit(ctx context.Context, sub entity.OrgSubmission) error
+	CountSubmissions(ctx context.Context, id, sha256 string) (int, error)
+	Submissions(ctx context.Context, id, sha256 string, offset, limit int) ([]entity.OrgSubmission, error)
+	Memberships(ctx context.Context, username string) ([]entity.OrgMembership, error)
+	UserSubmissions(ctx context.Context, username string) ([]entity.OrgSubmission, error)
+	Leave(ctx context.Context, username string) error
+}
+
+type service struct {
+	repo    Repository
+	logger  log.Logger
+	userSvc user.Service
+}
+
+// CreateOrgRequest represents an organization creation request.
+type CreateOrgRequest struct {
+	Name        string `json:"name" validate:"required,max=64" example:"ACME CSIRT"`
+	Description string `json:"description" validate:"max=1024"`
+}
+
+// UpdateOrgRequest represents an organization update request, only the
+// given fields are changed.
+type UpdateOrgRequest struct {
+	Name        *string `json:"name" validate:"omitempty,min=1,max=64"`
+	Description *string `json:"description" validate:"omitempty,max=1024"`
+}
+
+// SetMemberRequest represents the role given to a member.
+type SetMemberRequest struct {
+	Role string `json:"role" validate:"required,oneof=owner admin member" example:"member"`
+}
+
+// NewService creates a new organization service.
+func NewService(repo Repository, logger log.Logger,
+	userSvc user.Service) Service {
+	return service{repo, logger, userSvc}
+}
+
+// Exists checks if an organization exists for the given id.
+func (s service) Exists(ctx context.Context, id string) (bool, error) {
+	return s.repo.Exists(ctx, id)
+}
+
+// Get returns the organization with the specified ID, an organization is
+// only visible to its members and to admins.
+func (s service) Get(ctx context.Context, id string) (
+	entity.Organization, error) {
+
+	org, _, err := s.get(ctx, id)
+	return org, err
+}
+
+// Create creates a new organization, the logged in user becomes its owner.
+func (s service) Create(ctx context.Context, req CreateOrgRequest) (
+	entity.Organization, error) {
+
+	now := time.Now().Unix()
+	org := entity.Organization{
+		Meta:        &entity.DocMetadata{CreatedAt: now, LastUpdated: now, Version: 1},
+		Type:        "org",
+		ID:          entity.ID(),
+		Name:        strings.TrimSpace(req.Name),
+		Description: req.Description,
+		Username:    viewer(ctx),
+		Timestamp:   now,
+	}
+	if org.Name == "" {
+		return entity.Organization{}, errors.BadRequest("name is required")
+	}
+	if err := s.repo.Create(ctx, org); err != nil {
+		return entity.Organization{}, err
+	}
+
+	err := s.repo.AddMember(ctx, entity.OrgMembership{
+		Type:      "orgmember",
+		Org:       org.ID,
+		Username:  org.Username,
+		Role:      entity.OrgOwner,
+		Timestamp: now,
+	})
+	if err != nil {
+		return entity.Organization{}, err
+	}
+	org.MembersCount = 1
+	return org, nil
+}
+
+// Update changes the name or the description of an organization, only its
+// admins can update it.
+func (s service) Update(ctx context.Context, id string,
+	input UpdateOrgRequest) (entity.Organization, error) {
+
+	org, err := s.manageable(ctx, id, entity.OrgAdmin)
+	if err != nil {
+		return entity.Organization{}, err
+	}
+
+	if input.Name != nil {
+		org.Name = strings.TrimSpace(*input.Name)
+		if org.Name == "" {
+			return entity.Organization{}, errors.BadRequest("name is required")
+		}
+		if err = s.repo.Patch(ctx, org.ID, "name", org.Name); err != nil {
+			return entity.Organization{}, err
+		}
+	}
+	if input.Description != nil {
+		org.Description = *input.Description
+		err = s.repo.Patch(ctx, org.ID, "description", org.Description)
+		if err != nil {
+			return entity.Organization{}, err
+		}
+	}
+
+	org.Meta.LastUpdated = time.Now().Unix()
+	err = s.repo.Patch(ctx, org.ID, "doc.last_updated", org.Meta.LastUpdated)
+	return org, err
+}
+
+// Delete deletes an organization with its memberships and its private
+// submissions, only its owners can delete it. The files are kept.
+func (s service) Delete(ctx context.Context, id string) (
+	entity.Organization, error) {
+
+	org, err := s.manageable(ctx, id, entity.OrgOwner)
+	if err != nil {
+		return entity.Organization{}, err
+	}
+	err = s.repo.Delete(ctx, org.ID)
+	return org, err
+}
+
+// Count returns the number of organizations the logged in user is a
+// member of.
+func (s service) Count(ctx context.Context) (int, error) {
+	return s.repo.CountOrgs(ctx, viewer(ctx))
+}
+
+// Query returns the organizations the logged in user is a member of with
+// the specified offset and limit.
+func (s service) Query(ctx context.Context, offset, limit int) (
+	[]entity.Organization, error) {
+	return s.repo.Orgs(ctx, viewer(ctx), offset, limit)
+}
+
+// CountMembers returns the number of members of an organization.
+func (s service) CountMembers(ctx context.Context, id string) (int, error) {
+	org, _, err := s.get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return s.repo.CountMembers(ctx, org.ID, "")
+}
+
+// Members returns the members of an organization with the specified
+// offset and limit, only the members can list them.
+func (s service) Members(ctx context.Context, id string, offset,
+	limit int) ([]entity.OrgMembership, error) {
+
+	org, _, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.Members(ctx, org.ID, offset, limit)
+}
+
+// SetMember adds a user to an organization or changes the role of a
+// member. The admins manage the members, only the owners manage the admins
+// and the owners, and the last owner cannot be demoted.
+func (s service) SetMember(ctx context.Context, id, username string,
+	input SetMemberRequest) (entity.OrgMembership, error) {
+
+	org, err := s.manageable(ctx, id, entity.OrgAdmin)
+	if err != nil {
+		return entity.OrgMembership{}, err
+	}
+
+	username = strings.ToLower(username)
+	exists, err := s.userSvc.Exists(ctx, username)
+	if err != nil {
+		return entity.OrgMembership{}, err
+	}
+	if !exists {
+		return entity.OrgMembership{}, errors.BadRequest(
+			"user not found: " + username)
+	}
+
+	m, err := s.repo.Membership(ctx, org.ID, username)
+	if err != nil && err != db.ErrDocumentNotFound {
+		return entity.OrgMembership{}, err
+	}
+	isMember := err == nil
+
+	if input.Role != entity.OrgMember || (isMember && m.Role != entity.OrgMember) {
+		if _, err = s.manageable(ctx, id, entity.OrgOwner); err != nil {
+			return entity.OrgMembership{}, err
+		}
+	}
+
+	if !isMember {
+		m = entity.OrgMembership{
+			Type:      "orgmember",
+			Org:       org.ID,
+			Username:  username,
+			Role:      input.Role,
+			Timestamp: time.Now().Unix(),
+		}
+		return m, s.repo.AddMember(ctx, m)
+	}
+
+	if m.Role == input.Role {
+		return m, nil
+	}
+	if m.Role == entity.OrgOwner {
+		if err = s.keepOwner(ctx, org.ID); err != nil {
+			return entity.OrgMembership{}, err
+		}
+	}
+	m.Role = input.Role
+	return m, s.repo.SetRole(ctx, org.ID, username, m.Role)
+}
+
+// RemoveMember removes a user from an organization. The admins remove the
+// members, only the owners remove the admins and the owners, and any member
+// can leave. The last owner cannot leave.
+func (s service) RemoveMember(ctx context.Context, id, username string) error {
+	org, _, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	username = strings.ToLower(username)
+	m, err := s.repo.Membership(ctx, org.ID, username)
+	if err == db.ErrDocumentNotFound {
+		return errors.NotFound("user is not a member")
+	}
+	if err != nil {
+		return err
+	}
+
+	if username != viewer(ctx) {
+		required := entity.OrgAdmin
+		if m.Role != entity.OrgMember {
+			required = entity.OrgOwner
+		}
+		if _, err = s.manageable(ctx, id, required); err != nil {
+			return err
+		}
+	}
+	if m.Role == entity.OrgOwner {
+		if err = s.keepOwner(ctx, org.ID); err != nil {
+			return err
+		}
+	}
+	return s.repo.RemoveMember(ctx, org.ID, username)
+}
+
+// Submit records a file submitted privately to an organization by the
+// logged in user, who must be one of its members.
+func (s service) Submit(ctx context.Context, sub entity.OrgSubmission) error {
+	org, role, err := s.get(ctx, sub.Org)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return errors.Forbidden("not a member of the organization")
+	}
+
+	sub.Type = "orgsubmission"
+	sub.ID = entity.ID()
+	sub.Org = org.ID
+	sub.Username = viewer(ctx)
+	if sub.Timestamp == 0 {
+		sub.Timestamp = time.Now().Unix()
+	}
+	return s.repo.CreateSubmission(ctx, sub)
+}
+
+// CountSubmissions returns the number of private submissions of an
+// organization, optionally of a given file.
+func (s service) CountSubmissions(ctx context.Context, id, sha256 string) (
+	int, error) {
+
+	org, _, err := s.get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	return s.repo.CountSubmissions(ctx, org.ID, strings.ToLower(sha256))
+}
+
+// Submissions returns the private submissions of an organization with the
+// specified offset and limit, optionally of a given file. Only the members
+// can see them.
+func (s service) Submissions(ctx context.Context, id, sha256 string,
+	offset, limit int) ([]entity.OrgSubmission, error) {
+
+	org, _, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.Submissions(ctx, org.ID, strings.ToLower(sha256), offset,
+		limit)
+}
+
+// Memberships returns the memberships of a user to all organizations.
+func (s service) Memberships(ctx context.Context, username string) (
+	[]entity.OrgMembership, error) {
+	return s.repo.Memberships(ctx, strings.ToLower(username))
+}
+
+// UserSubmissions returns the private submissions made by a user.
+func (s service) UserSubmissions(ctx context.Context, username string) (
+	[]entity.OrgSubmission, error) {
+	return s.repo.UserSubmissions(ctx, strings.ToLower(username))
+}
+
+// Leave removes a user from all the organizations and anonymizes their
+// private submissions, as part of the erasure of the account. When the user
+// was the last owner, the oldest remaining member takes over, and an
+// organization left without members is deleted.
+func (s service) Leave(ctx context.Context, username string) error {
+	username = strings.ToLower(username)
+	ms, err := s.repo.Memberships(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if m.Role == entity.OrgOwner {
+			owners, err := s.repo.CountMembers(ctx, m.Org, entity.OrgOwner)
+			if err != nil {
+				return err
+			}
+			if owners <= 1 {
+				if err = s.handOver(ctx, m.Org, username); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		err = s.repo.RemoveMember(ctx, m.Org, username)
+		if err != nil && err != db.ErrDocumentNotFound {
+			return err
+		}
+	}
+	return s.repo.AnonymizeSubmissions(ctx, username)
+}
+
+// handOver removes the last owner of an organization, the oldest remaining
+// member becomes its owner, or the organization is deleted when empty.
+func (s service) handOver(ctx context.Context, org, username string) error {
+	ms, err := s.repo.Members(ctx, org, 0, 2)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if m.Username == username {
+			continue
+		}
+		err = s.repo.SetRole(ctx, org, m.Username, entity.OrgOwner)
+		if err != nil {
+			return err
+		}
+		return s.repo.RemoveMember(ctx, org, username)
+	}
+	return s.repo.Delete(ctx, org)
+}
+
+// get returns an organization visible to the logged in user and their
+// role in it, admins see all organizations even without a role.
+func (s service) get(ctx context.Context, id string) (
+	entity.Organization, string, error) {
+
+	org, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return entity.Organization{}, "", err
+	}
+	if org.Type != "org" {
+		return entity.Organization{}, "", errors.NotFound("")
+	}
+
+	m, err := s.repo.Membership(ctx, org.ID, viewer(ctx))
+	if err != nil && err != db.ErrDocumentNotFound {
+		return entity.Organization{}, "", err
+	}
+	if m.Role == "" && !isAdmin(ctx) {
+		return entity.Organization{}, "", errors.NotFound("")
+	}
+	return org, m.Role, nil
+}
+
+// manageable returns an organization in which the logged in user has at
+// least the given role, admins manage all organizations.
+func (s service) manageable(ctx context.Context, id, role string) (
+	entity.Organization, error) {
+
+	org, r, err := s.get(ctx, id)
+	if err != nil {
+		return entity.Organization{}, err
+	}
+	if !isAdmin(ctx) && rank(r) < rank(role) {
+		return entity.Organization{}, errors.Forbidden("")
+	}
+	return org, nil
+}
+
+// keepOwner checks that an organization has another owner before one is
+// demoted or removed.
+func (s service) keepOwner(ctx context.Context, org string) error {
+	owners, err := s.repo.CountMembers(ctx, org, entity.OrgOwner)
+	if err != nil {
+		return err
+	}
+	if owners <= 1 {
+		return errors.BadRequest("an organization needs at least one owner")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package org
+
+import (
+	"context"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
+)
+
+// viewer returns the ID of the logged in user, empty when anonymous.
+func viewer(ctx context.Context) string {
+	user, _ := ctx.Value(entity.UserKey).(entity.User)
+	return user.ID()
+}
+
+// isAdmin checks if the logged in user is an admin of the platform.
+func isAdmin(ctx context.Context) bool {
+	user, ok := ctx.Value(entity.UserKey).(entity.User)
+	return ok && user.IsAdmin()
+}
+
+// rank orders the roles in an organization, a user without a role ranks
+// the lowest.
+func rank(role string) int {
+	switch role {
+	case entity.OrgOwner:
+		return 3
+	case entity.OrgAdmin:
+		return 2
+	case entity.OrgMember:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package privacy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/saferwall/saferwall-api/internal/errors"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func RegisterHandlers(g *echo.Group, service Service, logger log.Logger,
+	requireLogin, verifyUser echo.MiddlewareFunc) {
+
+	res := resource{service, logger}
+
+	g.GET("/users/:username/export/", res.export, verifyUser, requireLogin)
+	g.DELETE("/users/:username/", res.erase, verifyUser, requireLogin)
+
+	// The progress of an erasure outlives the account.
+	g.GET("/users/:username/erasure/", res.erasure, requireLogin)
+}
+
+// @Summary Export the personal data of a user
+// @Description Download a zip archive of the personal data of a user: the
+// @Description profile, the avatar, the comments, the activities, the
+// @Description submissions, the relationships, the collections, the tags,
+// @Description the notifications, the organizations and the private
+// @Description submissions. Only the user or an admin can export it.
+// @Tags User
+// @Produce mpfd
+// @Param username path string true "Username"
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /users/{username}/export/ [get]
+// @Security Bearer
+func (r resource) export(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := strings.ToLower(c.Param("username"))
+	if !canAccess(ctx, username) {
+		return errors.Forbidden("")
+	}
+
+	exp, err := r.service.Export(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	header := c.Response().Header()
+	header.Set("Content-Type", "application/zip")
+	header.Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%s-export.zip", username))
+	header.Set("Cache-Control", "no-store")
+	c.Response().WriteHeader(http.StatusOK)
+
+	// The response is already committed, errors can only be logged.
+	if err = exp.Write(c.Response()); err != nil {
+		r.logger.With(ctx).Errorf("failed to write the export of %s: %v",
+			username, err)
+	}
+	return nil
+}
+
+// @Summary Erase a user and their personal data
+// @Description Start the erasure of a user: the comments are replaced by
+// @Description anonymous tombstones, the relationships, the activities, the
+// @Description notifications, the collections, the tags, the memberships of
+// @Description organizations and the avatar are removed, and the account
+// @Description deleted last. The erasure runs in
+// @Description the background, its progress is returned. Only the user or an
+// @Description admin can erase it.
+// @Tags User
+// @Produce json
+// @Param username path string true "Username"
+// @Success 202 {object} entity.Erasure
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /users/{username}/ [delete]
+// @Security Bearer
+func (r resource) erase(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := strings.ToLower(c.Param("username"))
+	if !canAccess(ctx, username) {
+		return errors.Forbidden("")
+	}
+
+	e, err := r.service.Erase(ctx, username)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, e)
+}
+
+// @Summary Get the progress of the erasure of a user
+// @Description Returns the progress of the erasure of a user, it remains
+// @Description available once the account is deleted. Only the user or an
+// @Description admin can follow it.
+// @Tags User
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} entity.Erasure
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 403 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /users/{username}/erasure/ [get]
+// @Security Bearer
+func (r resource) erasure(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := strings.ToLower(c.Param("username"))
+	if !regUsername.MatchString(username) {
+		return errors.BadRequest("invalid username string")
+	}
+	if !canAccess(ctx, username) {
+		return errors.Forbidden("")
+	}
+
+	e, err := r.service.Erasure(ctx, username)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, e)
+}
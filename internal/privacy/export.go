@@ -0,0 +1,84 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package privacy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+
+	"github.com/h2non/filetype"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
+)
+
+// Export holds the personal data of a user.
+type Export struct {
+	Profile        entity.User
+	Avatar         []byte
+	Comments       []entity.Comment
+	Activities     []entity.Activity
+	Submissions    []Submission
+	Likes          []entity.Edge
+	Votes          []entity.Edge
+	Following      []entity.Edge
+	Followers      []entity.Edge
+	Collections    []entity.Collection
+	Tags           []entity.UserTag
+	Notifications  []entity.Notification
+	Orgs           []entity.OrgMembership
+	OrgSubmissions []entity.OrgSubmission
+}
+
+// Write writes the personal data of a user as a zip archive holding a JSON
+// document for each kind of data, and the avatar.
+func (e Export) Write(w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	for _, doc := range []struct {
+		name string
+		val  interface{}
+	}{
+		{"profile.json", e.Profile},
+		{"comments.json", e.Comments},
+		{"activities.json", e.Activities},
+		{"submissions.json", e.Submissions},
+		{"likes.json", e.Likes},
+		{"votes.json", e.Votes},
+		{"following.json", e.Following},
+		{"followers.json", e.Followers},
+		{"collections.json", e.Collections},
+		{"tags.json", e.Tags},
+		{"notifications.json", e.Notifications},
+		{"organizations.json", e.Orgs},
+		{"org_submissions.json", e.OrgSubmissions},
+	} {
+		f, err := zw.Create(doc.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(doc.val); err != nil {
+			return err
+		}
+	}
+
+	if len(e.Avatar) > 0 {
+		name := "avatar"
+		if kind, _ := filetype.Match(e.Avatar); kind != filetype.Unknown {
+			name += "." + kind.Extension
+		}
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(e.Avatar); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
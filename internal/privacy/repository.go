@@ -0,0 +1,346 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package privacy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access the personal data of users
+// from the data source.
+type Repository interface {
+	// Erasure returns the erasure of the data of a user.
+	Erasure(ctx context.Context, username string) (entity.Erasure, error)
+	// SaveErasure creates or replaces the erasure of the data of a user.
+	SaveErasure(ctx context.Context, e entity.Erasure) error
+	// Comments returns the comments written by a user, the deleted ones
+	// included when tombstones is set.
+	Comments(ctx context.Context, username string, tombstones bool) (
+		[]entity.Comment, error)
+	// Activities returns the activities of a user.
+	Activities(ctx context.Context, username string) ([]entity.Activity, error)
+	// Edges returns the relationships starting from a user and the follows
+	// of the user by others.
+	Edges(ctx context.Context, username string) ([]entity.Edge, error)
+	// Submissions returns the files submitted by a user.
+	Submissions(ctx context.Context, username string) ([]Submission, error)
+	// Collections returns the collections owned by a user.
+	Collections(ctx context.Context, username string) (
+		[]entity.Collection, error)
+	// UserTags returns the tags attached to files by a user.
+	UserTags(ctx context.Context, username string) ([]entity.UserTag, error)
+	// Notifications returns the notifications received by a user.
+	Notifications(ctx context.Context, username string) (
+		[]entity.Notification, error)
+	// AnonymizeComments removes the author of the comments written by a
+	// user.
+	AnonymizeComments(ctx context.Context, username string) error
+	// RemoveReports removes the reports made by a user on comments.
+	RemoveReports(ctx context.Context, username string) error
+	// RemoveMentions removes a user from the mentions of the comments.
+	RemoveMentions(ctx context.Context, username string) error
+	// AnonymizeSubmission removes the country a file was submitted from.
+	AnonymizeSubmission(ctx context.Context, s Submission) error
+	// DeleteEdge removes a relationship.
+	DeleteEdge(ctx context.Context, edge entity.Edge) error
+	// DeleteActivities removes the activities of a user and the follows
+	// of the user by others.
+	DeleteActivities(ctx context.Context, username string) error
+	// DeleteNotifications removes the notifications received or caused by
+	// a user and the scans they wait for.
+	DeleteNotifications(ctx context.Context, username string) error
+}
+
+// Submission represents a file submitted by a user.
+type Submission struct {
+	SHA256    string `json:"sha256"`
+	Filename  string `json:"filename,omitempty"`
+	Source    string `json:"src,omitempty"`
+	Country   string `json:"country,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// repository accesses the personal data of users in database.
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new privacy repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Erasure reads the erasure of the data of a user from the database.
+func (r repository) Erasure(ctx context.Context, username string) (
+	entity.Erasure, error) {
+	var e entity.Erasure
+	err := r.db.Get(ctx, entity.ErasureID(username), &e)
+	return e, err
+}
+
+// SaveErasure saves the erasure of the data of a user in the database.
+func (r repository) SaveErasure(ctx context.Context, e entity.Erasure) error {
+	e.Type = "erasure"
+	err := r.db.Create(ctx, e.ID(), &e)
+	if errors.Is(err, dbcontext.ErrDocumentExists) {
+		return r.db.Update(ctx, e.ID(), &e)
+	}
+	return err
+}
+
+// Comments retrieves the comments written by a user from the database, the
+// oldest first.
+func (r repository) Comments(ctx context.Context, username string,
+	tombstones bool) ([]entity.Comment, error) {
+
+	statement := "SELECT c.* FROM `" + r.db.Bucket.Name() + "` c " +
+		"WHERE c.`type` = $docType AND LOWER(c.username) = $username"
+	if !tombstones {
+		statement += " AND IFMISSINGORNULL(c.status, '') != $deleted"
+	}
+	statement += " ORDER BY c.timestamp"
+
+	var comments []entity.Comment
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "comment",
+		"username": username,
+		"deleted":  entity.CommentDeleted,
+	}, &comments)
+	return comments, err
+}
+
+// Activities retrieves the activities of a user from the database, the
+// oldest first.
+func (r repository) Activities(ctx context.Context, username string) (
+	[]entity.Activity, error) {
+
+	statement := "SELECT META(a).id, a.* FROM `" + r.db.Bucket.Name() + "` a " +
+		"WHERE a.`type` = $docType AND LOWER(a.username) = $username " +
+		"ORDER BY a.timestamp"
+
+	var activities []entity.Activity
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "activity",
+		"username": username,
+	}, &activities)
+	return activities, err
+}
+
+// Edges retrieves the relationships of a user from the database.
+func (r repository) Edges(ctx context.Context, username string) (
+	[]entity.Edge, error) {
+
+	statement := "SELECT e.* FROM `" + r.db.Bucket.Name() + "` e " +
+		"WHERE e.`type` = $docType AND (e.username = $username " +
+		"OR (e.kind = $follow AND e.target = $username)) ORDER BY e.ts"
+
+	var edges []entity.Edge
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "edge",
+		"follow":   entity.EdgeFollow,
+		"username": username,
+	}, &edges)
+	return edges, err
+}
+
+// Submissions retrieves the files submitted by a user from the database,
+// the submission of a file is the one made at the time of the edge.
+func (r repository) Submissions(ctx context.Context, username string) (
+	[]Submission, error) {
+
+	statement := "SELECT e.target AS sha256, e.ts AS `timestamp`, " +
+		"s.filename, s.src, s.country " +
+		"FROM `" + r.db.Bucket.Name() + "` e " +
+		"LEFT JOIN `" + r.db.Bucket.Name() + "` f ON KEYS e.target " +
+		"LET s = FIRST x FOR x IN IFMISSINGORNULL(f.submissions, []) " +
+		"WHEN x.`timestamp` = e.ts END " +
+		"WHERE e.`type` = $docType AND e.kind = $submit " +
+		"AND e.username = $username ORDER BY e.ts"
+
+	var submissions []Submission
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "edge",
+		"submit":   entity.EdgeSubmit,
+		"username": username,
+	}, &submissions)
+	return submissions, err
+}
+
+// Collections retrieves the collections owned by a user from the database.
+func (r repository) Collections(ctx context.Context, username string) (
+	[]entity.Collection, error) {
+
+	statement := "SELECT d.* FROM `" + r.db.Bucket.Name() + "` d " +
+		"WHERE d.`type` = $docType AND d.username = $username " +
+		"ORDER BY d.timestamp"
+
+	var cols []entity.Collection
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "collection",
+		"username": username,
+	}, &cols)
+	return cols, err
+}
+
+// UserTags retrieves the tags attached to files by a user from the
+// database.
+func (r repository) UserTags(ctx context.Context, username string) (
+	[]entity.UserTag, error) {
+
+	statement := "SELECT t.* FROM `" + r.db.Bucket.Name() + "` t " +
+		"WHERE t.`type` = $docType AND t.username = $username ORDER BY t.ts"
+
+	var tags []entity.UserTag
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "usertag",
+		"username": username,
+	}, &tags)
+	return tags, err
+}
+
+// Notifications retrieves the notifications received by a user from the
+// database.
+func (r repository) Notifications(ctx context.Context, username string) (
+	[]entity.Notification, error) {
+
+	statement := "SELECT n.* FROM `" + r.db.Bucket.Name() + "` n " +
+		"WHERE n.`type` = $docType AND n.username = $username " +
+		"ORDER BY n.timestamp"
+
+	var notifications []entity.Notification
+	err := r.query(ctx, statement, map[string]interface{}{
+		"docType":  "notification",
+		"username": username,
+	}, &notifications)
+	return notifications, err
+}
+
+// AnonymizeComments removes the author of the comments written by a user
+// in the database, the comments must already be tombstones.
+func (r repository) AnonymizeComments(ctx context.Context,
+	username string) error {
+
+	statement := "UPDATE `" + r.db.Bucket.Name() + "` c UNSET c.username " +
+		"WHERE c.`type` = $docType AND LOWER(c.username) = $username"
+
+	return r.exec(ctx, statement, map[string]interface{}{
+		"docType":  "comment",
+		"username": username,
+	})
+}
+
+// RemoveReports removes the reports made by a user from the comments in
+// the database.
+func (r repository) RemoveReports(ctx context.Context, username string) error {
+	statement := "UPDATE `" + r.db.Bucket.Name() + "` c " +
+		"SET c.reports = ARRAY x FOR x IN c.reports " +
+		"WHEN x.username != $username END, " +
+		"c.reports_count = c.reports_count - 1 " +
+		"WHERE c.`type` = $docType " +
+		"AND ANY x IN c.reports SATISFIES x.username = $username END"
+
+	return r.exec(ctx, statement, map[string]interface{}{
+		"docType":  "comment",
+		"username": username,
+	})
+}
+
+// RemoveMentions removes a user from the mentions of the comments in the
+// database.
+func (r repository) RemoveMentions(ctx context.Context, username string) error {
+	statement := "UPDATE `" + r.db.Bucket.Name() + "` c " +
+		"SET c.mentions = ARRAY_REMOVE(c.mentions, $username) " +
+		"WHERE c.`type` = $docType " +
+		"AND ANY m IN c.mentions SATISFIES m = $username END"
+
+	return r.exec(ctx, statement, map[string]interface{}{
+		"docType":  "comment",
+		"username": username,
+	})
+}
+
+// AnonymizeSubmission removes the country from the submission of a file in
+// the database.
+func (r repository) AnonymizeSubmission(ctx context.Context,
+	s Submission) error {
+
+	statement := "UPDATE `" + r.db.Bucket.Name() + "` f USE KEYS $sha256 " +
+		"SET f.submissions = ARRAY (CASE WHEN x.`timestamp` = $ts " +
+		"THEN OBJECT_REMOVE(x, 'country') ELSE x END) " +
+		"FOR x IN f.submissions END"
+
+	return r.exec(ctx, statement, map[string]interface{}{
+		"sha256": s.SHA256,
+		"ts":     s.Timestamp,
+	})
+}
+
+// DeleteEdge deletes a relationship from the database.
+func (r repository) DeleteEdge(ctx context.Context, edge entity.Edge) error {
+	err := r.db.Delete(ctx, edge.ID())
+	if errors.Is(err, dbcontext.ErrDocumentNotFound) {
+		return nil
+	}
+	return err
+}
+
+// DeleteActivities deletes the activities of a user and the follows of the
+// user by others from the database.
+func (r repository) DeleteActivities(ctx context.Context,
+	username string) error {
+
+	statement := "DELETE FROM `" + r.db.Bucket.Name() + "` a " +
+		"WHERE a.`type` = $docType AND (LOWER(a.username) = $username " +
+		"OR (a.kind = $follow AND LOWER(a.target) = $username))"
+
+	return r.exec(ctx, statement, map[string]interface{}{
+		"docType":  "activity",
+		"follow":   "follow",
+		"username": username,
+	})
+}
+
+// DeleteNotifications deletes the notifications received or caused by a
+// user and the scans they wait for from the database.
+func (r repository) DeleteNotifications(ctx context.Context,
+	username string) error {
+
+	statement := "DELETE FROM `" + r.db.Bucket.Name() + "` n " +
+		"WHERE (n.`type` = $docType AND (n.username = $username " +
+		"OR LOWER(n.actor) = $username)) " +
+		"OR (n.`type` = $watchType AND n.username = $username)"
+
+	return r.exec(ctx, statement, map[string]interface{}{
+		"docType":   "notification",
+		"watchType": "scanwatch",
+		"username":  username,
+	})
+}
+
+// query runs a statement and decodes its rows into val.
+func (r repository) query(ctx context.Context, statement string,
+	params map[string]interface{}, val interface{}) error {
+
+	var res interface{}
+	if err := r.db.Query(ctx, statement, params, &res); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(res)
+	return json.Unmarshal(b, val)
+}
+
+// exec runs a statement which returns no rows.
+func (r repository) exec(ctx context.Context, statement string,
+	params map[string]interface{}) error {
+	var res interface{}
+	return r.db.Query(ctx, statement, params, &res)
+}
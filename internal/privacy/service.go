@@ -0,0 +1,364 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package privacy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/auth"
+	"github.com/saferwall/saferwall-api/internal/collection"
+	"github.com/saferwall/saferwall-api/internal/comment"
+	dbcontext "github.com/saferwall/saferwall-api/internal/db"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/file"
+	"github.com/saferwall/saferwall-api/internal/org"
+	"github.com/saferwall/saferwall-api/internal/storage"
+	"github.com/saferwall/saferwall-api/internal/user"
+	"github.com/saferwall/saferwall-api/pkg/avatar"
+	"github.com/saferwall/saferwall-api/pkg/log"
+)
+
+// erasureTimeout is the time after which an erasure which made no progress
+// is considered interrupted and can be started again.
+var erasureTimeout = time.Duration(time.Minute * 30)
+
+// Service encapsulates use case logic for the personal data of users.
+type Service interface {
+	Export(ctx context.Context, username string) (Export, error)
+	Erase(ctx context.Context, username string) (entity.Erasure, error)
+	Erasure(ctx context.Context, username string) (entity.Erasure, error)
+}
+
+// Storage represents the object storage holding the avatars.
+type Storage interface {
+	Download(ctx context.Context, bucket, key string, file io.Writer) error
+	Delete(ctx context.Context, bucket, key string) error
+}
+
+type service struct {
+	repo          Repository
+	logger        log.Logger
+	objSto        Storage
+	avatarBucket  string
+	userSvc       user.Service
+	fileSvc       file.Service
+	commentSvc    comment.Service
+	collectionSvc collection.Service
+	orgSvc        org.Service
+}
+
+// erasureStep is a step of the erasure of the data of a user, every step
+// can be run again when a previous erasure failed.
+type erasureStep struct {
+	name string
+	run  func(ctx context.Context, username string) error
+}
+
+// NewService creates a new privacy service.
+func NewService(repo Repository, logger log.Logger, objSto Storage,
+	avatarBucket string, userSvc user.Service, fileSvc file.Service,
+	commentSvc comment.Service, collectionSvc collection.Service,
+	orgSvc org.Service) Service {
+	return service{repo, logger, objSto, avatarBucket, userSvc, fileSvc,
+		commentSvc, collectionSvc, orgSvc}
+}
+
+// Export gathers the personal data of a user.
+func (s service) Export(ctx context.Context, username string) (Export,
+	error) {
+
+	exp := Export{Likes: []entity.Edge{}, Votes: []entity.Edge{},
+		Following: []entity.Edge{}, Followers: []entity.Edge{}}
+
+	usr, err := s.userSvc.Get(ctx, username)
+	if err != nil {
+		return Export{}, err
+	}
+	username = usr.ID()
+	exp.Profile = usr.User
+	exp.Profile.Password = ""
+
+	avatar := new(bytes.Buffer)
+	err = s.objSto.Download(ctx, s.avatarBucket, username, avatar)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		return Export{}, err
+	}
+	exp.Avatar = avatar.Bytes()
+
+	if exp.Comments, err = s.repo.Comments(ctx, username, false); err != nil {
+		return Export{}, err
+	}
+	if exp.Activities, err = s.repo.Activities(ctx, username); err != nil {
+		return Export{}, err
+	}
+	if exp.Submissions, err = s.repo.Submissions(ctx, username); err != nil {
+		return Export{}, err
+	}
+	if exp.Collections, err = s.repo.Collections(ctx, username); err != nil {
+		return Export{}, err
+	}
+	if exp.Tags, err = s.repo.UserTags(ctx, username); err != nil {
+		return Export{}, err
+	}
+	exp.Notifications, err = s.repo.Notifications(ctx, username)
+	if err != nil {
+		return Export{}, err
+	}
+	if exp.Orgs, err = s.orgSvc.Memberships(ctx, username); err != nil {
+		return Export{}, err
+	}
+	exp.OrgSubmissions, err = s.orgSvc.UserSubmissions(ctx, username)
+	if err != nil {
+		return Export{}, err
+	}
+
+	edges, err := s.repo.Edges(ctx, username)
+	if err != nil {
+		return Export{}, err
+	}
+	for _, edge := range edges {
+		switch {
+		case edge.Kind == entity.EdgeLike:
+			exp.Likes = append(exp.Likes, edge)
+		case edge.Kind == entity.EdgeVote:
+			exp.Votes = append(exp.Votes, edge)
+		case edge.Kind == entity.EdgeFollow && edge.Username == username:
+			exp.Following = append(exp.Following, edge)
+		case edge.Kind == entity.EdgeFollow:
+			exp.Followers = append(exp.Followers, edge)
+		}
+	}
+	return exp, nil
+}
+
+// Erase starts the erasure of the data of a user in the background and
+// returns its progress. An erasure already running is returned as is.
+func (s service) Erase(ctx context.Context, username string) (
+	entity.Erasure, error) {
+
+	usr, err := s.userSvc.Get(ctx, username)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+	username = usr.ID()
+
+	e, err := s.repo.Erasure(ctx, username)
+	if err != nil && !errors.Is(err, dbcontext.ErrDocumentNotFound) {
+		return entity.Erasure{}, err
+	}
+	if err == nil && e.Status == entity.ErasureRunning &&
+		time.Since(time.Unix(e.UpdatedAt, 0)) < erasureTimeout {
+		return e, nil
+	}
+
+	now := time.Now().Unix()
+	requester, _ := ctx.Value(entity.UserKey).(entity.User)
+	e = entity.Erasure{
+		Username:    username,
+		RequestedBy: requester.ID(),
+		Status:      entity.ErasureRunning,
+		Total:       len(s.erasureSteps()),
+		StartedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err = s.repo.SaveErasure(ctx, e); err != nil {
+		return entity.Erasure{}, err
+	}
+
+	// The erasure outlives the request, it acts on behalf of the user.
+	go s.erase(auth.WithUser(context.Background(), username, false), e)
+
+	return e, nil
+}
+
+// Erasure returns the progress of the erasure of the data of a user.
+func (s service) Erasure(ctx context.Context, username string) (
+	entity.Erasure, error) {
+	return s.repo.Erasure(ctx, username)
+}
+
+// erase runs the steps of an erasure, saving its progress after each one.
+func (s service) erase(ctx context.Context, e entity.Erasure) {
+	for i, step := range s.erasureSteps() {
+		e.Step = step.name
+		e.Done = i
+		e.UpdatedAt = time.Now().Unix()
+		if err := s.repo.SaveErasure(ctx, e); err != nil {
+			s.logger.Errorf("failed to save the erasure of %s: %v",
+				e.Username, err)
+		}
+
+		if err := step.run(ctx, e.Username); err != nil {
+			s.logger.Errorf("failed to erase the %s of %s: %v", step.name,
+				e.Username, err)
+			e.Status = entity.ErasureFailed
+			e.Error = err.Error()
+			e.UpdatedAt = time.Now().Unix()
+			if err = s.repo.SaveErasure(ctx, e); err != nil {
+				s.logger.Errorf("failed to save the erasure of %s: %v",
+					e.Username, err)
+			}
+			return
+		}
+	}
+
+	e.Status = entity.ErasureDone
+	e.Step = ""
+	e.Done = e.Total
+	e.UpdatedAt = time.Now().Unix()
+	if err := s.repo.SaveErasure(ctx, e); err != nil {
+		s.logger.Errorf("failed to save the erasure of %s: %v", e.Username,
+			err)
+	}
+}
+
+// erasureSteps returns the steps of an erasure, the account is removed
+// last so that the other steps can still update its counters.
+func (s service) erasureSteps() []erasureStep {
+	return []erasureStep{
+		{"comments", s.eraseComments},
+		{"mentions", s.eraseMentions},
+		{"relationships", s.eraseRelationships},
+		{"submissions", s.eraseSubmissions},
+		{"tags", s.eraseTags},
+		{"collections", s.eraseCollections},
+		{"organizations", s.orgSvc.Leave},
+		{"activities", s.repo.DeleteActivities},
+		{"notifications", s.repo.DeleteNotifications},
+		{"avatar", s.eraseAvatar},
+		{"account", s.eraseAccount},
+	}
+}
+
+// eraseComments replaces the comments of a user by anonymous tombstones,
+// which keep the replies of others threaded.
+func (s service) eraseComments(ctx context.Context, username string) error {
+	comments, err := s.repo.Comments(ctx, username, false)
+	if err != nil {
+		return err
+	}
+	for _, com := range comments {
+		if _, err = s.commentSvc.Delete(ctx, com.ID); err != nil {
+			return err
+		}
+	}
+	return s.repo.AnonymizeComments(ctx, username)
+}
+
+// eraseMentions removes a user from the mentions and the reports of the
+// comments of others.
+func (s service) eraseMentions(ctx context.Context, username string) error {
+	if err := s.repo.RemoveMentions(ctx, username); err != nil {
+		return err
+	}
+	return s.repo.RemoveReports(ctx, username)
+}
+
+// eraseRelationships removes the likes, the votes and the follows of a
+// user, the counters of the other ends are updated. The relationships with
+// a user or a file which is gone are deleted directly.
+func (s service) eraseRelationships(ctx context.Context, username string) error {
+	edges, err := s.repo.Edges(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, edge := range edges {
+		switch {
+		case edge.Kind == entity.EdgeLike:
+			err = s.fileSvc.Unlike(ctx, edge.Target)
+		case edge.Kind == entity.EdgeVote:
+			_, err = s.fileSvc.Unvote(ctx, edge.Target)
+		case edge.Kind == entity.EdgeFollow && edge.Username == username:
+			err = s.userSvc.UnFollow(ctx, edge.Target)
+		case edge.Kind == entity.EdgeFollow:
+			err = s.userSvc.UnFollow(
+				auth.WithUser(ctx, edge.Username, false), username)
+		default:
+			continue
+		}
+		if errors.Is(err, dbcontext.ErrDocumentNotFound) {
+			err = s.repo.DeleteEdge(ctx, edge)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseSubmissions removes the submissions of a user, the files are kept
+// without the country they were submitted from.
+func (s service) eraseSubmissions(ctx context.Context, username string) error {
+	submissions, err := s.repo.Submissions(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, submission := range submissions {
+		err = s.repo.AnonymizeSubmission(ctx, submission)
+		if err != nil && !errors.Is(err, dbcontext.ErrDocumentNotFound) {
+			return err
+		}
+		err = s.repo.DeleteEdge(ctx, entity.Edge{Kind: entity.EdgeSubmit,
+			Username: username, Target: submission.SHA256})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseTags removes the tags attached to files by a user.
+func (s service) eraseTags(ctx context.Context, username string) error {
+	tags, err := s.repo.UserTags(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = s.fileSvc.RemoveTag(ctx, tag.SHA256, tag.Tag)
+		if err != nil && !errors.Is(err, dbcontext.ErrDocumentNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseCollections deletes the collections of a user.
+func (s service) eraseCollections(ctx context.Context, username string) error {
+	cols, err := s.repo.Collections(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, col := range cols {
+		if _, err = s.collectionSvc.Delete(ctx, col.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseAvatar deletes the avatar of a user and its scaled copies from the
+// object storage.
+func (s service) eraseAvatar(ctx context.Context, username string) error {
+	for _, size := range avatar.Variants {
+		err := s.objSto.Delete(ctx, s.avatarBucket, avatar.Key(username, size))
+		if err != nil {
+			return err
+		}
+	}
+	return s.objSto.Delete(ctx, s.avatarBucket, username)
+}
+
+// eraseAccount deletes the document of a user.
+func (s service) eraseAccount(ctx context.Context, username string) error {
+	_, err := s.userSvc.Delete(ctx, username)
+	if errors.Is(err, dbcontext.ErrDocumentNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package privacy
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
+)
+
+var (
+	regUsername = regexp.MustCompile(`^[a-zA-Z0-9]{1,20}$`)
+)
+
+// canAccess checks if the logged in user can access the personal data of a
+// user: only the user themselves or an admin can.
+func canAccess(ctx context.Context, username string) bool {
+	user, ok := ctx.Value(entity.UserKey).(entity.User)
+	return ok && (user.ID() == username || user.IsAdmin())
+}
@@ -16,12 +16,18 @@ type Type int
 // Key is the identifier which can map to one or multiple fields
 // if none is provided it's assumed that the field is the identifier.
 // if Type is not provided it's assumed to be a string.
+// Resolve maps a value to the IDs of the matching documents instead, for
+// the identifiers which are not part of the indexed documents.
 type Config map[string]struct {
 	Type       Type
 	Field      string
 	FieldGroup []string
+	Resolve    Resolver
 }
 
+// Resolver returns the IDs of the documents matching a value.
+type Resolver func(value string) ([]string, error)
+
 const (
 	STRING Type = iota
 	NUMBER
@@ -56,6 +62,9 @@ func Generate(input string, cfg Config) (search.Query, error) {
 		if v.Field != "" && len(v.FieldGroup) != 0 {
 			panic("config can not have path and path group at the same time")
 		}
+		if v.Resolve != nil && (v.Field != "" || len(v.FieldGroup) != 0) {
+			panic("config can not have a resolver and a path at the same time")
+		}
 	}
 	config = cfg
 	result, err := GenerateCouchbaseFTS(expr)
@@ -99,6 +108,10 @@ func generateBinaryCouchbase(expr *parser.BinaryExpression) (search.Query, error
 }
 
 func generateComparisonCouchbase(expr *parser.ComparisonExpression) (search.Query, error) {
+	if resolve := config[expr.Left].Resolve; resolve != nil {
+		return buildResolvedQuery(expr.Left, expr.Right, expr.Operator.Type, resolve)
+	}
+
 	if len(config[expr.Left].FieldGroup) != 0 {
 		queries := []search.Query{}
 		for _, field := range config[expr.Left].FieldGroup {
@@ -152,6 +165,31 @@ func buildComparisonQuery(field, value string, operator token.TokenType, valueTy
 	}
 }
 
+// buildResolvedQuery matches the documents a resolver returns for a value,
+// only equality and inequality are supported.
+func buildResolvedQuery(identifier, value string, operator token.TokenType,
+	resolve Resolver) (search.Query, error) {
+
+	if operator != token.ASSIGN && operator != token.NOT_EQ {
+		return nil, fmt.Errorf("unsupported comparison operator for %s: %s",
+			identifier, operator)
+	}
+	ids, err := resolve(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var query search.Query = search.NewMatchNoneQuery()
+	if len(ids) > 0 {
+		query = search.NewDocIDQuery(ids...)
+	}
+	if operator == token.NOT_EQ {
+		return search.NewBooleanQuery().Must(search.NewMatchAllQuery()).
+			MustNot(query), nil
+	}
+	return query, nil
+}
+
 func buildRangeQuery(field, value string, operator token.TokenType, valueType Type) (search.Query, error) {
 	isInclusive := operator == token.GE || operator == token.LE
 	switch operator {
@@ -2,6 +2,7 @@ package gen
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 
@@ -326,6 +327,93 @@ func TestGenerate(t *testing.T) {
 			},
 			wanted: search.NewNumericRangeQuery().Field("first_seen").Min(float32(1672531200), true).Max(float32(1672531200), true),
 		},
+		{
+			name:  "resolved identifier",
+			input: "technique=T1055 AND type=pe",
+			config: Config{
+				"technique": {Resolve: techniques},
+				"type":      {},
+			},
+			wanted: search.NewConjunctionQuery(
+				search.NewDocIDQuery("a1", "b2"),
+				search.NewMatchQuery("pe").Field("type"),
+			),
+		},
+		{
+			name:  "resolved identifier not equals",
+			input: "technique!=T1055",
+			config: Config{
+				"technique": {Resolve: techniques},
+			},
+			wanted: search.NewBooleanQuery().Must(search.NewMatchAllQuery()).
+				MustNot(search.NewDocIDQuery("a1", "b2")),
+		},
+		{
+			name:  "resolved identifier without match",
+			input: "technique=T1003",
+			config: Config{
+				"technique": {Resolve: techniques},
+			},
+			wanted: search.NewMatchNoneQuery(),
+		},
+		{
+			name:  "resolved identifier range",
+			input: "technique>T1055",
+			config: Config{
+				"technique": {Resolve: techniques},
+			},
+			wantErr:     true,
+			errContains: "unsupported comparison operator for technique",
+		},
+		{
+			name:  "resolver failure",
+			input: "technique=invalid",
+			config: Config{
+				"technique": {Resolve: techniques},
+			},
+			wantErr:     true,
+			errContains: "invalid technique",
+		},
+		{
+			name:  "user tag",
+			input: "usertag=apt28",
+			config: Config{
+				"usertag": {Field: "user_tags"},
+			},
+			wanted: search.NewMatchQuery("apt28").Field("user_tags"),
+		},
+		{
+			name:  "quoted user tag",
+			input: `usertag="cobalt-strike" OR usertag!=apt28`,
+			config: Config{
+				"usertag": {Field: "user_tags"},
+			},
+			wanted: search.NewDisjunctionQuery(
+				search.NewMatchQuery("cobalt-strike").Field("user_tags"),
+				search.NewBooleanQuery().MustNot(
+					search.NewMatchQuery("apt28").Field("user_tags")),
+			),
+		},
+		{
+			name:  "collection",
+			input: `collection="5f0c1d2e-8c4a-4b4e-9a51-2f3d6f1b7c90" AND type=pe`,
+			config: Config{
+				"collection": {Resolve: collections},
+				"type":       {},
+			},
+			wanted: search.NewConjunctionQuery(
+				search.NewDocIDQuery("a1", "c3"),
+				search.NewMatchQuery("pe").Field("type"),
+			),
+		},
+		{
+			name:  "private collection",
+			input: `collection="0d9a3b1e-5f1c-4c2e-8e7a-6b4f2c1d9e80"`,
+			config: Config{
+				"collection": {Resolve: collections},
+			},
+			wanted: search.NewMatchNoneQuery(),
+		},
 		{
 			name:  "wildcard values",
 			input: "type=p*",
@@ -356,3 +444,24 @@ func TestGenerate(t *testing.T) {
 		})
 	}
 }
+
+// techniques resolves the files exhibiting an ATT&CK technique.
+func techniques(value string) ([]string, error) {
+	switch value {
+	case "T1055":
+		return []string{"a1", "b2"}, nil
+	case "invalid":
+		return nil, errors.New("invalid technique")
+	default:
+		return nil, nil
+	}
+}
+
+// collections resolves the files of the collections visible to the user,
+// the other collections resolve to no file.
+func collections(value string) ([]string, error) {
+	if value == "5f0c1d2e-8c4a-4b4e-9a51-2f3d6f1b7c90" {
+		return []string{"a1", "c3"}, nil
+	}
+	return nil, nil
+}
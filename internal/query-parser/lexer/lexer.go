@@ -158,7 +158,7 @@ func (l *Lexer) skipWhitespace() {
 
 func (l *Lexer) readIdentifier() string {
 	position := l.position
-	for isLetter(l.ch) || l.ch == '*' {
+	for isLetter(l.ch) || isDigit(l.ch) || l.ch == '*' {
 		l.eatChar()
 	}
 	return l.input[position:l.position]
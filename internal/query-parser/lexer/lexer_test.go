@@ -68,6 +68,19 @@ var tests = []struct {
 			{Type: token.EOF, Literal: ""},
 		},
 	},
+	{
+		input: `technique != T1055.001 and engines = w32`,
+		expected: []token.Token{
+			{Type: token.IDENT, Literal: "technique"},
+			{Type: token.NOT_EQ, Literal: "!="},
+			{Type: token.IDENT, Literal: "T1055.001"},
+			{Type: token.AND, Literal: "and"},
+			{Type: token.IDENT, Literal: "engines"},
+			{Type: token.ASSIGN, Literal: "="},
+			{Type: token.IDENT, Literal: "w32"},
+			{Type: token.EOF, Literal: ""},
+		},
+	},
 }
 
 func TestNextToken(t *testing.T) {
@@ -5,9 +5,11 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"regexp"
 	"runtime/debug"
+	"time"
 
 	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
@@ -17,11 +19,16 @@ import (
 	"github.com/saferwall/saferwall-api/internal/archive"
 	"github.com/saferwall/saferwall-api/internal/auth"
 	"github.com/saferwall/saferwall-api/internal/behavior"
+	"github.com/saferwall/saferwall-api/internal/blob"
+	"github.com/saferwall/saferwall-api/internal/collection"
 	"github.com/saferwall/saferwall-api/internal/comment"
 	"github.com/saferwall/saferwall-api/internal/config"
 	dbcontext "github.com/saferwall/saferwall-api/internal/db"
 	"github.com/saferwall/saferwall-api/internal/errors"
 	"github.com/saferwall/saferwall-api/internal/file"
+	"github.com/saferwall/saferwall-api/internal/notification"
+	"github.com/saferwall/saferwall-api/internal/org"
+	"github.com/saferwall/saferwall-api/internal/privacy"
 	"github.com/saferwall/saferwall-api/internal/support"
 	"github.com/saferwall/saferwall-api/internal/healthcheck"
 	smtpmailer "github.com/saferwall/saferwall-api/internal/mailer/smtp"
@@ -51,8 +58,9 @@ var (
 	usernameRegex = regexp.MustCompile(usernameRegexString)
 )
 
-// BuildHandler sets up the HTTP routing and builds an HTTP handler.
-func BuildHandler(logger log.Logger, db *dbcontext.DB, sec password.Service,
+// BuildHandler sets up the HTTP routing and builds an HTTP handler, the
+// background tasks of the services run until ctx is done.
+func BuildHandler(ctx context.Context, logger log.Logger, db *dbcontext.DB, sec password.Service,
 	cfg *config.Config, version string, trans ut.Translator,
 	updown storage.UploadDownloader, p queue.Producer,
 	smtpMailer smtpmailer.SMTPMailer, arch archive.Archiver,
@@ -117,22 +125,43 @@ func BuildHandler(logger log.Logger, db *dbcontext.DB, sec password.Service,
 
 	// Create the services and register the handlers.
 	actSvc := activity.NewService(activity.NewRepository(db, logger), logger)
+	notifSvc := notification.NewService(notification.NewRepository(db, logger),
+		logger, smtpMailer, emailTpl, cfg.UI.Address)
 	userSvc := user.NewService(user.NewRepository(db, logger), logger, tokenGen,
-		sec, cfg.ObjStorage.AvatarsContainerName, updown, actSvc)
+		sec, cfg.ObjStorage.AvatarsContainerName, updown, actSvc, notifSvc)
 	commentSvc := comment.NewService(comment.NewRepository(db, logger), logger,
-		actSvc, userSvc)
+		actSvc, userSvc, notifSvc, cfg.Comments.MaxPerHour)
 	authSvc := auth.NewService(cfg.JWTSigningKey, cfg.JWTExpiration, logger,
 		sec, userSvc, tokenGen)
+	behaviorSvc := behavior.NewService(behavior.NewRepository(db, logger), logger,
+		updown, cfg.ObjStorage.ArtifactsContainerName, cfg.SamplesZipPwd)
+	orgSvc := org.NewService(org.NewRepository(db, logger), logger, userSvc)
 	fileSvc := file.NewService(file.NewRepository(db, logger), logger, updown,
-		p, cfg.Broker.Topic, cfg.ObjStorage.FileContainerName, cfg.SamplesZipPwd,
-		userSvc, actSvc, commentSvc, arch)
-
-	behaviorSvc := behavior.NewService(behavior.NewRepository(db, logger), logger)
+		p, cfg.Broker.Topic, cfg.ObjStorage.FileContainerName,
+		cfg.ObjStorage.QuarantineContainerName, cfg.SamplesZipPwd, cfg.JWTSigningKey,
+		userSvc, actSvc, commentSvc, behaviorSvc, notifSvc, orgSvc, arch, file.BulkDownloadLimits{
+			MaxHashes: cfg.BulkDownload.MaxHashes,
+			MaxSize:   int64(cfg.BulkDownload.MaxSize) * 1024 * 1024,
+			Workers:   cfg.BulkDownload.Workers,
+		})
+	collectionSvc := collection.NewService(collection.NewRepository(db, logger),
+		logger, fileSvc)
+	privacySvc := privacy.NewService(privacy.NewRepository(db, logger), logger,
+		updown, cfg.ObjStorage.AvatarsContainerName, userSvc, fileSvc,
+		commentSvc, collectionSvc, orgSvc)
+
+	// Notify the uploaders of their finished scans and email the digests in
+	// the background, until the server shuts down.
+	go notifSvc.Run(ctx,
+		time.Duration(cfg.Notifications.ScanInterval)*time.Second,
+		time.Duration(cfg.Notifications.DigestInterval)*time.Hour)
 
 	// Create the middlewares.
 	fileMiddleware := file.NewMiddleware(fileSvc, logger)
 	userMiddleware := user.NewMiddleware(userSvc, logger)
 	commentMiddleware := comment.NewMiddleware(commentSvc, logger)
+	collectionMiddleware := collection.NewMiddleware(collectionSvc, logger)
+	orgMiddleware := org.NewMiddleware(orgSvc, logger)
 	behaviorMiddleware := behavior.NewMiddleware(behaviorSvc, logger)
 
 	// Register the handlers.
@@ -145,10 +174,22 @@ func BuildHandler(logger log.Logger, db *dbcontext.DB, sec password.Service,
 		fileMiddleware.ModifyResponse)
 	activity.RegisterHandlers(g, actSvc, authHandler, logger)
 	comment.RegisterHandlers(g, commentSvc, logger, authHandler, commentMiddleware.VerifyID)
+	collection.RegisterHandlers(g, collectionSvc, fileSvc, logger, authHandler,
+		optAuthHandler, collectionMiddleware.VerifyID)
+	notification.RegisterHandlers(g, notifSvc, logger, authHandler)
+	org.RegisterHandlers(g, orgSvc, logger, authHandler,
+		orgMiddleware.VerifyID)
+	privacy.RegisterHandlers(g, privacySvc, logger, authHandler,
+		userMiddleware.VerifyUser)
 	behavior.RegisterHandlers(g, behaviorSvc, behaviorMiddleware.CacheResponse,
-		behaviorMiddleware.VerifyID, logger)
+		behaviorMiddleware.VerifyID, authHandler, logger)
 	support.RegisterHandlers(e, logger, smtpMailer, recaptchaVerifier)
 
+	// Backends which can't pre-sign URLs rely on the API to serve them.
+	if store, ok := updown.(blob.Store); ok {
+		blob.RegisterHandlers(g, store, logger)
+	}
+
 	return e
 }
 
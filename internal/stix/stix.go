@@ -0,0 +1,414 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+// Package stix converts saferwall file reports to STIX 2.1 bundles.
+package stix
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/ioc"
+)
+
+const (
+	// SpecVersion is the STIX specification version of generated objects.
+	SpecVersion = "2.1"
+	// timestampFormat is the STIX timestamp format with millisecond precision.
+	timestampFormat = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	// namespace is the UUIDv5 namespace STIX defines for deterministic
+	// identifiers of cyber observable objects.
+	namespace = uuid.MustParse("00abedb4-aa42-466c-9c01-fed23315a9b7")
+
+	// identity is the producer of every object in a bundle.
+	identity = Identity{
+		Common: Common{
+			Type:        "identity",
+			SpecVersion: SpecVersion,
+			ID:          "identity--" + uuid.NewSHA1(namespace, []byte("saferwall")).String(),
+			Created:     "2018-01-01T00:00:00.000Z",
+			Modified:    "2018-01-01T00:00:00.000Z",
+		},
+		Name:          "Saferwall",
+		IdentityClass: "organization",
+	}
+)
+
+// Bundle represents a STIX bundle.
+type Bundle struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id"`
+	Objects []interface{} `json:"objects"`
+}
+
+// Common represents the properties shared by STIX objects.
+type Common struct {
+	Type         string `json:"type"`
+	SpecVersion  string `json:"spec_version"`
+	ID           string `json:"id"`
+	Created      string `json:"created,omitempty"`
+	Modified     string `json:"modified,omitempty"`
+	CreatedByRef string `json:"created_by_ref,omitempty"`
+}
+
+// Identity represents a STIX identity SDO.
+type Identity struct {
+	Common
+	Name          string `json:"name"`
+	IdentityClass string `json:"identity_class"`
+}
+
+// File represents a STIX file SCO.
+type File struct {
+	Common
+	Hashes map[string]string `json:"hashes"`
+	Size   int64             `json:"size,omitempty"`
+	Name   string            `json:"name,omitempty"`
+}
+
+// Network represents a STIX domain-name, ipv4-addr, ipv6-addr or url SCO.
+type Network struct {
+	Common
+	Value string `json:"value"`
+}
+
+// Malware represents a STIX malware SDO.
+type Malware struct {
+	Common
+	Name       string   `json:"name"`
+	IsFamily   bool     `json:"is_family"`
+	SampleRefs []string `json:"sample_refs"`
+}
+
+// MalwareAnalysis represents a STIX malware-analysis SDO.
+type MalwareAnalysis struct {
+	Common
+	Product       string `json:"product"`
+	Result        string `json:"result"`
+	ResultName    string `json:"result_name,omitempty"`
+	AnalysisEnded string `json:"analysis_ended,omitempty"`
+	SampleRef     string `json:"sample_ref"`
+}
+
+// Indicator represents a STIX indicator SDO.
+type Indicator struct {
+	Common
+	Name           string   `json:"name"`
+	IndicatorTypes []string `json:"indicator_types"`
+	Pattern        string   `json:"pattern"`
+	PatternType    string   `json:"pattern_type"`
+	ValidFrom      string   `json:"valid_from"`
+}
+
+// ObservedData represents a STIX observed-data SDO.
+type ObservedData struct {
+	Common
+	FirstObserved  string   `json:"first_observed"`
+	LastObserved   string   `json:"last_observed"`
+	NumberObserved int      `json:"number_observed"`
+	ObjectRefs     []string `json:"object_refs"`
+}
+
+// ExternalReference represents a reference to a non-STIX source.
+type ExternalReference struct {
+	SourceName string `json:"source_name"`
+	ExternalID string `json:"external_id,omitempty"`
+	URL        string `json:"url,omitempty"`
+}
+
+// KillChainPhase represents a phase in a kill chain.
+type KillChainPhase struct {
+	KillChainName string `json:"kill_chain_name"`
+	PhaseName     string `json:"phase_name"`
+}
+
+// AttackPattern represents a STIX attack-pattern SDO.
+type AttackPattern struct {
+	Common
+	Name               string              `json:"name"`
+	ExternalReferences []ExternalReference `json:"external_references"`
+	KillChainPhases    []KillChainPhase    `json:"kill_chain_phases,omitempty"`
+}
+
+// Relationship represents a STIX relationship SRO.
+type Relationship struct {
+	Common
+	RelationshipType string `json:"relationship_type"`
+	SourceRef        string `json:"source_ref"`
+	TargetRef        string `json:"target_ref"`
+}
+
+// multiAV represents the subset of the multi-av scan results of a file.
+type multiAV struct {
+	LastScan struct {
+		Timestamp  int64 `json:"timestamp"`
+		Detections map[string]struct {
+			Infected bool   `json:"infected"`
+			Output   string `json:"output"`
+		} `json:"detections"`
+	} `json:"last_scan"`
+}
+
+// NewBundle generates a STIX bundle for a file, its network indicators and
+// the capabilities of its default behavior report. Identifiers are derived
+// from the file SHA256 so that exporting the same report twice yields the
+// same objects, letting consumers update them in place.
+func NewBundle(file entity.File, iocs []ioc.IOC,
+	capabilities []entity.Capability) Bundle {
+
+	b := builder{
+		sha256:    strings.ToLower(file.SHA256),
+		timestamp: formatTime(file.LastScanned),
+	}
+	if file.FirstSeen > 0 {
+		b.firstSeen = formatTime(file.FirstSeen)
+	} else {
+		b.firstSeen = b.timestamp
+	}
+
+	b.add(identity)
+
+	fileObj := b.file(file)
+	b.add(fileObj)
+
+	malware := Malware{
+		Common:     b.sdo("malware", ""),
+		Name:       b.sha256,
+		SampleRefs: []string{fileObj.ID},
+	}
+	b.add(malware)
+
+	b.analyses(file, fileObj.ID)
+	b.network(iocs, fileObj.ID, malware.ID)
+	b.attackPatterns(capabilities, malware.ID)
+
+	return Bundle{
+		Type:    "bundle",
+		ID:      "bundle--" + uuid.NewSHA1(namespace, []byte(b.sha256)).String(),
+		Objects: b.objects,
+	}
+}
+
+type builder struct {
+	sha256    string
+	timestamp string
+	firstSeen string
+	objects   []interface{}
+}
+
+func (b *builder) add(obj interface{}) {
+	b.objects = append(b.objects, obj)
+}
+
+// sdo returns the common properties of a domain object, its identifier is
+// derived from the file hash, the object type and a discriminator.
+func (b *builder) sdo(typ, discriminator string) Common {
+	name := typ + "|" + b.sha256 + "|" + discriminator
+	return Common{
+		Type:         typ,
+		SpecVersion:  SpecVersion,
+		ID:           typ + "--" + uuid.NewSHA1(namespace, []byte(name)).String(),
+		Created:      b.timestamp,
+		Modified:     b.timestamp,
+		CreatedByRef: identity.ID,
+	}
+}
+
+// sco returns the common properties of a cyber observable object, its
+// identifier is derived from the object contributing properties.
+func sco(typ string, contributing map[string]interface{}) Common {
+	name, _ := json.Marshal(contributing)
+	return Common{
+		Type:        typ,
+		SpecVersion: SpecVersion,
+		ID:          typ + "--" + uuid.NewSHA1(namespace, name).String(),
+	}
+}
+
+func (b *builder) file(file entity.File) File {
+	hashes := map[string]string{}
+	for algo, value := range map[string]string{
+		"MD5":     file.MD5,
+		"SHA-1":   file.SHA1,
+		"SHA-256": file.SHA256,
+		"SHA-512": file.SHA512,
+		"SSDEEP":  file.SSDeep,
+		"TLSH":    file.TLSH,
+	} {
+		if value != "" {
+			hashes[algo] = value
+		}
+	}
+
+	obj := File{
+		Common: sco("file", map[string]interface{}{
+			"hashes": map[string]string{"SHA-256": b.sha256}}),
+		Hashes: hashes,
+		Size:   file.Size,
+	}
+	if len(file.Submissions) > 0 {
+		obj.Name = file.Submissions[0].Filename
+	}
+	return obj
+}
+
+// analyses adds a malware-analysis object per anti-virus engine.
+func (b *builder) analyses(file entity.File, fileRef string) {
+	var av multiAV
+	raw, _ := json.Marshal(file.MultiAV)
+	_ = json.Unmarshal(raw, &av)
+
+	engines := make([]string, 0, len(av.LastScan.Detections))
+	for engine := range av.LastScan.Detections {
+		engines = append(engines, engine)
+	}
+	sort.Strings(engines)
+
+	for _, engine := range engines {
+		detection := av.LastScan.Detections[engine]
+		analysis := MalwareAnalysis{
+			Common:    b.sdo("malware-analysis", engine),
+			Product:   engine,
+			Result:    "unknown",
+			SampleRef: fileRef,
+		}
+		if detection.Infected {
+			analysis.Result = "malicious"
+			analysis.ResultName = detection.Output
+		}
+		if av.LastScan.Timestamp > 0 {
+			analysis.AnalysisEnded = formatTime(av.LastScan.Timestamp)
+		}
+		b.add(analysis)
+	}
+}
+
+// network adds an observable, an indicator and its relationships per IOC,
+// as well as the observed data grouping the observables.
+func (b *builder) network(iocs []ioc.IOC, fileRef, malwareRef string) {
+	if len(iocs) == 0 {
+		return
+	}
+
+	observed := ObservedData{
+		Common:         b.sdo("observed-data", ""),
+		FirstObserved:  b.firstSeen,
+		LastObserved:   b.timestamp,
+		NumberObserved: 1,
+		ObjectRefs:     []string{fileRef},
+	}
+
+	var objects []interface{}
+	for _, i := range iocs {
+		typ := scoType(i.Type)
+		obj := Network{
+			Common: sco(typ, map[string]interface{}{"value": i.Value}),
+			Value:  i.Value,
+		}
+		observed.ObjectRefs = append(observed.ObjectRefs, obj.ID)
+
+		indicator := Indicator{
+			Common:         b.sdo("indicator", obj.ID),
+			Name:           i.Value,
+			IndicatorTypes: []string{"malicious-activity"},
+			Pattern: fmt.Sprintf("[%s:value = '%s']", typ,
+				strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(i.Value)),
+			PatternType: "stix",
+			ValidFrom:   b.timestamp,
+		}
+
+		objects = append(objects, obj, indicator,
+			b.relationship("indicates", indicator.ID, malwareRef),
+			b.relationship("based-on", indicator.ID, observed.ID))
+	}
+
+	b.add(observed)
+	b.objects = append(b.objects, objects...)
+}
+
+// attackPatterns adds an attack-pattern object per ATT&CK technique.
+func (b *builder) attackPatterns(capabilities []entity.Capability, malwareRef string) {
+	patterns := map[string]*AttackPattern{}
+	var ids []string
+
+	for _, capability := range capabilities {
+		for _, technique := range capability.Techniques {
+			id := strings.ToUpper(technique.ID)
+			pattern, ok := patterns[id]
+			if !ok {
+				name := technique.Name
+				if name == "" {
+					name = id
+				}
+				pattern = &AttackPattern{
+					Common: b.sdo("attack-pattern", id),
+					Name:   name,
+					ExternalReferences: []ExternalReference{{
+						SourceName: "mitre-attack",
+						ExternalID: id,
+						URL: "https://attack.mitre.org/techniques/" +
+							strings.ReplaceAll(id, ".", "/") + "/",
+					}},
+				}
+				patterns[id] = pattern
+				ids = append(ids, id)
+			}
+
+			phase := KillChainPhase{"mitre-attack", strings.ToLower(technique.Tactic)}
+			if phase.PhaseName != "" && !containsPhase(pattern.KillChainPhases, phase) {
+				pattern.KillChainPhases = append(pattern.KillChainPhases, phase)
+			}
+		}
+	}
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		b.add(*patterns[id])
+		b.add(b.relationship("uses", malwareRef, patterns[id].ID))
+	}
+}
+
+func (b *builder) relationship(typ, source, target string) Relationship {
+	return Relationship{
+		Common:           b.sdo("relationship", typ+"|"+source+"|"+target),
+		RelationshipType: typ,
+		SourceRef:        source,
+		TargetRef:        target,
+	}
+}
+
+// scoType maps an indicator type to its STIX cyber observable type.
+func scoType(t ioc.Type) string {
+	switch t {
+	case ioc.Domain:
+		return "domain-name"
+	case ioc.IPv4:
+		return "ipv4-addr"
+	case ioc.IPv6:
+		return "ipv6-addr"
+	default:
+		return "url"
+	}
+}
+
+func containsPhase(phases []KillChainPhase, phase KillChainPhase) bool {
+	for _, p := range phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+func formatTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(timestampFormat)
+}
@@ -0,0 +1,88 @@
+package stix
+
+import (
+	"testing"
+
+	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/ioc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBundle(t *testing.T) {
+	file := entity.File{
+		MD5:         "44d88612fea8a8f36de82e1278abb02f",
+		SHA256:      "275A021BBFB6489E54D471899F7DB9D1663FC695EC2FE2A2C4538AABF651FD0F",
+		Size:        68,
+		FirstSeen:   1700000000,
+		LastScanned: 1700000060,
+		Submissions: []entity.Submission{{Filename: "eicar.com"}},
+		MultiAV: map[string]interface{}{
+			"last_scan": map[string]interface{}{
+				"timestamp": 1700000060,
+				"detections": map[string]interface{}{
+					"eset":  map[string]interface{}{"infected": true, "output": "Eicar"},
+					"avast": map[string]interface{}{"infected": false},
+				},
+			},
+		},
+	}
+	iocs := []ioc.IOC{{Type: ioc.Domain, Value: "evil.com", Sources: []string{ioc.SourceStrings}}}
+	capabilities := []entity.Capability{
+		{Techniques: []entity.AttackTechnique{
+			{ID: "T1055", Name: "Process Injection", Tactic: "defense-evasion"},
+			{ID: "T1055", Name: "Process Injection", Tactic: "privilege-escalation"},
+		}},
+		{Techniques: []entity.AttackTechnique{{ID: "T1055", Tactic: "defense-evasion"}}},
+	}
+
+	bundle := NewBundle(file, iocs, capabilities)
+	assert.Equal(t, "bundle", bundle.Type)
+	assert.Equal(t, bundle, NewBundle(file, iocs, capabilities), "ids are deterministic")
+
+	var types []string
+	for _, obj := range bundle.Objects {
+		switch o := obj.(type) {
+		case Identity:
+			types = append(types, o.Type)
+		case File:
+			types = append(types, o.Type)
+			assert.Equal(t, "eicar.com", o.Name)
+			assert.Equal(t, file.MD5, o.Hashes["MD5"])
+			assert.NotContains(t, o.Hashes, "SHA-1")
+		case Malware:
+			types = append(types, o.Type)
+		case MalwareAnalysis:
+			types = append(types, o.Type+":"+o.Product+":"+o.Result)
+			assert.Equal(t, "2023-11-14T22:14:20.000Z", o.AnalysisEnded)
+		case ObservedData:
+			types = append(types, o.Type)
+			assert.Len(t, o.ObjectRefs, 2)
+		case Network:
+			types = append(types, o.Type)
+		case Indicator:
+			types = append(types, o.Type)
+			assert.Equal(t, "[domain-name:value = 'evil.com']", o.Pattern)
+		case AttackPattern:
+			types = append(types, o.Type)
+			assert.Equal(t, "T1055", o.ExternalReferences[0].ExternalID)
+			assert.Len(t, o.KillChainPhases, 2)
+		case Relationship:
+			types = append(types, o.Type+":"+o.RelationshipType)
+		}
+	}
+
+	assert.Equal(t, []string{
+		"identity",
+		"file",
+		"malware",
+		"malware-analysis:avast:unknown",
+		"malware-analysis:eset:malicious",
+		"observed-data",
+		"domain-name",
+		"indicator",
+		"relationship:indicates",
+		"relationship:based-on",
+		"attack-pattern",
+		"relationship:uses",
+	}, types)
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/saferwall/saferwall-api/internal/storage/object"
+)
+
+// Service provides abstraction to cloud object storage. Buckets map to blob
+// containers and keys to blob names.
+type Service struct {
+	// azure blob client.
+	client *azblob.Client
+	// Lifetime of the pre-signed URLs.
+	presignTTL time.Duration
+}
+
+// New generates new Azure Blob Storage service authenticated with a shared
+// key. A non empty endpoint overrides the service URL, it is used to point
+// the client to an emulator like Azurite.
+func New(accountName, accountKey, endpoint string,
+	presignTTL time.Duration) (Service, error) {
+
+	cred, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return Service{}, err
+	}
+
+	serviceURL := endpoint
+	if serviceURL == "" {
+		serviceURL = fmt.Sprintf("https://%s.blob.core.windows.net/", accountName)
+	}
+
+	client, err := azblob.NewClientWithSharedKeyCredential(serviceURL, cred, nil)
+	if err != nil {
+		return Service{}, err
+	}
+
+	return Service{client, presignTTL}, nil
+}
+
+// Upload uploads an object to the remote storage.
+func (s Service) Upload(ctx context.Context, bucket, key string,
+	file io.Reader) error {
+	return s.UploadWithMetadata(ctx, bucket, key, file, nil)
+}
+
+// UploadWithMetadata uploads an object to the remote storage alongside user
+// defined metadata.
+func (s Service) UploadWithMetadata(ctx context.Context, bucket, key string,
+	file io.Reader, metadata map[string]string) error {
+
+	contentType := "application/octet-stream"
+	opts := &azblob.UploadStreamOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	}
+	if len(metadata) > 0 {
+		opts.Metadata = make(map[string]*string, len(metadata))
+		for k, v := range metadata {
+			opts.Metadata[k] = &v
+		}
+	}
+	_, err := s.client.UploadStream(ctx, bucket, key, file, opts)
+	return err
+}
+
+// Download downloads an object from the remote storage.
+func (s Service) Download(ctx context.Context, bucket, key string,
+	file io.Writer) error {
+
+	resp, err := s.client.DownloadStream(ctx, bucket, key, nil)
+	if err != nil {
+		return notFound(err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(file, resp.Body)
+	return err
+}
+
+// DownloadRange downloads length bytes of an object starting at offset, or
+// less when the object ends before.
+func (s Service) DownloadRange(ctx context.Context, bucket, key string,
+	file io.Writer, offset, length int64) error {
+
+	resp, err := s.client.DownloadStream(ctx, bucket, key,
+		&azblob.DownloadStreamOptions{
+			Range: blob.HTTPRange{Offset: offset, Count: length},
+		})
+	if err != nil {
+		return notFound(err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(file, resp.Body)
+	return err
+}
+
+// DownloadWithSize downloads an object from the remote storage and returns
+// its size. The copy happens in the background, done is called once the
+// object has been fully written to file, with the error of the copy.
+func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
+	file io.Writer, done func(error)) (size int64, err error) {
+
+	resp, err := s.client.DownloadStream(ctx, bucket, key, nil)
+	if err != nil {
+		return 0, notFound(err)
+	}
+
+	if resp.ContentLength != nil {
+		size = *resp.ContentLength
+	}
+	go func() {
+		defer resp.Body.Close()
+		_, err := io.Copy(file, resp.Body)
+		done(err)
+	}()
+	return size, nil
+}
+
+// GetFileSize gets an object's size from the remote storage.
+func (s Service) GetFileSize(ctx context.Context, bucket, key string,
+	done func()) (size int64, err error) {
+
+	info, err := s.Stat(ctx, bucket, key)
+	if err != nil {
+		return
+	}
+
+	defer done()
+
+	return info.Size, nil
+}
+
+// MakeBucket creates a new container, location is ignored as it is
+// determined by the storage account.
+func (s Service) MakeBucket(ctx context.Context, bucketName,
+	location string) error {
+
+	_, err := s.client.CreateContainer(ctx, bucketName, nil)
+	if bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// Exists checks whether an object exists already in the object storage.
+func (s Service) Exists(ctx context.Context, bucketName,
+	key string) (bool, error) {
+
+	_, err := s.Stat(ctx, bucketName, key)
+	if errors.Is(err, object.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GeneratePresignedURL creates a read only shared access signature URL.
+func (s Service) GeneratePresignedURL(ctx context.Context, bucketName,
+	key string) (string, error) {
+
+	return s.blob(bucketName, key).GetSASURL(sas.BlobPermissions{Read: true},
+		time.Now().Add(s.presignTTL), nil)
+}
+
+// Delete deletes an object from the remote storage, deleting a missing
+// object is not an error.
+func (s Service) Delete(ctx context.Context, bucket, key string) error {
+	_, err := s.client.DeleteBlob(ctx, bucket, key, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return err
+}
+
+// List returns the objects whose key starts with prefix, sorted by key.
+func (s Service) List(ctx context.Context, bucket, prefix string) (
+	[]object.Info, error) {
+
+	pager := s.client.NewListBlobsFlatPager(bucket,
+		&container.ListBlobsFlatOptions{Prefix: &prefix})
+	objects := []object.Info{}
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			info := object.Info{Key: *item.Name}
+			if props := item.Properties; props != nil {
+				if props.ContentLength != nil {
+					info.Size = *props.ContentLength
+				}
+				if props.LastModified != nil {
+					info.LastModified = props.LastModified.UTC()
+				}
+			}
+			objects = append(objects, info)
+		}
+	}
+	return objects, nil
+}
+
+// Stat returns the metadata of an object.
+func (s Service) Stat(ctx context.Context, bucket, key string) (
+	object.Info, error) {
+
+	props, err := s.blob(bucket, key).GetProperties(ctx, nil)
+	if err != nil {
+		return object.Info{}, notFound(err)
+	}
+	info := object.Info{Key: key}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		info.LastModified = props.LastModified.UTC()
+	}
+	metadata := make(map[string]string, len(props.Metadata))
+	for k, v := range props.Metadata {
+		if v != nil {
+			metadata[k] = *v
+		}
+	}
+	info.Metadata = object.NormalizeMetadata(metadata)
+	return info, nil
+}
+
+// notFound translates the missing object errors to object.ErrNotFound.
+func notFound(err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return object.ErrNotFound
+	}
+	return err
+}
+
+func (s Service) blob(bucket, key string) *blob.Client {
+	return s.client.ServiceClient().NewContainerClient(bucket).NewBlobClient(key)
+}
@@ -0,0 +1,58 @@
+package azure_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/storage/azure"
+	"github.com/saferwall/saferwall-api/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// Well-known development account of Azurite.
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// The tests run against Azurite, for instance:
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//	SFW_TEST_AZURITE_ENDPOINT=http://localhost:10000/devstoreaccount1 go test ./internal/storage/azure/
+func newTestService(t *testing.T) azure.Service {
+	endpoint := os.Getenv("SFW_TEST_AZURITE_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("SFW_TEST_AZURITE_ENDPOINT is not set")
+	}
+	svc, err := azure.New(azuriteAccount, azuriteKey, endpoint, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, newTestService(t), "saferwall-conformance")
+}
+
+func TestPresignedURL(t *testing.T) {
+	svc := newTestService(t)
+	ctx := context.Background()
+	bucket, key := "saferwall-conformance", "presigned"
+
+	assert.Nil(t, svc.MakeBucket(ctx, bucket, ""))
+	assert.Nil(t, svc.Upload(ctx, bucket, key, bytes.NewReader([]byte("x"))))
+	defer svc.Delete(ctx, bucket, key)
+
+	url, err := svc.GeneratePresignedURL(ctx, bucket, key)
+	assert.Nil(t, err)
+	resp, err := http.Get(url)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
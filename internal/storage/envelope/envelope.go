@@ -0,0 +1,717 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+// Package envelope encrypts the objects at rest on top of any object storage
+// backend.
+//
+// Every object is encrypted with its own random data key using AES-256-GCM,
+// the data key itself is wrapped by a master key and stored in the object
+// header. The payload is split in chunks sealed independently, so objects
+// are encrypted and decrypted as they stream. Rotating the master key only
+// rewrites the header, the payload is left untouched.
+//
+// An encrypted object is laid out as follows:
+//
+//	magic (4) | version (1) | master key fingerprint (8) |
+//	wrapping nonce (12) | wrapped data key (32 + 16) |
+//	chunk 0 (up to 64KiB + 16) | chunk 1 | ...
+//
+// The nonce of a chunk is its index, with the last byte set on the final
+// chunk to detect truncated objects.
+//
+// Objects uploaded before the encryption was enabled do not start with the
+// magic, they are served as is until Rotate encrypts them.
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/saferwall/saferwall-api/internal/storage/object"
+)
+
+const (
+	magic           = "SFWE"
+	version         = 1
+	keySize         = 32
+	nonceSize       = 12
+	tagSize         = 16
+	fingerprintSize = 8
+	chunkSize       = 64 * 1024
+
+	// Offsets of the header fields.
+	fingerprintOffset = len(magic) + 1
+	nonceOffset       = fingerprintOffset + fingerprintSize
+	wrappedKeyOffset  = nonceOffset + nonceSize
+	headerSize        = wrappedKeyOffset + keySize + tagSize
+)
+
+var (
+	// ErrInvalidMasterKey is returned when a master key is not a base64
+	// encoded 256 bits key.
+	ErrInvalidMasterKey = errors.New("master key must be 32 bytes encoded in base64")
+	// ErrUnknownMasterKey is returned when an object was encrypted with a
+	// master key which is not configured.
+	ErrUnknownMasterKey = errors.New("object encrypted with an unknown master key")
+	// ErrCorrupt is returned when an encrypted object has an invalid header
+	// or fails its authentication.
+	ErrCorrupt = errors.New("encrypted object is corrupt")
+)
+
+// Backend represents the object storage the objects are saved to.
+type Backend interface {
+	Upload(ctx context.Context, bucket, key string, file io.Reader) error
+	UploadWithMetadata(ctx context.Context, bucket, key string, file io.Reader,
+		metadata map[string]string) error
+	Download(ctx context.Context, bucket, key string, file io.Writer) error
+	DownloadRange(ctx context.Context, bucket, key string, file io.Writer,
+		offset, length int64) error
+	DownloadWithSize(ctx context.Context, bucket, key string, file io.Writer, done func(error)) (int64, error)
+	GetFileSize(ctx context.Context, bucket, key string, done func()) (int64, error)
+	MakeBucket(ctx context.Context, bucket, location string) error
+	Exists(ctx context.Context, bucket, key string) (bool, error)
+	GeneratePresignedURL(ctx context.Context, bucket, key string) (string, error)
+	Delete(ctx context.Context, bucket, key string) error
+	List(ctx context.Context, bucket, prefix string) ([]object.Info, error)
+	Stat(ctx context.Context, bucket, key string) (object.Info, error)
+}
+
+// tokenVerifier is implemented by the backends whose download links are
+// served by the API, like the local file system.
+type tokenVerifier interface {
+	VerifyToken(token string) (bucket, key string, err error)
+}
+
+// masterKey represents a key wrapping the data keys.
+type masterKey struct {
+	fingerprint []byte
+	aead        cipher.AEAD
+}
+
+// Service encrypts the objects of a set of buckets before handing them
+// to the backend, the objects of the other buckets are left as is.
+type Service struct {
+	backend Backend
+	// Master keys, the first one wraps the data keys of new objects.
+	keys []masterKey
+	// Buckets whose objects are encrypted.
+	buckets map[string]bool
+}
+
+// New creates an encrypting wrapper around backend. masterKeys are base64
+// encoded 256 bits keys, the first one is the active key while the others
+// are retired keys still able to decrypt the objects until they are rotated.
+func New(backend Backend, masterKeys []string, buckets []string) (
+	Service, error) {
+
+	if len(masterKeys) == 0 {
+		return Service{}, ErrInvalidMasterKey
+	}
+
+	s := Service{backend: backend, buckets: make(map[string]bool)}
+	for _, encoded := range masterKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize {
+			return Service{}, ErrInvalidMasterKey
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return Service{}, err
+		}
+		sum := sha256.Sum256(key)
+		s.keys = append(s.keys, masterKey{sum[:fingerprintSize], aead})
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = true
+	}
+	return s, nil
+}
+
+// Upload encrypts and uploads an object.
+func (s Service) Upload(ctx context.Context, bucket, key string,
+	file io.Reader) error {
+	return s.UploadWithMetadata(ctx, bucket, key, file, nil)
+}
+
+// UploadWithMetadata encrypts and uploads an object alongside user defined
+// metadata, the metadata is not encrypted.
+func (s Service) UploadWithMetadata(ctx context.Context, bucket, key string,
+	file io.Reader, metadata map[string]string) error {
+
+	if !s.buckets[bucket] {
+		return s.backend.UploadWithMetadata(ctx, bucket, key, file, metadata)
+	}
+
+	r, err := s.newEncrypter(file)
+	if err != nil {
+		return err
+	}
+	return s.backend.UploadWithMetadata(ctx, bucket, key, r, metadata)
+}
+
+// Download downloads and decrypts an object.
+func (s Service) Download(ctx context.Context, bucket, key string,
+	file io.Writer) error {
+
+	if !s.buckets[bucket] {
+		return s.backend.Download(ctx, bucket, key, file)
+	}
+
+	w := s.newDecrypter(file)
+	if err := s.backend.Download(ctx, bucket, key, w); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// DownloadRange downloads and decrypts length bytes of an object starting
+// at offset, or less when the object ends before. Only the header and the
+// chunks overlapping the range are downloaded.
+func (s Service) DownloadRange(ctx context.Context, bucket, key string,
+	file io.Writer, offset, length int64) error {
+
+	if !s.buckets[bucket] {
+		return s.backend.DownloadRange(ctx, bucket, key, file, offset, length)
+	}
+
+	encrypted, err := s.encrypted(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		return s.backend.DownloadRange(ctx, bucket, key, file, offset, length)
+	}
+
+	info, err := s.backend.Stat(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	size := plaintextSize(info.Size)
+	end := min(offset+length, size)
+	if offset >= end {
+		return nil
+	}
+
+	header := &bytes.Buffer{}
+	err = s.backend.DownloadRange(ctx, bucket, key, header, 0, int64(headerSize))
+	if err != nil {
+		return err
+	}
+	w := s.newDecrypter(&trimWriter{file, offset % chunkSize, end - offset})
+	if _, err = w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	// The chunks are sealed with their index, the last one is final.
+	first, last := offset/chunkSize, (end-1)/chunkSize
+	w.counter = uint64(first)
+	w.last = uint64(max(size-1, 0) / chunkSize)
+	err = s.backend.DownloadRange(ctx, bucket, key, w,
+		int64(headerSize)+first*(chunkSize+tagSize),
+		(last-first+1)*(chunkSize+tagSize))
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// DownloadWithSize downloads and decrypts an object and returns its
+// plaintext size. A payload failing its authentication stops the download
+// before the unauthenticated data is written, done is then called with
+// ErrCorrupt.
+func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
+	file io.Writer, done func(error)) (int64, error) {
+
+	if !s.buckets[bucket] {
+		return s.backend.DownloadWithSize(ctx, bucket, key, file, done)
+	}
+
+	encrypted, err := s.encrypted(ctx, bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	if !encrypted {
+		return s.backend.DownloadWithSize(ctx, bucket, key, file, done)
+	}
+
+	w := s.newDecrypter(file)
+	size, err := s.backend.DownloadWithSize(ctx, bucket, key, w, func(err error) {
+		// Closing authenticates the final chunk, a truncated or tampered
+		// object is only detected there.
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		done(err)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return plaintextSize(size), nil
+}
+
+// GetFileSize returns the plaintext size of an object.
+func (s Service) GetFileSize(ctx context.Context, bucket, key string,
+	done func()) (int64, error) {
+
+	size, err := s.backend.GetFileSize(ctx, bucket, key, done)
+	if err != nil || !s.buckets[bucket] {
+		return size, err
+	}
+	return s.plaintextSize(ctx, bucket, key, size)
+}
+
+// MakeBucket creates a new bucket.
+func (s Service) MakeBucket(ctx context.Context, bucket, location string) error {
+	return s.backend.MakeBucket(ctx, bucket, location)
+}
+
+// Exists checks whether an object exists.
+func (s Service) Exists(ctx context.Context, bucket, key string) (bool, error) {
+	return s.backend.Exists(ctx, bucket, key)
+}
+
+// GeneratePresignedURL generates a pre-signed URL for the objects which are
+// not encrypted. Encrypted objects can only be pre-signed by the backends
+// serving their links through the API, as the API decrypts them.
+func (s Service) GeneratePresignedURL(ctx context.Context, bucket,
+	key string) (string, error) {
+
+	if _, ok := s.backend.(tokenVerifier); s.buckets[bucket] && !ok {
+		return "", object.ErrNotSupported
+	}
+	return s.backend.GeneratePresignedURL(ctx, bucket, key)
+}
+
+// VerifyToken verifies a download token of the backends serving their links
+// through the API.
+func (s Service) VerifyToken(token string) (bucket, key string, err error) {
+	v, ok := s.backend.(tokenVerifier)
+	if !ok {
+		return "", "", object.ErrNotSupported
+	}
+	return v.VerifyToken(token)
+}
+
+// Delete removes an object.
+func (s Service) Delete(ctx context.Context, bucket, key string) error {
+	return s.backend.Delete(ctx, bucket, key)
+}
+
+// List returns the objects whose key starts with prefix with their
+// plaintext size.
+func (s Service) List(ctx context.Context, bucket, prefix string) (
+	[]object.Info, error) {
+
+	objects, err := s.backend.List(ctx, bucket, prefix)
+	if err != nil || !s.buckets[bucket] {
+		return objects, err
+	}
+	for i := range objects {
+		objects[i].Size, err = s.plaintextSize(ctx, bucket, objects[i].Key,
+			objects[i].Size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// Stat returns the metadata of an object with its plaintext size.
+func (s Service) Stat(ctx context.Context, bucket, key string) (
+	object.Info, error) {
+
+	info, err := s.backend.Stat(ctx, bucket, key)
+	if err != nil || !s.buckets[bucket] {
+		return info, err
+	}
+	info.Size, err = s.plaintextSize(ctx, bucket, key, info.Size)
+	return info, err
+}
+
+// encrypted tells whether an object starts with the magic, the objects
+// uploaded before the encryption was enabled are stored as is.
+func (s Service) encrypted(ctx context.Context, bucket, key string) (
+	bool, error) {
+
+	prefix := &bytes.Buffer{}
+	err := s.backend.DownloadRange(ctx, bucket, key, prefix, 0,
+		int64(len(magic)))
+	if err != nil {
+		return false, err
+	}
+	return !unencrypted(prefix.Bytes()), nil
+}
+
+// plaintextSize returns the size of the plaintext of an object given its
+// stored size, which is the size of the objects stored as is.
+func (s Service) plaintextSize(ctx context.Context, bucket, key string,
+	size int64) (int64, error) {
+
+	encrypted, err := s.encrypted(ctx, bucket, key)
+	if err != nil || !encrypted {
+		return size, err
+	}
+	return plaintextSize(size), nil
+}
+
+// Rotate re-wraps with the active master key the data keys of the objects
+// whose key starts with prefix. Only the headers are rewritten, though the
+// objects are streamed through the API as backends can't patch objects in
+// place. The objects stored as is are encrypted. It returns the number of
+// objects rotated or encrypted.
+func (s Service) Rotate(ctx context.Context, bucket, prefix string) (int, error) {
+
+	if !s.buckets[bucket] {
+		return 0, nil
+	}
+
+	objects, err := s.backend.List(ctx, bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, obj := range objects {
+		rotated, err := s.rotate(ctx, bucket, obj.Key)
+		if err != nil {
+			return count, err
+		}
+		if rotated {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// rotate re-wraps the data key of an object if it is not wrapped by the
+// active master key, or encrypts the object if it is stored as is.
+func (s Service) rotate(ctx context.Context, bucket, key string) (bool, error) {
+
+	info, err := s.backend.Stat(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.backend.Download(ctx, bucket, key, pw))
+	}()
+	defer pr.Close()
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(pr, header)
+	if err != nil && !errors.Is(err, io.EOF) &&
+		!errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+	if unencrypted(header[:n]) {
+		r, err := s.newEncrypter(io.MultiReader(
+			bytes.NewReader(header[:n]), pr))
+		if err != nil {
+			return false, err
+		}
+		err = s.backend.UploadWithMetadata(ctx, bucket, key, r, info.Metadata)
+		return err == nil, err
+	}
+	if n < headerSize {
+		return false, ErrCorrupt
+	}
+	if bytes.Equal(header[fingerprintOffset:nonceOffset], s.keys[0].fingerprint) {
+		return false, nil
+	}
+
+	dataKey, err := s.unwrap(header)
+	if err != nil {
+		return false, err
+	}
+	header, err = s.wrap(dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.backend.UploadWithMetadata(ctx, bucket, key,
+		io.MultiReader(bytes.NewReader(header), pr), info.Metadata)
+	return err == nil, err
+}
+
+// wrap generates the header of an object holding its data key wrapped by
+// the active master key.
+func (s Service) wrap(dataKey []byte) ([]byte, error) {
+	header := make([]byte, wrappedKeyOffset, headerSize)
+	copy(header, magic)
+	header[len(magic)] = version
+	copy(header[fingerprintOffset:], s.keys[0].fingerprint)
+	if _, err := rand.Read(header[nonceOffset:wrappedKeyOffset]); err != nil {
+		return nil, err
+	}
+	return s.keys[0].aead.Seal(header, header[nonceOffset:wrappedKeyOffset],
+		dataKey, header[:nonceOffset]), nil
+}
+
+// unwrap returns the data key of an object given its header.
+func (s Service) unwrap(header []byte) ([]byte, error) {
+	if len(header) != headerSize || string(header[:len(magic)]) != magic ||
+		header[len(magic)] != version {
+		return nil, ErrCorrupt
+	}
+
+	fingerprint := header[fingerprintOffset:nonceOffset]
+	for _, k := range s.keys {
+		if !bytes.Equal(fingerprint, k.fingerprint) {
+			continue
+		}
+		dataKey, err := k.aead.Open(nil, header[nonceOffset:wrappedKeyOffset],
+			header[wrappedKeyOffset:], header[:nonceOffset])
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		return dataKey, nil
+	}
+	return nil, ErrUnknownMasterKey
+}
+
+// encrypter encrypts a stream as it is read.
+type encrypter struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	// Encrypted data not read yet.
+	pending []byte
+	plain   []byte
+	sealed  []byte
+	final   bool
+}
+
+func (s Service) newEncrypter(src io.Reader) (*encrypter, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	header, err := s.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		src:     bufio.NewReaderSize(src, chunkSize),
+		aead:    aead,
+		pending: header,
+		plain:   make([]byte, chunkSize),
+		sealed:  make([]byte, 0, chunkSize+tagSize),
+	}, nil
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.final {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// seal encrypts the next chunk, the final chunk is the first one which is
+// not followed by any data.
+func (e *encrypter) seal() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	switch err {
+	case nil:
+		if _, err = e.src.Peek(1); err == io.EOF {
+			e.final = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		e.final = true
+	default:
+		return err
+	}
+
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.counter, e.final),
+		e.plain[:n], nil)
+	e.pending = e.sealed
+	e.counter++
+	return nil
+}
+
+// decrypter decrypts a stream as it is written, a chunk is only written to
+// dst once authenticated.
+type decrypter struct {
+	svc     Service
+	dst     io.Writer
+	aead    cipher.AEAD
+	counter uint64
+	// Index of the final chunk, when only a range of the chunks is
+	// decrypted.
+	last uint64
+	// Plain is set when the object is stored as is, it is then written to
+	// dst unchanged.
+	plain bool
+	buf   []byte
+	err   error
+}
+
+func (s Service) newDecrypter(dst io.Writer) *decrypter {
+	return &decrypter{svc: s, dst: dst, last: math.MaxUint64}
+}
+
+func (d *decrypter) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.plain {
+		return d.dst.Write(p)
+	}
+	d.buf = append(d.buf, p...)
+
+	if d.aead == nil {
+		if len(d.buf) >= len(magic) && unencrypted(d.buf) {
+			d.plain = true
+			if _, err := d.dst.Write(d.buf); err != nil {
+				d.err = err
+				return 0, err
+			}
+			d.buf = nil
+			return len(p), nil
+		}
+		if len(d.buf) < headerSize {
+			return len(p), nil
+		}
+		dataKey, err := d.svc.unwrap(d.buf[:headerSize])
+		if err == nil {
+			d.aead, err = newAEAD(dataKey)
+		}
+		if err != nil {
+			d.err = err
+			return 0, err
+		}
+		d.buf = d.buf[headerSize:]
+	}
+
+	// The last chunk is held back until we know whether it is the final one.
+	consumed := 0
+	for len(d.buf)-consumed > chunkSize+tagSize {
+		if err := d.open(d.buf[consumed:consumed+chunkSize+tagSize], false); err != nil {
+			return 0, err
+		}
+		consumed += chunkSize + tagSize
+	}
+	d.buf = append(d.buf[:0], d.buf[consumed:]...)
+	return len(p), nil
+}
+
+// Close decrypts the last chunk, it fails when the object is truncated.
+func (d *decrypter) Close() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.plain {
+		d.err = io.ErrClosedPipe
+		return nil
+	}
+	if d.aead == nil {
+		// Objects stored as is may be shorter than the magic.
+		if unencrypted(d.buf) {
+			d.plain = true
+			_, err := d.dst.Write(d.buf)
+			return err
+		}
+		d.err = ErrCorrupt
+		return d.err
+	}
+	final := d.last == math.MaxUint64 || d.counter == d.last
+	if err := d.open(d.buf, final); err != nil {
+		return err
+	}
+	d.buf = nil
+	d.err = io.ErrClosedPipe
+	return nil
+}
+
+func (d *decrypter) open(chunk []byte, final bool) error {
+	plain, err := d.aead.Open(nil, chunkNonce(d.counter, final), chunk, nil)
+	if err != nil {
+		d.err = ErrCorrupt
+		return d.err
+	}
+	d.counter++
+	if _, err = d.dst.Write(plain); err != nil {
+		d.err = err
+		return err
+	}
+	return nil
+}
+
+// trimWriter skips the first bytes written through it and drops the ones
+// past its limit.
+type trimWriter struct {
+	w     io.Writer
+	skip  int64
+	limit int64
+}
+
+func (t *trimWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	skip := min(t.skip, int64(len(p)))
+	p, t.skip = p[skip:], t.skip-skip
+	p = p[:min(t.limit, int64(len(p)))]
+	t.limit -= int64(len(p))
+	if _, err := t.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// unencrypted tells whether an object starting with prefix was stored as
+// is, only a complete magic marks an encrypted object.
+func unencrypted(prefix []byte) bool {
+	return len(prefix) < len(magic) || string(prefix[:len(magic)]) != magic
+}
+
+// plaintextSize returns the size of an object given the size of its
+// encrypted representation. Every chunk but the last one is full, and an
+// empty object still holds one empty chunk.
+func plaintextSize(size int64) int64 {
+	size -= int64(headerSize)
+	if size < tagSize {
+		return 0
+	}
+	chunks := (size + chunkSize + tagSize - 1) / (chunkSize + tagSize)
+	return size - chunks*tagSize
+}
+
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[nonceSize-9:], counter)
+	if final {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
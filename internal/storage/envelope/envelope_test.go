@@ -0,0 +1,313 @@
+package envelope_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/storage/envelope"
+	"github.com/saferwall/saferwall-api/internal/storage/local"
+	"github.com/saferwall/saferwall-api/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	bucket    = "samples"
+	plain     = "avatars"
+	chunkSize = 64 * 1024
+)
+
+func newKey(t *testing.T) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newBackend(t *testing.T) local.Service {
+	backend, err := local.New(t.TempDir(), "secret", "http://localhost:8080",
+		time.Minute)
+	require.Nil(t, err)
+	require.Nil(t, backend.MakeBucket(context.Background(), bucket, ""))
+	require.Nil(t, backend.MakeBucket(context.Background(), plain, ""))
+	return backend
+}
+
+func newService(t *testing.T, backend envelope.Backend,
+	keys ...string) envelope.Service {
+	svc, err := envelope.New(backend, keys, []string{bucket, "saferwall-conformance"})
+	require.Nil(t, err)
+	return svc
+}
+
+func TestConformance(t *testing.T) {
+	svc := newService(t, newBackend(t), newKey(t))
+	storagetest.Run(t, svc, "saferwall-conformance")
+}
+
+func TestNew(t *testing.T) {
+	backend := newBackend(t)
+	for _, keys := range [][]string{
+		nil,
+		{"not base64"},
+		{base64.StdEncoding.EncodeToString([]byte("too short"))},
+		{newKey(t), ""},
+	} {
+		_, err := envelope.New(backend, keys, []string{bucket})
+		assert.Equal(t, envelope.ErrInvalidMasterKey, err, keys)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	svc := newService(t, backend, newKey(t))
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1,
+		3 * chunkSize, 3*chunkSize + 7} {
+		content := make([]byte, size)
+		_, err := rand.Read(content)
+		require.Nil(t, err)
+		require.Nil(t, svc.Upload(ctx, bucket, "sample", bytes.NewReader(content)))
+
+		raw := &bytes.Buffer{}
+		require.Nil(t, backend.Download(ctx, bucket, "sample", raw))
+		assert.Greater(t, raw.Len(), size, size)
+		if size >= 16 {
+			assert.False(t, bytes.Contains(raw.Bytes(), content), size)
+		}
+
+		info, err := svc.Stat(ctx, bucket, "sample")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), info.Size, size)
+
+		objects, err := svc.List(ctx, bucket, "")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), objects[0].Size, size)
+
+		buf := &bytes.Buffer{}
+		assert.Nil(t, svc.Download(ctx, bucket, "sample", buf))
+		assert.True(t, bytes.Equal(content, buf.Bytes()), size)
+
+		buf.Reset()
+		done := make(chan error, 1)
+		n, err := svc.DownloadWithSize(ctx, bucket, "sample", buf,
+			func(err error) { done <- err })
+		require.Nil(t, err)
+		assert.Nil(t, <-done, size)
+		assert.Equal(t, int64(size), n, size)
+		assert.True(t, bytes.Equal(content, buf.Bytes()), size)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	ctx := context.Background()
+	svc := newService(t, newBackend(t), newKey(t))
+
+	content := make([]byte, 3*chunkSize+100)
+	_, err := rand.Read(content)
+	require.Nil(t, err)
+	require.Nil(t, svc.Upload(ctx, bucket, "sample", bytes.NewReader(content)))
+
+	size := int64(len(content))
+	for _, r := range []struct{ offset, length int64 }{
+		{0, 10},
+		{chunkSize - 5, 10},    // across two chunks
+		{chunkSize, chunkSize}, // a whole chunk
+		{10, 2*chunkSize + 50},
+		{size - 50, 50}, // within the final chunk
+		{size - 50, 500},
+		{size, 10},
+	} {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, svc.DownloadRange(ctx, bucket, "sample", buf,
+			r.offset, r.length), r)
+		end := min(r.offset+r.length, size)
+		assert.True(t, bytes.Equal(content[r.offset:end], buf.Bytes()), r)
+	}
+}
+
+func TestUnencryptedBucket(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	svc := newService(t, backend, newKey(t))
+	content := []byte("avatar")
+
+	require.Nil(t, svc.Upload(ctx, plain, "admin", bytes.NewReader(content)))
+	raw := &bytes.Buffer{}
+	require.Nil(t, backend.Download(ctx, plain, "admin", raw))
+	assert.Equal(t, content, raw.Bytes())
+}
+
+func TestTampering(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	svc := newService(t, backend, newKey(t))
+
+	content := make([]byte, 2*chunkSize+10)
+	require.Nil(t, svc.Upload(ctx, bucket, "sample", bytes.NewReader(content)))
+	raw := &bytes.Buffer{}
+	require.Nil(t, backend.Download(ctx, bucket, "sample", raw))
+	encrypted := raw.Bytes()
+
+	flipped := append([]byte{}, encrypted...)
+	flipped[len(flipped)-1] ^= 1
+	truncated := encrypted[:len(encrypted)-26]
+	swapped := append([]byte{}, encrypted...)
+	copy(swapped[30:], "xxxx")
+
+	for name, tampered := range map[string][]byte{
+		"flipped":   flipped,
+		"truncated": truncated,
+		"header":    swapped,
+		"magic":     []byte("SFWE not encrypted"),
+	} {
+		require.Nil(t, backend.Upload(ctx, bucket, "sample",
+			bytes.NewReader(tampered)))
+		err := svc.Download(ctx, bucket, "sample", &bytes.Buffer{})
+		assert.Equal(t, envelope.ErrCorrupt, err, name)
+	}
+}
+
+func TestTamperingWithSize(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	svc := newService(t, backend, newKey(t))
+
+	content := make([]byte, 2*chunkSize+10)
+	require.Nil(t, svc.Upload(ctx, bucket, "sample", bytes.NewReader(content)))
+	raw := &bytes.Buffer{}
+	require.Nil(t, backend.Download(ctx, bucket, "sample", raw))
+	encrypted := raw.Bytes()
+
+	// Only the final chunk is cut, the full chunks still authenticate.
+	truncated := encrypted[:len(encrypted)-5]
+	require.Nil(t, backend.Upload(ctx, bucket, "sample",
+		bytes.NewReader(truncated)))
+
+	buf := &bytes.Buffer{}
+	done := make(chan error, 1)
+	_, err := svc.DownloadWithSize(ctx, bucket, "sample", buf,
+		func(err error) { done <- err })
+	require.Nil(t, err)
+	assert.Equal(t, envelope.ErrCorrupt, <-done)
+	assert.Equal(t, content[:2*chunkSize], buf.Bytes())
+}
+
+func TestUnencryptedObject(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	svc := newService(t, backend, newKey(t))
+
+	// Objects uploaded before the encryption was enabled are served as is.
+	content := make([]byte, 2*chunkSize+10)
+	_, err := rand.Read(content)
+	require.Nil(t, err)
+	content[0] = 'M'
+	metadata := map[string]string{"sha256": "checksum"}
+	require.Nil(t, backend.UploadWithMetadata(ctx, bucket, "legacy",
+		bytes.NewReader(content), metadata))
+	require.Nil(t, backend.Upload(ctx, bucket, "short", bytes.NewReader(
+		[]byte("MZ"))))
+	require.Nil(t, backend.Upload(ctx, bucket, "empty", bytes.NewReader(nil)))
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, svc.Download(ctx, bucket, "legacy", buf))
+	assert.Equal(t, content, buf.Bytes())
+	for key, want := range map[string]string{"short": "MZ", "empty": ""} {
+		buf.Reset()
+		require.Nil(t, svc.Download(ctx, bucket, key, buf), key)
+		assert.Equal(t, want, buf.String(), key)
+	}
+
+	buf.Reset()
+	require.Nil(t, svc.DownloadRange(ctx, bucket, "legacy", buf, chunkSize-5, 20))
+	assert.Equal(t, content[chunkSize-5:chunkSize+15], buf.Bytes())
+
+	buf.Reset()
+	done := make(chan error, 1)
+	size, err := svc.DownloadWithSize(ctx, bucket, "legacy", buf,
+		func(err error) { done <- err })
+	require.Nil(t, err)
+	assert.Nil(t, <-done)
+	assert.Equal(t, int64(len(content)), size)
+	assert.Equal(t, content, buf.Bytes())
+
+	info, err := svc.Stat(ctx, bucket, "legacy")
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	objects, err := svc.List(ctx, bucket, "")
+	require.Nil(t, err)
+	sizes := map[string]int64{}
+	for _, obj := range objects {
+		sizes[obj.Key] = obj.Size
+	}
+	assert.Equal(t, map[string]int64{"legacy": int64(len(content)),
+		"short": 2, "empty": 0}, sizes)
+
+	// Rotating encrypts them in place.
+	count, err := svc.Rotate(ctx, bucket, "")
+	require.Nil(t, err)
+	assert.Equal(t, 3, count)
+	raw := &bytes.Buffer{}
+	require.Nil(t, backend.Download(ctx, bucket, "legacy", raw))
+	assert.Equal(t, "SFWE", raw.String()[:4])
+	info, err = svc.Stat(ctx, bucket, "legacy")
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.Equal(t, metadata, info.Metadata)
+	for key, want := range map[string][]byte{"legacy": content,
+		"short": []byte("MZ"), "empty": {}} {
+		buf.Reset()
+		require.Nil(t, svc.Download(ctx, bucket, key, buf), key)
+		assert.Equal(t, want, append([]byte{}, buf.Bytes()...), key)
+	}
+	count, err = svc.Rotate(ctx, bucket, "")
+	require.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	oldKey, newKey := newKey(t), newKey(t)
+	content := []byte("saferwall")
+	metadata := map[string]string{"sha256": "checksum"}
+
+	old := newService(t, backend, oldKey)
+	require.Nil(t, old.UploadWithMetadata(ctx, bucket, "a", bytes.NewReader(content),
+		metadata))
+	require.Nil(t, old.Upload(ctx, bucket, "b", bytes.NewReader(content)))
+
+	// Objects encrypted with a retired key stay readable.
+	svc := newService(t, backend, newKey, oldKey)
+	require.Nil(t, svc.Upload(ctx, bucket, "c", bytes.NewReader(content)))
+	buf := &bytes.Buffer{}
+	assert.Nil(t, svc.Download(ctx, bucket, "a", buf))
+	assert.Equal(t, content, buf.Bytes())
+
+	count, err := svc.Rotate(ctx, bucket, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	count, err = svc.Rotate(ctx, bucket, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// The retired key can now be dropped.
+	rotated := newService(t, backend, newKey)
+	for _, key := range []string{"a", "b", "c"} {
+		buf.Reset()
+		assert.Nil(t, rotated.Download(ctx, bucket, key, buf), key)
+		assert.Equal(t, content, buf.Bytes(), key)
+	}
+	info, err := rotated.Stat(ctx, bucket, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, metadata, info.Metadata)
+
+	err = old.Download(ctx, bucket, "a", &bytes.Buffer{})
+	assert.Equal(t, envelope.ErrUnknownMasterKey, err)
+}
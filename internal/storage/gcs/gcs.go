@@ -0,0 +1,257 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/saferwall/saferwall-api/internal/storage/object"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// Service provides abstraction to cloud object storage.
+type Service struct {
+	// gcs client.
+	client *gcs.Client
+	// Project ID which owns the buckets.
+	projectID string
+	// Whether the client targets an emulator, which can't sign URLs.
+	emulated bool
+	// Lifetime of the pre-signed URLs.
+	presignTTL time.Duration
+}
+
+// New generates new Google Cloud Storage service. When credentialsFile is
+// empty, the application default credentials are used. A non empty endpoint
+// overrides the API endpoint, it is used to point the client to an emulator,
+// in which case no authentication is performed.
+func New(ctx context.Context, projectID, credentialsFile, endpoint string,
+	presignTTL time.Duration) (Service, error) {
+
+	opts := []option.ClientOption{}
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint),
+			option.WithoutAuthentication())
+	}
+
+	client, err := gcs.NewClient(ctx, opts...)
+	if err != nil {
+		return Service{}, err
+	}
+
+	return Service{client, projectID, endpoint != "", presignTTL}, nil
+}
+
+// Upload uploads an object to the remote storage.
+func (s Service) Upload(ctx context.Context, bucket, key string,
+	file io.Reader) error {
+	return s.UploadWithMetadata(ctx, bucket, key, file, nil)
+}
+
+// UploadWithMetadata uploads an object to the remote storage alongside user
+// defined metadata.
+func (s Service) UploadWithMetadata(ctx context.Context, bucket, key string,
+	file io.Reader, metadata map[string]string) error {
+
+	w := s.client.Bucket(bucket).Object(key).NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	w.Metadata = metadata
+	if _, err := io.Copy(w, file); err != nil {
+		w.Close()
+		return err
+	}
+
+	// The object is only committed once the writer is closed.
+	return w.Close()
+}
+
+// Download downloads an object from the remote storage.
+func (s Service) Download(ctx context.Context, bucket, key string,
+	file io.Writer) error {
+
+	reader, err := s.client.Bucket(bucket).Object(key).NewReader(ctx)
+	if err != nil {
+		return notFound(err)
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
+
+// DownloadRange downloads length bytes of an object starting at offset, or
+// less when the object ends before.
+func (s Service) DownloadRange(ctx context.Context, bucket, key string,
+	file io.Writer, offset, length int64) error {
+
+	reader, err := s.client.Bucket(bucket).Object(key).NewRangeReader(ctx,
+		offset, length)
+	if err != nil {
+		return notFound(err)
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
+
+// DownloadWithSize downloads an object from the remote storage and returns
+// its size. The copy happens in the background, done is called once the
+// object has been fully written to file, with the error of the copy.
+func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
+	file io.Writer, done func(error)) (size int64, err error) {
+
+	reader, err := s.client.Bucket(bucket).Object(key).NewReader(ctx)
+	if err != nil {
+		return 0, notFound(err)
+	}
+
+	size = reader.Attrs.Size
+	go func() {
+		defer reader.Close()
+		_, err := io.CopyN(file, reader, size)
+		done(err)
+	}()
+	return size, nil
+}
+
+// GetFileSize gets an object's size from the remote storage.
+func (s Service) GetFileSize(ctx context.Context, bucket, key string,
+	done func()) (size int64, err error) {
+
+	info, err := s.Stat(ctx, bucket, key)
+	if err != nil {
+		return
+	}
+
+	defer done()
+
+	return info.Size, nil
+}
+
+// MakeBucket creates a new bucket with bucketName with a context to control
+// cancellations and timeouts.
+func (s Service) MakeBucket(ctx context.Context, bucketName,
+	location string) error {
+
+	bucket := s.client.Bucket(bucketName)
+	err := bucket.Create(ctx, s.projectID, &gcs.BucketAttrs{Location: location})
+	if err != nil {
+		// Check to see if we already own this bucket
+		// (which happens if you run this twice)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+			if _, errAttrs := bucket.Attrs(ctx); errAttrs == nil {
+				return nil
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Exists checks whether an object exists already in the object storage.
+func (s Service) Exists(ctx context.Context, bucketName,
+	key string) (bool, error) {
+
+	_, err := s.Stat(ctx, bucketName, key)
+	if errors.Is(err, object.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GeneratePresignedURL creates a V4 signed URL. Signing requires a service
+// account key, either from the credentials file or the attached service
+// account.
+func (s Service) GeneratePresignedURL(ctx context.Context, bucketName,
+	key string) (string, error) {
+
+	if s.emulated {
+		return "", object.ErrNotSupported
+	}
+
+	// Set request parameters for content-disposition.
+	attachment := fmt.Sprintf("attachment; filename=\"%s\"", key)
+
+	return s.client.Bucket(bucketName).SignedURL(key, &gcs.SignedURLOptions{
+		Scheme:          gcs.SigningSchemeV4,
+		Method:          http.MethodGet,
+		Expires:         time.Now().Add(s.presignTTL),
+		QueryParameters: map[string][]string{"response-content-disposition": {attachment}},
+	})
+}
+
+// Delete deletes an object from the remote storage, deleting a missing
+// object is not an error.
+func (s Service) Delete(ctx context.Context, bucket, key string) error {
+	err := s.client.Bucket(bucket).Object(key).Delete(ctx)
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List returns the objects whose key starts with prefix, sorted by key.
+func (s Service) List(ctx context.Context, bucket, prefix string) (
+	[]object.Info, error) {
+
+	it := s.client.Bucket(bucket).Objects(ctx, &gcs.Query{Prefix: prefix})
+	objects := []object.Info{}
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, info(attrs))
+	}
+	return objects, nil
+}
+
+// Stat returns the metadata of an object.
+func (s Service) Stat(ctx context.Context, bucket, key string) (
+	object.Info, error) {
+
+	attrs, err := s.client.Bucket(bucket).Object(key).Attrs(ctx)
+	if err != nil {
+		return object.Info{}, notFound(err)
+	}
+	info := info(attrs)
+	info.Metadata = object.NormalizeMetadata(attrs.Metadata)
+	return info, nil
+}
+
+// notFound translates the missing object errors to object.ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return object.ErrNotFound
+	}
+	return err
+}
+
+func info(attrs *gcs.ObjectAttrs) object.Info {
+	return object.Info{
+		Key:          attrs.Name,
+		Size:         attrs.Size,
+		LastModified: attrs.Updated.UTC(),
+	}
+}
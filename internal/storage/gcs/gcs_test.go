@@ -0,0 +1,28 @@
+package gcs_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/storage/gcs"
+	"github.com/saferwall/saferwall-api/internal/storage/storagetest"
+)
+
+// The tests run against fake-gcs-server, for instance:
+//
+//	docker run -p 4443:4443 fsouza/fake-gcs-server -scheme http -public-host localhost:4443
+//	SFW_TEST_GCS_ENDPOINT=http://localhost:4443/storage/v1/ go test ./internal/storage/gcs/
+func TestConformance(t *testing.T) {
+	endpoint := os.Getenv("SFW_TEST_GCS_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("SFW_TEST_GCS_ENDPOINT is not set")
+	}
+	svc, err := gcs.New(context.Background(), "saferwall-test", "", endpoint,
+		time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.Run(t, svc, "saferwall-conformance")
+}
@@ -6,57 +6,110 @@ package local
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/storage/object"
+)
+
+var (
+	// errInvalidKey is returned when a key resolves outside of its bucket.
+	errInvalidKey = errors.New("invalid object key")
+)
+
+const (
+	// Directory holding the objects metadata, as JSON files mirroring the
+	// buckets layout.
+	metadataDir = ".metadata"
+	// Directory holding the objects being uploaded.
+	tempDir = ".tmp"
 )
 
 // Service provides abstraction to cloud object storage.
 type Service struct {
 	// Root directory in the local file system.
 	root string
+	// Key used to sign the download tokens.
+	signingKey []byte
+	// URL the API is reachable at, download links point to it.
+	publicURL string
+	// Lifetime of the download links.
+	presignTTL time.Duration
 }
 
-// New generates new object storage service.
-func New(root string) (Service, error) {
+// New generates new object storage service. The API serves the pre-signed
+// URLs itself under publicURL, an empty signingKey disables them.
+func New(root, signingKey, publicURL string, presignTTL time.Duration) (
+	Service, error) {
 	if _, err := os.Stat(root); os.IsNotExist(err) {
 		if err := os.MkdirAll(root, os.ModePerm); err != nil {
 			return Service{}, err
 		}
 	}
-	return Service{root}, nil
+	return Service{root, []byte(signingKey), strings.TrimRight(publicURL, "/"),
+		presignTTL}, nil
 }
 
 // Upload upload an object to s3.
 func (s Service) Upload(ctx context.Context, bucket, key string,
 	file io.Reader) error {
+	return s.UploadWithMetadata(ctx, bucket, key, file, nil)
+}
+
+// UploadWithMetadata uploads an object alongside user defined metadata. The
+// object is written to a temporary file first and then moved in place, so a
+// failed upload never leaves a truncated object behind.
+func (s Service) UploadWithMetadata(ctx context.Context, bucket, key string,
+	file io.Reader, metadata map[string]string) error {
 
-	dest := filepath.Join(s.root, bucket, key)
+	dest, err := s.path(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	// Keys may contain slashes, create the intermediate directories.
+	if err = os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(s.root, tempDir)
+	if err = os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return err
+	}
 
 	// Create new file.
-	new, err := os.Create(dest)
+	new, err := os.CreateTemp(tmpDir, "upload-*")
 	if err != nil {
 		return err
 	}
-	defer new.Close()
+	defer os.Remove(new.Name())
 
 	// Perform the copy.
 	if _, err := io.Copy(new, file); err != nil {
+		new.Close()
+		return err
+	}
+	if err = new.Close(); err != nil {
 		return err
 	}
 
-	return nil
+	if err = s.writeMetadata(bucket, key, metadata); err != nil {
+		return err
+	}
+	return os.Rename(new.Name(), dest)
 }
 
 // Download downloads an object from the local file system.
 func (s Service) Download(ctx context.Context, bucket, key string,
 	dst io.Writer) error {
 
-	// Create new file.
-	name := filepath.Join(s.root, bucket, key)
-	src, err := os.Open(name)
+	src, err := s.open(bucket, key)
 	if err != nil {
 		return err
 	}
@@ -70,14 +123,32 @@ func (s Service) Download(ctx context.Context, bucket, key string,
 	return nil
 }
 
+// DownloadRange downloads length bytes of an object starting at offset, or
+// less when the object ends before.
+func (s Service) DownloadRange(ctx context.Context, bucket, key string,
+	dst io.Writer, offset, length int64) error {
+
+	src, err := s.open(bucket, key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err = src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(dst, src, length)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
 // Download downloads an object from the local file system.
 func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
-	dst io.Writer, done func()) (size int64, err error) {
-
-	// Create new file.
-	name := filepath.Join(s.root, bucket, key)
-	src, err := os.Open(name)
+	dst io.Writer, done func(error)) (size int64, err error) {
 
+	src, err := s.open(bucket, key)
 	if err != nil {
 		return
 	}
@@ -91,10 +162,8 @@ func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
 	// Perform the copy.
 	go func() {
 		defer src.Close()
-		defer done()
-		if _, err = io.Copy(dst, src); err != nil {
-			fmt.Println(err)
-		}
+		_, err := io.Copy(dst, src)
+		done(err)
 	}()
 
 	return fileInfo.Size(), err
@@ -103,14 +172,12 @@ func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
 // GetFileSize gets an object's size from the local file system.
 func (s Service) GetFileSize(ctx context.Context, bucket, key string, done func()) (size int64, err error) {
 
-	name := filepath.Join(s.root, bucket, key)
-	fileInfo, err := os.Stat(name)
-
+	info, err := s.Stat(ctx, bucket, key)
 	if err != nil {
 		return
 	}
 	defer done()
-	return fileInfo.Size(), err
+	return info.Size, nil
 }
 
 // MakeBucket creates a new folder in the local file system that acts like
@@ -127,32 +194,198 @@ func (s Service) MakeBucket(ctx context.Context, bucketName, location string) er
 
 // Exists checks whether a file exists in disk.
 func (s Service) Exists(ctx context.Context, bucketName, key string) (bool, error) {
-	name := filepath.Join(s.root, bucketName, key)
-	_, err := os.Stat(name)
+	_, err := s.Stat(ctx, bucketName, key)
 	if err == nil {
 		return true, nil
 	}
-	if errors.Is(err, os.ErrNotExist) {
+	if errors.Is(err, object.ErrNotFound) {
 		return false, nil
 	}
 	return false, err
 }
 
-// GeneratePresignedURL is left here only to satisfy the interface. Pre-signed URLs
-// don't make sense for the local storage.
+// GeneratePresignedURL creates a download link carrying a signed token,
+// the link is served by the `/v1/blobs/:token/` route of the API.
 func (s Service) GeneratePresignedURL(ctx context.Context, bucketName, key string) (string, error) {
-	return "", errors.New("not implemented")
+	if len(s.signingKey) == 0 {
+		return "", object.ErrNotSupported
+	}
+	token, err := s.newToken(bucketName, key)
+	if err != nil {
+		return "", err
+	}
+	return s.publicURL + "/v1/blobs/" + token + "/", nil
 }
 
-// Delete deletes an object from the local file system.
+// Delete deletes an object from the local file system, the directories left
+// empty are removed as well.
 func (s Service) Delete(ctx context.Context, bucket, key string) error {
 
 	// Get the file path.
-	name := filepath.Join(s.root, bucket, key)
-	err := os.Remove(name)
+	name, err := s.path(bucket, key)
 	if err != nil {
 		return err
 	}
+	err = os.Remove(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(name), filepath.Join(s.root, bucket))
 
-	return nil
+	return s.writeMetadata(bucket, key, nil)
+}
+
+// List returns the objects whose key starts with prefix, sorted by key.
+func (s Service) List(ctx context.Context, bucket, prefix string) (
+	[]object.Info, error) {
+
+	bucketDir := filepath.Join(s.root, bucket)
+	objects := []object.Info{}
+	err := filepath.WalkDir(bucketDir, func(path string, d fs.DirEntry,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, info(key, fileInfo))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Directories are walked entry by entry, which does not match the
+	// lexical order of the full keys.
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// Stat returns the metadata of an object.
+func (s Service) Stat(ctx context.Context, bucket, key string) (
+	object.Info, error) {
+
+	name, err := s.path(bucket, key)
+	if err != nil {
+		return object.Info{}, err
+	}
+	fileInfo, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && fileInfo.IsDir()) {
+		return object.Info{}, object.ErrNotFound
+	}
+	if err != nil {
+		return object.Info{}, err
+	}
+
+	info := info(key, fileInfo)
+	content, err := os.ReadFile(s.metadataPath(bucket, key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return object.Info{}, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(content, &info.Metadata); err != nil {
+			return object.Info{}, err
+		}
+	}
+	return info, nil
+}
+
+// writeMetadata saves the metadata of an object, empty metadata removes
+// the metadata previously saved.
+func (s Service) writeMetadata(bucket, key string,
+	metadata map[string]string) error {
+
+	name := s.metadataPath(bucket, key)
+	metadata = object.NormalizeMetadata(metadata)
+	if len(metadata) == 0 {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		removeEmptyDirs(filepath.Dir(name), filepath.Join(s.root, metadataDir))
+		return nil
+	}
+
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(name, content, 0o644)
+}
+
+// metadataPath returns the location of the metadata of an object, the key
+// must have been validated beforehand.
+func (s Service) metadataPath(bucket, key string) string {
+	return filepath.Join(s.root, metadataDir, bucket, key) + ".json"
+}
+
+// removeEmptyDirs removes dir and its parents up to root as long as they
+// are empty. Removing a non empty directory fails, which stops the walk.
+func removeEmptyDirs(dir, root string) {
+	for ; dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+// path returns the location of an object in the local file system.
+func (s Service) path(bucket, key string) (string, error) {
+	bucketDir := filepath.Join(s.root, bucket)
+	name := filepath.Join(bucketDir, key)
+	if !strings.HasPrefix(name, bucketDir+string(filepath.Separator)) {
+		return "", errInvalidKey
+	}
+	return name, nil
+}
+
+// open opens an object for reading.
+func (s Service) open(bucket, key string) (*os.File, error) {
+	name, err := s.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, object.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		f.Close()
+		return nil, object.ErrNotFound
+	}
+	return f, nil
+}
+
+func info(key string, fileInfo fs.FileInfo) object.Info {
+	return object.Info{
+		Key:          key,
+		Size:         fileInfo.Size(),
+		LastModified: fileInfo.ModTime().UTC(),
+	}
 }
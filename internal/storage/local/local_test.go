@@ -0,0 +1,87 @@
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/storage/local"
+	"github.com/saferwall/saferwall-api/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+const publicURL = "http://localhost:8080"
+
+func newTestService(t *testing.T, ttl time.Duration) local.Service {
+	svc, err := local.New(t.TempDir(), "secret", publicURL+"/", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, newTestService(t, time.Minute), "saferwall-conformance")
+}
+
+func TestKeyOutsideBucket(t *testing.T) {
+	svc := newTestService(t, time.Minute)
+	ctx := context.Background()
+	assert.Nil(t, svc.MakeBucket(ctx, "bucket", ""))
+
+	for _, key := range []string{"../escape", "dir/../../escape", ".", ""} {
+		err := svc.Upload(ctx, "bucket", key, bytes.NewReader([]byte("x")))
+		assert.NotNil(t, err, key)
+	}
+}
+
+// tokenOf extracts the token from a download link.
+func tokenOf(t *testing.T, url string) string {
+	prefix := publicURL + "/v1/blobs/"
+	if !strings.HasPrefix(url, prefix) || !strings.HasSuffix(url, "/") {
+		t.Fatalf("unexpected download link %s", url)
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(url, prefix), "/")
+}
+
+func TestVerifyToken(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestService(t, time.Minute)
+	url, err := svc.GeneratePresignedURL(ctx, "bucket", "dir/key")
+	assert.Nil(t, err)
+	token := tokenOf(t, url)
+
+	bucket, key, err := svc.VerifyToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "bucket", bucket)
+	assert.Equal(t, "dir/key", key)
+
+	payload, sig, _ := strings.Cut(token, ".")
+	tests := []struct {
+		tag   string
+		token string
+	}{
+		{"empty", ""},
+		{"no signature", payload},
+		{"bad encoding", payload + ".!!"},
+		{"bad signature", payload + "." + strings.Repeat("A", len(sig))},
+		{"swapped", sig + "." + payload},
+	}
+	for _, test := range tests {
+		_, _, err := svc.VerifyToken(test.token)
+		assert.Equal(t, local.ErrInvalidToken, err, test.tag)
+	}
+
+	other, err := local.New(t.TempDir(), "other secret", publicURL, time.Minute)
+	assert.Nil(t, err)
+	_, _, err = other.VerifyToken(token)
+	assert.Equal(t, local.ErrInvalidToken, err, "signed with another key")
+
+	expired := newTestService(t, -time.Minute)
+	url, err = expired.GeneratePresignedURL(ctx, "bucket", "dir/key")
+	assert.Nil(t, err)
+	_, _, err = expired.VerifyToken(tokenOf(t, url))
+	assert.Equal(t, local.ErrTokenExpired, err)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+package local
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned when a download token is malformed or
+	// its signature does not match.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned when a download token is past its
+	// expiration.
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// claims represents the payload of a download token.
+type claims struct {
+	Bucket     string `json:"b"`
+	Key        string `json:"k"`
+	Expiration int64  `json:"e"`
+}
+
+// newToken creates a download token for an object, made of the base64
+// encoded claims and their HMAC-SHA256 signature separated by a dot.
+func (s Service) newToken(bucket, key string) (string, error) {
+	payload, err := json.Marshal(claims{
+		Bucket:     bucket,
+		Key:        key,
+		Expiration: time.Now().Add(s.presignTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(payload)), nil
+}
+
+// VerifyToken checks the signature and the expiration of a download token
+// and returns the object it grants access to.
+func (s Service) VerifyToken(token string) (bucket, key string, err error) {
+	if len(s.signingKey) == 0 {
+		return "", "", ErrInvalidToken
+	}
+
+	enc := base64.RawURLEncoding
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", ErrInvalidToken
+	}
+	payload, err := enc.DecodeString(encPayload)
+	if err != nil {
+		return "", "", ErrInvalidToken
+	}
+	sig, err := enc.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, s.sign(payload)) {
+		return "", "", ErrInvalidToken
+	}
+
+	var c claims
+	if err = json.Unmarshal(payload, &c); err != nil {
+		return "", "", ErrInvalidToken
+	}
+	if time.Now().Unix() > c.Expiration {
+		return "", "", ErrTokenExpired
+	}
+	return c.Bucket, c.Key, nil
+}
+
+func (s Service) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
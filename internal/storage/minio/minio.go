@@ -7,6 +7,7 @@ package minio
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -14,6 +15,7 @@ import (
 
 	mio "github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/saferwall/saferwall-api/internal/storage/object"
 )
 
 var (
@@ -25,9 +27,12 @@ var (
 type Service struct {
 	// s3 client.
 	client *mio.Client
+	// Lifetime of the pre-signed URLs.
+	presignTTL time.Duration
 }
 
-func New(endpoint, accessKey, secretKey string) (Service, error) {
+func New(endpoint, accessKey, secretKey string, presignTTL time.Duration) (
+	Service, error) {
 
 	// New returns an Amazon S3 compatible client object.
 	// API compatibility (v2 or v4) is automatically
@@ -40,12 +45,19 @@ func New(endpoint, accessKey, secretKey string) (Service, error) {
 		return Service{}, nil
 	}
 
-	return Service{s3Client}, nil
+	return Service{s3Client, presignTTL}, nil
 }
 
 // Upload uploads an object to the remote storage,.
 func (s Service) Upload(ctx context.Context, bucket, key string,
 	file io.Reader) error {
+	return s.UploadWithMetadata(ctx, bucket, key, file, nil)
+}
+
+// UploadWithMetadata uploads an object to the remote storage alongside user
+// defined metadata.
+func (s Service) UploadWithMetadata(ctx context.Context, bucket, key string,
+	file io.Reader, metadata map[string]string) error {
 
 	// Get the size.
 	buf := &bytes.Buffer{}
@@ -54,7 +66,8 @@ func (s Service) Upload(ctx context.Context, bucket, key string,
 		return err
 	}
 	_, err = s.client.PutObject(ctx, bucket, key, buf, size,
-		mio.PutObjectOptions{ContentType: "application/octet-stream"})
+		mio.PutObjectOptions{ContentType: "application/octet-stream",
+			UserMetadata: metadata})
 	if err != nil {
 		return err
 	}
@@ -69,10 +82,11 @@ func (s Service) Download(ctx context.Context, bucket, key string,
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
 	stat, err := reader.Stat()
 	if err != nil {
-		return err
+		return notFound(err)
 	}
 
 	_, err = io.CopyN(file, reader, stat.Size)
@@ -82,8 +96,27 @@ func (s Service) Download(ctx context.Context, bucket, key string,
 	return nil
 }
 
+// DownloadRange downloads length bytes of an object starting at offset, or
+// less when the object ends before.
+func (s Service) DownloadRange(ctx context.Context, bucket, key string,
+	file io.Writer, offset, length int64) error {
+
+	opts := mio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return err
+	}
+	reader, err := s.client.GetObject(ctx, bucket, key, opts)
+	if err != nil {
+		return notFound(err)
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(file, reader)
+	return notFound(err)
+}
+
 func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
-	file io.Writer, done func()) (size int64, err error) {
+	file io.Writer, done func(error)) (size int64, err error) {
 
 	reader, err := s.client.GetObject(ctx, bucket, key, mio.GetObjectOptions{})
 	if err != nil {
@@ -92,16 +125,14 @@ func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
 
 	stat, err := reader.Stat()
 	if err != nil {
-		return
+		reader.Close()
+		return 0, notFound(err)
 	}
 
 	go func() {
 		defer reader.Close()
-		defer done()
 		_, err := io.CopyN(file, reader, stat.Size)
-		if err != nil {
-			fmt.Println(err)
-		}
+		done(err)
 	}()
 	return stat.Size, err
 }
@@ -109,14 +140,14 @@ func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
 // GetFileSize gets an object's size from the local file system.
 func (s Service) GetFileSize(ctx context.Context, bucket, key string, done func()) (size int64, err error) {
 
-	attr, err := s.client.GetObjectAttributes(ctx, bucket, key, mio.ObjectAttributesOptions{})
+	info, err := s.Stat(ctx, bucket, key)
 	if err != nil {
 		return
 	}
 
 	defer done()
 
-	return int64(attr.ObjectSize), err
+	return info.Size, nil
 }
 
 // MakeBucket creates a new bucket with bucketName with a context to control
@@ -141,15 +172,12 @@ func (s Service) MakeBucket(ctx context.Context, bucketName,
 // Exists checks whether an object exists already in the object storage.
 func (s Service) Exists(ctx context.Context, bucketName,
 	key string) (bool, error) {
-	opts := mio.GetObjectOptions{}
-	_, err := s.client.StatObject(ctx, bucketName, key, opts)
+	_, err := s.Stat(ctx, bucketName, key)
 	if err != nil {
-		switch err.Error() {
-		case ErrNoSuchKey:
+		if errors.Is(err, object.ErrNotFound) {
 			return false, nil
-		default:
-			return false, err
 		}
+		return false, err
 	}
 	return true, nil
 }
@@ -163,16 +191,17 @@ func (s Service) GeneratePresignedURL(ctx context.Context, bucketName,
 	attachment := fmt.Sprintf("attachment; filename=\"%s\"", key)
 	reqParams.Set("response-content-disposition", attachment)
 
-	// Generates a presigned url which expires in a day.
+	// Generates a presigned url which expires after the configured TTL.
 	presignedURL, err := s.client.PresignedGetObject(ctx, bucketName, key,
-		time.Minute*5, reqParams)
+		s.presignTTL, reqParams)
 	if err != nil {
 		return "", err
 	}
 	return presignedURL.String(), nil
 }
 
-// Delete deletes an object from the remote storage.
+// Delete deletes an object from the remote storage, deleting a missing
+// object is not an error.
 func (s Service) Delete(ctx context.Context, bucket, key string) error {
 
 	opts := mio.RemoveObjectOptions{}
@@ -184,3 +213,46 @@ func (s Service) Delete(ctx context.Context, bucket, key string) error {
 
 	return nil
 }
+
+// List returns the objects whose key starts with prefix, sorted by key.
+func (s Service) List(ctx context.Context, bucket, prefix string) (
+	[]object.Info, error) {
+
+	opts := mio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	objects := []object.Info{}
+	for obj := range s.client.ListObjects(ctx, bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, object.Info{
+			Key:          obj.Key,
+			Size:         obj.Size,
+			LastModified: obj.LastModified.UTC(),
+		})
+	}
+	return objects, nil
+}
+
+// Stat returns the metadata of an object.
+func (s Service) Stat(ctx context.Context, bucket, key string) (
+	object.Info, error) {
+
+	stat, err := s.client.StatObject(ctx, bucket, key, mio.StatObjectOptions{})
+	if err != nil {
+		return object.Info{}, notFound(err)
+	}
+	return object.Info{
+		Key:          key,
+		Size:         stat.Size,
+		LastModified: stat.LastModified.UTC(),
+		Metadata:     object.NormalizeMetadata(stat.UserMetadata),
+	}, nil
+}
+
+// notFound translates the missing object errors to object.ErrNotFound.
+func notFound(err error) error {
+	if mio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return object.ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package minio_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/storage/minio"
+	"github.com/saferwall/saferwall-api/internal/storage/storagetest"
+)
+
+// The tests run against a MinIO container, for instance:
+//
+//	docker run -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+//	SFW_TEST_MINIO_ENDPOINT=localhost:9000 go test ./internal/storage/minio/
+func TestConformance(t *testing.T) {
+	endpoint := os.Getenv("SFW_TEST_MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("SFW_TEST_MINIO_ENDPOINT is not set")
+	}
+	svc, err := minio.New(endpoint, "minio", "minio123", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.Run(t, svc, "saferwall-conformance")
+}
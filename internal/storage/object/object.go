@@ -0,0 +1,46 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+// Package object holds the types shared by the object storage backends.
+package object
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when an object does not exist in a bucket.
+	ErrNotFound = errors.New("object not found")
+	// ErrNotSupported is returned when a backend does not support an
+	// operation.
+	ErrNotSupported = errors.New("operation not supported")
+)
+
+// Info describes an object stored in a bucket.
+type Info struct {
+	// Key of the object in the bucket.
+	Key string `json:"key"`
+	// Size of the object in bytes.
+	Size int64 `json:"size"`
+	// LastModified is the time the object was last written.
+	LastModified time.Time `json:"last_modified"`
+	// Metadata holds the user defined metadata of the object, keys are
+	// lower cased. It is only populated by Stat.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// NormalizeMetadata lower cases the metadata keys, as backends do not agree
+// on their case when reading them back.
+func NormalizeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	normalized := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		normalized[strings.ToLower(k)] = v
+	}
+	return normalized
+}
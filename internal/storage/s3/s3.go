@@ -6,6 +6,8 @@ package s3
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	awss3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/saferwall/saferwall-api/internal/storage/object"
 )
 
 // Service provides abstraction to cloud object storage.
@@ -25,6 +28,8 @@ type Service struct {
 	uploader *s3manager.Uploader
 	// s3 downloader.
 	downloader *s3manager.Downloader
+	// Lifetime of the pre-signed URLs.
+	presignTTL time.Duration
 }
 
 // FakeWriterAt represents a struct that provides the method WriteAt so it will
@@ -42,13 +47,19 @@ func (fw FakeWriterAt) WriteAt(p []byte, offset int64) (n int, err error) {
 	return fw.w.Write(p)
 }
 
-// New generates new s3 object storage service.
-func New(region, accessKey, secretKey string) (Service, error) {
+// New generates new s3 object storage service. A non empty endpoint targets
+// an S3 compatible service instead of AWS, using path style addressing.
+func New(region, accessKey, secretKey, endpoint string,
+	presignTTL time.Duration) (Service, error) {
 
 	// The session the S3 Uploader will use.
 	creds := credentials.NewStaticCredentials(accessKey, secretKey, "")
-	sess, err := session.NewSession(&aws.Config{Region: aws.String(region),
-		Credentials: creds})
+	cfg := &aws.Config{Region: aws.String(region), Credentials: creds}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(cfg)
 	if err != nil {
 		return Service{}, nil
 	}
@@ -69,12 +80,18 @@ func New(region, accessKey, secretKey string) (Service, error) {
 			u.PartSize = 5 * 1024 * 1024 // 5MB per part
 		})
 
-	return Service{s3Svc, uploader, downloader}, nil
+	return Service{s3Svc, uploader, downloader, presignTTL}, nil
 }
 
 // Upload upload an object to s3.
 func (s Service) Upload(ctx context.Context, bucket, key string,
 	file io.Reader) error {
+	return s.UploadWithMetadata(ctx, bucket, key, file, nil)
+}
+
+// UploadWithMetadata uploads an object to s3 alongside user defined metadata.
+func (s Service) UploadWithMetadata(ctx context.Context, bucket, key string,
+	file io.Reader, metadata map[string]string) error {
 
 	// Upload input parameters
 	upParams := &s3manager.UploadInput{
@@ -82,6 +99,9 @@ func (s Service) Upload(ctx context.Context, bucket, key string,
 		Key:    &key,
 		Body:   file,
 	}
+	if len(metadata) > 0 {
+		upParams.Metadata = aws.StringMap(metadata)
+	}
 
 	// Perform an upload.
 	_, err := s.uploader.UploadWithContext(ctx, upParams)
@@ -102,12 +122,32 @@ func (s Service) Download(ctx context.Context, bucket, key string,
 	// Perform the download.
 	_, err := s.downloader.DownloadWithContext(ctx, FakeWriterAt{file}, input)
 
+	return notFound(err)
+}
+
+// DownloadRange downloads length bytes of an object starting at offset, or
+// less when the object ends before.
+func (s Service) DownloadRange(ctx context.Context, bucket, key string,
+	file io.Writer, offset, length int64) error {
+
+	input := &awss3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	obj, err := s.downloader.S3.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return notFound(err)
+	}
+	defer obj.Body.Close()
+
+	_, err = io.Copy(file, obj.Body)
 	return err
 }
 
 // Download downloads an object from s3.
 func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
-	file io.Writer, done func()) (int64, error) {
+	file io.Writer, done func(error)) (int64, error) {
 
 
 	// Download input parameters.
@@ -118,15 +158,15 @@ func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
 
 	// Perform the download.
 
-	obj, err := s.downloader.S3.GetObject(input)
+	obj, err := s.downloader.S3.GetObjectWithContext(ctx, input)
 	if err != nil {
-		return 0, err
+		return 0, notFound(err)
 	}
 	size := *obj.ContentLength
 	go func () {
 		defer obj.Body.Close()
-		defer done()
-		io.CopyN(file, obj.Body, size)
+		_, err := io.CopyN(file, obj.Body, size)
+		done(err)
 	}()
 	return size, err
 }
@@ -134,20 +174,12 @@ func (s Service) DownloadWithSize(ctx context.Context, bucket, key string,
 // GetFileSize gets an object's size from s3.
 func (s Service) GetFileSize(ctx context.Context, bucket, key string, done func()) (int64, error) {
 
-	// GetAttributes input parameters.
-	input := &awss3.GetObjectAttributesInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		ObjectAttributes: aws.StringSlice([]string{awss3.ObjectAttributesObjectSize}),
-	}
-
-	// Perform the GetAttributes request.
-	obj, err := s.downloader.S3.GetObjectAttributes(input)
+	info, err := s.Stat(ctx, bucket, key)
 	if err != nil {
 		return 0, err
 	}
 	defer done()
-	return *obj.ObjectSize, err
+	return info.Size, nil
 }
 
 // MakeBucket creates a new bucket in s2.
@@ -157,16 +189,23 @@ func (s Service) MakeBucket(ctx context.Context, bucketName, location string) er
 
 	// ignore location constraint for `us-east-1`, otherwise bucket
 	// creation request fails.
-	if location != "us-east-1" {
+	if location != "" && location != "us-east-1" {
 		input.CreateBucketConfiguration = &awss3.CreateBucketConfiguration{
 			LocationConstraint: aws.String(location)}
 	}
 
-	_, err := s.s3svc.CreateBucket(input)
+	_, err := s.s3svc.CreateBucketWithContext(ctx, input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case awss3.ErrCodeBucketAlreadyExists:
+				// Some S3 compatible services report buckets we already
+				// own this way, check whether we have access to it.
+				_, errHead := s.s3svc.HeadBucketWithContext(ctx,
+					&awss3.HeadBucketInput{Bucket: aws.String(bucketName)})
+				if errHead == nil {
+					return nil
+				}
 				return aerr
 			case awss3.ErrCodeBucketAlreadyOwnedByYou:
 				return nil
@@ -184,20 +223,10 @@ func (s Service) MakeBucket(ctx context.Context, bucketName, location string) er
 func (s Service) Exists(ctx context.Context, bucketName,
 	key string) (bool, error) {
 
-	_, err := s.s3svc.HeadObjectWithContext(ctx, &awss3.HeadObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(key),
-	})
+	_, err := s.Stat(ctx, bucketName, key)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			// s3.ErrCodeNoSuchKey does not work, aws is missing this error code
-			// so we hardwire a string
-			case "NotFound":
-				return false, nil
-			default:
-				return false, err
-			}
+		if errors.Is(err, object.ErrNotFound) {
+			return false, nil
 		}
 		return false, err
 	}
@@ -209,7 +238,7 @@ func (s Service) GeneratePresignedURL(ctx context.Context, bucketName, key strin
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(key),
 	})
-	urlStr, err := req.Presign(5 * time.Minute)
+	urlStr, err := req.Presign(s.presignTTL)
 	if err != nil {
 		return "", err
 	}
@@ -217,8 +246,9 @@ func (s Service) GeneratePresignedURL(ctx context.Context, bucketName, key strin
 	return urlStr, nil
 }
 
-// Delete removes an object from the store.
-func (s Service) Delete(ctx context.Context, bucket, key string) (bool, error) {
+// Delete removes an object from the store, deleting a missing object is not
+// an error.
+func (s Service) Delete(ctx context.Context, bucket, key string) error {
 
 	// Prepare the delete object input.
 	input := &awss3.DeleteObjectInput{
@@ -227,9 +257,64 @@ func (s Service) Delete(ctx context.Context, bucket, key string) (bool, error) {
 	}
 
 	_, err := s.s3svc.DeleteObjectWithContext(ctx, input)
+	return err
+}
+
+// List returns the objects whose key starts with prefix, sorted by key.
+func (s Service) List(ctx context.Context, bucket, prefix string) (
+	[]object.Info, error) {
+
+	input := &awss3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	objects := []object.Info{}
+	err := s.s3svc.ListObjectsV2PagesWithContext(ctx, input,
+		func(page *awss3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				objects = append(objects, object.Info{
+					Key:          aws.StringValue(obj.Key),
+					Size:         aws.Int64Value(obj.Size),
+					LastModified: aws.TimeValue(obj.LastModified).UTC(),
+				})
+			}
+			return true
+		})
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Stat returns the metadata of an object.
+func (s Service) Stat(ctx context.Context, bucket, key string) (
+	object.Info, error) {
+
+	obj, err := s.s3svc.HeadObjectWithContext(ctx, &awss3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return object.Info{}, notFound(err)
 	}
+	return object.Info{
+		Key:          key,
+		Size:         aws.Int64Value(obj.ContentLength),
+		LastModified: aws.TimeValue(obj.LastModified).UTC(),
+		Metadata:     object.NormalizeMetadata(aws.StringValueMap(obj.Metadata)),
+	}, nil
+}
 
-	return true, nil
+// notFound translates the missing object errors to object.ErrNotFound.
+func notFound(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		// HEAD requests have no body, the error code is then derived from
+		// the status code.
+		case awss3.ErrCodeNoSuchKey, "NotFound":
+			return object.ErrNotFound
+		}
+	}
+	return err
 }
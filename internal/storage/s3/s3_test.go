@@ -0,0 +1,26 @@
+package s3_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/storage/s3"
+	"github.com/saferwall/saferwall-api/internal/storage/storagetest"
+)
+
+// The tests run against any S3 compatible stand-in, like the MinIO
+// container used by the minio backend tests:
+//
+//	SFW_TEST_S3_ENDPOINT=http://localhost:9000 go test ./internal/storage/s3/
+func TestConformance(t *testing.T) {
+	endpoint := os.Getenv("SFW_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("SFW_TEST_S3_ENDPOINT is not set")
+	}
+	svc, err := s3.New("us-east-1", "minio", "minio123", endpoint, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.Run(t, svc, "saferwall-conformance")
+}
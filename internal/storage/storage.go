@@ -11,25 +11,51 @@ import (
 	"time"
 
 	"github.com/saferwall/saferwall-api/internal/config"
+	"github.com/saferwall/saferwall-api/internal/storage/azure"
+	"github.com/saferwall/saferwall-api/internal/storage/envelope"
+	"github.com/saferwall/saferwall-api/internal/storage/gcs"
 	"github.com/saferwall/saferwall-api/internal/storage/local"
 	"github.com/saferwall/saferwall-api/internal/storage/minio"
+	"github.com/saferwall/saferwall-api/internal/storage/object"
 	"github.com/saferwall/saferwall-api/internal/storage/s3"
 )
 
 var (
 	errDeploymentNotFound = errors.New("deployment not found")
 	timeout               = time.Duration(time.Second * 5)
+	// default lifetime of the pre-signed URLs.
+	defaultPresignTTL = time.Duration(time.Minute * 5)
+
+	// ErrObjectNotFound is returned by every backend when an object does
+	// not exist.
+	ErrObjectNotFound = object.ErrNotFound
+	// ErrNotSupported is returned when a backend does not support an
+	// operation.
+	ErrNotSupported = object.ErrNotSupported
 )
 
+// ObjectInfo describes an object stored in a bucket.
+type ObjectInfo = object.Info
+
 // UploadDownloader abstract uploading and download files from different
-// object storage solutions.
+// object storage solutions. Every backend returns ErrObjectNotFound when
+// reading a missing object and ErrNotSupported for unsupported operations.
 type UploadDownloader interface {
 	// Upload uploads a file to an object storage.
 	Upload(ctx context.Context, bucket, key string, file io.Reader) error
+	// UploadWithMetadata uploads a file alongside user defined metadata,
+	// returned by Stat.
+	UploadWithMetadata(ctx context.Context, bucket, key string, file io.Reader,
+		metadata map[string]string) error
 	// Download downloads a file from a remote object storage location.
 	Download(ctx context.Context, bucket, key string, file io.Writer) error
+	// DownloadRange downloads length bytes of a file starting at offset, or
+	// less when the file ends before.
+	DownloadRange(ctx context.Context, bucket, key string, file io.Writer,
+		offset, length int64) error
 	// DownloadWithSize downloads a file from a remote object storage location and returns it's size.
-	DownloadWithSize(ctx context.Context, bucket, key string, file io.Writer, done func ()) (int64, error)
+	// The copy happens in the background, done is called with its error once it completes.
+	DownloadWithSize(ctx context.Context, bucket, key string, file io.Writer, done func(error)) (int64, error)
 	// GetFileSize returns a file's size from a remote object storage location.
 	GetFileSize(ctx context.Context, bucket, key string, done func ()) (int64, error)
 	// MakeBucket creates a new bucket.
@@ -38,6 +64,12 @@ type UploadDownloader interface {
 	Exists(ctx context.Context, bucket, key string) (bool, error)
 	// GeneratePresignedURL generates a pre-signed URL for downloading samples.
 	GeneratePresignedURL(ctx context.Context, bucket, key string)(string, error)
+	// Delete removes an object, deleting a missing object is not an error.
+	Delete(ctx context.Context, bucket, key string) error
+	// List returns the objects whose key starts with prefix, sorted by key.
+	List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error)
+	// Stat returns the metadata of an object.
+	Stat(ctx context.Context, bucket, key string) (ObjectInfo, error)
 }
 
 func New(cfg config.StorageCfg) (UploadDownloader, error) {
@@ -56,52 +88,95 @@ func New(cfg config.StorageCfg) (UploadDownloader, error) {
 		defer cancelFn()
 	}
 
+	presignTTL := time.Duration(cfg.PresignTTL) * time.Minute
+	if presignTTL <= 0 {
+		presignTTL = defaultPresignTTL
+	}
+
+	var svc UploadDownloader
+	var location string
+	var err error
+
 	switch cfg.DeploymentKind {
 	case "aws":
-		svc, err := s3.New(cfg.S3.Region, cfg.S3.AccessKey, cfg.S3.SecretKey)
-		if err != nil {
-			return nil, err
-		}
-		err = svc.MakeBucket(ctx, cfg.FileContainerName, cfg.S3.Region)
-		if err != nil {
-			return nil, err
-		}
-		err = svc.MakeBucket(ctx, cfg.AvatarsContainerName, cfg.S3.Region)
-		if err != nil {
-			return nil, err
-		}
-		return svc, nil
-
+		svc, err = s3.New(cfg.S3.Region, cfg.S3.AccessKey, cfg.S3.SecretKey,
+			cfg.S3.Endpoint, presignTTL)
+		location = cfg.S3.Region
 	case "minio":
-		svc, err := minio.New(cfg.Minio.Endpoint, cfg.Minio.AccessKey,
-			cfg.Minio.SecretKey)
-		if err != nil {
-			return nil, err
-		}
-		err = svc.MakeBucket(ctx, cfg.FileContainerName, cfg.Minio.Region)
-		if err != nil {
-			return nil, err
-		}
-		err = svc.MakeBucket(ctx, cfg.AvatarsContainerName, cfg.Minio.Region)
-		if err != nil {
-			return nil, err
-		}
-		return svc, nil
+		svc, err = minio.New(cfg.Minio.Endpoint, cfg.Minio.AccessKey,
+			cfg.Minio.SecretKey, presignTTL)
+		location = cfg.Minio.Region
+	case "gcs":
+		svc, err = gcs.New(context.Background(), cfg.GCS.ProjectID, cfg.GCS.CredentialsFile,
+			cfg.GCS.Endpoint, presignTTL)
+		location = cfg.GCS.Location
+	case "azure":
+		svc, err = azure.New(cfg.Azure.AccountName, cfg.Azure.AccountKey,
+			cfg.Azure.Endpoint, presignTTL)
 	case "local":
-		svc, err := local.New(cfg.Local.RootDir)
-		if err != nil {
-			return nil, err
-		}
-		err = svc.MakeBucket(ctx, cfg.FileContainerName, "")
+		svc, err = local.New(cfg.Local.RootDir, cfg.Local.SigningKey,
+			cfg.Local.PublicURL, presignTTL)
+	default:
+		return nil, errDeploymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Avatars are public images, only the containers holding malware are
+	// encrypted.
+	if cfg.Encryption.Enabled {
+		svc, err = envelope.New(svc, cfg.Encryption.MasterKeys,
+			encryptedContainers(cfg))
 		if err != nil {
 			return nil, err
 		}
-		err = svc.MakeBucket(ctx, cfg.AvatarsContainerName, "")
+	}
+
+	err = makeBuckets(ctx, svc, cfg, location)
+	if err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
+
+// RotateKeys re-wraps the data keys of the encrypted objects with the active
+// master key, and returns the number of objects rotated.
+func RotateKeys(ctx context.Context, svc UploadDownloader,
+	cfg config.StorageCfg) (int, error) {
+
+	enc, ok := svc.(envelope.Service)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+
+	count := 0
+	for _, bucket := range encryptedContainers(cfg) {
+		n, err := enc.Rotate(ctx, bucket, "")
+		count += n
 		if err != nil {
-			return nil, err
+			return count, err
 		}
-		return svc, nil
 	}
+	return count, nil
+}
 
-	return nil, errDeploymentNotFound
+// encryptedContainers returns the containers encrypted at rest.
+func encryptedContainers(cfg config.StorageCfg) []string {
+	return []string{cfg.FileContainerName, cfg.ArtifactsContainerName,
+		cfg.QuarantineContainerName}
+}
+
+// makeBuckets creates the containers used by the API.
+func makeBuckets(ctx context.Context, svc UploadDownloader,
+	cfg config.StorageCfg, location string) error {
+
+	for _, bucket := range []string{cfg.FileContainerName,
+		cfg.AvatarsContainerName, cfg.ArtifactsContainerName,
+		cfg.QuarantineContainerName} {
+		if err := svc.MakeBucket(ctx, bucket, location); err != nil {
+			return err
+		}
+	}
+	return nil
 }
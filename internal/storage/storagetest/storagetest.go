@@ -0,0 +1,182 @@
+// Copyright 2018 Saferwall. All rights reserved.
+// Use of this source code is governed by Apache v2 license
+// license that can be found in the LICENSE file.
+
+// Package storagetest provides a conformance test suite shared by the
+// object storage backends.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/saferwall/saferwall-api/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run checks that svc behaves like every other backend. The bucket is
+// created if it does not exist, and the objects are written under a unique
+// prefix which is cleaned up afterwards.
+func Run(t *testing.T, svc storage.UploadDownloader, bucket string) {
+	ctx := context.Background()
+	prefix := fmt.Sprintf("conformance-%d/", time.Now().UnixNano())
+	key := prefix + "sample"
+	content := []byte("saferwall conformance test")
+
+	require.Nil(t, svc.MakeBucket(ctx, bucket, ""))
+	require.Nil(t, svc.MakeBucket(ctx, bucket, ""), "make bucket is idempotent")
+
+	t.Run("missing", func(t *testing.T) {
+		exists, err := svc.Exists(ctx, bucket, key)
+		assert.Nil(t, err)
+		assert.False(t, exists)
+
+		_, err = svc.Stat(ctx, bucket, key)
+		assert.True(t, errors.Is(err, storage.ErrObjectNotFound), err)
+
+		err = svc.Download(ctx, bucket, key, &bytes.Buffer{})
+		assert.True(t, errors.Is(err, storage.ErrObjectNotFound), err)
+
+		_, err = svc.DownloadWithSize(ctx, bucket, key, &bytes.Buffer{}, func(error) {})
+		assert.True(t, errors.Is(err, storage.ErrObjectNotFound), err)
+
+		err = svc.DownloadRange(ctx, bucket, key, &bytes.Buffer{}, 0, 1)
+		assert.True(t, errors.Is(err, storage.ErrObjectNotFound), err)
+
+		_, err = svc.GetFileSize(ctx, bucket, key, func() {})
+		assert.True(t, errors.Is(err, storage.ErrObjectNotFound), err)
+
+		assert.Nil(t, svc.Delete(ctx, bucket, key), "delete is idempotent")
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		require.Nil(t, svc.Upload(ctx, bucket, key, bytes.NewReader([]byte("stale"))))
+		require.Nil(t, svc.Upload(ctx, bucket, key, bytes.NewReader(content)),
+			"upload overwrites")
+
+		exists, err := svc.Exists(ctx, bucket, key)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+
+		info, err := svc.Stat(ctx, bucket, key)
+		assert.Nil(t, err)
+		assert.Equal(t, key, info.Key)
+		assert.Equal(t, int64(len(content)), info.Size)
+		assert.False(t, info.LastModified.IsZero())
+	})
+
+	t.Run("download", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, svc.Download(ctx, bucket, key, buf))
+		assert.Equal(t, content, buf.Bytes())
+
+		buf.Reset()
+		done := make(chan error, 1)
+		size, err := svc.DownloadWithSize(ctx, bucket, key, buf, func(err error) { done <- err })
+		require.Nil(t, err)
+		assert.Nil(t, <-done)
+		assert.Equal(t, int64(len(content)), size)
+		assert.Equal(t, content, buf.Bytes())
+
+		calls := 0
+		size, err = svc.GetFileSize(ctx, bucket, key, func() { calls++ })
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(content)), size)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		for _, r := range []struct{ offset, length int64 }{
+			{0, 1},
+			{3, 5},
+			{int64(len(content)) - 4, 4},
+			{int64(len(content)) - 4, 100}, // past the end
+		} {
+			buf := &bytes.Buffer{}
+			err := svc.DownloadRange(ctx, bucket, key, buf, r.offset, r.length)
+			assert.Nil(t, err, r)
+			end := min(r.offset+r.length, int64(len(content)))
+			assert.Equal(t, content[r.offset:end], buf.Bytes(), r)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		keys := []string{prefix + "dir/b", prefix + "dir/a", prefix + "dir-c"}
+		for _, k := range keys {
+			require.Nil(t, svc.Upload(ctx, bucket, k, bytes.NewReader(content)))
+		}
+
+		objects, err := svc.List(ctx, bucket, prefix)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{prefix + "dir-c", prefix + "dir/a",
+			prefix + "dir/b", key}, keysOf(objects))
+
+		objects, err = svc.List(ctx, bucket, prefix+"dir/")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{prefix + "dir/a", prefix + "dir/b"}, keysOf(objects))
+		for _, obj := range objects {
+			assert.Equal(t, int64(len(content)), obj.Size)
+		}
+
+		objects, err = svc.List(ctx, bucket, prefix+"nothing")
+		assert.Nil(t, err)
+		assert.Empty(t, objects)
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		metaKey := prefix + "metadata"
+		metadata := map[string]string{"SHA256": "0123abcd", "kind": "sample"}
+		require.Nil(t, svc.UploadWithMetadata(ctx, bucket, metaKey,
+			bytes.NewReader(content), metadata))
+
+		info, err := svc.Stat(ctx, bucket, metaKey)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"sha256": "0123abcd", "kind": "sample"},
+			info.Metadata, "keys are lower cased")
+
+		require.Nil(t, svc.Upload(ctx, bucket, metaKey, bytes.NewReader(content)))
+		info, err = svc.Stat(ctx, bucket, metaKey)
+		assert.Nil(t, err)
+		assert.Empty(t, info.Metadata, "overwriting replaces the metadata")
+
+		assert.Nil(t, svc.Delete(ctx, bucket, metaKey))
+	})
+
+	t.Run("presign", func(t *testing.T) {
+		url, err := svc.GeneratePresignedURL(ctx, bucket, key)
+		if errors.Is(err, storage.ErrNotSupported) {
+			t.Skip("pre-signed URLs are not supported")
+		}
+		assert.Nil(t, err)
+		assert.NotEmpty(t, url)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		objects, err := svc.List(ctx, bucket, prefix)
+		require.Nil(t, err)
+		for _, obj := range objects {
+			assert.Nil(t, svc.Delete(ctx, bucket, obj.Key))
+		}
+
+		exists, err := svc.Exists(ctx, bucket, key)
+		assert.Nil(t, err)
+		assert.False(t, exists)
+
+		objects, err = svc.List(ctx, bucket, prefix)
+		assert.Nil(t, err)
+		assert.Empty(t, objects)
+	})
+}
+
+func keysOf(objects []storage.ObjectInfo) []string {
+	keys := []string{}
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
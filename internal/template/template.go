@@ -21,12 +21,14 @@ const (
 	ConfirmAccount = iota
 	ResetPassword
 	EmailUpdate
+	NotificationDigest
 )
 
 var emailTplMap = map[string]EmailTemplate{
 	"account-confirmation": ConfirmAccount,
 	"password-reset":       ResetPassword,
 	"email-update":         EmailUpdate,
+	"notification-digest":  NotificationDigest,
 }
 
 var (
@@ -132,6 +134,8 @@ func New(filePath string) (Service, error) {
 			er.Subject = "saferwall - reset password"
 		case "email-update":
 			er.Subject = "saferwall - confirm new email"
+		case "notification-digest":
+			er.Subject = "saferwall - your unread notifications"
 		}
 		templates[key] = er
 	}
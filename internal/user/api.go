@@ -6,22 +6,35 @@ package user
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 
+	"github.com/h2non/filetype"
 	"github.com/labstack/echo/v4"
 	"github.com/saferwall/saferwall-api/internal/entity"
 	"github.com/saferwall/saferwall-api/internal/errors"
 	"github.com/saferwall/saferwall-api/internal/mailer"
 	tpl "github.com/saferwall/saferwall-api/internal/template"
+	"github.com/saferwall/saferwall-api/pkg/avatar"
 	"github.com/saferwall/saferwall-api/pkg/log"
 	"github.com/saferwall/saferwall-api/pkg/pagination"
 )
 
 const (
 	KB = 1000
+
+	// maxFeedUsers is the maximum number of users an activity feed can be
+	// filtered on.
+	maxFeedUsers = 50
 )
 
+// avatarSizes lists the sizes the avatars can be scaled to.
+var avatarSizes = []int{32, 64, 128, 256}
+
 func RegisterHandlers(g *echo.Group, service Service, maxAvatarSize int,
 	requireLogin, optionalLogin, verifyUser echo.MiddlewareFunc,
 	logger log.Logger, mailer mailer.Mailer, templater tpl.Service) {
@@ -35,7 +48,6 @@ func RegisterHandlers(g *echo.Group, service Service, maxAvatarSize int,
 	g.PATCH("/users/:username/", res.update, verifyUser, requireLogin)
 	g.PATCH("/users/:username/password/", res.password, verifyUser, requireLogin)
 	g.PATCH("/users/:username/email/", res.email, verifyUser, requireLogin)
-	g.DELETE("/users/:username/", res.delete, verifyUser, requireLogin)
 	g.GET("/users/activities/", res.activities, optionalLogin)
 	g.GET("/users/:username/likes/", res.likes, verifyUser, optionalLogin)
 	g.GET("/users/:username/following/", res.following, verifyUser, optionalLogin)
@@ -45,6 +57,7 @@ func RegisterHandlers(g *echo.Group, service Service, maxAvatarSize int,
 	g.POST("/users/:username/follow/", res.follow, verifyUser, requireLogin)
 	g.POST("/users/:username/unfollow/", res.unFollow, verifyUser, requireLogin)
 	g.POST("/users/:username/avatar/", res.avatar, verifyUser, requireLogin)
+	g.GET("/users/:username/avatar/", res.getAvatar, verifyUser)
 }
 
 type resource struct {
@@ -78,26 +91,13 @@ func (r resource) get(c echo.Context) error {
 	curUser, ok := ctx.Value(entity.UserKey).(entity.User)
 	if !ok || curUser.ID() != strings.ToLower(c.Param("username")) {
 		user.Email = ""
+		user.Notifications = nil
 	}
 
 	// Always hide the password.
 	user.Password = ""
 
-	// Create a new struct dynamically including LikesCount
-	response := struct {
-		User
-		LikesCount       int `json:"likes_count"`
-		SubmissionsCount int `json:"submissions_count"`
-		FollowingCount   int `json:"following_count"`
-		FollowersCount   int `json:"followers_count"`
-	}{
-		User:             user,
-		LikesCount:       len(user.Likes),
-		SubmissionsCount: len(user.Submissions),
-		FollowingCount:   len(user.Following),
-		FollowersCount:   len(user.Followers),
-	}
-	return c.JSON(http.StatusOK, response)
+	return c.JSON(http.StatusOK, user)
 }
 
 // @Summary Create a new user
@@ -233,37 +233,6 @@ func (r resource) update(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
-// @Summary Deletes a user
-// @Description Deletes a user by ID.
-// @Tags User
-// @Produce json
-// @Param username path string true "Username"
-// @Success 204 {object} entity.User
-// @Failure 403 {object} errors.ErrorResponse
-// @Failure 404 {object} errors.ErrorResponse
-// @Failure 500 {object} errors.ErrorResponse
-// @Router /users/{username}/ [delete]
-// @Security Bearer
-func (r resource) delete(c echo.Context) error {
-
-	var isAdmin bool
-	ctx := c.Request().Context()
-	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
-		isAdmin = user.IsAdmin()
-	}
-	if !isAdmin {
-		return errors.Forbidden("")
-	}
-
-	user, err := r.service.Delete(ctx, c.Param("username"))
-	if err != nil {
-		return err
-	}
-	user.Email = ""
-	user.Password = ""
-	return c.JSON(http.StatusOK, user)
-}
-
 // @Summary Retrieves a paginated list of users
 // @Description List users.
 // @Tags User
@@ -301,13 +270,25 @@ func (r resource) list(c echo.Context) error {
 }
 
 // @Summary Returns a paginated list of a user's activities
-// @Description List of activities of a user.
+// @Description List of activities of the users followed by the logged in
+// @Description user, or of everyone for anonymous users. Poll for the new
+// @Description activities by passing the returned `latest` as `since`, an
+// @Description unchanged feed answers 304 to a matching If-None-Match.
 // @Tags Activity
 // @Accept json
 // @Produce json
 // @Param per_page query uint false "Number of items per page"
 // @Param page query uint false "Specify the page number"
-// @Success 200 {object} pagination.Pages
+// @Param kinds query string false "Comma separated kinds of activities" example(submit,like)
+// @Param source query string false "Source of the activities, defaults to web" Enums(web, api, all)
+// @Param from query int false "Only the activities from this unix timestamp"
+// @Param to query int false "Only the activities up to this unix timestamp"
+// @Param since query int false "Only the activities after this unix timestamp"
+// @Param users query string false "Comma separated usernames"
+// @Param If-None-Match header string false "ETag of a previous response"
+// @Success 200 {object} object{latest=int,items=[]interface{}}
+// @Success 304
+// @Failure 400 {object} errors.ErrorResponse
 // @Failure 403 {object} errors.ErrorResponse
 // @Failure 404 {object} errors.ErrorResponse
 // @Failure 500 {object} errors.ErrorResponse
@@ -316,27 +297,67 @@ func (r resource) list(c echo.Context) error {
 func (r resource) activities(c echo.Context) error {
 	ctx := c.Request().Context()
 	var id string
-	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
+	user, authenticated := ctx.Value(entity.UserKey).(entity.User)
+	if authenticated {
 		id = user.ID()
 	}
-	count, err := r.service.CountActivities(ctx)
+
+	filter, err := activityFilter(c)
+	if err != nil {
+		return err
+	}
+	count, err := r.service.CountActivities(ctx, id, filter)
 	if err != nil {
 		return err
 	}
 
 	// If the user has just signed-up, and did not follow any user.
 	// Treat him as anonymous user, so we can show him some activities.
-	if count == 0 {
+	if count == 0 && id != "" && isDefaultFilter(filter) {
 		id = ""
+		count, err = r.service.CountActivities(ctx, id, filter)
+		if err != nil {
+			return err
+		}
 	}
 	pages := pagination.NewFromRequest(c.Request(), count)
-	activities, err := r.service.Activities(ctx, id, pages.Offset(), pages.Limit())
+	activities, err := r.service.Activities(ctx, id, filter, pages.Offset(),
+		pages.Limit())
 	if err != nil {
 		return err
 	}
 	pages.Items = activities
-	c.Response().Header().Set("Cache-Control", "public, max-age=120")
-	return c.JSON(http.StatusOK, pages)
+
+	latest := filter.Since
+	for _, activity := range activities {
+		if a, ok := activity.(map[string]interface{}); ok {
+			if date, ok := a["date"].(float64); ok {
+				latest = max(latest, int64(date))
+			}
+		}
+	}
+
+	body, err := json.Marshal(struct {
+		*pagination.Pages
+		Latest int64 `json:"latest"`
+	}{pages, latest})
+	if err != nil {
+		return err
+	}
+	etag := fmt.Sprintf(`W/"%x"`, sha256.Sum256(body))
+	// The feed of a logged in user is their own, shared caches must not
+	// keep it and the browser revalidates it with the ETag.
+	if authenticated {
+		c.Response().Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		c.Response().Header().Set("Cache-Control", "public, max-age=120")
+	}
+	c.Response().Header().Add("Vary", "Authorization, Cookie")
+	c.Response().Header().Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
 }
 
 // @Summary Returns a paginated list of a user's likes
@@ -545,7 +566,8 @@ func (r resource) unFollow(c echo.Context) error {
 }
 
 // @Summary Update user avatar
-// @Description Change user avatar
+// @Description Change user avatar. GIF, JPEG and PNG images are accepted,
+// @Description they are cropped to a square and re-encoded as PNG.
 // @Tags User
 // @Accept json
 // @Produce json
@@ -596,6 +618,11 @@ func (r resource) avatar(c echo.Context) error {
 		switch err {
 		case errImageFormatNotSupported:
 			return errors.UnsupportedMediaType("The image format is not supported.")
+		case errImageDimensions:
+			return errors.BadRequest(fmt.Sprintf(
+				"The image must be between %dx%d and %dx%d pixels.",
+				avatar.MinDimension, avatar.MinDimension,
+				avatar.MaxDimension, avatar.MaxDimension))
 		default:
 			r.logger.With(ctx).Error(err)
 			return err
@@ -700,3 +727,110 @@ func (r resource) email(c echo.Context) error {
 		Status  int    `json:"status"`
 	}{"ok", http.StatusOK})
 }
+
+// activityFilter binds the filter of an activity feed from the query
+// parameters.
+func activityFilter(c echo.Context) (ActivityFilter, error) {
+	var filter ActivityFilter
+	var from, since int64
+
+	err := echo.QueryParamsBinder(c).
+		Int64("from", &from).
+		Int64("to", &filter.Until).
+		Int64("since", &since).
+		BindError()
+	if err != nil || from < 0 || filter.Until < 0 || since < 0 {
+		return ActivityFilter{}, errors.BadRequest("invalid time range")
+	}
+	filter.Since = max(from-1, since, 0)
+
+	for _, kind := range splitParam(c.QueryParam("kinds")) {
+		if !slices.Contains(activityKinds, kind) {
+			return ActivityFilter{}, errors.BadRequest(
+				"invalid activity kind: " + kind)
+		}
+		filter.Kinds = append(filter.Kinds, kind)
+	}
+
+	switch c.QueryParam("source") {
+	case "":
+	case "web", "api":
+		filter.Sources = []string{c.QueryParam("source")}
+	case "all":
+		filter.Sources = []string{"web", "api"}
+	default:
+		return ActivityFilter{}, errors.BadRequest("invalid source")
+	}
+
+	for _, username := range splitParam(c.QueryParam("users")) {
+		if !userReg.MatchString(username) {
+			return ActivityFilter{}, errors.BadRequest(
+				"invalid username: " + username)
+		}
+		filter.Users = append(filter.Users, strings.ToLower(username))
+	}
+	if len(filter.Users) > maxFeedUsers {
+		return ActivityFilter{}, errors.BadRequest(
+			fmt.Sprintf("too many users, at most %d", maxFeedUsers))
+	}
+	return filter, nil
+}
+
+// isDefaultFilter checks if an activity feed is not filtered.
+func isDefaultFilter(filter ActivityFilter) bool {
+	return len(filter.Kinds) == 0 && len(filter.Sources) == 0 &&
+		len(filter.Users) == 0 && filter.Since == 0 && filter.Until == 0
+}
+
+// splitParam splits a comma separated query parameter, the empty values
+// are dropped.
+func splitParam(param string) []string {
+	var values []string
+	for _, value := range strings.Split(param, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// @Summary Get user avatar
+// @Description Returns the avatar of a user, scaled to a square of `size`
+// @Description pixels. Users without an avatar get an identicon generated
+// @Description from their username.
+// @Tags User
+// @Produce png
+// @Param username path string true "Username"
+// @Param size query int false "Width and height of the avatar" Enums(32, 64, 128, 256)
+// @Param If-None-Match header string false "ETag of a previous response"
+// @Success 200
+// @Success 304
+// @Failure 400 {object} errors.ErrorResponse
+// @Failure 404 {object} errors.ErrorResponse
+// @Failure 500 {object} errors.ErrorResponse
+// @Router /users/{username}/avatar/ [get]
+func (r resource) getAvatar(c echo.Context) error {
+	var size int
+	err := echo.QueryParamsBinder(c).Int("size", &size).BindError()
+	if err != nil || (size != 0 && !slices.Contains(avatarSizes, size)) {
+		return errors.BadRequest("invalid avatar size")
+	}
+
+	ctx := c.Request().Context()
+	data, err := r.service.Avatar(ctx, c.Param("username"), size)
+	if err != nil {
+		return err
+	}
+
+	contentType := "application/octet-stream"
+	if kind, _ := filetype.Match(data); kind != filetype.Unknown {
+		contentType = kind.MIME.Value
+	}
+	etag := fmt.Sprintf(`W/"%x"`, sha256.Sum256(data))
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	c.Response().Header().Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, contentType, data)
+}
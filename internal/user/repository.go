@@ -7,6 +7,7 @@ package user
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strings"
 
 	dbContext "github.com/saferwall/saferwall-api/internal/db"
@@ -44,13 +45,23 @@ type Repository interface {
 		[]interface{}, error)
 	Comments(ctx context.Context, id string, offset, limit int) (
 		[]interface{}, error)
-	Activities(ctx context.Context, id string, offset, limit int) ([]interface{}, error)
-	CountActivities(ctx context.Context) (int, error)
+	Activities(ctx context.Context, id string, filter ActivityFilter, offset, limit int) ([]interface{}, error)
+	CountActivities(ctx context.Context, id string, filter ActivityFilter) (int, error)
 	Like(ctx context.Context, id string, userLike entity.UserLike) error
-	Follow(ctx context.Context, username string, userLike entity.UserFollows) error
+	// Follow saves a user following another one, it returns false when
+	// the user was already followed.
+	Follow(ctx context.Context, username string, userLike entity.UserFollows) (bool, error)
 	Unlike(ctx context.Context, id, sha256 string) error
 	Unfollow(ctx context.Context, username, targetUsername string) error
 	Submit(ctx context.Context, id string, userSubmission entity.UserSubmission) error
+	// Vote saves the verdict of a user on a file, replacing their previous
+	// vote.
+	Vote(ctx context.Context, id string, userVote entity.UserVote) error
+	// Unvote removes the verdict of a user on a file.
+	Unvote(ctx context.Context, id, sha256 string) error
+	// MigrateEdges moves the relationships embedded in the user documents
+	// to edge documents and returns the number of users migrated.
+	MigrateEdges(ctx context.Context) (int, error)
 }
 
 // repository persists users in database.
@@ -195,12 +206,12 @@ func (r repository) Query(ctx context.Context, offset, limit int) (
 	return users, nil
 }
 
-func (r repository) Activities(ctx context.Context, id string, offset,
-	limit int) ([]interface{}, error) {
+func (r repository) Activities(ctx context.Context, id string,
+	filter ActivityFilter, offset, limit int) ([]interface{}, error) {
 
 	var err error
 	var activities interface{}
-	params := make(map[string]interface{}, 1)
+	params := activityParams(filter, id == "")
 	params["offset"] = offset
 	params["limit"] = limit
 
@@ -370,25 +381,20 @@ func (r repository) Comments(ctx context.Context, id string, offset,
 	return results.([]interface{}), nil
 }
 
-func (r repository) CountActivities(ctx context.Context) (int, error) {
+func (r repository) CountActivities(ctx context.Context, id string,
+	filter ActivityFilter) (int, error) {
 
 	var count int
 	var query string
-	var currentUser string
-	params := make(map[string]interface{}, 1)
-
-	if user, ok := ctx.Value(entity.UserKey).(entity.User); ok {
-		currentUser = user.ID()
-	}
+	params := activityParams(filter, id == "")
 
-	if currentUser == "" {
+	if id == "" {
 		// For an anonymous user.
 		query = r.db.N1QLQuery[dbContext.CountAnoUserActivities]
 	} else {
 		// For a logged-in user.
-		params["user"] = currentUser
+		params["user"] = id
 		query = r.db.N1QLQuery[dbContext.CountUserActivities]
-
 	}
 	err := r.db.Count(ctx, query, params, &count)
 	if err != nil {
@@ -398,88 +404,338 @@ func (r repository) CountActivities(ctx context.Context) (int, error) {
 	return count, nil
 }
 
-func (r repository) Like(ctx context.Context, id string, userLike entity.UserLike) error {
+// activityParams returns the query parameters of an activity feed filter,
+// the empty fields fall back to the defaults.
+func activityParams(filter ActivityFilter, anonymous bool) map[string]interface{} {
+	params := make(map[string]interface{}, 8)
+	params["kinds"] = filter.Kinds
+	if len(filter.Kinds) == 0 && anonymous {
+		params["kinds"] = defaultAnoActivityKinds
+	} else if len(filter.Kinds) == 0 {
+		params["kinds"] = defaultActivityKinds
+	}
+	params["sources"] = filter.Sources
+	if len(filter.Sources) == 0 {
+		params["sources"] = []string{"web"}
+	}
+	params["users"] = filter.Users
+	if filter.Users == nil {
+		params["users"] = []string{}
+	}
+	params["since"] = filter.Since
+	params["until"] = filter.Until
+	return params
+}
 
-	var results interface{}
+// counter references a counter of a user document.
+type counter struct {
+	key  string
+	path string
+}
 
-	params := make(map[string]interface{}, 1)
-	params["sha256"] = userLike.SHA256
-	params["ts"] = userLike.Timestamp
-	params["user"] = id
+// edgeCounters returns the counters maintained for the relationships of
+// the kind of an edge.
+func edgeCounters(edge entity.Edge) []counter {
+	switch edge.Kind {
+	case entity.EdgeLike:
+		return []counter{{edge.Username, "likes_count"}}
+	case entity.EdgeSubmit:
+		return []counter{{edge.Username, "submissions_count"}}
+	case entity.EdgeVote:
+		return []counter{{edge.Username, "votes_count"}}
+	case entity.EdgeFollow:
+		return []counter{{edge.Username, "following_count"},
+			{edge.Target, "followers_count"}}
+	default:
+		return nil
+	}
+}
+
+// insertEdge saves a relationship unless it already exists, it returns
+// whether the relationship was created.
+func (r repository) insertEdge(ctx context.Context, edge entity.Edge) (
+	bool, error) {
+
+	edge.Type = "edge"
+	err := r.db.Create(ctx, edge.ID(), &edge)
+	if errors.Is(err, dbContext.ErrDocumentExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
 
-	query := r.db.N1QLQuery[dbContext.ActionLike]
-	return r.db.Query(ctx, query, params, &results)
+// createEdge saves a relationship and increments the counters of its
+// endpoints. A relationship which already exists is left untouched, it
+// returns whether the relationship was created.
+func (r repository) createEdge(ctx context.Context, edge entity.Edge) (
+	bool, error) {
+	created, err := r.insertEdge(ctx, edge)
+	if !created {
+		return false, err
+	}
+	return true, r.incrementCounters(ctx, edge, 1)
 }
 
-func (r repository) Unlike(ctx context.Context, id, sha256 string) error {
+// deleteEdge removes a relationship and decrements the counters of its
+// endpoints. A relationship which does not exist is ignored.
+func (r repository) deleteEdge(ctx context.Context, edge entity.Edge) error {
+	err := r.db.Delete(ctx, edge.ID())
+	if errors.Is(err, dbContext.ErrDocumentNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.incrementCounters(ctx, edge, -1)
+}
 
-	var results interface{}
+// incrementCounters adds delta to the counters of the endpoints of an edge.
+func (r repository) incrementCounters(ctx context.Context, edge entity.Edge,
+	delta int64) error {
 
-	params := make(map[string]interface{}, 1)
-	params["sha256"] = sha256
-	params["user"] = id
+	for _, c := range edgeCounters(edge) {
+		if err := r.db.Increment(ctx, c.key, c.path, delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	query := r.db.N1QLQuery[dbContext.ActionUnlike]
-	return r.db.Query(ctx, query, params, &results)
+func (r repository) Like(ctx context.Context, id string, userLike entity.UserLike) error {
+	_, err := r.createEdge(ctx, entity.Edge{
+		Kind:      entity.EdgeLike,
+		Username:  strings.ToLower(id),
+		Target:    userLike.SHA256,
+		Timestamp: userLike.Timestamp,
+	})
+	return err
 }
 
-func (r repository) Follow(ctx context.Context, username string, userFollow entity.UserFollows) error {
+func (r repository) Unlike(ctx context.Context, id, sha256 string) error {
+	return r.deleteEdge(ctx, entity.Edge{
+		Kind:     entity.EdgeLike,
+		Username: strings.ToLower(id),
+		Target:   sha256,
+	})
+}
 
-	var results interface{}
+func (r repository) Follow(ctx context.Context, username string,
+	userFollow entity.UserFollows) (bool, error) {
+	return r.createEdge(ctx, entity.Edge{
+		Kind:      entity.EdgeFollow,
+		Username:  strings.ToLower(username),
+		Target:    strings.ToLower(userFollow.Username),
+		Timestamp: userFollow.Timestamp,
+	})
+}
 
-	params := make(map[string]interface{}, 1)
-	params["username"] = userFollow.Username
-	params["ts"] = userFollow.Timestamp
-	params["user"] = username
+func (r repository) Unfollow(ctx context.Context, username, targetUsername string) error {
+	return r.deleteEdge(ctx, entity.Edge{
+		Kind:     entity.EdgeFollow,
+		Username: strings.ToLower(username),
+		Target:   strings.ToLower(targetUsername),
+	})
+}
 
-	query := r.db.N1QLQuery[dbContext.ActionFollow]
-	query = strings.ReplaceAll(query, "DYNAMIC_FIELD", "following")
-	err := r.db.Query(ctx, query, params, &results)
+func (r repository) Submit(ctx context.Context, id string, userSubmission entity.UserSubmission) error {
+	_, err := r.createEdge(ctx, entity.Edge{
+		Kind:      entity.EdgeSubmit,
+		Username:  strings.ToLower(id),
+		Target:    userSubmission.SHA256,
+		Timestamp: userSubmission.Timestamp,
+	})
+	return err
+}
+
+func (r repository) Vote(ctx context.Context, id string, userVote entity.UserVote) error {
+	edge := entity.Edge{
+		Kind:      entity.EdgeVote,
+		Username:  strings.ToLower(id),
+		Target:    userVote.SHA256,
+		Timestamp: userVote.Timestamp,
+		Verdict:   userVote.Verdict,
+		Family:    userVote.Family,
+	}
+	created, err := r.insertEdge(ctx, edge)
 	if err != nil {
 		return err
 	}
 
-	// As we can't chain two N1QL queries, we execute them sequentially.
-	query = r.db.N1QLQuery[dbContext.ActionFollow]
-	query = strings.ReplaceAll(query, "DYNAMIC_FIELD", "followers")
-	params["username"] = username
-	params["user"] = userFollow.Username
-	return r.db.Query(ctx, query, params, &results)
+	// Voting again replaces the verdict, the counters are unchanged.
+	if !created {
+		edge.Type = "edge"
+		return r.db.Update(ctx, edge.ID(), &edge)
+	}
+	return r.incrementCounters(ctx, edge, 1)
+}
 
+func (r repository) Unvote(ctx context.Context, id, sha256 string) error {
+	return r.deleteEdge(ctx, entity.Edge{
+		Kind:     entity.EdgeVote,
+		Username: strings.ToLower(id),
+		Target:   sha256,
+	})
 }
 
-func (r repository) Unfollow(ctx context.Context, username, targetUsername string) error {
+// legacyUser holds the relationships embedded in a user document by the
+// previous versions, the relationships which are missing are nil.
+type legacyUser struct {
+	ID          string                  `json:"id"`
+	Likes       []entity.UserLike       `json:"likes"`
+	Following   []entity.UserFollows    `json:"following"`
+	Followers   []entity.UserFollows    `json:"followers"`
+	Submissions []entity.UserSubmission `json:"submissions"`
+}
 
-	var results interface{}
+// edges returns the relationships of a legacy user, the followers mirror
+// the following of other users and are only recorded once.
+func (u legacyUser) edges() []entity.Edge {
+	var edges []entity.Edge
+	for _, like := range u.Likes {
+		edges = append(edges, entity.Edge{Kind: entity.EdgeLike,
+			Username: u.ID, Target: like.SHA256, Timestamp: like.Timestamp})
+	}
+	for _, submission := range u.Submissions {
+		edges = append(edges, entity.Edge{Kind: entity.EdgeSubmit,
+			Username: u.ID, Target: submission.SHA256,
+			Timestamp: submission.Timestamp})
+	}
+	for _, follow := range u.Following {
+		edges = append(edges, entity.Edge{Kind: entity.EdgeFollow,
+			Username: u.ID, Target: strings.ToLower(follow.Username),
+			Timestamp: follow.Timestamp})
+	}
+	for _, follow := range u.Followers {
+		edges = append(edges, entity.Edge{Kind: entity.EdgeFollow,
+			Username: strings.ToLower(follow.Username), Target: u.ID,
+			Timestamp: follow.Timestamp})
+	}
+	return edges
+}
 
+// fields returns the paths of the relationships embedded in the document.
+func (u legacyUser) fields() []string {
+	var fields []string
+	if u.Likes != nil {
+		fields = append(fields, "likes")
+	}
+	if u.Submissions != nil {
+		fields = append(fields, "submissions")
+	}
+	if u.Following != nil {
+		fields = append(fields, "following")
+	}
+	if u.Followers != nil {
+		fields = append(fields, "followers")
+	}
+	return fields
+}
+
+// MigrateEdges moves the relationships embedded in the user documents to
+// edge documents. The counters of every user are then computed from the
+// edges, and the embedded relationships removed last, so that the
+// migration can be run again when interrupted.
+func (r repository) MigrateEdges(ctx context.Context) (int, error) {
+	var res interface{}
 	params := make(map[string]interface{}, 1)
-	params["username"] = targetUsername
-	params["user"] = username
+	params["docType"] = "user"
 
-	query := r.db.N1QLQuery[dbContext.ActionUnfollow]
-	query = strings.ReplaceAll(query, "DYNAMIC_FIELD", "following")
-	err := r.db.Query(ctx, query, params, &results)
-	if err != nil {
-		return err
+	statement :=
+		"SELECT META(u).id, u.likes, u.following, u.followers, u.submissions " +
+			"FROM `" + r.db.Bucket.Name() + "` u WHERE u.`type`=$docType AND " +
+			"(u.likes IS NOT MISSING OR u.following IS NOT MISSING OR " +
+			"u.followers IS NOT MISSING OR u.submissions IS NOT MISSING)"
+	if err := r.db.QueryConsistent(ctx, statement, params, &res); err != nil {
+		return 0, err
+	}
+	var users []legacyUser
+	b, _ := json.Marshal(res)
+	if err := json.Unmarshal(b, &users); err != nil {
+		return 0, err
 	}
 
-	// As we can't chain two N1QL queries, we execute them sequentially.
-	query = r.db.N1QLQuery[dbContext.ActionUnfollow]
-	query = strings.ReplaceAll(query, "DYNAMIC_FIELD", "followers")
-	params["username"] = username
-	params["user"] = targetUsername
-	return r.db.Query(ctx, query, params, &results)
-}
-
-func (r repository) Submit(ctx context.Context, id string, userSubmission entity.UserSubmission) error {
+	for _, u := range users {
+		for _, edge := range u.edges() {
+			if _, err := r.insertEdge(ctx, edge); err != nil {
+				return 0, err
+			}
+		}
+		r.logger.With(ctx).Infof("migrated the relationships of %s", u.ID)
+	}
 
-	var results interface{}
+	// The counters are queried once the indexes include the edges just
+	// inserted, the embedded relationships are removed from them after.
+	if err := r.recountEdges(ctx); err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		if err := r.db.Unset(ctx, u.ID, u.fields()); err != nil {
+			return 0, err
+		}
+	}
+	return len(users), nil
+}
 
+// recountEdges sets the relationships counters of every user from the
+// edge documents.
+func (r repository) recountEdges(ctx context.Context) error {
+	var res interface{}
 	params := make(map[string]interface{}, 1)
-	params["sha256"] = userSubmission.SHA256
-	params["ts"] = userSubmission.Timestamp
-	params["user"] = id
+	params["docType"] = "user"
+	statement :=
+		"SELECT RAW META(u).id FROM `" + r.db.Bucket.Name() + "` u " +
+			"WHERE u.`type`=$docType"
+	if err := r.db.QueryConsistent(ctx, statement, params, &res); err != nil {
+		return err
+	}
+	counts := make(map[counter]int)
+
+	// Every edge counts toward the user it starts from, a follow also
+	// counts toward the user followed.
+	params["docType"] = "edge"
+	for _, statement := range []string{
+		"SELECT e.kind, e.username AS `user`, COUNT(*) AS `count` " +
+			"FROM `" + r.db.Bucket.Name() + "` e WHERE e.`type`=$docType " +
+			"GROUP BY e.kind, e.username",
+		"SELECT \"followed\" AS kind, e.target AS `user`, COUNT(*) AS `count` " +
+			"FROM `" + r.db.Bucket.Name() + "` e WHERE e.`type`=$docType " +
+			"AND e.kind=\"follow\" GROUP BY e.target",
+	} {
+		var rows interface{}
+		if err := r.db.QueryConsistent(ctx, statement, params, &rows); err != nil {
+			return err
+		}
+		var groups []struct {
+			Kind  string `json:"kind"`
+			User  string `json:"user"`
+			Count int    `json:"count"`
+		}
+		b, _ := json.Marshal(rows)
+		if err := json.Unmarshal(b, &groups); err != nil {
+			return err
+		}
+		for _, g := range groups {
+			edge := entity.Edge{Kind: g.Kind, Username: g.User, Target: g.User}
+			if g.Kind == "followed" {
+				edge.Kind = entity.EdgeFollow
+				counts[edgeCounters(edge)[1]] += g.Count
+				continue
+			}
+			if c := edgeCounters(edge); len(c) > 0 {
+				counts[c[0]] += g.Count
+			}
+		}
+	}
 
-	query := r.db.N1QLQuery[dbContext.ActionSubmit]
-	return r.db.Query(ctx, query, params, &results)
+	for _, id := range res.([]interface{}) {
+		id, _ := id.(string)
+		for _, path := range []string{"likes_count", "submissions_count",
+			"following_count", "followers_count", "votes_count"} {
+			err := r.db.Patch(ctx, id, path, counts[counter{id, path}])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
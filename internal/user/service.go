@@ -9,8 +9,8 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"slices"
 	"strings"
 	"time"
 
@@ -18,8 +18,12 @@ import (
 
 	"github.com/saferwall/saferwall-api/internal/activity"
 	"github.com/saferwall/saferwall-api/internal/entity"
+	"github.com/saferwall/saferwall-api/internal/notification"
 	"github.com/saferwall/saferwall-api/internal/secure"
+	"github.com/saferwall/saferwall-api/internal/storage"
+	"github.com/saferwall/saferwall-api/pkg/avatar"
 	"github.com/saferwall/saferwall-api/pkg/log"
+	"github.com/saferwall/saferwall-api/pkg/markdown"
 )
 
 // Service encapsulates use case logic for users.
@@ -32,8 +36,8 @@ type Service interface {
 	Patch(ctx context.Context, id, path string, input interface{}) error
 	Delete(ctx context.Context, id string) (User, error)
 	Exists(ctx context.Context, id string) (bool, error)
-	Activities(ctx context.Context, id string, offset, limit int) (
-		[]interface{}, error)
+	Activities(ctx context.Context, id string, filter ActivityFilter,
+		offset, limit int) ([]interface{}, error)
 	Likes(ctx context.Context, id string, offset, limit int) (
 		[]interface{}, error)
 	Followers(ctx context.Context, id string, offset, limit int) (
@@ -44,7 +48,8 @@ type Service interface {
 		[]interface{}, error)
 	Comments(ctx context.Context, id string, offset, limit int) (
 		[]interface{}, error)
-	CountActivities(ctx context.Context) (int, error)
+	CountActivities(ctx context.Context, id string, filter ActivityFilter) (
+		int, error)
 	CountLikes(ctx context.Context, id string) (int, error)
 	CountFollowing(ctx context.Context, id string) (int, error)
 	CountFollowers(ctx context.Context, id string) (int, error)
@@ -54,6 +59,7 @@ type Service interface {
 	UnFollow(ctx context.Context, id string) error
 	GetByEmail(ctx context.Context, id string) (User, error)
 	UpdateAvatar(ctx context.Context, id string, src io.Reader) error
+	Avatar(ctx context.Context, id string, size int) ([]byte, error)
 	UpdatePassword(ctx context.Context, input UpdatePasswordRequest) error
 	UpdateEmail(ctx context.Context, input UpdateEmailRequest) error
 	GenerateConfirmationEmail(ctx context.Context, user User) (
@@ -61,6 +67,8 @@ type Service interface {
 	Like(ctx context.Context, id string, userLike entity.UserLike) error
 	Unlike(ctx context.Context, id, sha256 string) error
 	Submit(ctx context.Context, id string, userLike entity.UserSubmission) error
+	Vote(ctx context.Context, id string, userVote entity.UserVote) error
+	Unvote(ctx context.Context, id, sha256 string) error
 }
 
 var (
@@ -73,6 +81,11 @@ var (
 	errWrongPassword           = errors.New("wrong password")
 	errUserSelfFollow          = errors.New("user can't self follow")
 	errImageFormatNotSupported = errors.New("unsupported file type")
+	errImageDimensions         = errors.New("unsupported image dimensions")
+
+	// avatarFormats lists the extensions of the image formats accepted for
+	// the avatars.
+	avatarFormats = []string{"gif", "jpg", "png"}
 )
 
 // User represents the data about a user.
@@ -80,9 +93,11 @@ type User struct {
 	entity.User
 }
 
-// Uploader represents the file upload interface.
-type Uploader interface {
+// UploadDownloader represents the object storage holding the avatars.
+type UploadDownloader interface {
 	Upload(ctx context.Context, bucket, key string, file io.Reader) error
+	Download(ctx context.Context, bucket, key string, file io.Writer) error
+	Delete(ctx context.Context, bucket, key string) error
 }
 
 type service struct {
@@ -92,7 +107,8 @@ type service struct {
 	sec      secure.Password
 	actSvc   activity.Service
 	bucket   string
-	objSto   Uploader
+	objSto   UploadDownloader
+	notifSvc notification.Service
 }
 
 // CreateUserRequest represents a user creation request.
@@ -108,6 +124,8 @@ type UpdateUserRequest struct {
 	Location string `json:"location" validate:"omitempty,min=1,max=16" example:"Damascus"`
 	URL      string `json:"url" validate:"omitempty,url,max=64" example:"https://en.wikipedia.org/wiki/Ibn_Taymiyyah"`
 	Bio      string `json:"bio" validate:"omitempty,min=1,max=64" example:"What really counts are good endings, not flawed beginnings."`
+	// DownloadFormat is the default packaging format of the downloaded samples.
+	DownloadFormat string `json:"download_format" validate:"omitempty,oneof=zip zipcrypto xor base64" example:"zipcrypto"`
 }
 
 // UpdatePasswordRequest represents a password update request.
@@ -122,6 +140,34 @@ type UpdateEmailRequest struct {
 	NewEmail string `json:"email" validate:"required,email" example:"mike@proton.me"`
 }
 
+// activityKinds lists the kinds of activities a feed can be filtered on.
+var activityKinds = []string{
+	"comment", "follow", "like", "mention", "reply", "submit", "vote"}
+
+// defaultActivityKinds lists the kinds of activities shown in a feed which
+// is not filtered on kinds.
+var defaultActivityKinds = []string{
+	"follow", "like", "mention", "reply", "submit", "vote"}
+
+// defaultAnoActivityKinds lists the kinds of activities shown in an
+// anonymous feed which is not filtered on kinds.
+var defaultAnoActivityKinds = []string{
+	"like", "mention", "reply", "submit", "vote"}
+
+// ActivityFilter narrows down an activity feed.
+type ActivityFilter struct {
+	// Kinds of the activities, defaultActivityKinds when empty.
+	Kinds []string
+	// Sources of the activities, "web" or "api", the web only when empty.
+	Sources []string
+	// Since excludes the activities up to this timestamp, Until the ones
+	// after it. A zero bound is ignored.
+	Since int64
+	Until int64
+	// Users limits the feed to the activities of these users.
+	Users []string
+}
+
 // ConfirmAccountResponse holds data coming from the token generator.
 type ConfirmAccountResponse struct {
 	Token    string
@@ -131,8 +177,9 @@ type ConfirmAccountResponse struct {
 
 // NewService creates a new user service.
 func NewService(repo Repository, logger log.Logger, tokenGen secure.TokenGenerator,
-	sec secure.Password, bucket string, upl Uploader, actSvc activity.Service) Service {
-	return service{repo, logger, tokenGen, sec, actSvc, bucket, upl}
+	sec secure.Password, bucket string, upl UploadDownloader, actSvc activity.Service,
+	notifSvc notification.Service) Service {
+	return service{repo, logger, tokenGen, sec, actSvc, bucket, upl, notifSvc}
 }
 
 // Get returns the user with the specified user ID.
@@ -175,28 +222,19 @@ func (s service) Create(ctx context.Context, req CreateUserRequest) (
 		Email:       strings.ToLower(req.Email),
 		MemberSince: now,
 		LastSeen:    now,
-		Following:   []entity.UserFollows{},
-		Followers:   []entity.UserFollows{},
-		Submissions: []entity.UserSubmission{},
-		Likes:       []entity.UserLike{},
 	})
 	if err != nil {
 		return User{}, err
 	}
 
-	// Set a default avatar for the user with the help of `Robohash`. A web
-	// service used to generate avatars. Do not fail if these operations returns
-	// an error.
+	// Set a default avatar for the user, an identicon generated from the
+	// username. Do not fail if the upload returns an error, the identicon is
+	// served anyway when the avatar is missing.
 	id := strings.ToLower(req.Username)
-	url := fmt.Sprintf("https://robohash.org/%s?set=set1&bgset=bg1&size=200x200", id)
-	buffer, err := downloadURLContent(url)
+	err = s.objSto.Upload(ctx, s.bucket, id,
+		bytes.NewReader(avatar.Identicon(id)))
 	if err != nil {
-		s.logger.Errorf("failed to download user's avatar: %v", err)
-	} else {
-		err = s.objSto.Upload(ctx, s.bucket, id, buffer)
-		if err != nil {
-			s.logger.Errorf("failed to upload user's avatar: %v", err)
-		}
+		s.logger.Errorf("failed to upload user's avatar: %v", err)
 	}
 
 	return s.Get(ctx, req.Username)
@@ -272,13 +310,14 @@ func (s service) Query(ctx context.Context, offset, limit int) (
 	return result, nil
 }
 
-func (s service) Activities(ctx context.Context, id string, offset, limit int) (
-	[]interface{}, error) {
+func (s service) Activities(ctx context.Context, id string,
+	filter ActivityFilter, offset, limit int) ([]interface{}, error) {
 
-	result, err := s.repo.Activities(ctx, id, offset, limit)
+	result, err := s.repo.Activities(ctx, id, filter, offset, limit)
 	if err != nil {
 		return nil, err
 	}
+	markdown.RenderItems(result, "comment", "body_html")
 	return result, nil
 }
 
@@ -329,11 +368,13 @@ func (s service) Comments(ctx context.Context, id string, offset, limit int) (
 	if err != nil {
 		return nil, err
 	}
+	markdown.RenderItems(result, "comment", "body_html")
 	return result, nil
 }
 
-func (s service) CountActivities(ctx context.Context) (int, error) {
-	count, err := s.repo.CountActivities(ctx)
+func (s service) CountActivities(ctx context.Context, id string,
+	filter ActivityFilter) (int, error) {
+	count, err := s.repo.CountActivities(ctx, id, filter)
 	if err != nil {
 		return 0, err
 	}
@@ -345,7 +386,7 @@ func (s service) CountLikes(ctx context.Context, id string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return len(user.Likes), err
+	return user.LikesCount, err
 }
 
 func (s service) CountFollowing(ctx context.Context, id string) (int, error) {
@@ -353,7 +394,7 @@ func (s service) CountFollowing(ctx context.Context, id string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return len(user.Following), err
+	return user.FollowingCount, err
 }
 
 func (s service) CountFollowers(ctx context.Context, id string) (int, error) {
@@ -361,7 +402,7 @@ func (s service) CountFollowers(ctx context.Context, id string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return len(user.Followers), err
+	return user.FollowersCount, err
 }
 
 func (s service) CountComments(ctx context.Context, id string) (int, error) {
@@ -377,7 +418,7 @@ func (s service) CountSubmissions(ctx context.Context, id string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return len(user.Submissions), err
+	return user.SubmissionsCount, err
 }
 
 func (s service) Follow(ctx context.Context, id string) error {
@@ -402,7 +443,17 @@ func (s service) Follow(ctx context.Context, id string) error {
 		return errUserSelfFollow
 	}
 
-	// Add new activity even if the user is already followed.
+	// Following a user again does nothing, so that the followed user is
+	// not notified every time.
+	newFollow := entity.UserFollows{
+		Username:  targetUser.Username,
+		Timestamp: time.Now().Unix(),
+	}
+	created, err := s.repo.Follow(ctx, curUser.Username, newFollow)
+	if err != nil || !created {
+		return err
+	}
+
 	if _, err = s.actSvc.Create(ctx, activity.CreateActivityRequest{
 		Kind:     "follow",
 		Username: curUser.Username,
@@ -411,15 +462,11 @@ func (s service) Follow(ctx context.Context, id string) error {
 	}); err != nil {
 		return err
 	}
-
-	newFollow := entity.UserFollows{
-		Username:  targetUser.Username,
-		Timestamp: time.Now().Unix(),
-	}
-	if err = s.repo.Follow(ctx, curUser.Username, newFollow); err != nil {
-		return err
-	}
-	return nil
+	return s.notifSvc.Notify(ctx, entity.Notification{
+		Kind:   entity.NotificationFollow,
+		Actor:  curUser.Username,
+		Target: targetUser.Username,
+	}, []string{targetUsername})
 }
 
 func (s service) UnFollow(ctx context.Context, id string) error {
@@ -498,7 +545,17 @@ func (s service) UpdateAvatar(ctx context.Context, id string, src io.Reader) err
 		return err
 	}
 
-	if !filetype.IsImage(fileContent) {
+	// The image is re-encoded, which drops its metadata and anything
+	// appended to it.
+	kind, _ := filetype.Match(fileContent)
+	if !slices.Contains(avatarFormats, kind.Extension) {
+		return errImageFormatNotSupported
+	}
+	fileContent, err = avatar.Normalize(fileContent)
+	if errors.Is(err, avatar.ErrTooSmall) || errors.Is(err, avatar.ErrTooLarge) {
+		return errImageDimensions
+	}
+	if err != nil {
 		return errImageFormatNotSupported
 	}
 
@@ -516,9 +573,84 @@ func (s service) UpdateAvatar(ctx context.Context, id string, src io.Reader) err
 		return err
 	}
 
+	// Drop the scaled copies of the previous avatar, they are cached again
+	// from the new one.
+	for _, size := range avatar.Variants {
+		err = s.objSto.Delete(uploadCtx, s.bucket, avatar.Key(id, size))
+		if err != nil {
+			return err
+		}
+	}
+
 	return s.repo.Update(ctx, user)
 }
 
+// Avatar returns the avatar of a user as a square image of size pixels, or
+// at its stored size when size is zero. Users without an avatar get their
+// identicon. The scaled avatars are cached in the object storage.
+func (s service) Avatar(ctx context.Context, id string, size int) (
+	[]byte, error) {
+
+	id = strings.ToLower(id)
+
+	// The avatars are normalized to avatar.Size on upload, the cache is
+	// only looked up at that size for the avatars stored at another size.
+	cached := size != 0 && size != avatar.Size
+	if cached {
+		if data, err := s.cachedAvatar(ctx, id, size); data != nil || err != nil {
+			return data, err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err := s.objSto.Download(ctx, s.bucket, id, buf)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		buf = bytes.NewBuffer(avatar.Identicon(id))
+	} else if err != nil {
+		return nil, err
+	}
+	original := buf.Bytes()
+	if size == 0 || avatar.HasSize(original, size) {
+		return original, nil
+	}
+	if !cached {
+		if data, err := s.cachedAvatar(ctx, id, size); data != nil || err != nil {
+			return data, err
+		}
+	}
+
+	data, err := avatar.Resize(original, size)
+	if err != nil {
+		// The avatars uploaded before they were normalized may be in a format
+		// which is not decoded, they are served as is.
+		s.logger.With(ctx).Infof("failed to scale the avatar of %s: %v",
+			id, err)
+		return original, nil
+	}
+	key := avatar.Key(id, size)
+	err = s.objSto.Upload(ctx, s.bucket, key, bytes.NewReader(data))
+	if err != nil {
+		s.logger.Errorf("failed to cache the avatar %s: %v", key, err)
+	}
+	return data, nil
+}
+
+// cachedAvatar returns the avatar of a user scaled to size from the cache,
+// or nil when it is not cached yet.
+func (s service) cachedAvatar(ctx context.Context, id string, size int) (
+	[]byte, error) {
+
+	buf := new(bytes.Buffer)
+	err := s.objSto.Download(ctx, s.bucket, avatar.Key(id, size), buf)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // GetByEmail returns the user given its email address.
 func (s service) GetByEmail(ctx context.Context, email string) (User, error) {
 	user, err := s.repo.GetByEmail(ctx, email)
@@ -560,3 +692,11 @@ func (s service) Unlike(ctx context.Context, id, sha256 string) error {
 func (s service) Submit(ctx context.Context, id string, userSubmission entity.UserSubmission) error {
 	return s.repo.Submit(ctx, id, userSubmission)
 }
+
+func (s service) Vote(ctx context.Context, id string, userVote entity.UserVote) error {
+	return s.repo.Vote(ctx, id, userVote)
+}
+
+func (s service) Unvote(ctx context.Context, id, sha256 string) error {
+	return s.repo.Unvote(ctx, id, sha256)
+}
@@ -0,0 +1,215 @@
+// Package avatar generates the default avatars of users and normalizes the
+// uploaded ones.
+package avatar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+
+	// Register the formats accepted for the uploaded avatars.
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+const (
+	// Size is the width and the height in pixels of the avatars stored.
+	Size = 256
+	// MinDimension and MaxDimension bound the width and the height of the
+	// uploaded images.
+	MinDimension = 32
+	MaxDimension = 4096
+
+	// grid is the number of cells of an identicon on each side.
+	grid = 5
+)
+
+var (
+	// ErrTooSmall is returned when an image is smaller than MinDimension.
+	ErrTooSmall = errors.New("image too small")
+	// ErrTooLarge is returned when an image is larger than MaxDimension.
+	ErrTooLarge = errors.New("image too large")
+	// ErrInvalidSize is returned when scaling an image to a size out of
+	// the range ]0, Size].
+	ErrInvalidSize = errors.New("invalid avatar size")
+
+	// Variants lists the sizes the avatars are scaled to when served, the
+	// scaled avatars are cached next to the original. The avatars are
+	// stored at Size, except the ones uploaded before they were normalized.
+	Variants = []int{32, 64, 128, Size}
+
+	background = color.NRGBA{0xf0, 0xf0, 0xf0, 0xff}
+)
+
+// Identicon returns a PNG avatar derived from the hash of seed: a grid of
+// cells mirrored around its vertical axis, in a color picked from the hash.
+// The same seed always gives the same avatar.
+func Identicon(seed string) []byte {
+	sum := sha256.Sum256([]byte(seed))
+
+	hue := float64(uint16(sum[0])<<8|uint16(sum[1])) / 65536 * 360
+	saturation := 0.45 + float64(sum[2])/255*0.2
+	lightness := 0.45 + float64(sum[3])/255*0.15
+	fg := hsl(hue, saturation, lightness)
+
+	cell := Size / (grid + 1)
+	margin := (Size - grid*cell) / 2
+	img := image.NewNRGBA(image.Rect(0, 0, Size, Size))
+	fill(img, img.Bounds(), background)
+
+	// Only the left half and the middle column are drawn from the hash,
+	// one bit per cell, the right half mirrors them.
+	for row := 0; row < grid; row++ {
+		for col := 0; col < (grid+1)/2; col++ {
+			bit := row*((grid+1)/2) + col
+			if sum[4+bit/8]>>(bit%8)&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, grid - 1 - col} {
+				x, y := margin+c*cell, margin+row*cell
+				fill(img, image.Rect(x, y, x+cell, y+cell), fg)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// Key returns the key of the avatar of a user in the object storage, the
+// key of the avatar scaled to size when size is not zero.
+func Key(id string, size int) string {
+	if size == 0 {
+		return id
+	}
+	return fmt.Sprintf("%s@%d", id, size)
+}
+
+// HasSize tells whether an image is a square of size pixels.
+func HasSize(data []byte, size int) bool {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return err == nil && cfg.Width == size && cfg.Height == size
+}
+
+// Normalize decodes an uploaded image, crops it to a centered square and
+// scales it to Size, then encodes it as PNG. Any metadata of the original
+// image is dropped.
+func Normalize(data []byte) ([]byte, error) {
+	cfg, err := decodeConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width < MinDimension || cfg.Height < MinDimension {
+		return nil, ErrTooSmall
+	}
+	return Resize(data, Size)
+}
+
+// Resize returns an image cropped to a centered square and scaled to size,
+// encoded as PNG. The dimensions of the image are checked before decoding
+// it, so an image declaring huge dimensions is not allocated.
+func Resize(data []byte, size int) ([]byte, error) {
+	if size <= 0 || size > Size {
+		return nil, ErrInvalidSize
+	}
+	if _, err := decodeConfig(data); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, scale(src, size)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeConfig reads the dimensions of an image from its header and checks
+// they do not exceed MaxDimension.
+func decodeConfig(data []byte) (image.Config, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Width > MaxDimension || cfg.Height > MaxDimension {
+		return cfg, ErrTooLarge
+	}
+	return cfg, nil
+}
+
+// scale crops src to a centered square and scales it to size. Every pixel
+// is the average of the pixels of the source it covers.
+func scale(src image.Image, size int) *image.NRGBA {
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0 := y0 + y*side/size
+		sy1 := max(y0+(y+1)*side/size, sy0+1)
+		for x := 0; x < size; x++ {
+			sx0 := x0 + x*side/size
+			sx1 := max(x0+(x+1)*side/size, sx0+1)
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb),
+						a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n),
+				uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// fill paints a rectangle of an image with a color.
+func fill(img *image.NRGBA, r image.Rectangle, c color.NRGBA) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+}
+
+// hsl converts a color given by its hue in degrees, its saturation and its
+// lightness between 0 and 1.
+func hsl(h, s, l float64) color.NRGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	hp := h / 60
+	x := c * (1 - math.Abs(math.Mod(hp, 2)-1))
+
+	var r, g, b float64
+	switch {
+	case hp < 1:
+		r, g = c, x
+	case hp < 2:
+		r, g = x, c
+	case hp < 3:
+		g, b = c, x
+	case hp < 4:
+		g, b = x, c
+	case hp < 5:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := l - c/2
+	return color.NRGBA{uint8((r + m) * 255), uint8((g + m) * 255),
+		uint8((b + m) * 255), 0xff}
+}
@@ -0,0 +1,104 @@
+package avatar
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encode(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&buf, img, nil))
+	return buf.Bytes()
+}
+
+func TestIdenticon(t *testing.T) {
+	a := Identicon("mike")
+	assert.Equal(t, a, Identicon("mike"))
+	assert.NotEqual(t, a, Identicon("john"))
+
+	img, err := png.Decode(bytes.NewReader(a))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, Size, Size), img.Bounds())
+
+	// The cells are mirrored around the vertical axis.
+	for y := 0; y < Size; y += 8 {
+		for x := 0; x < Size/2; x += 8 {
+			assert.Equal(t, img.At(x, y), img.At(Size-1-x, y))
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			src.Set(x, y, color.RGBA{0, 0, 0xff, 0xff})
+		}
+	}
+
+	data, err := Normalize(encode(t, src))
+	assert.Nil(t, err)
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, Size, cfg.Width)
+	assert.Equal(t, Size, cfg.Height)
+
+	_, err = Normalize(encode(t, image.NewRGBA(image.Rect(0, 0, 16, 64))))
+	assert.Equal(t, ErrTooSmall, err)
+
+	_, err = Normalize([]byte("not an image"))
+	assert.NotNil(t, err)
+}
+
+func TestResize(t *testing.T) {
+	data, err := Resize(Identicon("mike"), 32)
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 32, 32), img.Bounds())
+
+	// The corners are part of the margin, left with the background.
+	r, g, b, _ := img.At(0, 0).RGBA()
+	assert.Equal(t, []uint32{0xf0f0, 0xf0f0, 0xf0f0}, []uint32{r, g, b})
+}
+
+func TestResizeBounds(t *testing.T) {
+	for _, size := range []int{-1, 0, Size + 1, 1 << 20} {
+		_, err := Resize(Identicon("mike"), size)
+		assert.Equal(t, ErrInvalidSize, err, size)
+	}
+
+	// A GIF declaring a huge logical screen in its header is rejected before
+	// it is decoded.
+	var buf bytes.Buffer
+	assert.Nil(t, gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 1, 1),
+		color.Palette{color.Black}), nil))
+	data := buf.Bytes()
+	copy(data[6:10], []byte{0xff, 0xff, 0xff, 0xff})
+	_, err := Resize(data, 32)
+	assert.Equal(t, ErrTooLarge, err)
+	_, err = Normalize(data)
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "mike", Key("mike", 0))
+	assert.Equal(t, "mike@256", Key("mike", Size))
+	assert.Equal(t, "mike@32", Key("mike", 32))
+}
+
+func TestHasSize(t *testing.T) {
+	assert.True(t, HasSize(Identicon("mike"), Size))
+	assert.False(t, HasSize(Identicon("mike"), 32))
+	assert.False(t, HasSize(encode(t, image.NewRGBA(image.Rect(0, 0, 200, 200))),
+		Size))
+	assert.False(t, HasSize([]byte("RIFF....WEBPVP8 "), Size))
+}
@@ -0,0 +1,37 @@
+// Package markdown renders the markdown written by users to HTML.
+package markdown
+
+import (
+	"bytes"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// renderer converts GitHub flavored markdown. It runs in safe mode: raw
+// HTML is omitted and the links with a dangerous scheme, like javascript:,
+// are dropped, which makes its output fit to be embedded in a page.
+var renderer = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// Render returns the sanitized HTML rendering of a markdown source.
+func Render(source string) string {
+	var buf bytes.Buffer
+	if err := renderer.Convert([]byte(source), &buf); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// RenderItems adds the HTML rendering of the markdown field src to every
+// item of a query result having it, under the field dst.
+func RenderItems(items []interface{}, src, dst string) {
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if source, ok := m[src].(string); ok {
+			m[dst] = Render(source)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package markdown
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		tag, source, expected string
+	}{
+		{"emphasis", "**packed** with `UPX`",
+			"<p><strong>packed</strong> with <code>UPX</code></p>\n"},
+		{"link", "[report](https://saferwall.com)",
+			"<p><a href=\"https://saferwall.com\">report</a></p>\n"},
+		{"raw html", "<script>alert(1)</script>",
+			"<!-- raw HTML omitted -->\n"},
+		{"inline html", "hi <img src=x onerror=alert(1)>",
+			"<p>hi <!-- raw HTML omitted --></p>\n"},
+		{"dangerous link", "[x](javascript:alert(1))",
+			"<p><a href=\"\">x</a></p>\n"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Render(tt.source), tt.tag)
+	}
+}
+
+func TestRenderItems(t *testing.T) {
+	items := []interface{}{
+		map[string]interface{}{"comment": "*upx*"},
+		map[string]interface{}{"type": "like"},
+	}
+	RenderItems(items, "comment", "body_html")
+	assert.Equal(t, "<p><em>upx</em></p>\n", items[0].(map[string]interface{})["body_html"])
+	assert.NotContains(t, items[1], "body_html")
+}